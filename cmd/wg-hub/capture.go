@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/capture"
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func newCaptureCmd(log *logrus.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "capture",
+		Short: "Capture the decrypted packets of the hub into a pcapng file for Wireshark",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runCapture(log, cmd, args); err != nil {
+				log.Errorf("ERROR: %v", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().String("api", "", "URL of the hub api (e.g. http://192.168.0.254)")
+	cmd.Flags().String("token", os.Getenv("WG_HUB_TOKEN"), "api token with the capture:read scope (default is $WG_HUB_TOKEN)")
+	cmd.Flags().String("public-key", "", "only capture the packets of the peer with this public key")
+	cmd.Flags().String("filter", "", "capture filter (e.g. \"proto tcp and port 443\")")
+	cmd.Flags().Duration("duration", 30*time.Second, "duration of the capture")
+	cmd.Flags().Int64("max-size", 0, "maximum size of the capture in bytes (default is the limit of the hub)")
+	cmd.Flags().StringP("output", "o", "capture.pcapng", "output file (- for stdout)")
+	config.Must(cmd.MarkFlagRequired("api"))
+	return cmd
+}
+
+func runCapture(log *logrus.Logger, cmd *cobra.Command, _ []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	req := &capture.Request{
+		Peer:     config.MustGet(cmd.Flags().GetString("public-key")),
+		Filter:   config.MustGet(cmd.Flags().GetString("filter")),
+		Duration: config.MustGet(cmd.Flags().GetDuration("duration")),
+		MaxSize:  config.MustGet(cmd.Flags().GetInt64("max-size")),
+	}
+	output := config.MustGet(cmd.Flags().GetString("output"))
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	log.Infof("capturing for %s (stop with Ctrl+C)", req.Duration)
+	n, err := capture.Fetch(ctx, config.MustGet(cmd.Flags().GetString("api")), config.MustGet(cmd.Flags().GetString("token")), req, w)
+	if err != nil {
+		return err
+	}
+	log.Infof("captured %d bytes to %s", n, output)
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/wgconn"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func newClientProxyCmd(log *logrus.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "client-proxy",
+		Short: "Forward the UDP traffic of a local WireGuard® client over a TCP/WebSocket stream",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runClientProxy(log, cmd, args); err != nil {
+				log.Errorf("ERROR: %v", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().String("listen", "127.0.0.1:51821", "local UDP address the WireGuard® client uses as peer endpoint")
+	cmd.Flags().String("server", "", "stream address of the hub (host:port for tcp, ws:// or wss:// URL for websocket)")
+	cmd.Flags().String("protocol", wgconn.StreamProtocolTCP, "stream protocol (tcp, websocket)")
+	config.Must(cmd.MarkFlagRequired("server"))
+	return cmd
+}
+
+func runClientProxy(log *logrus.Logger, cmd *cobra.Command, _ []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	listenAddress := config.MustGet(cmd.Flags().GetString("listen"))
+	serverAddress := config.MustGet(cmd.Flags().GetString("server"))
+	protocol := config.MustGet(cmd.Flags().GetString("protocol"))
+	proxy, err := wgconn.ListenClientProxy(log, listenAddress, protocol, serverAddress)
+	if err != nil {
+		return err
+	}
+	log.Infof("forwarding udp://%s to %s (%s)", proxy.LocalAddr(), serverAddress, protocol)
+	return proxy.Run(ctx)
+}
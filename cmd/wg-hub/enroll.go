@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/enroll"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func newEnrollCmd(log *logrus.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "enroll",
+		Short: "Enroll this device with a pre-auth key and write its WireGuard config",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runEnroll(log, cmd, args); err != nil {
+				log.Errorf("ERROR: %v", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().String("key", os.Getenv("WG_HUB_PREAUTH_KEY"), "pre-auth key (default is $WG_HUB_PREAUTH_KEY)")
+	setDeviceFlags(cmd)
+	return cmd
+}
+
+// setDeviceFlags sets the flags of the commands that add this device to the hub.
+func setDeviceFlags(cmd *cobra.Command) {
+	cmd.Flags().String("url", "", "URL of the enrollment endpoint of the hub (e.g. https://hub.example.com:8443)")
+	cmd.Flags().String("private-key", "", "private key of the device (default is a new private key)")
+	cmd.Flags().StringP("output", "o", "wg-hub.conf", "output file of the wg-quick config (- for stdout)")
+	config.Must(cmd.MarkFlagRequired("url"))
+}
+
+func devicePrivateKey(cmd *cobra.Command) (wgtypes.Key, error) {
+	if s := config.MustGet(cmd.Flags().GetString("private-key")); s != "" {
+		return wgtypes.ParseKey(s)
+	}
+	return wgtypes.GeneratePrivateKey()
+}
+
+// writeClientConfig writes the wg-quick config with the private key of the device.
+func writeClientConfig(log *logrus.Logger, cmd *cobra.Command, res *enroll.Response, privateKey wgtypes.Key) error {
+	clientConfig := res.ClientConfig(privateKey.String())
+	output := config.MustGet(cmd.Flags().GetString("output"))
+	if output == "-" {
+		_, err := fmt.Fprint(os.Stdout, clientConfig)
+		return err
+	}
+	if err := os.WriteFile(output, []byte(clientConfig), 0o600); err != nil {
+		return err
+	}
+	log.Infof("added %s with address %s, wrote config to %s", res.PublicKey, res.AllowedIP, output)
+	return nil
+}
+
+func runEnroll(log *logrus.Logger, cmd *cobra.Command, _ []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	privateKey, err := devicePrivateKey(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to get private key: %w", err)
+	}
+	// only the public key is sent to the hub
+	res, err := enroll.Enroll(ctx, config.MustGet(cmd.Flags().GetString("url")), &enroll.Request{
+		Key:       config.MustGet(cmd.Flags().GetString("key")),
+		PublicKey: privateKey.PublicKey().String(),
+	})
+	if err != nil {
+		return err
+	}
+	return writeClientConfig(log, cmd, res, privateKey)
+}
@@ -1,23 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/christophwitzko/wg-hub/pkg/config"
-	"github.com/christophwitzko/wg-hub/pkg/debug"
-	"github.com/christophwitzko/wg-hub/pkg/hub"
-	"github.com/christophwitzko/wg-hub/pkg/loopback"
-	"github.com/christophwitzko/wg-hub/pkg/webui"
-	"github.com/christophwitzko/wg-hub/pkg/wgconn"
+	"github.com/christophwitzko/wg-hub/pkg/wghub"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"golang.zx2c4.com/wireguard/device"
-	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
 var Version = "dev"
@@ -45,6 +37,10 @@ func main() {
 	}
 
 	config.SetFlags(rootCmd)
+	rootCmd.AddCommand(newClientProxyCmd(log))
+	rootCmd.AddCommand(newCaptureCmd(log))
+	rootCmd.AddCommand(newEnrollCmd(log))
+	rootCmd.AddCommand(newRegisterCmd(log))
 
 	cobra.OnInitialize(func() {
 		config.OnInitialize(log, rootCmd)
@@ -55,7 +51,6 @@ func main() {
 	}
 }
 
-//gocyclo:ignore
 func run(log *logrus.Logger, cmd *cobra.Command, _ []string) error {
 	cfg, err := config.ParseConfig(log, cmd)
 	if err != nil {
@@ -64,60 +59,27 @@ func run(log *logrus.Logger, cmd *cobra.Command, _ []string) error {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	tunDev := loopback.CreateTun(device.DefaultMTU)
-	devLogger := &device.Logger{
-		Verbosef: log.Debugf,
-		Errorf:   log.Errorf,
-	}
-	dev := device.NewDevice(tunDev, wgconn.NewStdNetBind(cfg.BindAddress), devLogger)
-
-	wgConf := &bytes.Buffer{}
-	wgConf.WriteString("private_key=" + cfg.PrivateKeyHex + "\n")
-	wgConf.WriteString("listen_port=" + cfg.GetPort() + "\n")
-	for _, peer := range cfg.Peers {
-		wgConf.WriteString("public_key=" + peer.PublicKeyHex + "\n")
-		wgConf.WriteString("allowed_ip=" + peer.AllowedIP + "\n")
-	}
-	err = dev.IpcSetOperation(wgConf)
+	srv, err := wghub.New(wghub.WithConfig(cfg), wghub.WithLogger(log))
 	if err != nil {
 		return err
 	}
-	err = dev.Up()
+	err = srv.Start(ctx)
 	if err != nil {
 		return err
 	}
 
-	stopHubInstance := func() {}
-	var tunNet *netstack.Net
-	if cfg.HubAddress != "" {
-		log.Infof("starting hub instance on %s", cfg.HubAddress)
-		stopHubInstance, tunNet, err = hub.Init(log, dev, cfg)
-		if err != nil {
-			return fmt.Errorf("failed to start hub instance: %w", err)
-		}
+	var serveErr error
+	select {
+	case <-ctx.Done():
+	case serveErr = <-srv.Err():
+		log.Errorf("%v", serveErr)
 	}
-
-	if cfg.DebugServer && tunNet != nil {
-		log.Infof("starting debug server on http://%s:8080", cfg.HubAddress)
-		err = debug.StartServer(log, dev, tunNet)
-		if err != nil {
-			return fmt.Errorf("failed to start debug server: %w", err)
-		}
-	}
-
-	if cfg.Webui && tunNet != nil {
-		log.Infof("starting webui on http://%s", cfg.HubAddress)
-		err = webui.StartServer(log, dev, cfg, tunNet)
-		if err != nil {
-			return fmt.Errorf("failed to start api server: %w", err)
-		}
-	}
-
-	<-ctx.Done()
 	log.Println("stopping...")
 	stop()
-	stopHubInstance()
-	dev.Close()
+	err = srv.Close()
+	if err != nil {
+		return err
+	}
 	log.Println("stopped")
-	return nil
+	return serveErr
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/enroll"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func newRegisterCmd(log *logrus.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "register",
+		Short: "Request the approval of this device, wait for the decision and write its WireGuard config",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runRegister(log, cmd, args); err != nil {
+				log.Errorf("ERROR: %v", err)
+				os.Exit(1)
+			}
+		},
+	}
+	hostname, _ := os.Hostname()
+	cmd.Flags().String("hostname", hostname, "hostname of the device")
+	cmd.Flags().String("name", "", "requested name of the device")
+	cmd.Flags().Duration("poll-interval", 5*time.Second, "interval of the checks for the decision")
+	setDeviceFlags(cmd)
+	return cmd
+}
+
+func runRegister(log *logrus.Logger, cmd *cobra.Command, _ []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	privateKey, err := devicePrivateKey(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to get private key: %w", err)
+	}
+	enrollURL := config.MustGet(cmd.Flags().GetString("url"))
+	res, err := enroll.Register(ctx, enrollURL, &enroll.RegistrationRequest{
+		PublicKey: privateKey.PublicKey().String(),
+		Hostname:  config.MustGet(cmd.Flags().GetString("hostname")),
+		Name:      config.MustGet(cmd.Flags().GetString("name")),
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("registration %s submitted, waiting for the approval of an admin", res.ID)
+	ticker := time.NewTicker(config.MustGet(cmd.Flags().GetDuration("poll-interval")))
+	defer ticker.Stop()
+	for res.Status == "pending" {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for registration %s", res.ID)
+		case <-ticker.C:
+		}
+		res, err = enroll.Poll(ctx, enrollURL, res.ID)
+		if err != nil {
+			return err
+		}
+	}
+	if res.Response == nil {
+		return fmt.Errorf("registration %s %s: %s", res.ID, res.Status, res.Reason)
+	}
+	return writeClientConfig(log, cmd, res.Response, privateKey)
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/auth"
+	"github.com/christophwitzko/wg-hub/pkg/events"
+)
+
+// actor returns the user or the API token of the request.
+func actor(r *http.Request) string {
+	if token := apiTokenFromContext(r.Context()); token != nil {
+		return "token:" + token.Name
+	}
+	username, _, _ := getClaims(r)
+	return username
+}
+
+// record appends the event of the request to the audit log, the actor is
+// taken from the request if it is not set. Failures are only logged.
+func (a *API) record(r *http.Request, e *audit.Event) {
+	if e.Actor == "" {
+		e.Actor = actor(r)
+	}
+	e.RemoteIP = remoteIP(r)
+	if err := a.audit.Record(e); err != nil {
+		a.log.Errorf("failed to record audit event %s: %v", e.Action, err)
+	}
+}
+
+func peerState(allowedIP string) any {
+	if allowedIP == "" {
+		return nil
+	}
+	return map[string]string{"allowedIP": allowedIP}
+}
+
+func usersSummary(users *auth.Users) []string {
+	summary := make([]string, 0, users.Len())
+	for _, u := range users.List() {
+		summary = append(summary, u.Username+":"+string(u.Role))
+	}
+	return summary
+}
+
+// loadUsers loads the webui users and records a config reload if the users changed since the last load.
+func (a *API) loadUsers(r *http.Request) (*auth.Users, error) {
+	users, err := a.cfg.LoadUsers()
+	if err != nil {
+		return nil, err
+	}
+	summary := usersSummary(users)
+	a.usersMu.Lock()
+	previous := a.loadedUsers
+	a.loadedUsers = summary
+	a.usersMu.Unlock()
+	if previous != nil && !slices.Equal(previous, summary) {
+		a.log.Infof("reloaded %d webui users", users.Len())
+		a.record(r, &audit.Event{
+			Action:  audit.ActionConfigReload,
+			Target:  "webuiUsers",
+			Before:  previous,
+			After:   summary,
+			Details: "webui users changed",
+		})
+		a.events.Publish(events.ConfigChanged, &events.ConfigData{Target: "webuiUsers"})
+	}
+	return users, nil
+}
+
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func parseIntParam(r *http.Request, name string) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(v)
+}
+
+func (a *API) listAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := &audit.Query{
+		Action: audit.Action(query.Get("action")),
+		Actor:  query.Get("actor"),
+		Target: query.Get("target"),
+	}
+	var errs []error
+	var err error
+	q.Since, err = parseTimeParam(r, "since")
+	errs = append(errs, err)
+	q.Until, err = parseTimeParam(r, "until")
+	errs = append(errs, err)
+	q.Offset, err = parseIntParam(r, "offset")
+	errs = append(errs, err)
+	q.Limit, err = parseIntParam(r, "limit")
+	errs = append(errs, err)
+	if err := errors.Join(errs...); err != nil {
+		a.sendError(w, "invalid query parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := a.audit.Query(q)
+	if errors.Is(err, audit.ErrInvalidQuery) {
+		a.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.writeJSON(w, page)
+}
@@ -1,15 +1,116 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/auth"
+	"github.com/christophwitzko/wg-hub/pkg/events"
 	"github.com/go-chi/jwtauth/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/lestrrat-go/jwx/v2/jwt"
 )
 
+type apiTokenContextKey struct{}
+
+func apiTokenFromContext(ctx context.Context) *auth.APIToken {
+	token, _ := ctx.Value(apiTokenContextKey{}).(*auth.APIToken)
+	return token
+}
+
+// verifier verifies the API token or the JWT of the Authorization header.
+func (a *API) verifier(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer := jwtauth.TokenFromHeader(r)
+		if bearer == "" {
+			bearer = jwtauth.TokenFromCookie(r)
+		}
+		if !auth.IsAPIToken(bearer) {
+			var token jwt.Token
+			err := jwtauth.ErrNoTokenFound
+			if bearer != "" {
+				token, err = a.sessions.Verify(bearer)
+			}
+			next.ServeHTTP(w, r.WithContext(jwtauth.NewContext(r.Context(), token, err)))
+			return
+		}
+		token, err := a.tokens.Verify(bearer)
+		if err != nil {
+			a.sendError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiTokenContextKey{}, token)))
+	})
+}
+
+// remoteIP returns the source address of the request, the API is only served inside the hub network.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// getClaims returns the claims of the verified JWT of the request.
+func getClaims(r *http.Request) (username string, role auth.Role, err error) {
+	_, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil {
+		return "", "", err
+	}
+	username, _ = claims["username"].(string)
+	roleClaim, _ := claims["role"].(string)
+	role, err = auth.ParseRole(roleClaim)
+	return username, role, err
+}
+
+// requireRole only allows requests with a JWT of at least the given role, API tokens are rejected.
+func (a *API) requireRole(required auth.Role) func(http.Handler) http.Handler {
+	return a.require(required, "")
+}
+
+// require only allows requests with a JWT of at least the given role or
+// with an API token that has the given scope.
+func (a *API) require(required auth.Role, scope auth.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token := apiTokenFromContext(r.Context()); token != nil {
+				if scope == "" || !token.HasScope(scope) {
+					a.sendError(w, "insufficient api token scope", http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			_, role, err := getClaims(r)
+			if err != nil {
+				a.sendError(w, "invalid auth token role", http.StatusUnauthorized)
+				return
+			}
+			if !role.Allows(required) {
+				a.sendError(w, "insufficient permissions", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func (a *API) getAuth(w http.ResponseWriter, r *http.Request) {
+	if apiToken := apiTokenFromContext(r.Context()); apiToken != nil {
+		a.writeJSON(w, apiToken)
+		return
+	}
+	if _, _, err := getClaims(r); err != nil {
+		a.sendError(w, "invalid auth token role", http.StatusUnauthorized)
+		return
+	}
 	token, _, err := jwtauth.FromContext(r.Context())
 	if err != nil {
 		a.sendError(w, err.Error(), http.StatusUnauthorized)
@@ -19,9 +120,25 @@ func (a *API) getAuth(w http.ResponseWriter, r *http.Request) {
 	a.writeJSON(w, jwt)
 }
 
+// loginFailed records the failed login in the audit log and publishes it.
+func (a *API) loginFailed(r *http.Request, username, reason string) {
+	a.record(r, &audit.Event{Actor: username, Action: audit.ActionLoginFailed, Details: reason})
+	a.events.Publish(events.LoginFailed, &events.LoginData{Username: username, RemoteIP: remoteIP(r), Reason: reason})
+}
+
+// failLogin counts a failed login, records it and logs the resulting lockouts.
+func (a *API) failLogin(r *http.Request, ip, username, reason string) {
+	a.loginFailed(r, username, reason)
+	for _, lockout := range a.limiter.Fail(ip, username) {
+		a.log.Warnf("security: locked %s until %s after %d failed logins", lockout.Key, lockout.LockedUntil.Format(time.RFC3339), lockout.Failures)
+	}
+}
+
 type AuthRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// Code is the TOTP code or a recovery code, it is required if the user enabled TOTP.
+	Code string `json:"code,omitempty"`
 }
 
 func (a *API) createAuth(w http.ResponseWriter, r *http.Request) {
@@ -36,27 +153,131 @@ func (a *API) createAuth(w http.ResponseWriter, r *http.Request) {
 		a.sendError(w, "Invalid username or password.", http.StatusBadRequest)
 		return
 	}
-	if req.Username != "admin" {
-		a.sendError(w, "Invalid username or password.", http.StatusBadRequest)
+	ip := remoteIP(r)
+	// the lockout is checked before the password, so locked logins do not cost a bcrypt run
+	if retryAfter, err := a.limiter.Check(ip, req.Username); err != nil {
+		a.log.Warnf("security: rejected locked login of user %q from %s", req.Username, ip)
+		a.record(r, &audit.Event{Actor: req.Username, Action: audit.ActionLoginFailed, Details: "locked"})
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		a.sendError(w, "Too many failed login attempts, try again later.", http.StatusTooManyRequests)
+		return
+	}
+	select {
+	case a.loginSlots <- struct{}{}:
+		defer func() { <-a.loginSlots }()
+	case <-r.Context().Done():
+		return
+	}
+	// the users are loaded on every login, so changes of the users file apply without a restart
+	users, err := a.loadUsers(r)
+	if err != nil {
+		a.log.Errorf("failed to load webui users: %v", err)
+		a.sendError(w, "Failed to load users.", http.StatusInternalServerError)
 		return
 	}
-	if a.cfg.WebuiAdminPasswordHash == "" {
-		a.sendError(w, "Webui admin password is not set.", http.StatusBadRequest)
+	if users.Len() == 0 {
+		a.sendError(w, "No webui users are configured.", http.StatusBadRequest)
 		return
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(a.cfg.WebuiAdminPasswordHash), []byte(req.Password))
+	user, err := users.Authenticate(req.Username, req.Password)
 	if err != nil {
+		a.log.Warnf("security: failed login of user %q from %s", req.Username, ip)
+		a.failLogin(r, ip, req.Username, "invalid username or password")
 		a.sendError(w, "Invalid username or password.", http.StatusBadRequest)
 		return
 	}
-	claims := map[string]any{"username": req.Username}
-	jwtauth.SetIssuedNow(claims)
-	// set expiry to 1000 days
-	jwtauth.SetExpiryIn(claims, time.Hour*24*1000)
-	_, token, err := a.tokenAuth.Encode(claims)
+	if a.totp.Enabled(user.Username) {
+		if req.Code == "" {
+			a.writeJSON(w, map[string]any{"error": "Two-factor code required.", "totpRequired": true}, http.StatusUnauthorized)
+			return
+		}
+		err := a.totp.Verify(user.Username, req.Code)
+		if isInvalidTOTPCode(err) {
+			a.log.Warnf("security: invalid totp code of user %q from %s", user.Username, ip)
+			a.failLogin(r, ip, req.Username, "invalid totp code")
+			a.sendError(w, "Invalid two-factor code.", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			a.log.Errorf("failed to verify totp code: %v", err)
+			a.sendError(w, "Failed to verify two-factor code.", http.StatusInternalServerError)
+			return
+		}
+	}
+	a.limiter.Succeed(user.Username)
+	pair, err := a.sessions.Login(user)
 	if err != nil {
-		a.sendError(w, "Failed to create JWT.", http.StatusInternalServerError)
+		a.log.Errorf("failed to create session: %v", err)
+		a.sendError(w, "Failed to create session.", http.StatusInternalServerError)
+		return
+	}
+	a.record(r, &audit.Event{Actor: user.Username, Action: audit.ActionLogin, Details: "password"})
+	a.writeJSON(w, pair)
+}
+
+type RefreshAuthRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+func (a *API) refreshAuth(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req RefreshAuthRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		a.sendError(w, "failed to decode request", http.StatusBadRequest)
+		return
+	}
+	users, err := a.loadUsers(r)
+	if err != nil {
+		a.log.Errorf("failed to load webui users: %v", err)
+		a.sendError(w, "failed to load users", http.StatusInternalServerError)
+		return
+	}
+	pair, err := a.sessions.Refresh(req.RefreshToken, users)
+	if err != nil {
+		if errors.Is(err, auth.ErrRefreshTokenReused) {
+			a.log.Warnf("security: refresh token reuse detected from %s", remoteIP(r))
+		}
+		a.sendError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	a.writeJSON(w, pair)
+}
+
+func (a *API) logout(w http.ResponseWriter, r *http.Request) {
+	token, _, err := jwtauth.FromContext(r.Context())
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := a.sessions.Logout(token); err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.record(r, &audit.Event{Action: audit.ActionLogout})
+	a.writeJSON(w, map[string]string{"status": "ok"})
+}
+
+func (a *API) listSessions(w http.ResponseWriter, _ *http.Request) {
+	a.writeJSON(w, a.sessions.List())
+}
+
+func (a *API) revokeSessions(w http.ResponseWriter, r *http.Request) {
+	if err := a.sessions.RevokeAll(); err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.log.Infof("revoked all sessions")
+	a.record(r, &audit.Event{Action: audit.ActionSessionsRevoke})
+	a.writeJSON(w, map[string]string{"status": "ok"})
+}
+
+func (a *API) rotateKey(w http.ResponseWriter, r *http.Request) {
+	if err := a.sessions.RotateKey(); err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	a.writeJSON(w, map[string]string{"token": token})
+	a.log.Infof("rotated jwt signing key")
+	a.record(r, &audit.Event{Action: audit.ActionKeyRotate})
+	a.writeJSON(w, map[string]string{"status": "ok"})
 }
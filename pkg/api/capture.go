@@ -0,0 +1,143 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/capture"
+)
+
+const (
+	defaultCaptureDuration = 30 * time.Second
+	MaxCaptureDuration     = 10 * time.Minute
+	defaultCaptureSize     = 10 << 20
+	MaxCaptureSize         = 100 << 20
+	captureSnaplen         = 65535
+	// captureBuffer is the number of packets buffered per capture, packets are dropped for slow clients.
+	captureBuffer = 1024
+)
+
+type captureRequest struct {
+	expr     string
+	duration time.Duration
+	maxSize  int64
+}
+
+func (a *API) parseCaptureRequest(r *http.Request) (*captureRequest, error) {
+	q := r.URL.Query()
+	req := &captureRequest{expr: q.Get("filter"), duration: defaultCaptureDuration, maxSize: defaultCaptureSize}
+	if publicKey := q.Get("peer"); publicKey != "" {
+		ipcPeers, err := a.peers.List()
+		if err != nil {
+			return nil, err
+		}
+		allowedIP := ""
+		for _, peer := range ipcPeers {
+			if peer.PublicKey == publicKey {
+				allowedIP = peer.AllowedIP
+			}
+		}
+		if allowedIP == "" {
+			return nil, fmt.Errorf("peer not found")
+		}
+		if req.expr == "" {
+			req.expr = "net " + allowedIP
+		} else {
+			req.expr = "net " + allowedIP + " and " + req.expr
+		}
+	}
+	if duration := q.Get("duration"); duration != "" {
+		d, err := time.ParseDuration(duration)
+		if err != nil || d <= 0 || d > MaxCaptureDuration {
+			return nil, fmt.Errorf("duration must be between 1s and %s", MaxCaptureDuration)
+		}
+		req.duration = d
+	}
+	if maxSize := q.Get("maxSize"); maxSize != "" {
+		n, err := strconv.ParseInt(maxSize, 10, 64)
+		if err != nil || n <= 0 || n > MaxCaptureSize {
+			return nil, fmt.Errorf("maxSize must be between 1 and %d bytes", MaxCaptureSize)
+		}
+		req.maxSize = n
+	}
+	return req, nil
+}
+
+// streamCapture streams the matching packets as pcapng until the duration
+// passed, the maximum size is reached or the client disconnects.
+func (a *API) streamCapture(w http.ResponseWriter, r *http.Request) {
+	if a.capturer == nil {
+		a.sendError(w, "packet capture not available", http.StatusNotFound)
+		return
+	}
+	req, err := a.parseCaptureRequest(r)
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := capture.ParseFilter(req.expr)
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the capture stream itself passes the hub
+	remoteAddr, remoteErr := netip.ParseAddrPort(r.RemoteAddr)
+	if localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && remoteErr == nil {
+		if localAddr, err := netip.ParseAddrPort(localAddr.String()); err == nil {
+			filter.ExcludeConnection(remoteAddr, localAddr)
+		}
+	}
+	a.record(r, &audit.Event{
+		Action:  audit.ActionCaptureStart,
+		Target:  r.URL.Query().Get("peer"),
+		Details: fmt.Sprintf("filter=%q duration=%s maxSize=%d", req.expr, req.duration, req.maxSize),
+	})
+	sess := a.capturer.Start(filter, captureBuffer)
+	defer sess.Close()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	w.Header().Set("Content-Disposition", `attachment; filename="wg-hub.pcapng"`)
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	pw, err := capture.NewWriter(w, captureSnaplen)
+	if err != nil || rc.Flush() != nil {
+		return
+	}
+	pw.MaxSize = req.maxSize
+
+	timer := time.NewTimer(req.duration)
+	defer timer.Stop()
+	defer func() {
+		if dropped := sess.Dropped(); dropped > 0 {
+			a.log.Warnf("packet capture dropped %d packets", dropped)
+		}
+	}()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-a.done:
+			return
+		case <-timer.C:
+			return
+		case p, ok := <-sess.Packets():
+			if !ok {
+				return
+			}
+			// ends the capture if the maximum size is reached
+			if err := pw.WritePacket(p.Time, p.Data); err != nil {
+				return
+			}
+			// flush once the buffered packets are written
+			if len(sess.Packets()) == 0 && rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
@@ -2,29 +2,35 @@ package api
 
 import (
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/christophwitzko/wg-hub/pkg/config"
-	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/peers"
 	"gopkg.in/yaml.v3"
 )
 
 func (a *API) getConfig(w http.ResponseWriter, _ *http.Request) {
-	devConfig, err := a.dev.IpcGet()
+	ipcPeers, err := a.peers.List()
 	if err != nil {
-		a.sendError(w, "failed to get ipc operation", http.StatusInternalServerError)
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	peers := ipc.ParsePeers(devConfig)
 	currentPeers := make([]*config.Peer, 0)
-	for _, peer := range peers {
+	for _, peer := range ipcPeers {
 		if peer.AllowedIP == a.cfg.GetHubAddress() {
 			continue
 		}
-		currentPeers = append(currentPeers, &config.Peer{
-			PublicKey: peer.PublicKey,
-			AllowedIP: peer.AllowedIP,
-		})
+		currentPeer := &config.Peer{
+			PublicKey:      peer.PublicKey,
+			AllowedIP:      peer.AllowedIP,
+			AllowedSources: a.peers.AllowedSources(peer.PublicKey),
+		}
+		if slices.Contains(a.peers.Suspended(peer.PublicKey), peers.SuspendDisabled) {
+			enabled := false
+			currentPeer.Enabled = &enabled
+		}
+		currentPeers = append(currentPeers, currentPeer)
 	}
 	// create a new config with the current config and the peers
 	cfgData, err := yaml.Marshal(config.Config{
@@ -37,6 +43,40 @@ func (a *API) getConfig(w http.ResponseWriter, _ *http.Request) {
 		Webui:                  a.cfg.Webui,
 		WebuiJWTSecret:         "<redacted>",
 		WebuiAdminPasswordHash: a.cfg.WebuiAdminPasswordHash,
+		WebuiAccessTokenTTL:    a.cfg.WebuiAccessTokenTTL,
+		WebuiRefreshTokenTTL:   a.cfg.WebuiRefreshTokenTTL,
+		WebuiLoginMaxAttempts:  a.cfg.WebuiLoginMaxAttempts,
+		WebuiLoginLockout:      a.cfg.WebuiLoginLockout,
+		WebuiLoginMaxLockout:   a.cfg.WebuiLoginMaxLockout,
+		WebuiUsers:             a.cfg.WebuiUsers,
+		WebuiUsersFile:         a.cfg.WebuiUsersFile,
+		WebuiOIDC:              redactOIDC(a.cfg.WebuiOIDC),
+		StreamAddress:          a.cfg.StreamAddress,
+		StreamProtocol:         a.cfg.StreamProtocol,
+		AllowedSources:         a.cfg.AllowedSources,
+		SourceRateLimit:        a.cfg.SourceRateLimit,
+		SourceRateBurst:        a.cfg.SourceRateBurst,
+		StateDir:               a.cfg.StateDir,
+		AuditLogFile:           a.cfg.AuditLogFile,
+		PeerWatchInterval:      a.cfg.PeerWatchInterval,
+		PeerOfflineTimeout:     a.cfg.PeerOfflineTimeout,
+		PeerIdleTimeout:        a.cfg.PeerIdleTimeout,
+		PeerStatsPersist:       a.cfg.PeerStatsPersist,
+		FlowLogFile:            a.cfg.FlowLogFile,
+		FlowIPFIXCollector:     a.cfg.FlowIPFIXCollector,
+		FlowIdleTimeout:        a.cfg.FlowIdleTimeout,
+		FlowActiveTimeout:      a.cfg.FlowActiveTimeout,
+		Webhooks:               redactWebhooks(a.cfg.Webhooks),
+		Shaping:                a.cfg.Shaping,
+		Quotas:                 a.cfg.Quotas,
+		Schedules:              a.cfg.Schedules,
+		EnrollAddress:          a.cfg.EnrollAddress,
+		EnrollTLSCert:          a.cfg.EnrollTLSCert,
+		EnrollTLSKey:           a.cfg.EnrollTLSKey,
+		Registrations:          a.cfg.Registrations,
+		RegistrationTTL:        a.cfg.RegistrationTTL,
+		RegistrationPendingTTL: a.cfg.RegistrationPendingTTL,
+		ShutdownTimeout:        a.cfg.ShutdownTimeout,
 		Peers:                  currentPeers,
 	})
 	if err != nil {
@@ -48,3 +88,25 @@ func (a *API) getConfig(w http.ResponseWriter, _ *http.Request) {
 	cfgStr.Write(cfgData)
 	a.writeJSON(w, map[string]string{"config": cfgStr.String()})
 }
+
+func redactOIDC(o *config.OIDCConfig) *config.OIDCConfig {
+	if o == nil || o.ClientSecret == "" {
+		return o
+	}
+	redacted := *o
+	redacted.ClientSecret = "<redacted>"
+	return &redacted
+}
+
+func redactWebhooks(webhooks []*config.WebhookConfig) []*config.WebhookConfig {
+	redacted := make([]*config.WebhookConfig, 0, len(webhooks))
+	for _, w := range webhooks {
+		if w.Secret != "" {
+			rw := *w
+			rw.Secret = "<redacted>"
+			w = &rw
+		}
+		redacted = append(redacted, w)
+	}
+	return redacted
+}
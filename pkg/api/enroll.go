@@ -0,0 +1,180 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/auth"
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/enroll"
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/christophwitzko/wg-hub/pkg/peers"
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// NewEnrollmentHandler returns a handler that only serves the enrollment and registration
+// endpoints (POST /api/enroll, POST /api/register, GET /api/register/{id}) for a listener
+// outside of the hub network.
+func NewEnrollmentHandler(log *logrus.Logger, cfg *config.Config, peerManager *peers.Manager, opts ...Option) http.Handler {
+	a := &API{
+		router: chi.NewRouter(),
+		log:    log,
+		cfg:    cfg,
+		peers:  peerManager,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.limiter == nil {
+		a.limiter = auth.NewLoginLimiter(&auth.LoginLimiterConfig{
+			MaxAttempts: cfg.WebuiLoginMaxAttempts,
+			Lockout:     cfg.WebuiLoginLockout,
+			MaxLockout:  cfg.WebuiLoginMaxLockout,
+		})
+	}
+	if a.audit == nil {
+		a.audit = config.MustGet(audit.Open(""))
+	}
+	if a.events == nil {
+		a.events = events.NewBus()
+	}
+	a.router.Use(a.loggerMiddleware)
+	a.router.NotFound(func(w http.ResponseWriter, _ *http.Request) {
+		a.sendError(w, "not found", http.StatusNotFound)
+	})
+	a.router.Post("/api/enroll", a.enroll)
+	a.router.Post("/api/register", a.register)
+	a.router.Get("/api/register/{id}", a.pollRegistration)
+	return a
+}
+
+// enroll adds the device with the public key of the request as peer, the pre-auth
+// key determines the address pool and the tag. Invalid keys count as failed logins
+// of the source address.
+func (a *API) enroll(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if a.preAuthKeys == nil {
+		a.sendError(w, "enrollment not available", http.StatusNotFound)
+		return
+	}
+	var req enroll.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.sendError(w, "failed to decode request", http.StatusBadRequest)
+		return
+	}
+	ip := remoteIP(r)
+	if retryAfter, err := a.limiter.Check(ip, ""); err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		a.sendError(w, "too many failed enrollments, try again later", http.StatusTooManyRequests)
+		return
+	}
+	var res *peers.AddResult
+	key, err := a.preAuthKeys.Redeem(req.Key, func(key *auth.PreAuthKey) error {
+		var enrollErr error
+		res, enrollErr = a.peers.Enroll(req.PublicKey, key.Pool, key.Tag)
+		return enrollErr
+	})
+	if errors.Is(err, auth.ErrInvalidPreAuthKey) || errors.Is(err, auth.ErrPreAuthKeyExpired) || errors.Is(err, auth.ErrPreAuthKeyUsed) {
+		a.log.Warnf("security: failed enrollment from %s: %v", ip, err)
+		a.record(r, &audit.Event{Actor: "enrollment", Action: audit.ActionPeerEnrollFailed, Target: req.PublicKey, Details: err.Error()})
+		for _, lockout := range a.limiter.Fail(ip, "") {
+			a.log.Warnf("security: locked %s until %s after %d failed enrollments", lockout.Key, lockout.LockedUntil.Format(time.RFC3339), lockout.Failures)
+		}
+		a.sendError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		a.sendPeerError(w, err)
+		return
+	}
+	a.log.Infof("peer %s enrolled with pre-auth key %s", req.PublicKey, key.ID)
+	a.record(r, &audit.Event{
+		Actor:   "preauth:" + key.ID,
+		Action:  audit.ActionPeerEnroll,
+		Target:  req.PublicKey,
+		After:   peerState(res.AllowedIP),
+		Details: "tag=" + key.Tag,
+	})
+	resp := &enroll.Response{
+		PublicKey:    req.PublicKey,
+		AllowedIP:    res.AllowedIP,
+		HubNetwork:   res.HubNetwork,
+		HubPublicKey: a.cfg.PrivateKey.PublicKey().String(),
+		Endpoint:     a.cfg.GetExternalAddress() + ":" + a.cfg.GetPort(),
+		Tag:          key.Tag,
+	}
+	resp.Config = resp.ClientConfig(enroll.PrivateKeyPlaceholder)
+	a.writeJSON(w, resp)
+}
+
+func (a *API) listPreAuthKeys(w http.ResponseWriter, _ *http.Request) {
+	if a.preAuthKeys == nil {
+		a.sendError(w, "enrollment not available", http.StatusNotFound)
+		return
+	}
+	a.writeJSON(w, a.preAuthKeys.List())
+}
+
+type CreatePreAuthKeyRequest struct {
+	Tag       string    `json:"tag"`
+	Pool      string    `json:"pool"`
+	Reusable  bool      `json:"reusable"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type CreatePreAuthKeyResponse struct {
+	*auth.PreAuthKey
+	Key string `json:"key"`
+}
+
+func (a *API) createPreAuthKey(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if a.preAuthKeys == nil {
+		a.sendError(w, "enrollment not available", http.StatusNotFound)
+		return
+	}
+	var req CreatePreAuthKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.sendError(w, "failed to decode request", http.StatusBadRequest)
+		return
+	}
+	username, _, _ := getClaims(r)
+	secret, key, err := a.preAuthKeys.Create(req.Tag, req.Pool, req.Reusable, req.ExpiresAt, username)
+	if errors.Is(err, auth.ErrInvalidTag) || errors.Is(err, auth.ErrInvalidPool) || errors.Is(err, auth.ErrInvalidKeyExpiry) {
+		a.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.log.Infof("pre-auth key %s (%s) created by %s", key.ID, key.Tag, username)
+	a.record(r, &audit.Event{Action: audit.ActionPreAuthKeyCreate, Target: key.ID, After: key})
+	a.writeJSON(w, CreatePreAuthKeyResponse{PreAuthKey: key, Key: secret})
+}
+
+func (a *API) revokePreAuthKey(w http.ResponseWriter, r *http.Request) {
+	if a.preAuthKeys == nil {
+		a.sendError(w, "enrollment not available", http.StatusNotFound)
+		return
+	}
+	id := chi.URLParam(r, "id")
+	err := a.preAuthKeys.Revoke(id)
+	if errors.Is(err, auth.ErrPreAuthKeyNotFound) {
+		a.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.log.Infof("pre-auth key %s revoked", id)
+	a.record(r, &audit.Event{Action: audit.ActionPreAuthKeyRevoke, Target: id})
+	a.writeJSON(w, map[string]string{"status": "ok"})
+}
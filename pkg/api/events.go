@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/auth"
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/go-chi/jwtauth/v5"
+)
+
+const (
+	// sseHeartbeatInterval keeps idle event streams open through proxies.
+	sseHeartbeatInterval = 15 * time.Second
+	// sseBuffer is the number of events buffered per stream, events are dropped for slow clients.
+	sseBuffer = 256
+	// PeersSnapshot is the first event of every stream and contains the current peers.
+	PeersSnapshot events.Type = "peers.snapshot"
+)
+
+// canReadSecurityEvents reports whether the request may receive the auth.* events, which contain usernames and addresses.
+func canReadSecurityEvents(r *http.Request) bool {
+	if token := apiTokenFromContext(r.Context()); token != nil {
+		return token.HasScope(auth.ScopeAuditRead)
+	}
+	_, role, err := getClaims(r)
+	return err == nil && role.Allows(auth.RoleAdmin)
+}
+
+// parseEventFilter parses the comma separated event type patterns of the types query parameter.
+func parseEventFilter(r *http.Request) ([]string, error) {
+	types := r.URL.Query().Get("types")
+	if types == "" {
+		return nil, nil
+	}
+	patterns := strings.Split(types, ",")
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid event type pattern: %q", pattern)
+		}
+	}
+	return patterns, nil
+}
+
+func matchesEventFilter(patterns []string, t events.Type) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, string(t)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func writeSSE(w http.ResponseWriter, e *events.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+// streamEvents sends the events as Server-Sent Events until the client disconnects, the
+// server shuts down or the access token expires.
+func (a *API) streamEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	securityEvents := canReadSecurityEvents(r)
+	// subscribe before the snapshot, so no change gets lost in between
+	sub := a.events.Subscribe(sseBuffer)
+	defer sub.Close()
+	annotatedPeers, err := a.getPeers(r)
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var expired <-chan time.Time
+	if token, _, _ := jwtauth.FromContext(r.Context()); token != nil && !token.Expiration().IsZero() {
+		timer := time.NewTimer(time.Until(token.Expiration()))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	err = writeSSE(w, &events.Event{Type: PeersSnapshot, Time: time.Now().UTC(), Data: annotatedPeers})
+	if err != nil || rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-a.done:
+			return
+		case <-expired:
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			if !matchesEventFilter(filter, e.Type) || (!securityEvents && strings.HasPrefix(string(e.Type), "auth.")) {
+				continue
+			}
+			if err := writeSSE(w, e); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
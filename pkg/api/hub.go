@@ -35,3 +35,7 @@ func (a *API) getHubInfo(w http.ResponseWriter, r *http.Request) {
 	}
 	a.writeJSON(w, hubInfo)
 }
+
+func (a *API) getFilterStats(w http.ResponseWriter, _ *http.Request) {
+	a.writeJSON(w, a.filter.Stats())
+}
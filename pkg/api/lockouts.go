@@ -0,0 +1,33 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/auth"
+	"github.com/go-chi/chi/v5"
+)
+
+func (a *API) listLockouts(w http.ResponseWriter, _ *http.Request) {
+	a.writeJSON(w, a.limiter.List())
+}
+
+func (a *API) clearLockouts(w http.ResponseWriter, r *http.Request) {
+	a.limiter.ClearAll()
+	a.log.Infof("security: cleared all login lockouts")
+	a.record(r, &audit.Event{Action: audit.ActionLockoutClear, Details: "all lockouts"})
+	a.writeJSON(w, map[string]string{"status": "ok"})
+}
+
+func (a *API) clearLockout(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	err := a.limiter.Clear(key)
+	if errors.Is(err, auth.ErrLockoutNotFound) {
+		a.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	a.log.Infof("security: cleared login lockout of %s", key)
+	a.record(r, &audit.Event{Action: audit.ActionLockoutClear, Target: key})
+	a.writeJSON(w, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metric struct {
+	name, help, kind string
+	samples          []metricSample
+}
+
+type metricSample struct {
+	labels [][2]string
+	value  uint64
+}
+
+// writeMetric writes the metric in the Prometheus text exposition format.
+func writeMetric(w io.Writer, m *metric) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, s := range m.samples {
+		labels := make([]string, 0, len(s.labels))
+		for _, l := range s.labels {
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, l[0], labelEscaper.Replace(l[1])))
+		}
+		fmt.Fprintf(w, "%s{%s} %d\n", m.name, strings.Join(labels, ","), s.value)
+	}
+}
+
+// getMetrics exposes the traffic matrix in the Prometheus text exposition format.
+func (a *API) getMetrics(w http.ResponseWriter, _ *http.Request) {
+	matrixBytes := &metric{
+		name: "wghub_peer_traffic_bytes_total",
+		help: "Bytes sent from the source to the destination peer through the hub.",
+		kind: "counter",
+	}
+	matrixPackets := &metric{
+		name: "wghub_peer_traffic_packets_total",
+		help: "Packets sent from the source to the destination peer through the hub.",
+		kind: "counter",
+	}
+	for _, e := range a.matrix.Entries() {
+		labels := [][2]string{{"source", e.Source}, {"destination", e.Destination}, {"protocol", e.Protocol}}
+		matrixBytes.samples = append(matrixBytes.samples, metricSample{labels: labels, value: e.Bytes})
+		matrixPackets.samples = append(matrixPackets.samples, metricSample{labels: labels, value: e.Packets})
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(w, matrixBytes)
+	writeMetric(w, matrixPackets)
+}
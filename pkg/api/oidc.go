@@ -0,0 +1,423 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/auth"
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// oidcProviderName is the provider of the sessions that are created by an OIDC login.
+const oidcProviderName = "oidc"
+
+// oidcUsernamePrefix separates the OIDC users from the local users (local usernames can not contain a colon),
+// so the TOTP enrollment, the lockouts and the audit events of a local user can not be taken over by an OIDC user.
+const oidcUsernamePrefix = oidcProviderName + ":"
+
+const (
+	// oidcLoginTimeout is the time a user has to complete the login at the identity provider.
+	oidcLoginTimeout = 10 * time.Minute
+	// maxPendingOIDCLogins limits the memory of the unauthenticated login endpoint.
+	maxPendingOIDCLogins = 1024
+	// jwksMaxAge is the time after which the keys of the identity provider are fetched again.
+	jwksMaxAge = time.Hour
+	// jwksMinRefreshInterval limits the fetches of unknown keys.
+	jwksMinRefreshInterval = time.Minute
+	// maxOIDCResponseSize limits the size of the responses of the identity provider.
+	maxOIDCResponseSize = 1 << 20
+)
+
+var (
+	errOIDCInvalidState = errors.New("invalid or expired oidc login state")
+	errOIDCNoRole       = errors.New("user is not in any allowed group")
+)
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcLogin struct {
+	verifier string
+	nonce    string
+	created  time.Time
+}
+
+// oidcProvider implements the authorization code flow with PKCE against the identity provider.
+type oidcProvider struct {
+	cfg    *config.OIDCConfig
+	client *http.Client
+	// now is replaced in tests
+	now func() time.Time
+
+	mu          sync.Mutex // protects following fields
+	discovery   *oidcDiscovery
+	keys        jwk.Set
+	keysFetched time.Time
+	logins      map[string]*oidcLogin // by state
+}
+
+func newOIDCProvider(cfg *config.OIDCConfig) *oidcProvider {
+	return &oidcProvider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+		logins: make(map[string]*oidcLogin),
+	}
+}
+
+func randomURLString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, u)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponseSize)).Decode(v)
+}
+
+// discover returns the endpoints of the identity provider, they are fetched on first use.
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	d := p.discovery
+	p.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+	d = &oidcDiscovery{}
+	err := p.getJSON(ctx, strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", d)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery failed: %w", err)
+	}
+	if d.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc discovery failed: issuer mismatch (%s)", d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc discovery failed: missing endpoints")
+	}
+	p.mu.Lock()
+	p.discovery = d
+	p.mu.Unlock()
+	return d, nil
+}
+
+// keySet returns the cached keys of the identity provider. If refresh is set, the keys are
+// fetched again unless they were fetched recently, e.g. if a token is signed by an unknown key.
+func (p *oidcProvider) keySet(ctx context.Context, d *oidcDiscovery, refresh bool) (jwk.Set, error) {
+	p.mu.Lock()
+	keys, age := p.keys, p.now().Sub(p.keysFetched)
+	p.mu.Unlock()
+	if keys != nil && age < jwksMaxAge && (!refresh || age < jwksMinRefreshInterval) {
+		return keys, nil
+	}
+	var raw json.RawMessage
+	if err := p.getJSON(ctx, d.JWKSURI, &raw); err != nil {
+		return nil, fmt.Errorf("failed to fetch oidc keys: %w", err)
+	}
+	keys, err := jwk.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse oidc keys: %w", err)
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.keysFetched = p.now()
+	p.mu.Unlock()
+	return keys, nil
+}
+
+// authCodeURL starts a login and returns the URL of the authorization endpoint.
+func (p *oidcProvider) authCodeURL(ctx context.Context) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	state, err := randomURLString(24)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomURLString(24)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomURLString(32)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	now := p.now()
+	for s, login := range p.logins {
+		if now.Sub(login.created) > oidcLoginTimeout {
+			delete(p.logins, s)
+		}
+	}
+	if len(p.logins) >= maxPendingOIDCLogins {
+		p.mu.Unlock()
+		return "", fmt.Errorf("too many pending oidc logins")
+	}
+	p.logins[state] = &oidcLogin{verifier: verifier, nonce: nonce, created: now}
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.cfg.ClientID)
+	params.Set("redirect_uri", p.cfg.RedirectURL)
+	params.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// exchange completes the login with the authorization code and returns the user of the ID token.
+func (p *oidcProvider) exchange(ctx context.Context, state, code string) (*auth.User, error) {
+	p.mu.Lock()
+	login, ok := p.logins[state]
+	delete(p.logins, state)
+	p.mu.Unlock()
+	if !ok || p.now().Sub(login.created) > oidcLoginTimeout {
+		return nil, errOIDCInvalidState
+	}
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("code_verifier", login.verifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	var tokenRes struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponseSize)).Decode(&tokenRes); err != nil {
+		return nil, fmt.Errorf("failed to decode oidc token response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc token request failed: %s %s", tokenRes.Error, tokenRes.ErrorDescription)
+	}
+	if tokenRes.IDToken == "" {
+		return nil, fmt.Errorf("oidc token response without id token")
+	}
+
+	token, err := p.verifyIDToken(ctx, d, tokenRes.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	nonce, _ := token.Get("nonce")
+	nonceStr, _ := nonce.(string)
+	if subtle.ConstantTimeCompare([]byte(nonceStr), []byte(login.nonce)) != 1 {
+		return nil, fmt.Errorf("invalid id token nonce")
+	}
+	return p.userFromToken(token)
+}
+
+func (p *oidcProvider) parseIDToken(raw string, keys jwk.Set) (jwt.Token, error) {
+	token, err := jwt.Parse([]byte(raw),
+		jwt.WithKeySet(keys, jws.WithInferAlgorithmFromKey(true)),
+		jwt.WithValidate(true),
+		jwt.WithIssuer(p.cfg.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithRequiredClaim(jwt.IssuedAtKey),
+		jwt.WithRequiredClaim(jwt.ExpirationKey),
+		jwt.WithClock(jwt.ClockFunc(p.now)),
+		jwt.WithAcceptableSkew(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	// the authorized party is required if the token has multiple audiences
+	if len(token.Audience()) > 1 {
+		azp, _ := token.Get("azp")
+		if azp != p.cfg.ClientID {
+			return nil, fmt.Errorf("invalid authorized party")
+		}
+	}
+	return token, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience and lifetime of the ID token.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, d *oidcDiscovery, raw string) (jwt.Token, error) {
+	keys, err := p.keySet(ctx, d, false)
+	if err != nil {
+		return nil, err
+	}
+	token, err := p.parseIDToken(raw, keys)
+	if err == nil {
+		return token, nil
+	}
+	// the identity provider may have rotated its keys
+	keys, refreshErr := p.keySet(ctx, d, true)
+	if refreshErr != nil {
+		return nil, refreshErr
+	}
+	token, err = p.parseIDToken(raw, keys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+	return token, nil
+}
+
+func stringsClaim(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// userFromToken maps the claims of the ID token to a user with the oidc: prefix, the role is derived from the groups.
+func (p *oidcProvider) userFromToken(token jwt.Token) (*auth.User, error) {
+	var username string
+	for _, claim := range []string{p.cfg.UsernameClaim, "email"} {
+		if v, ok := token.Get(claim); ok {
+			if s, ok := v.(string); ok && s != "" {
+				username = s
+				break
+			}
+		}
+	}
+	if username == "" {
+		username = token.Subject()
+	}
+	if username == "" {
+		return nil, fmt.Errorf("id token without username")
+	}
+	groupsClaim, _ := token.Get(p.cfg.GroupsClaim)
+	groups := stringsClaim(groupsClaim)
+	role, ok := p.cfg.RoleForGroups(groups)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s (groups: %s)", errOIDCNoRole, username, strings.Join(groups, ", "))
+	}
+	return &auth.User{Username: oidcUsernamePrefix + username, Role: role}, nil
+}
+
+// webuiRedirect redirects to the webui with the values in the URL fragment, so they are not sent to any server.
+func webuiRedirect(w http.ResponseWriter, r *http.Request, values url.Values) {
+	http.Redirect(w, r, "/#"+values.Encode(), http.StatusFound)
+}
+
+func (a *API) getOIDC(w http.ResponseWriter, _ *http.Request) {
+	a.writeJSON(w, map[string]bool{"enabled": a.oidc != nil})
+}
+
+func (a *API) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if a.oidc == nil {
+		a.sendError(w, "oidc login is not configured", http.StatusNotFound)
+		return
+	}
+	authURL, err := a.oidc.authCodeURL(r.Context())
+	if err != nil {
+		a.log.Errorf("failed to start oidc login: %v", err)
+		webuiRedirect(w, r, url.Values{"error": {"Failed to start the SSO login."}})
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (a *API) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if a.oidc == nil {
+		a.sendError(w, "oidc login is not configured", http.StatusNotFound)
+		return
+	}
+	ip := remoteIP(r)
+	query := r.URL.Query()
+	if idpErr := query.Get("error"); idpErr != "" {
+		a.log.Warnf("security: oidc login from %s rejected by the identity provider: %s %s", ip, idpErr, query.Get("error_description"))
+		a.loginFailed(r, "", "oidc: "+idpErr)
+		webuiRedirect(w, r, url.Values{"error": {"The SSO login was rejected."}})
+		return
+	}
+	user, err := a.oidc.exchange(r.Context(), query.Get("state"), query.Get("code"))
+	if err != nil {
+		a.log.Warnf("security: failed oidc login from %s: %v", ip, err)
+		a.loginFailed(r, "", "oidc: "+err.Error())
+		msg := "The SSO login failed."
+		if errors.Is(err, errOIDCNoRole) {
+			msg = "You are not allowed to access this hub."
+		}
+		webuiRedirect(w, r, url.Values{"error": {msg}})
+		return
+	}
+	pair, err := a.sessions.LoginWithProvider(user, oidcProviderName)
+	if err != nil {
+		a.log.Errorf("failed to create session: %v", err)
+		webuiRedirect(w, r, url.Values{"error": {"Failed to create session."}})
+		return
+	}
+	a.log.Infof("security: oidc login of user %q (%s) from %s", user.Username, user.Role, ip)
+	a.record(r, &audit.Event{Actor: user.Username, Action: audit.ActionLogin, Details: "oidc"})
+	webuiRedirect(w, r, url.Values{
+		"token":        {pair.AccessToken},
+		"refreshToken": {pair.RefreshToken},
+		"expiresAt":    {pair.ExpiresAt.Format(time.RFC3339)},
+	})
+}
@@ -2,12 +2,18 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/audit"
 	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/peers"
 	"github.com/go-chi/chi/v5"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -16,6 +22,18 @@ type AnnotatedPeer struct {
 	*ipc.Peer
 	IsHub       bool `json:"isHub"`
 	IsRequester bool `json:"isRequester"`
+	// State is empty for the hub and if the peer has not been polled yet.
+	State peers.State `json:"state,omitempty"`
+	// Enabled is false if the peer was disabled, disabled peers keep their allowed ip.
+	Enabled bool `json:"enabled"`
+	// Suspended contains the reasons why the peer is suspended.
+	Suspended []peers.SuspendReason `json:"suspended,omitempty"`
+	// Tag is the tag of the pre-auth key the peer was enrolled with.
+	Tag string `json:"tag,omitempty"`
+	// Groups are the groups assigned when the registration of the peer was approved.
+	Groups []string `json:"groups,omitempty"`
+	// AllowedSources restricts the source addresses the peer may connect from.
+	AllowedSources []string `json:"allowedSources,omitempty"`
 }
 
 type AnnotatedPeers []*AnnotatedPeer
@@ -29,158 +47,245 @@ func (p AnnotatedPeers) GetAllowedIPRanges() []string {
 }
 
 func (a *API) getPeers(r *http.Request) (AnnotatedPeers, error) {
-	devConfig, err := a.dev.IpcGet()
+	ipcPeers, err := a.peers.List()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get ipc operation")
+		return nil, err
 	}
 	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse remote address")
 	}
 	hubIP := a.cfg.GetHubAddress()
-	ipcPeers := ipc.ParsePeers(devConfig)
-	peers := make(AnnotatedPeers, len(ipcPeers))
+	annotatedPeers := make(AnnotatedPeers, len(ipcPeers))
 	for i, peer := range ipcPeers {
-		peers[i] = &AnnotatedPeer{
-			Peer:        peer,
-			IsHub:       peer.AllowedIP == hubIP,
-			IsRequester: peer.AllowedIP == remoteIP+"/32",
+		suspended := a.peers.Suspended(peer.PublicKey)
+		annotatedPeers[i] = &AnnotatedPeer{
+			Peer:           peer,
+			IsHub:          peer.AllowedIP == hubIP,
+			IsRequester:    peer.AllowedIP == remoteIP+"/32",
+			Enabled:        !slices.Contains(suspended, peers.SuspendDisabled),
+			Suspended:      suspended,
+			Tag:            a.peers.Tag(peer.PublicKey),
+			Groups:         a.peers.Groups(peer.PublicKey),
+			AllowedSources: a.peers.AllowedSources(peer.PublicKey),
+		}
+		if a.watcher == nil {
+			continue
+		}
+		if status, ok := a.watcher.Status(peer.PublicKey); ok {
+			annotatedPeers[i].State = status.State
 		}
 	}
-	return peers, nil
+	return annotatedPeers, nil
 }
 
-func (a *API) listPeers(w http.ResponseWriter, r *http.Request) {
-	peers, err := a.getPeers(r)
-	if err != nil {
-		a.sendError(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	a.writeJSON(w, peers)
+type PeerDetails struct {
+	*AnnotatedPeer
+	Status   *peers.Status         `json:"status,omitempty"`
+	Quota    *peers.QuotaStatus    `json:"quota,omitempty"`
+	Schedule *peers.ScheduleStatus `json:"schedule,omitempty"`
 }
 
-//gocyclo:ignore
-func (a *API) validateAndAddPeer(w http.ResponseWriter, r *http.Request, publicKey, allowedIP string) (string, string, bool) {
-	publicKeyHex, err := ipc.Base64ToHex(publicKey)
-	if err != nil {
-		a.sendError(w, "failed to decode peer public key", http.StatusBadRequest)
-		return "", "", false
-	}
-
-	peers, err := a.getPeers(r)
-	if err != nil {
-		a.sendError(w, err.Error(), http.StatusInternalServerError)
-		return "", "", false
+// parseStatsRange parses the range query parameter, a duration (e.g. 10m or 24h) or a number of days (e.g. 30d).
+func parseStatsRange(r *http.Request) (time.Duration, error) {
+	param := r.URL.Query().Get("range")
+	if param == "" {
+		return time.Hour, nil
 	}
-
-	var hubNetwork, allowedIPPrefix string
-	if allowedIP == "" {
-		allowedIPPrefix, hubNetwork, err = config.GenerateRandomIP(peers.GetAllowedIPRanges())
+	var statsRange time.Duration
+	if days, ok := strings.CutSuffix(param, "d"); ok {
+		n, err := strconv.Atoi(days)
 		if err != nil {
-			a.sendError(w, "failed to generate random ip", http.StatusInternalServerError)
-			return "", "", false
+			return 0, fmt.Errorf("invalid range: %q", param)
 		}
+		statsRange = time.Duration(n) * 24 * time.Hour
 	} else {
-		allowedIPPrefix, err = config.NormalizeAllowedIP(allowedIP)
-		if err != nil {
-			a.sendError(w, "failed to parse allowed ip", http.StatusBadRequest)
-			return "", "", false
-		}
-		hubNetwork, err = config.FindMinimalNetwork(append(peers.GetAllowedIPRanges(), allowedIPPrefix))
+		var err error
+		statsRange, err = time.ParseDuration(param)
 		if err != nil {
-			a.sendError(w, "failed to find hub network", http.StatusInternalServerError)
-			return "", "", false
+			return 0, fmt.Errorf("invalid range: %q", param)
 		}
 	}
+	if statsRange <= 0 || statsRange > peers.MaxStatsRange {
+		return 0, fmt.Errorf("range must be between 1s and %dd", peers.MaxStatsRange/(24*time.Hour))
+	}
+	return statsRange, nil
+}
 
-	hubOverlap, err := config.CheckIPOverlap(allowedIPPrefix, a.cfg.GetHubAddress())
+// getPeer returns the details of a peer or with the suffix /sessions its connection
+// history, with the suffix /stats its traffic history, with /quota its quota and
+// with /schedule its schedule.
+func (a *API) getPeer(w http.ResponseWriter, r *http.Request) {
+	publicKey := chi.URLParam(r, "*")
+	view := ""
+	for _, suffix := range []string{"sessions", "stats", "quota", "schedule"} {
+		if key, ok := strings.CutSuffix(publicKey, "/"+suffix); ok {
+			publicKey, view = key, suffix
+			break
+		}
+	}
+	annotatedPeers, err := a.getPeers(r)
 	if err != nil {
-		a.sendError(w, "failed to check ip overlap", http.StatusInternalServerError)
-		return "", "", false
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	if hubOverlap {
-		a.sendError(w, "hub address overlaps with allowed ip", http.StatusBadRequest)
-		return "", "", false
+	idx := slices.IndexFunc(annotatedPeers, func(p *AnnotatedPeer) bool {
+		return p.PublicKey == publicKey
+	})
+	if idx < 0 {
+		a.sendError(w, "peer not found", http.StatusNotFound)
+		return
 	}
-
-	for _, peer := range peers {
-		overlap, overlapErr := config.CheckIPOverlap(peer.AllowedIP, allowedIPPrefix)
-		if overlapErr != nil {
-			a.sendError(w, "failed to check ip overlap", http.StatusInternalServerError)
-			return "", "", false
+	switch view {
+	case "sessions":
+		if a.watcher == nil {
+			a.writeJSON(w, []*peers.Session{})
+			return
+		}
+		a.writeJSON(w, a.watcher.Sessions(publicKey))
+	case "stats":
+		statsRange, err := parseStatsRange(r)
+		if err != nil {
+			a.sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if a.sampler == nil {
+			a.sendError(w, "peer stats not available", http.StatusNotFound)
+			return
+		}
+		// the hub and peers that were just added are not sampled
+		stats, ok := a.sampler.Stats(publicKey, statsRange)
+		if !ok {
+			a.sendError(w, "peer stats not available", http.StatusNotFound)
+			return
 		}
-		if overlap {
-			a.sendError(w, "allowed ip already in use", http.StatusBadRequest)
-			return "", "", false
+		a.writeJSON(w, stats)
+	case "quota":
+		a.getPeerQuota(w, publicKey)
+	case "schedule":
+		a.getPeerSchedule(w, publicKey)
+	default:
+		details := &PeerDetails{AnnotatedPeer: annotatedPeers[idx]}
+		if a.watcher != nil {
+			details.Status, _ = a.watcher.Status(publicKey)
 		}
+		if a.quotas != nil {
+			details.Quota, _ = a.quotas.Get(publicKey)
+		}
+		if a.schedule != nil {
+			details.Schedule, _ = a.schedule.Get(publicKey)
+		}
+		a.writeJSON(w, details)
 	}
-	addInstruction := fmt.Sprintf(
-		"public_key=%s\nreplace_allowed_ips=true\nallowed_ip=%s\n",
-		publicKeyHex,
-		allowedIPPrefix,
-	)
-	err = a.dev.IpcSet(addInstruction)
+}
+
+func (a *API) listPeers(w http.ResponseWriter, r *http.Request) {
+	annotatedPeers, err := a.getPeers(r)
 	if err != nil {
-		a.sendError(w, "failed to add peer", http.StatusInternalServerError)
-		a.log.Errorf("failed to add peer: %v", err)
-		return "", "", false
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	a.log.Infof("added peer %s (%s)", publicKeyHex, allowedIPPrefix)
-	return allowedIPPrefix, hubNetwork, true
+	a.writeJSON(w, annotatedPeers)
+}
+
+// sendPeerError responds with a bad request for rejected peer changes, all other errors are internal errors.
+func (a *API) sendPeerError(w http.ResponseWriter, err error) {
+	var validationErr *peers.ValidationError
+	if errors.As(err, &validationErr) {
+		a.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, peers.ErrPeerNotFound) {
+		a.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	a.sendError(w, err.Error(), http.StatusInternalServerError)
 }
 
 type AddPeerRequest struct {
 	AllowedIP string `json:"allowedIP"`
+	// AllowedSources replaces the allowed source addresses of the peer, the peer keeps them if unset.
+	AllowedSources []string `json:"allowedSources"`
+	// Enabled disables or enables the peer, the peer keeps its state if unset.
+	Enabled *bool `json:"enabled,omitempty"`
 }
 
-type AddPeerResponse struct {
-	AllowedIP  string `json:"allowedIP"`
-	HubNetwork string `json:"hubNetwork"`
-}
+type AddPeerResponse = peers.AddResult
 
 func (a *API) addPeer(w http.ResponseWriter, r *http.Request) {
-	a.ipcMutex.Lock()
-	defer a.ipcMutex.Unlock()
-
 	defer r.Body.Close()
+	if publicKey, ok := strings.CutSuffix(chi.URLParam(r, "*"), "/quota"); ok {
+		a.setPeerQuota(w, r, publicKey)
+		return
+	}
+	if publicKey, ok := strings.CutSuffix(chi.URLParam(r, "*"), "/schedule"); ok {
+		a.setPeerSchedule(w, r, publicKey)
+		return
+	}
 	var req AddPeerRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		a.sendError(w, "failed to decode request", http.StatusBadRequest)
 		return
 	}
-	allowedIP, hubNetwork, ok := a.validateAndAddPeer(w, r, chi.URLParam(r, "*"), req.AllowedIP)
-	if !ok {
+	publicKey := chi.URLParam(r, "*")
+	var opts []peers.AddOption
+	disable := req.Enabled != nil && !*req.Enabled && !slices.Contains(a.peers.Suspended(publicKey), peers.SuspendDisabled)
+	if disable {
+		opts = append(opts, peers.WithDisabled())
+	}
+	res, err := a.peers.Add(publicKey, req.AllowedIP, req.AllowedSources, opts...)
+	if err != nil {
+		a.sendPeerError(w, err)
 		return
 	}
-	a.writeJSON(w, AddPeerResponse{
-		AllowedIP:  allowedIP,
-		HubNetwork: hubNetwork,
+	action := audit.ActionPeerAdd
+	if res.PreviousAllowedIP != "" {
+		action = audit.ActionPeerUpdate
+	}
+	a.record(r, &audit.Event{
+		Action: action,
+		Target: publicKey,
+		Before: peerState(res.PreviousAllowedIP),
+		After:  peerState(res.AllowedIP),
 	})
+	if disable {
+		a.record(r, &audit.Event{Action: audit.ActionPeerDisable, Target: publicKey})
+	}
+	if req.Enabled != nil && *req.Enabled && !a.setPeerEnabled(w, r, publicKey, true) {
+		return
+	}
+	a.writeJSON(w, res)
 }
 
 func (a *API) removePeer(w http.ResponseWriter, r *http.Request) {
-	a.ipcMutex.Lock()
-	defer a.ipcMutex.Unlock()
-
-	peerPublicKeyHex, err := ipc.Base64ToHex(chi.URLParam(r, "*"))
-	if err != nil {
-		a.sendError(w, "failed to decode peer public key", http.StatusBadRequest)
+	publicKey := chi.URLParam(r, "*")
+	if key, ok := strings.CutSuffix(publicKey, "/quota"); ok {
+		a.removePeerQuota(w, r, key)
+		return
+	}
+	if key, ok := strings.CutSuffix(publicKey, "/schedule"); ok {
+		a.removePeerSchedule(w, r, key)
 		return
 	}
-	deleteInstruction := fmt.Sprintf("public_key=%s\nremove=true\n", peerPublicKeyHex)
-	err = a.dev.IpcSet(deleteInstruction)
+	allowedIP, err := a.peers.Remove(publicKey)
 	if err != nil {
-		a.sendError(w, "failed to remove peer", http.StatusInternalServerError)
-		a.log.Errorf("failed to remove peer: %v", err)
+		a.sendPeerError(w, err)
 		return
 	}
-	a.log.Infof("removed peer %s", peerPublicKeyHex)
+	a.record(r, &audit.Event{
+		Action: audit.ActionPeerRemove,
+		Target: publicKey,
+		Before: peerState(allowedIP),
+	})
 	a.writeJSON(w, map[string]string{"status": "ok"})
 }
 
 type GeneratePeerRequest struct {
-	AllowedIP string `json:"allowedIP"`
+	AllowedIP      string   `json:"allowedIP"`
+	AllowedSources []string `json:"allowedSources"`
+	// Enabled adds the peer disabled if false.
+	Enabled *bool `json:"enabled,omitempty"`
 }
 
 type GeneratePeerResponse struct {
@@ -191,9 +296,6 @@ type GeneratePeerResponse struct {
 }
 
 func (a *API) generatePeer(w http.ResponseWriter, r *http.Request) {
-	a.ipcMutex.Lock()
-	defer a.ipcMutex.Unlock()
-
 	defer r.Body.Close()
 	var req GeneratePeerRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -206,14 +308,84 @@ func (a *API) generatePeer(w http.ResponseWriter, r *http.Request) {
 		a.sendError(w, "failed to generate private key", http.StatusInternalServerError)
 		return
 	}
-	allowedIP, hubNetwork, ok := a.validateAndAddPeer(w, r, privateKey.PublicKey().String(), req.AllowedIP)
-	if !ok {
+	var opts []peers.AddOption
+	disable := req.Enabled != nil && !*req.Enabled
+	if disable {
+		opts = append(opts, peers.WithDisabled())
+	}
+	res, err := a.peers.Add(privateKey.PublicKey().String(), req.AllowedIP, req.AllowedSources, opts...)
+	if err != nil {
+		a.sendPeerError(w, err)
 		return
 	}
+	a.record(r, &audit.Event{
+		Action:  audit.ActionPeerAdd,
+		Target:  privateKey.PublicKey().String(),
+		After:   peerState(res.AllowedIP),
+		Details: "generated key pair",
+	})
+	if disable {
+		a.record(r, &audit.Event{Action: audit.ActionPeerDisable, Target: privateKey.PublicKey().String()})
+	}
 	a.writeJSON(w, GeneratePeerResponse{
 		PrivateKey: privateKey.String(),
 		PublicKey:  privateKey.PublicKey().String(),
-		AllowedIP:  allowedIP,
-		HubNetwork: hubNetwork,
+		AllowedIP:  res.AllowedIP,
+		HubNetwork: res.HubNetwork,
 	})
 }
+
+// peerAction handles the actions of a peer (POST /peers/:publicKey/<action>).
+func (a *API) peerAction(w http.ResponseWriter, r *http.Request) {
+	path := chi.URLParam(r, "*")
+	if publicKey, ok := strings.CutSuffix(path, "/quota/reset"); ok {
+		a.resetPeerQuota(w, r, publicKey)
+		return
+	}
+	if publicKey, ok := strings.CutSuffix(path, "/enable"); ok {
+		if a.setPeerEnabled(w, r, publicKey, true) {
+			a.writeJSON(w, map[string]string{"status": "ok"})
+		}
+		return
+	}
+	if publicKey, ok := strings.CutSuffix(path, "/disable"); ok {
+		if a.setPeerEnabled(w, r, publicKey, false) {
+			a.writeJSON(w, map[string]string{"status": "ok"})
+		}
+		return
+	}
+	a.sendError(w, "not found", http.StatusNotFound)
+}
+
+// setPeerEnabled disables or enables the peer, disabled peers are suspended and
+// keep their allowed ip. It returns false if an error response was sent.
+func (a *API) setPeerEnabled(w http.ResponseWriter, r *http.Request, publicKey string, enabled bool) bool {
+	ipcPeers, err := a.peers.List()
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !slices.ContainsFunc(ipcPeers, func(p *ipc.Peer) bool { return p.PublicKey == publicKey }) {
+		a.sendError(w, "peer not found", http.StatusNotFound)
+		return false
+	}
+	wasEnabled := !slices.Contains(a.peers.Suspended(publicKey), peers.SuspendDisabled)
+	if enabled {
+		err = a.peers.Resume(publicKey, peers.SuspendDisabled)
+	} else {
+		err = a.peers.Suspend(publicKey, peers.SuspendDisabled)
+	}
+	if err != nil {
+		a.sendPeerError(w, err)
+		return false
+	}
+	if wasEnabled == enabled {
+		return true
+	}
+	action := audit.ActionPeerDisable
+	if enabled {
+		action = audit.ActionPeerEnable
+	}
+	a.record(r, &audit.Event{Action: action, Target: publicKey})
+	return true
+}
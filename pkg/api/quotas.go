@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+)
+
+// requireQuotas checks that quotas are available and that the peer exists.
+func (a *API) requireQuotas(w http.ResponseWriter, publicKey string) bool {
+	if a.quotas == nil {
+		a.sendError(w, "peer quotas not available", http.StatusNotFound)
+		return false
+	}
+	ipcPeers, err := a.peers.List()
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !slices.ContainsFunc(ipcPeers, func(p *ipc.Peer) bool { return p.PublicKey == publicKey }) {
+		a.sendError(w, "peer not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func (a *API) getPeerQuota(w http.ResponseWriter, publicKey string) {
+	if a.quotas == nil {
+		a.sendError(w, "peer quotas not available", http.StatusNotFound)
+		return
+	}
+	status, ok := a.quotas.Get(publicKey)
+	if !ok {
+		a.sendError(w, "peer has no quota", http.StatusNotFound)
+		return
+	}
+	a.writeJSON(w, status)
+}
+
+func (a *API) setPeerQuota(w http.ResponseWriter, r *http.Request, publicKey string) {
+	if !a.requireQuotas(w, publicKey) {
+		return
+	}
+	var quota config.PeerQuota
+	if err := json.NewDecoder(r.Body).Decode(&quota); err != nil {
+		a.sendError(w, "failed to decode request", http.StatusBadRequest)
+		return
+	}
+	quota.PublicKey = publicKey
+	if err := quota.Validate(); err != nil {
+		a.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	before, _ := a.quotas.Get(publicKey)
+	status := a.quotas.Set(&quota)
+	event := &audit.Event{Action: audit.ActionQuotaUpdate, Target: publicKey, After: &quota}
+	if before != nil {
+		event.Before = before.PeerQuota
+	}
+	a.record(r, event)
+	a.writeJSON(w, status)
+}
+
+func (a *API) removePeerQuota(w http.ResponseWriter, r *http.Request, publicKey string) {
+	if a.quotas == nil {
+		a.sendError(w, "peer quotas not available", http.StatusNotFound)
+		return
+	}
+	before, ok := a.quotas.Get(publicKey)
+	if !ok || !a.quotas.Delete(publicKey) {
+		a.sendError(w, "peer has no quota", http.StatusNotFound)
+		return
+	}
+	a.record(r, &audit.Event{Action: audit.ActionQuotaRemove, Target: publicKey, Before: before.PeerQuota})
+	a.writeJSON(w, map[string]string{"status": "ok"})
+}
+
+func (a *API) resetPeerQuota(w http.ResponseWriter, r *http.Request, publicKey string) {
+	if a.quotas == nil {
+		a.sendError(w, "peer quotas not available", http.StatusNotFound)
+		return
+	}
+	before, ok := a.quotas.Get(publicKey)
+	if !ok {
+		a.sendError(w, "peer has no quota", http.StatusNotFound)
+		return
+	}
+	status, _ := a.quotas.Reset(publicKey)
+	a.record(r, &audit.Event{
+		Action:  audit.ActionQuotaReset,
+		Target:  publicKey,
+		Details: "used=" + strconv.FormatUint(before.Used, 10),
+	})
+	a.writeJSON(w, status)
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/enroll"
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/christophwitzko/wg-hub/pkg/peers"
+	"github.com/go-chi/chi/v5"
+)
+
+func (a *API) sendRegistrationError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, peers.ErrRegistrationNotFound):
+		a.sendError(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, peers.ErrTooManyRegistrations) || errors.Is(err, peers.ErrRegistrationLimited):
+		a.sendError(w, err.Error(), http.StatusTooManyRequests)
+	default:
+		a.sendPeerError(w, err)
+	}
+}
+
+// registrationResult returns the state of the registration for the device, the
+// client config is only included once the registration was approved.
+func (a *API) registrationResult(reg *peers.Registration) *enroll.RegistrationResult {
+	res := &enroll.RegistrationResult{ID: reg.ID, Status: string(reg.Status), Reason: reg.Reason}
+	if reg.Status == peers.RegistrationApproved {
+		res.Response = &enroll.Response{
+			PublicKey:    reg.PublicKey,
+			AllowedIP:    reg.AllowedIP,
+			HubNetwork:   reg.HubNetwork,
+			HubPublicKey: a.cfg.PrivateKey.PublicKey().String(),
+			Endpoint:     a.cfg.GetExternalAddress() + ":" + a.cfg.GetPort(),
+		}
+		res.Config = res.ClientConfig(enroll.PrivateKeyPlaceholder)
+	}
+	return res
+}
+
+// register adds a pending registration request of a device, the device polls the result via pollRegistration.
+func (a *API) register(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if a.registrations == nil {
+		a.sendError(w, "registrations not available", http.StatusNotFound)
+		return
+	}
+	var req enroll.RegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.sendError(w, "failed to decode request", http.StatusBadRequest)
+		return
+	}
+	reg, err := a.registrations.Submit(req.PublicKey, req.Hostname, req.Name, remoteIP(r))
+	if err != nil {
+		a.sendRegistrationError(w, err)
+		return
+	}
+	a.log.Infof("registration %s of peer %s (%s) pending approval", reg.ID, reg.PublicKey, reg.Hostname)
+	a.record(r, &audit.Event{Actor: "registration", Action: audit.ActionPeerRegister, Target: reg.PublicKey, After: reg})
+	a.events.Publish(events.PeerRegistration, reg)
+	a.writeJSON(w, a.registrationResult(reg), http.StatusAccepted)
+}
+
+func (a *API) pollRegistration(w http.ResponseWriter, r *http.Request) {
+	if a.registrations == nil {
+		a.sendError(w, "registrations not available", http.StatusNotFound)
+		return
+	}
+	reg, ok := a.registrations.Get(chi.URLParam(r, "id"))
+	if !ok {
+		a.sendError(w, peers.ErrRegistrationNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	a.writeJSON(w, a.registrationResult(reg))
+}
+
+func (a *API) listRegistrations(w http.ResponseWriter, r *http.Request) {
+	if a.registrations == nil {
+		a.sendError(w, "registrations not available", http.StatusNotFound)
+		return
+	}
+	status := peers.RegistrationStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "", peers.RegistrationPending, peers.RegistrationApproved, peers.RegistrationRejected:
+	default:
+		a.sendError(w, "invalid registration status", http.StatusBadRequest)
+		return
+	}
+	a.writeJSON(w, a.registrations.List(status))
+}
+
+type ApproveRegistrationRequest struct {
+	// AllowedIP is a random free ip of the hub network if empty.
+	AllowedIP string   `json:"allowedIP"`
+	Groups    []string `json:"groups"`
+}
+
+func (a *API) approveRegistration(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if a.registrations == nil {
+		a.sendError(w, "registrations not available", http.StatusNotFound)
+		return
+	}
+	var req ApproveRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.sendError(w, "failed to decode request", http.StatusBadRequest)
+		return
+	}
+	username, _, _ := getClaims(r)
+	reg, err := a.registrations.Approve(chi.URLParam(r, "id"), req.AllowedIP, req.Groups, username)
+	if err != nil {
+		a.sendRegistrationError(w, err)
+		return
+	}
+	a.log.Infof("registration %s of peer %s approved by %s", reg.ID, reg.PublicKey, username)
+	a.record(r, &audit.Event{Action: audit.ActionRegistrationApprove, Target: reg.PublicKey, After: peerState(reg.AllowedIP), Details: "registration=" + reg.ID})
+	a.writeJSON(w, reg)
+}
+
+type RejectRegistrationRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (a *API) rejectRegistration(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if a.registrations == nil {
+		a.sendError(w, "registrations not available", http.StatusNotFound)
+		return
+	}
+	var req RejectRegistrationRequest
+	// the body with the reason is optional
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		a.sendError(w, "failed to decode request", http.StatusBadRequest)
+		return
+	}
+	username, _, _ := getClaims(r)
+	reg, err := a.registrations.Reject(chi.URLParam(r, "id"), req.Reason, username)
+	if err != nil {
+		a.sendRegistrationError(w, err)
+		return
+	}
+	a.log.Infof("registration %s of peer %s rejected by %s", reg.ID, reg.PublicKey, username)
+	a.record(r, &audit.Event{Action: audit.ActionRegistrationReject, Target: reg.PublicKey, Details: reg.Reason})
+	a.writeJSON(w, reg)
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+)
+
+func (a *API) getPeerSchedule(w http.ResponseWriter, publicKey string) {
+	if a.schedule == nil {
+		a.sendError(w, "peer schedules not available", http.StatusNotFound)
+		return
+	}
+	status, ok := a.schedule.Get(publicKey)
+	if !ok {
+		a.sendError(w, "peer has no schedule", http.StatusNotFound)
+		return
+	}
+	a.writeJSON(w, status)
+}
+
+func (a *API) setPeerSchedule(w http.ResponseWriter, r *http.Request, publicKey string) {
+	if a.schedule == nil {
+		a.sendError(w, "peer schedules not available", http.StatusNotFound)
+		return
+	}
+	ipcPeers, err := a.peers.List()
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !slices.ContainsFunc(ipcPeers, func(p *ipc.Peer) bool { return p.PublicKey == publicKey }) {
+		a.sendError(w, "peer not found", http.StatusNotFound)
+		return
+	}
+	var schedule config.PeerSchedule
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		a.sendError(w, "failed to decode request", http.StatusBadRequest)
+		return
+	}
+	schedule.PublicKey = publicKey
+	if err := schedule.Validate(); err != nil {
+		a.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	before, _ := a.schedule.Get(publicKey)
+	status := a.schedule.Set(&schedule)
+	event := &audit.Event{Action: audit.ActionScheduleUpdate, Target: publicKey, After: &schedule}
+	if before != nil {
+		event.Before = before.PeerSchedule
+	}
+	a.record(r, event)
+	a.writeJSON(w, status)
+}
+
+func (a *API) removePeerSchedule(w http.ResponseWriter, r *http.Request, publicKey string) {
+	if a.schedule == nil {
+		a.sendError(w, "peer schedules not available", http.StatusNotFound)
+		return
+	}
+	before, ok := a.schedule.Get(publicKey)
+	if !ok || !a.schedule.Delete(publicKey) {
+		a.sendError(w, "peer has no schedule", http.StatusNotFound)
+		return
+	}
+	a.record(r, &audit.Event{Action: audit.ActionScheduleRemove, Target: publicKey, Before: before.PeerSchedule})
+	a.writeJSON(w, map[string]string{"status": "ok"})
+}
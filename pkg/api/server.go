@@ -1,51 +1,243 @@
 package api
 
 import (
-	"bytes"
-	"crypto/rand"
 	"encoding/json"
-	"io"
 	"net/http"
+	"runtime"
 	"sync"
 
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/auth"
+	"github.com/christophwitzko/wg-hub/pkg/capture"
 	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/christophwitzko/wg-hub/pkg/loopback"
+	"github.com/christophwitzko/wg-hub/pkg/peers"
+	"github.com/christophwitzko/wg-hub/pkg/shaping"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/christophwitzko/wg-hub/pkg/webhook"
+	"github.com/christophwitzko/wg-hub/pkg/wgconn"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/jwtauth/v5"
 	"github.com/sirupsen/logrus"
-	"golang.zx2c4.com/wireguard/device"
 )
 
 type API struct {
-	router    *chi.Mux
-	log       *logrus.Logger
-	dev       *device.Device
-	cfg       *config.Config
-	tokenAuth *jwtauth.JWTAuth
-	ipcMutex  sync.Mutex
+	router   *chi.Mux
+	log      *logrus.Logger
+	cfg      *config.Config
+	peers    *peers.Manager
+	sessions *auth.Sessions
+	tokens   *auth.Tokens
+	// preAuthKeys enable the enrollment of devices, the enrollment is disabled if nil
+	preAuthKeys *auth.PreAuthKeys
+	// registrations enable the registration requests of devices, the registrations are disabled if nil
+	registrations *peers.Registrations
+	totp          *auth.TOTP
+	oidc          *oidcProvider
+	audit         *audit.Log
+	events        *events.Bus
+	webhooks      *webhook.Dispatcher
+	watcher       *peers.Watcher
+	sampler       *peers.Sampler
+	quotas        *peers.Quotas
+	schedule      *peers.Scheduler
+	matrix        *loopback.Matrix
+	capturer      *capture.Capturer
+	shaper        *shaping.Shaper
+	limiter       *auth.LoginLimiter
+	// loginSlots limits the concurrent password checks, bcrypt is expensive
+	loginSlots chan struct{}
+	filter     *wgconn.SourceFilter
+
+	// done is closed on shutdown to end the event streams
+	done         chan struct{}
+	shutdownOnce sync.Once
+
+	usersMu sync.Mutex
+	// loadedUsers is the summary of the last loaded users to detect reloads
+	loadedUsers []string
+}
+
+type Option func(a *API)
+
+// WithSourceFilter exposes the stats of the source filter of the hub bind.
+func WithSourceFilter(filter *wgconn.SourceFilter) Option {
+	return func(a *API) {
+		a.filter = filter
+	}
+}
+
+// WithLoginLimiter sets the limiter of the failed logins, so the API and the enrollment
+// handler share the lockouts. By default every handler has its own limiter.
+func WithLoginLimiter(limiter *auth.LoginLimiter) Option {
+	return func(a *API) {
+		a.limiter = limiter
+	}
+}
+
+// WithTokens sets the API tokens, by default the tokens are only kept in memory.
+func WithTokens(tokens *auth.Tokens) Option {
+	return func(a *API) {
+		a.tokens = tokens
+	}
+}
+
+// WithPreAuthKeys enables the enrollment of devices with pre-auth keys.
+func WithPreAuthKeys(keys *auth.PreAuthKeys) Option {
+	return func(a *API) {
+		a.preAuthKeys = keys
+	}
+}
+
+// WithRegistrations enables the registration requests of devices that need to be approved by an admin.
+func WithRegistrations(registrations *peers.Registrations) Option {
+	return func(a *API) {
+		a.registrations = registrations
+	}
+}
+
+// WithSessions sets the webui sessions, by default the sessions are only kept in memory.
+func WithSessions(sessions *auth.Sessions) Option {
+	return func(a *API) {
+		a.sessions = sessions
+	}
+}
+
+// WithTOTP sets the TOTP enrollments, by default the enrollments are only kept in memory.
+func WithTOTP(totp *auth.TOTP) Option {
+	return func(a *API) {
+		a.totp = totp
+	}
+}
+
+// WithAuditLog sets the audit log, by default the events are only kept in memory.
+func WithAuditLog(log *audit.Log) Option {
+	return func(a *API) {
+		a.audit = log
+	}
+}
+
+// WithEvents sets the event bus the failed logins are published to.
+func WithEvents(bus *events.Bus) Option {
+	return func(a *API) {
+		a.events = bus
+	}
+}
+
+// WithWebhooks exposes the delivery status of the webhooks.
+func WithWebhooks(webhooks *webhook.Dispatcher) Option {
+	return func(a *API) {
+		a.webhooks = webhooks
+	}
+}
+
+// WithPeerWatcher exposes the connection state and the sessions of the peers.
+func WithPeerWatcher(watcher *peers.Watcher) Option {
+	return func(a *API) {
+		a.watcher = watcher
+	}
+}
+
+// WithPeerQuotas exposes and manages the traffic quotas of the peers.
+func WithPeerQuotas(quotas *peers.Quotas) Option {
+	return func(a *API) {
+		a.quotas = quotas
+	}
+}
+
+// WithPeerScheduler exposes and manages the expiry and the access windows of the peers.
+func WithPeerScheduler(scheduler *peers.Scheduler) Option {
+	return func(a *API) {
+		a.schedule = scheduler
+	}
+}
+
+// WithPeerSampler exposes the traffic history of the peers.
+func WithPeerSampler(sampler *peers.Sampler) Option {
+	return func(a *API) {
+		a.sampler = sampler
+	}
 }
 
-func NewAPIServer(log *logrus.Logger, dev *device.Device, cfg *config.Config) *API {
-	var jwtSecret bytes.Buffer
+// WithTrafficMatrix exposes the traffic between the peers.
+func WithTrafficMatrix(matrix *loopback.Matrix) Option {
+	return func(a *API) {
+		a.matrix = matrix
+	}
+}
+
+// WithCapturer enables the packet capture.
+func WithCapturer(capturer *capture.Capturer) Option {
+	return func(a *API) {
+		a.capturer = capturer
+	}
+}
+
+func WithShaper(shaper *shaping.Shaper) Option {
+	return func(a *API) {
+		a.shaper = shaper
+	}
+}
+
+func NewAPIServer(log *logrus.Logger, cfg *config.Config, peerManager *peers.Manager, opts ...Option) *API {
+	a := &API{
+		router:     chi.NewRouter(),
+		log:        log,
+		cfg:        cfg,
+		peers:      peerManager,
+		loginSlots: make(chan struct{}, runtime.GOMAXPROCS(0)),
+		done:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
 	if cfg.WebuiJWTSecret == "" {
 		log.Warnf("using random jwt secret")
-		_, err := jwtSecret.ReadFrom(io.LimitReader(rand.Reader, 32))
-		if err != nil {
-			panic(err)
+	}
+	if a.limiter == nil {
+		a.limiter = auth.NewLoginLimiter(&auth.LoginLimiterConfig{
+			MaxAttempts: cfg.WebuiLoginMaxAttempts,
+			Lockout:     cfg.WebuiLoginLockout,
+			MaxLockout:  cfg.WebuiLoginMaxLockout,
+		})
+	}
+	if a.sessions == nil {
+		a.sessions = config.MustGet(auth.NewSessions(store.NewMemoryStore(), cfg.WebuiJWTSecret, cfg.WebuiAccessTokenTTL, cfg.WebuiRefreshTokenTTL))
+	}
+	if a.tokens == nil {
+		a.tokens = config.MustGet(auth.NewTokens(store.NewMemoryStore()))
+	}
+	if cfg.WebuiOIDC != nil {
+		if err := cfg.WebuiOIDC.Validate(cfg.HubAddress); err != nil {
+			log.Errorf("oidc login disabled: %v", err)
+		} else {
+			a.oidc = newOIDCProvider(cfg.WebuiOIDC)
 		}
-	} else {
-		jwtSecret.WriteString(cfg.WebuiJWTSecret)
 	}
-	a := &API{
-		router:    chi.NewRouter(),
-		log:       log,
-		dev:       dev,
-		cfg:       cfg,
-		tokenAuth: jwtauth.New("HS256", jwtSecret.Bytes(), nil),
+	if a.events == nil {
+		a.events = events.NewBus()
+	}
+	if a.audit == nil {
+		a.audit = config.MustGet(audit.Open(""))
+	}
+	if users, err := cfg.LoadUsers(); err == nil {
+		a.loadedUsers = usersSummary(users)
+	}
+	if a.totp == nil {
+		a.totp = config.MustGet(auth.NewTOTP(store.NewMemoryStore()))
 	}
 	a.initRoutes()
 	return a
 }
 
+// Shutdown ends all event streams, so a graceful shutdown of the http server does not wait for them.
+func (a *API) Shutdown() {
+	a.shutdownOnce.Do(func() {
+		close(a.done)
+	})
+}
+
 func (a *API) loggerMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		a.log.Infof("api request: %s - %s %s", r.RemoteAddr, r.Method, r.URL.Path)
@@ -55,6 +247,10 @@ func (a *API) loggerMiddleware(next http.Handler) http.Handler {
 
 func (a *API) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiTokenFromContext(r.Context()) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
 		token, _, err := jwtauth.FromContext(r.Context())
 		if err != nil {
 			a.sendError(w, err.Error(), http.StatusUnauthorized)
@@ -96,27 +292,88 @@ func (a *API) initRoutes() {
 			a.writeJSON(w, map[string]string{"status": "ok"})
 		})
 		r.Post("/auth", a.createAuth)
+		r.Post("/auth/refresh", a.refreshAuth)
+		r.Get("/auth/oidc", a.getOIDC)
+		r.Get("/auth/oidc/login", a.oidcLogin)
+		r.Get("/auth/oidc/callback", a.oidcCallback)
+		r.Post("/enroll", a.enroll)
+		r.Post("/register", a.register)
+		r.Get("/register/{id}", a.pollRegistration)
 	})
 
 	// protected routes
 	a.router.Group(func(r chi.Router) {
-		r.Use(jwtauth.Verifier(a.tokenAuth))
+		r.Use(a.verifier)
 		r.Use(a.authMiddleware)
 
 		// auth routes
 		r.Get("/auth", a.getAuth)
+		r.With(a.requireRole(auth.RoleViewer)).Delete("/auth", a.logout)
+		r.With(a.requireRole(auth.RoleAdmin)).Get("/auth/sessions", a.listSessions)
+		r.With(a.requireRole(auth.RoleAdmin)).Delete("/auth/sessions", a.revokeSessions)
+		r.With(a.requireRole(auth.RoleAdmin)).Post("/auth/keys/rotate", a.rotateKey)
+		r.With(a.requireRole(auth.RoleViewer)).Get("/auth/totp", a.getTOTP)
+		r.With(a.requireRole(auth.RoleViewer)).Post("/auth/totp", a.enrollTOTP)
+		r.With(a.requireRole(auth.RoleViewer)).Post("/auth/totp/enable", a.enableTOTP)
+		r.With(a.requireRole(auth.RoleViewer)).Delete("/auth/totp", a.disableTOTP)
+		r.With(a.requireRole(auth.RoleAdmin)).Get("/auth/lockouts", a.listLockouts)
+		r.With(a.requireRole(auth.RoleAdmin)).Delete("/auth/lockouts", a.clearLockouts)
+		r.With(a.requireRole(auth.RoleAdmin)).Delete("/auth/lockouts/{key}", a.clearLockout)
 
 		// peers api
-		r.Get("/peers", a.listPeers)
-		r.Post("/peers", a.generatePeer)
-		r.Put("/peers/*", a.addPeer)
-		r.Delete("/peers/*", a.removePeer)
+		r.With(a.require(auth.RoleViewer, auth.ScopePeersRead)).Get("/peers", a.listPeers)
+		r.With(a.require(auth.RoleViewer, auth.ScopePeersRead)).Get("/peers/*", a.getPeer)
+		r.With(a.require(auth.RoleOperator, auth.ScopePeersWrite)).Post("/peers", a.generatePeer)
+		r.With(a.require(auth.RoleOperator, auth.ScopePeersWrite)).Put("/peers/*", a.addPeer)
+		r.With(a.require(auth.RoleOperator, auth.ScopePeersWrite)).Post("/peers/*", a.peerAction)
+		r.With(a.require(auth.RoleOperator, auth.ScopePeersWrite)).Delete("/peers/*", a.removePeer)
 
 		// config api
-		r.Get("/config", a.getConfig)
+		r.With(a.require(auth.RoleAdmin, auth.ScopeConfigRead)).Get("/config", a.getConfig)
+
+		// users api
+		r.With(a.require(auth.RoleAdmin, auth.ScopeUsersRead)).Get("/users", a.listUsers)
+		r.With(a.requireRole(auth.RoleAdmin)).Delete("/users/{username}/totp", a.resetTOTP)
+
+		// tokens api
+		r.With(a.requireRole(auth.RoleAdmin)).Get("/tokens", a.listTokens)
+		r.With(a.requireRole(auth.RoleAdmin)).Post("/tokens", a.createToken)
+		r.With(a.requireRole(auth.RoleAdmin)).Delete("/tokens/{id}", a.revokeToken)
+
+		// enrollment api
+		r.With(a.requireRole(auth.RoleAdmin)).Get("/enrollment/keys", a.listPreAuthKeys)
+		r.With(a.requireRole(auth.RoleAdmin)).Post("/enrollment/keys", a.createPreAuthKey)
+		r.With(a.requireRole(auth.RoleAdmin)).Delete("/enrollment/keys/{id}", a.revokePreAuthKey)
+		r.With(a.requireRole(auth.RoleAdmin)).Get("/registrations", a.listRegistrations)
+		r.With(a.requireRole(auth.RoleAdmin)).Post("/registrations/{id}/approve", a.approveRegistration)
+		r.With(a.requireRole(auth.RoleAdmin)).Post("/registrations/{id}/reject", a.rejectRegistration)
+
+		// audit api
+		r.With(a.require(auth.RoleAdmin, auth.ScopeAuditRead)).Get("/audit", a.listAudit)
+
+		// events api
+		r.With(a.require(auth.RoleViewer, auth.ScopeEventsRead)).Get("/events", a.streamEvents)
+
+		// webhooks api
+		r.With(a.requireRole(auth.RoleAdmin)).Get("/webhooks", a.listWebhooks)
 
 		// hub api
-		r.Get("/hub", a.getHubInfo)
+		r.With(a.require(auth.RoleViewer, auth.ScopeHubRead)).Get("/hub", a.getHubInfo)
+		r.With(a.require(auth.RoleViewer, auth.ScopeHubRead)).Get("/hub/filter", a.getFilterStats)
+
+		// traffic api
+		r.With(a.require(auth.RoleViewer, auth.ScopeHubRead)).Get("/traffic/matrix", a.getTrafficMatrix)
+
+		// metrics api
+		r.With(a.require(auth.RoleViewer, auth.ScopeMetricsRead)).Get("/metrics", a.getMetrics)
+
+		// capture api
+		r.With(a.require(auth.RoleAdmin, auth.ScopeCaptureRead)).Get("/capture", a.streamCapture)
+
+		// shaping api
+		r.With(a.require(auth.RoleViewer, auth.ScopeHubRead)).Get("/shaping", a.getShaping)
+		r.With(a.require(auth.RoleOperator, auth.ScopeShapingWrite)).Put("/shaping", a.updateShaping)
+		r.With(a.require(auth.RoleViewer, auth.ScopeHubRead)).Get("/shaping/queues", a.getShapingQueues)
 	})
 }
 
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/config"
+)
+
+func (a *API) getShaping(w http.ResponseWriter, _ *http.Request) {
+	if a.shaper == nil {
+		a.sendError(w, "traffic shaping not available", http.StatusNotFound)
+		return
+	}
+	a.writeJSON(w, a.shaper.Config())
+}
+
+func (a *API) updateShaping(w http.ResponseWriter, r *http.Request) {
+	if a.shaper == nil {
+		a.sendError(w, "traffic shaping not available", http.StatusNotFound)
+		return
+	}
+	defer r.Body.Close()
+	var cfg config.ShapingConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		a.sendError(w, "failed to decode request", http.StatusBadRequest)
+		return
+	}
+	before := a.shaper.Config()
+	if err := cfg.Validate(); err != nil {
+		a.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.shaper.Update(&cfg); err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.record(r, &audit.Event{
+		Action: audit.ActionShapingUpdate,
+		Before: before,
+		After:  &cfg,
+	})
+	a.writeJSON(w, &cfg)
+}
+
+func (a *API) getShapingQueues(w http.ResponseWriter, _ *http.Request) {
+	if a.shaper == nil {
+		a.sendError(w, "traffic shaping not available", http.StatusNotFound)
+		return
+	}
+	a.writeJSON(w, a.shaper.Stats())
+}
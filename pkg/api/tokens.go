@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/auth"
+	"github.com/go-chi/chi/v5"
+)
+
+func (a *API) listTokens(w http.ResponseWriter, _ *http.Request) {
+	a.writeJSON(w, a.tokens.List())
+}
+
+type CreateTokenRequest struct {
+	Name      string       `json:"name"`
+	Scopes    []auth.Scope `json:"scopes"`
+	ExpiresAt *time.Time   `json:"expiresAt"`
+}
+
+type CreateTokenResponse struct {
+	*auth.APIToken
+	Token string `json:"token"`
+}
+
+func (a *API) createToken(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req CreateTokenRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		a.sendError(w, "failed to decode request", http.StatusBadRequest)
+		return
+	}
+	username, _, _ := getClaims(r)
+	secret, token, err := a.tokens.Create(req.Name, req.Scopes, req.ExpiresAt, username)
+	if errors.Is(err, auth.ErrInvalidTokenName) || errors.Is(err, auth.ErrInvalidScope) || errors.Is(err, auth.ErrInvalidExpiry) {
+		a.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.log.Infof("api token %s (%s) created by %s", token.ID, token.Name, username)
+	a.record(r, &audit.Event{Action: audit.ActionTokenCreate, Target: token.ID, After: token})
+	a.writeJSON(w, CreateTokenResponse{APIToken: token, Token: secret})
+}
+
+func (a *API) revokeToken(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	err := a.tokens.Revoke(id)
+	if errors.Is(err, auth.ErrTokenNotFound) {
+		a.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.log.Infof("api token %s revoked", id)
+	a.record(r, &audit.Event{Action: audit.ActionTokenRevoke, Target: id})
+	a.writeJSON(w, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/auth"
+	"github.com/go-chi/chi/v5"
+)
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type EnrollTOTPResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type EnableTOTPResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+func isInvalidTOTPCode(err error) bool {
+	return errors.Is(err, auth.ErrInvalidTOTPCode) || errors.Is(err, auth.ErrTOTPCodeAlreadyUsed) || errors.Is(err, auth.ErrTOTPCodeRequired)
+}
+
+// checkTOTPLockout rejects the code check if the user or the source address is locked
+// by the login limiter, invalid codes are counted like failed logins.
+func (a *API) checkTOTPLockout(w http.ResponseWriter, r *http.Request, username string) bool {
+	retryAfter, err := a.limiter.Check(remoteIP(r), username)
+	if err == nil {
+		return true
+	}
+	a.log.Warnf("security: rejected locked totp code check of user %q from %s", username, remoteIP(r))
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	a.sendError(w, "Too many failed attempts, try again later.", http.StatusTooManyRequests)
+	return false
+}
+
+func (a *API) getTOTP(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getClaims(r)
+	a.writeJSON(w, a.totp.Status(username))
+}
+
+func (a *API) enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	username, _, _ := getClaims(r)
+	secret, uri, err := a.totp.Enroll(username)
+	if errors.Is(err, auth.ErrTOTPAlreadyEnabled) {
+		a.sendError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.writeJSON(w, EnrollTOTPResponse{Secret: secret, URI: uri})
+}
+
+func (a *API) enableTOTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.sendError(w, "failed to decode request", http.StatusBadRequest)
+		return
+	}
+	username, _, _ := getClaims(r)
+	if !a.checkTOTPLockout(w, r, username) {
+		return
+	}
+	recoveryCodes, err := a.totp.Enable(username, req.Code)
+	if isInvalidTOTPCode(err) {
+		a.log.Warnf("security: invalid totp code of user %q from %s", username, remoteIP(r))
+		a.failLogin(r, remoteIP(r), username, "invalid totp code")
+	}
+	switch {
+	case errors.Is(err, auth.ErrTOTPNotEnrolled) || isInvalidTOTPCode(err):
+		a.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, auth.ErrTOTPAlreadyEnabled):
+		a.sendError(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.limiter.Succeed(username)
+	a.log.Infof("security: totp enabled for user %q", username)
+	a.record(r, &audit.Event{Action: audit.ActionTOTPEnable, Target: username})
+	a.writeJSON(w, EnableTOTPResponse{RecoveryCodes: recoveryCodes})
+}
+
+func (a *API) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.sendError(w, "failed to decode request", http.StatusBadRequest)
+		return
+	}
+	username, _, _ := getClaims(r)
+	if !a.checkTOTPLockout(w, r, username) {
+		return
+	}
+	// a valid code is required, so a stolen session can not remove the second factor
+	err := a.totp.Verify(username, req.Code)
+	if isInvalidTOTPCode(err) {
+		a.log.Warnf("security: invalid totp code of user %q from %s", username, remoteIP(r))
+		a.failLogin(r, remoteIP(r), username, "invalid totp code")
+	}
+	if err == nil {
+		err = a.totp.Disable(username)
+	}
+	switch {
+	case errors.Is(err, auth.ErrTOTPNotEnrolled) || isInvalidTOTPCode(err):
+		a.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.limiter.Succeed(username)
+	a.log.Infof("security: totp disabled for user %q", username)
+	a.record(r, &audit.Event{Action: audit.ActionTOTPDisable, Target: username})
+	a.writeJSON(w, map[string]string{"status": "ok"})
+}
+
+func (a *API) resetTOTP(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+	err := a.totp.Disable(username)
+	if errors.Is(err, auth.ErrTOTPNotEnrolled) {
+		a.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		a.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	admin, _, _ := getClaims(r)
+	a.log.Infof("security: totp of user %q reset by %q", username, admin)
+	a.record(r, &audit.Event{Action: audit.ActionTOTPDisable, Target: username, Details: "reset by admin"})
+	a.writeJSON(w, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,9 @@
+package api
+
+import (
+	"net/http"
+)
+
+func (a *API) getTrafficMatrix(w http.ResponseWriter, _ *http.Request) {
+	a.writeJSON(w, a.matrix.Entries())
+}
@@ -0,0 +1,15 @@
+package api
+
+import (
+	"net/http"
+)
+
+func (a *API) listUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := a.loadUsers(r)
+	if err != nil {
+		a.log.Errorf("failed to load webui users: %v", err)
+		a.sendError(w, "failed to load users", http.StatusInternalServerError)
+		return
+	}
+	a.writeJSON(w, users.List())
+}
@@ -0,0 +1,15 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/christophwitzko/wg-hub/pkg/webhook"
+)
+
+func (a *API) listWebhooks(w http.ResponseWriter, _ *http.Request) {
+	if a.webhooks == nil {
+		a.writeJSON(w, []*webhook.EndpointStatus{})
+		return
+	}
+	a.writeJSON(w, a.webhooks.Status())
+}
@@ -0,0 +1,221 @@
+// Package audit records administrative changes and logins in an append-only JSON-lines log.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+type Action string
+
+const (
+	ActionPeerAdd             Action = "peer.add"
+	ActionPeerUpdate          Action = "peer.update"
+	ActionPeerRemove          Action = "peer.remove"
+	ActionPeerEnable          Action = "peer.enable"
+	ActionPeerDisable         Action = "peer.disable"
+	ActionPeerEnroll          Action = "peer.enroll"
+	ActionPeerEnrollFailed    Action = "peer.enroll_failed"
+	ActionPeerRegister        Action = "peer.register"
+	ActionRegistrationApprove Action = "peer.registration_approve"
+	ActionRegistrationReject  Action = "peer.registration_reject"
+	ActionQuotaUpdate         Action = "peer.quota_update"
+	ActionQuotaRemove         Action = "peer.quota_remove"
+	ActionQuotaReset          Action = "peer.quota_reset"
+	ActionScheduleUpdate      Action = "peer.schedule_update"
+	ActionScheduleRemove      Action = "peer.schedule_remove"
+	ActionLogin               Action = "auth.login"
+	ActionLoginFailed         Action = "auth.login_failed"
+	ActionLogout              Action = "auth.logout"
+	ActionSessionsRevoke      Action = "auth.sessions_revoke"
+	ActionKeyRotate           Action = "auth.key_rotate"
+	ActionLockoutClear        Action = "auth.lockout_clear"
+	ActionTOTPEnable          Action = "auth.totp_enable"
+	ActionTOTPDisable         Action = "auth.totp_disable"
+	ActionTokenCreate         Action = "token.create"
+	ActionTokenRevoke         Action = "token.revoke"
+	ActionPreAuthKeyCreate    Action = "enrollment.key_create"
+	ActionPreAuthKeyRevoke    Action = "enrollment.key_revoke"
+	ActionConfigReload        Action = "config.reload"
+	ActionCaptureStart        Action = "capture.start"
+	ActionShapingUpdate       Action = "shaping.update"
+)
+
+const (
+	// maxMemoryEvents limits the events of a log without file.
+	maxMemoryEvents = 10000
+	// DefaultLimit is the page size of queries without limit.
+	DefaultLimit = 50
+	// MaxLimit is the maximum page size of queries.
+	MaxLimit = 1000
+	// maxLineSize limits the size of a single event in the log file.
+	maxLineSize = 1 << 20
+)
+
+var (
+	ErrInvalidQuery = errors.New("invalid audit query")
+	ErrClosed       = errors.New("audit log closed")
+)
+
+// Event is a single entry of the audit log.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Actor is the username or token:<name> for API tokens, empty for anonymous requests.
+	Actor    string `json:"actor,omitempty"`
+	RemoteIP string `json:"remoteIP,omitempty"`
+	Action   Action `json:"action"`
+	Target   string `json:"target,omitempty"`
+	Before   any    `json:"before,omitempty"`
+	After    any    `json:"after,omitempty"`
+	Details  string `json:"details,omitempty"`
+}
+
+// Query filters the events, empty fields match all events.
+type Query struct {
+	Action Action
+	Actor  string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Offset int
+	Limit  int
+}
+
+func (q *Query) matches(e *Event) bool {
+	return (q.Action == "" || e.Action == q.Action) &&
+		(q.Actor == "" || e.Actor == q.Actor) &&
+		(q.Target == "" || e.Target == q.Target) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// Page contains the matching events of a query, newest first.
+type Page struct {
+	Events []*Event `json:"events"`
+	Total  int      `json:"total"`
+	Offset int      `json:"offset"`
+	Limit  int      `json:"limit"`
+}
+
+// Log appends the events to a JSON-lines file or keeps them in memory if no file is configured.
+type Log struct {
+	path string
+	// now is replaced in tests
+	now func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	events []*Event
+	closed bool
+}
+
+// Open opens the audit log file for appending, an empty path keeps the events in memory.
+func Open(path string) (*Log, error) {
+	l := &Log{path: path, now: time.Now}
+	if path == "" {
+		return l, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	l.file = f
+	return l, nil
+}
+
+// Record appends the event, the time is set if it is empty.
+func (l *Log) Record(e *Event) error {
+	if e.Time.IsZero() {
+		e.Time = l.now().UTC()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if l.file == nil {
+		if len(l.events) >= maxMemoryEvents {
+			l.events = slices.Delete(l.events, 0, len(l.events)-maxMemoryEvents+1)
+		}
+		l.events = append(l.events, e)
+		return nil
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit event: %w", err)
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+	return l.file.Sync()
+}
+
+func (l *Log) readEvents(fn func(e *Event)) error {
+	if l.file == nil {
+		for _, e := range l.events {
+			fn(e)
+		}
+		return nil
+	}
+	f, err := os.Open(l.path)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a partially written last line is skipped
+			continue
+		}
+		fn(&e)
+	}
+	return scanner.Err()
+}
+
+// Query returns the matching events, newest first.
+func (l *Log) Query(q *Query) (*Page, error) {
+	if q.Offset < 0 || q.Limit < 0 || q.Limit > MaxLimit {
+		return nil, ErrInvalidQuery
+	}
+	limit := q.Limit
+	if limit == 0 {
+		limit = DefaultLimit
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var matches []*Event
+	err := l.readEvents(func(e *Event) {
+		if q.matches(e) {
+			matches = append(matches, e)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Reverse(matches)
+	page := &Page{Events: make([]*Event, 0), Total: len(matches), Offset: q.Offset, Limit: limit}
+	if q.Offset < len(matches) {
+		page.Events = append(page.Events, matches[q.Offset:min(q.Offset+limit, len(matches))]...)
+	}
+	return page, nil
+}
+
+// Close closes the audit log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,101 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testLog(t *testing.T, l *Log) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Minute)
+		require.NoError(t, l.Record(&Event{
+			Actor:  "admin",
+			Action: ActionPeerAdd,
+			Target: "peer" + string(rune('a'+i)),
+			After:  map[string]string{"allowedIP": "10.0.0.1/32"},
+		}))
+	}
+	require.NoError(t, l.Record(&Event{Actor: "alice", Action: ActionLogin, RemoteIP: "10.0.0.2"}))
+
+	page, err := l.Query(&Query{})
+	require.NoError(t, err)
+	require.Equal(t, 6, page.Total)
+	require.Equal(t, DefaultLimit, page.Limit)
+	require.Equal(t, ActionLogin, page.Events[0].Action)
+	require.Equal(t, "10.0.0.2", page.Events[0].RemoteIP)
+
+	page, err = l.Query(&Query{Action: ActionPeerAdd, Offset: 1, Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, 5, page.Total)
+	require.Len(t, page.Events, 2)
+	require.Equal(t, "peerd", page.Events[0].Target)
+	require.Equal(t, "peerc", page.Events[1].Target)
+	require.Equal(t, map[string]any{"allowedIP": "10.0.0.1/32"}, toMap(page.Events[0].After))
+
+	since := time.Date(2024, 1, 1, 0, 2, 0, 0, time.UTC)
+	until := time.Date(2024, 1, 1, 0, 4, 0, 0, time.UTC)
+	page, err = l.Query(&Query{Actor: "admin", Since: since, Until: until})
+	require.NoError(t, err)
+	require.Equal(t, 2, page.Total)
+
+	page, err = l.Query(&Query{Target: "peera", Offset: 10})
+	require.NoError(t, err)
+	require.Equal(t, 1, page.Total)
+	require.Empty(t, page.Events)
+
+	_, err = l.Query(&Query{Limit: MaxLimit + 1})
+	require.ErrorIs(t, err, ErrInvalidQuery)
+
+	require.NoError(t, l.Close())
+	require.ErrorIs(t, l.Record(&Event{Action: ActionLogin}), ErrClosed)
+}
+
+// toMap converts the decoded before/after values of the file and the memory log.
+func toMap(v any) map[string]any {
+	switch v := v.(type) {
+	case map[string]any:
+		return v
+	case map[string]string:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = e
+		}
+		return m
+	}
+	return nil
+}
+
+func TestMemoryLog(t *testing.T) {
+	l, err := Open("")
+	require.NoError(t, err)
+	testLog(t, l)
+}
+
+func TestFileLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(path)
+	require.NoError(t, err)
+	testLog(t, l)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"action":"auth.login"`)
+
+	// the log is appended after a restart
+	l, err = Open(path)
+	require.NoError(t, err)
+	require.NoError(t, l.Record(&Event{Action: ActionConfigReload}))
+	page, err := l.Query(&Query{})
+	require.NoError(t, err)
+	require.Equal(t, 7, page.Total)
+	require.NoError(t, l.Close())
+}
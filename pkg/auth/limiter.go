@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTrackedLogins limits the number of tracked source addresses and usernames.
+const maxTrackedLogins = 4096
+
+var (
+	ErrLoginLocked     = errors.New("too many failed login attempts")
+	ErrLockoutNotFound = errors.New("lockout not found")
+)
+
+type LoginLimiterConfig struct {
+	// MaxAttempts is the number of failed logins before a source address or username is locked.
+	MaxAttempts int
+	// Lockout is the duration of the first lockout, it is doubled with every further failure.
+	Lockout time.Duration
+	// MaxLockout limits the lockout duration, failures are forgotten after this idle time.
+	MaxLockout time.Duration
+}
+
+// Lockout contains the failed logins of a source address (ip:<addr>) or a username (username:<name>).
+type Lockout struct {
+	Key         string     `json:"key"`
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"lastFailure"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"`
+}
+
+func (l *Lockout) lockedFor(now time.Time) time.Duration {
+	if l.LockedUntil == nil {
+		return 0
+	}
+	return max(l.LockedUntil.Sub(now), 0)
+}
+
+// LoginLimiter locks source addresses and usernames with an exponential backoff
+// after too many failed logins, the state is only kept in memory.
+type LoginLimiter struct {
+	maxAttempts int
+	lockout     time.Duration
+	maxLockout  time.Duration
+	// now is replaced in tests
+	now func() time.Time
+
+	mu       sync.Mutex
+	lockouts map[string]*Lockout
+}
+
+func NewLoginLimiter(cfg *LoginLimiterConfig) *LoginLimiter {
+	return &LoginLimiter{
+		maxAttempts: max(cfg.MaxAttempts, 1),
+		lockout:     max(cfg.Lockout, time.Second),
+		maxLockout:  max(cfg.MaxLockout, cfg.Lockout, time.Second),
+		now:         time.Now,
+		lockouts:    make(map[string]*Lockout),
+	}
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func usernameKey(username string) string {
+	return "username:" + strings.ToLower(username)
+}
+
+// keys returns the keys of the source address and the username, requests without
+// a username (e.g. enrollments) are only limited by their source address.
+func (l *LoginLimiter) keys(ip, username string) []string {
+	if username == "" {
+		return []string{ipKey(ip)}
+	}
+	return []string{ipKey(ip), usernameKey(username)}
+}
+
+// Check returns ErrLoginLocked and the remaining lockout duration if the source address or the username is locked.
+func (l *LoginLimiter) Check(ip, username string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var retryAfter time.Duration
+	for _, key := range l.keys(ip, username) {
+		if lockout, ok := l.lockouts[key]; ok {
+			retryAfter = max(retryAfter, lockout.lockedFor(now))
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter, ErrLoginLocked
+	}
+	return 0, nil
+}
+
+// Fail records a failed login and returns the lockouts that were created by this failure.
+func (l *LoginLimiter) Fail(ip, username string) []*Lockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var locked []*Lockout
+	for _, key := range l.keys(ip, username) {
+		lockout := l.getLockout(key, now)
+		if lockout == nil {
+			continue
+		}
+		lockout.Failures++
+		lockout.LastFailure = now
+		if lockout.Failures < l.maxAttempts {
+			continue
+		}
+		duration := l.maxLockout
+		// avoid an overflow of the shift, the duration is capped anyway
+		if exp := lockout.Failures - l.maxAttempts; exp < 32 {
+			duration = min(l.lockout<<exp, l.maxLockout)
+		}
+		lockedUntil := now.Add(duration)
+		lockout.LockedUntil = &lockedUntil
+		c := *lockout
+		locked = append(locked, &c)
+	}
+	return locked
+}
+
+// Succeed resets the failed logins of the username. The failures of the
+// source address are kept, so a valid login can not be used to guess the
+// passwords of other users.
+func (l *LoginLimiter) Succeed(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.lockouts, usernameKey(username))
+}
+
+func (l *LoginLimiter) isIdle(lockout *Lockout, now time.Time) bool {
+	return lockout.lockedFor(now) == 0 && now.Sub(lockout.LastFailure) >= l.maxLockout
+}
+
+func (l *LoginLimiter) getLockout(key string, now time.Time) *Lockout {
+	lockout, ok := l.lockouts[key]
+	if ok && l.isIdle(lockout, now) {
+		// the failures are forgotten after the idle time
+		lockout.Failures = 0
+		lockout.LockedUntil = nil
+	}
+	if ok {
+		return lockout
+	}
+	if len(l.lockouts) >= maxTrackedLogins {
+		l.prune(now)
+		if len(l.lockouts) >= maxTrackedLogins {
+			l.evictOldest()
+		}
+	}
+	lockout = &Lockout{Key: key}
+	l.lockouts[key] = lockout
+	return lockout
+}
+
+// evictOldest removes the lockout with the oldest failure, so new failures are
+// still recorded if many source addresses or usernames failed recently.
+func (l *LoginLimiter) evictOldest() {
+	var oldest *Lockout
+	for _, lockout := range l.lockouts {
+		if oldest == nil || lockout.LastFailure.Before(oldest.LastFailure) {
+			oldest = lockout
+		}
+	}
+	if oldest != nil {
+		delete(l.lockouts, oldest.Key)
+	}
+}
+
+func (l *LoginLimiter) prune(now time.Time) {
+	for key, lockout := range l.lockouts {
+		if l.isIdle(lockout, now) {
+			delete(l.lockouts, key)
+		}
+	}
+}
+
+// List returns all source addresses and usernames with failed logins, sorted by the last failure.
+func (l *LoginLimiter) List() []*Lockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(l.now())
+	lockouts := make([]*Lockout, 0, len(l.lockouts))
+	for _, lockout := range l.lockouts {
+		c := *lockout
+		lockouts = append(lockouts, &c)
+	}
+	sort.Slice(lockouts, func(i, j int) bool {
+		return lockouts[i].LastFailure.After(lockouts[j].LastFailure)
+	})
+	return lockouts
+}
+
+// Clear removes the failed logins of the given key.
+func (l *LoginLimiter) Clear(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.lockouts[key]; !ok {
+		return ErrLockoutNotFound
+	}
+	delete(l.lockouts, key)
+	return nil
+}
+
+// ClearAll removes all failed logins.
+func (l *LoginLimiter) ClearAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lockouts = make(map[string]*Lockout)
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	limiter := NewLoginLimiter(&LoginLimiterConfig{
+		MaxAttempts: 3,
+		Lockout:     time.Minute,
+		MaxLockout:  time.Hour,
+	})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		_, err := limiter.Check("10.0.0.1", "admin")
+		require.NoError(t, err)
+		require.Empty(t, limiter.Fail("10.0.0.1", "admin"))
+	}
+	locked := limiter.Fail("10.0.0.1", "admin")
+	require.Len(t, locked, 2)
+	require.Equal(t, "ip:10.0.0.1", locked[0].Key)
+	require.Equal(t, "username:admin", locked[1].Key)
+
+	retryAfter, err := limiter.Check("10.0.0.1", "alice")
+	require.ErrorIs(t, err, ErrLoginLocked)
+	require.Equal(t, time.Minute, retryAfter)
+	_, err = limiter.Check("10.0.0.2", "Admin")
+	require.ErrorIs(t, err, ErrLoginLocked)
+	_, err = limiter.Check("10.0.0.2", "alice")
+	require.NoError(t, err)
+
+	// the lockout is doubled with every further failure
+	now = now.Add(time.Minute)
+	_, err = limiter.Check("10.0.0.1", "admin")
+	require.NoError(t, err)
+	limiter.Fail("10.0.0.1", "admin")
+	retryAfter, _ = limiter.Check("10.0.0.1", "admin")
+	require.Equal(t, 2*time.Minute, retryAfter)
+	for i := 0; i < 10; i++ {
+		limiter.Fail("10.0.0.1", "admin")
+	}
+	retryAfter, _ = limiter.Check("10.0.0.1", "admin")
+	require.Equal(t, time.Hour, retryAfter)
+
+	// a successful login only resets the username
+	limiter.Succeed("admin")
+	_, err = limiter.Check("10.0.0.2", "admin")
+	require.NoError(t, err)
+	_, err = limiter.Check("10.0.0.1", "bob")
+	require.ErrorIs(t, err, ErrLoginLocked)
+
+	require.Len(t, limiter.List(), 1)
+	require.ErrorIs(t, limiter.Clear("ip:10.0.0.2"), ErrLockoutNotFound)
+	require.NoError(t, limiter.Clear("ip:10.0.0.1"))
+	_, err = limiter.Check("10.0.0.1", "bob")
+	require.NoError(t, err)
+
+	// failures are forgotten after the idle time
+	limiter.Fail("10.0.0.3", "bob")
+	limiter.Fail("10.0.0.3", "bob")
+	now = now.Add(2 * time.Hour)
+	require.Empty(t, limiter.Fail("10.0.0.3", "bob"))
+	require.Len(t, limiter.List(), 2)
+	limiter.ClearAll()
+	require.Empty(t, limiter.List())
+}
+
+func TestLoginLimiterFull(t *testing.T) {
+	limiter := NewLoginLimiter(&LoginLimiterConfig{
+		MaxAttempts: 1,
+		Lockout:     time.Minute,
+		MaxLockout:  time.Hour,
+	})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	// fill the table with recent failures that can not be pruned
+	for i := 0; i < maxTrackedLogins; i++ {
+		limiter.Fail(fmt.Sprintf("10.0.%d.%d", i/256, i%256), "")
+		now = now.Add(time.Millisecond)
+	}
+	require.Len(t, limiter.lockouts, maxTrackedLogins)
+
+	// further failures are still recorded, the oldest failure is evicted
+	require.Len(t, limiter.Fail("192.0.2.1", "admin"), 2)
+	require.Len(t, limiter.lockouts, maxTrackedLogins)
+	_, err := limiter.Check("192.0.2.1", "")
+	require.ErrorIs(t, err, ErrLoginLocked)
+	_, err = limiter.Check("198.51.100.1", "admin")
+	require.ErrorIs(t, err, ErrLoginLocked)
+	_, err = limiter.Check("10.0.0.0", "")
+	require.NoError(t, err)
+	_, err = limiter.Check("10.0.0.1", "")
+	require.NoError(t, err)
+	_, err = limiter.Check("10.0.0.2", "")
+	require.ErrorIs(t, err, ErrLoginLocked)
+}
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/store"
+)
+
+// preAuthKeysStoreKey is the store key of the pre-auth keys.
+const preAuthKeysStoreKey = "preauth_keys"
+
+// PreAuthKeyPrefix is the prefix of all pre-auth keys.
+const PreAuthKeyPrefix = "wgk_"
+
+var (
+	ErrInvalidPreAuthKey  = errors.New("invalid pre-auth key")
+	ErrPreAuthKeyExpired  = errors.New("pre-auth key expired")
+	ErrPreAuthKeyUsed     = errors.New("pre-auth key already used")
+	ErrPreAuthKeyNotFound = errors.New("pre-auth key not found")
+	ErrInvalidTag         = errors.New("invalid tag")
+	ErrInvalidPool        = errors.New("invalid address pool")
+	ErrInvalidKeyExpiry   = errors.New("pre-auth key expiry must be in the future")
+)
+
+// PreAuthKey allows devices to enroll themselves, only the hash of the key is stored.
+type PreAuthKey struct {
+	ID string `json:"id"`
+	// Tag is assigned to the enrolled peers.
+	Tag string `json:"tag,omitempty"`
+	// Pool is the network the addresses of the enrolled peers are assigned from, the hub network if empty.
+	Pool string `json:"pool,omitempty"`
+	// Reusable keys can enroll any number of devices until they expire.
+	Reusable   bool       `json:"reusable"`
+	CreatedBy  string     `json:"createdBy"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	Uses       int        `json:"uses"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+func (k *PreAuthKey) copy() *PreAuthKey {
+	c := *k
+	return &c
+}
+
+type storedPreAuthKey struct {
+	*PreAuthKey
+	Hash string `json:"hash"`
+}
+
+// PreAuthKeys manages the pre-auth keys and persists them in the store.
+type PreAuthKeys struct {
+	store store.Store
+	now   func() time.Time
+
+	mu   sync.Mutex
+	keys map[string]*storedPreAuthKey // by hash
+}
+
+// NewPreAuthKeys loads the pre-auth keys from the store.
+func NewPreAuthKeys(st store.Store) (*PreAuthKeys, error) {
+	k := &PreAuthKeys{
+		store: st,
+		now:   time.Now,
+		keys:  make(map[string]*storedPreAuthKey),
+	}
+	var stored []*storedPreAuthKey
+	err := st.Load(preAuthKeysStoreKey, &stored)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("failed to load pre-auth keys: %w", err)
+	}
+	for _, key := range stored {
+		k.keys[key.Hash] = key
+	}
+	return k, nil
+}
+
+func (k *PreAuthKeys) persist() error {
+	stored := make([]*storedPreAuthKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		stored = append(stored, key)
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].CreatedAt.Before(stored[j].CreatedAt)
+	})
+	return k.store.Save(preAuthKeysStoreKey, stored)
+}
+
+// Create creates a new pre-auth key and returns the secret, which is only available once.
+func (k *PreAuthKeys) Create(tag, pool string, reusable bool, expiresAt time.Time, createdBy string) (string, *PreAuthKey, error) {
+	tag = strings.TrimSpace(tag)
+	if len(tag) > 100 {
+		return "", nil, ErrInvalidTag
+	}
+	if pool != "" {
+		prefix, err := netip.ParsePrefix(pool)
+		if err != nil || !prefix.Addr().Is4() || prefix.Bits() > 30 {
+			return "", nil, fmt.Errorf("%w: %q", ErrInvalidPool, pool)
+		}
+		pool = prefix.Masked().String()
+	}
+	now := k.now()
+	if !expiresAt.After(now) {
+		return "", nil, ErrInvalidKeyExpiry
+	}
+	id, err := randomString(9)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", nil, err
+	}
+	secret = PreAuthKeyPrefix + secret
+	key := &PreAuthKey{
+		ID:        id,
+		Tag:       tag,
+		Pool:      pool,
+		Reusable:  reusable,
+		CreatedBy: createdBy,
+		CreatedAt: now.UTC(),
+		ExpiresAt: expiresAt.UTC(),
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[hashToken(secret)] = &storedPreAuthKey{PreAuthKey: key, Hash: hashToken(secret)}
+	if err := k.persist(); err != nil {
+		return "", nil, fmt.Errorf("failed to persist pre-auth keys: %w", err)
+	}
+	return secret, key.copy(), nil
+}
+
+// List returns all pre-auth keys sorted by their creation time.
+func (k *PreAuthKeys) List() []*PreAuthKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keys := make([]*PreAuthKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key.copy())
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// Revoke deletes the pre-auth key with the given id.
+func (k *PreAuthKeys) Revoke(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for hash, key := range k.keys {
+		if key.ID != id {
+			continue
+		}
+		delete(k.keys, hash)
+		if err := k.persist(); err != nil {
+			return fmt.Errorf("failed to persist pre-auth keys: %w", err)
+		}
+		return nil
+	}
+	return ErrPreAuthKeyNotFound
+}
+
+// Redeem verifies the secret and calls fn with the pre-auth key. The use is counted
+// and persisted before fn is called without holding the lock, so a single-use key
+// can not be redeemed concurrently or again after a restart, and it is rolled back
+// if fn fails. fn is not called if the use can not be persisted.
+func (k *PreAuthKeys) Redeem(secret string, fn func(key *PreAuthKey) error) (*PreAuthKey, error) {
+	if !strings.HasPrefix(secret, PreAuthKeyPrefix) {
+		return nil, ErrInvalidPreAuthKey
+	}
+	k.mu.Lock()
+	key, ok := k.keys[hashToken(secret)]
+	if !ok {
+		k.mu.Unlock()
+		return nil, ErrInvalidPreAuthKey
+	}
+	now := k.now()
+	if !now.Before(key.ExpiresAt) {
+		k.mu.Unlock()
+		return nil, ErrPreAuthKeyExpired
+	}
+	if !key.Reusable && key.Uses > 0 {
+		k.mu.Unlock()
+		return nil, ErrPreAuthKeyUsed
+	}
+	previousLastUsed := key.LastUsedAt
+	lastUsed := now.UTC()
+	rollback := func() {
+		key.Uses--
+		if key.LastUsedAt == &lastUsed {
+			key.LastUsedAt = previousLastUsed
+		}
+	}
+	key.Uses++
+	key.LastUsedAt = &lastUsed
+	if err := k.persist(); err != nil {
+		rollback()
+		k.mu.Unlock()
+		return nil, fmt.Errorf("failed to persist pre-auth keys: %w", err)
+	}
+	redeemed := key.copy()
+	k.mu.Unlock()
+
+	fnErr := fn(redeemed)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if fnErr != nil {
+		rollback()
+		// the key stays used if the rollback can not be persisted
+		if err := k.persist(); err != nil {
+			return nil, errors.Join(fnErr, fmt.Errorf("failed to persist pre-auth keys: %w", err))
+		}
+		return nil, fnErr
+	}
+	return key.copy(), nil
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreAuthKeys(t *testing.T) {
+	st := store.NewMemoryStore()
+	keys, err := NewPreAuthKeys(st)
+	require.NoError(t, err)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys.now = func() time.Time { return now }
+	expiry := now.Add(time.Hour)
+
+	_, _, err = keys.Create("laptops", "10.0.0.300/24", false, expiry, "admin")
+	require.ErrorIs(t, err, ErrInvalidPool)
+	_, _, err = keys.Create("laptops", "", false, now, "admin")
+	require.ErrorIs(t, err, ErrInvalidKeyExpiry)
+
+	secret, key, err := keys.Create("laptops", "10.0.1.7/24", false, expiry, "admin")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.1.0/24", key.Pool)
+	now = now.Add(time.Second)
+	reusableSecret, _, err := keys.Create("", "", true, expiry, "admin")
+	require.NoError(t, err)
+
+	// a failed enrollment does not use the key
+	enrollErr := errors.New("pool exhausted")
+	_, err = keys.Redeem(secret, func(*PreAuthKey) error { return enrollErr })
+	require.ErrorIs(t, err, enrollErr)
+	require.Equal(t, 0, keys.List()[0].Uses)
+	require.Nil(t, keys.List()[0].LastUsedAt)
+	redeemed, err := keys.Redeem(secret, func(k *PreAuthKey) error {
+		require.Equal(t, "laptops", k.Tag)
+		// the callback runs without the lock and the key is already reserved
+		_, err := keys.Redeem(secret, func(*PreAuthKey) error { return nil })
+		require.ErrorIs(t, err, ErrPreAuthKeyUsed)
+		require.Len(t, keys.List(), 2)
+		// the use is persisted before the callback
+		restored, err := NewPreAuthKeys(st)
+		require.NoError(t, err)
+		require.Equal(t, 1, restored.List()[0].Uses)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, redeemed.Uses)
+	_, err = keys.Redeem(secret, func(*PreAuthKey) error { return nil })
+	require.ErrorIs(t, err, ErrPreAuthKeyUsed)
+	_, err = keys.Redeem(secret+"x", func(*PreAuthKey) error { return nil })
+	require.ErrorIs(t, err, ErrInvalidPreAuthKey)
+	_, err = keys.Redeem("wgh_token", func(*PreAuthKey) error { return nil })
+	require.ErrorIs(t, err, ErrInvalidPreAuthKey)
+
+	for i := 0; i < 3; i++ {
+		_, err = keys.Redeem(reusableSecret, func(*PreAuthKey) error { return nil })
+		require.NoError(t, err)
+	}
+	now = expiry
+	_, err = keys.Redeem(reusableSecret, func(*PreAuthKey) error { return nil })
+	require.ErrorIs(t, err, ErrPreAuthKeyExpired)
+
+	// the keys survive a restart
+	keys, err = NewPreAuthKeys(st)
+	require.NoError(t, err)
+	list := keys.List()
+	require.Len(t, list, 2)
+	require.Equal(t, 3, list[1].Uses)
+	require.NoError(t, keys.Revoke(key.ID))
+	require.ErrorIs(t, keys.Revoke(key.ID), ErrPreAuthKeyNotFound)
+	require.Len(t, keys.List(), 1)
+}
@@ -0,0 +1,415 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// sessionsStoreKey is the store key of the signing keys and sessions.
+const sessionsStoreKey = "sessions"
+
+// RefreshTokenPrefix is the prefix of all refresh tokens.
+const RefreshTokenPrefix = "wgr_"
+
+// maxPreviousRefreshTokens is the number of rotated refresh tokens per session
+// that are kept to detect the reuse of a stolen refresh token.
+const maxPreviousRefreshTokens = 20
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused, session revoked")
+	ErrSessionExpired      = errors.New("session expired")
+	ErrSessionRevoked      = errors.New("session revoked")
+	ErrUserNotFound        = errors.New("user not found")
+)
+
+// Session is a login of a webui user that can be extended with its refresh token.
+type Session struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Role     Role   `json:"role"`
+	// Provider is the external identity provider of the login (e.g. oidc), empty for password logins.
+	Provider    string    `json:"provider,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	RefreshedAt time.Time `json:"refreshedAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+type storedSession struct {
+	*Session
+	RefreshHash    string   `json:"refreshHash"`
+	PreviousHashes []string `json:"previousHashes,omitempty"`
+}
+
+type signingKey struct {
+	ID     string `json:"id"`
+	Secret []byte `json:"secret,omitempty"`
+	// Configured is true for the key of the configured secret, its secret is never persisted.
+	Configured bool       `json:"configured,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	RetiredAt  *time.Time `json:"retiredAt,omitempty"`
+	jwtAuth    *jwtauth.JWTAuth
+}
+
+// persistedSigningKey has no MarshalJSON method.
+type persistedSigningKey signingKey
+
+func (k *signingKey) MarshalJSON() ([]byte, error) {
+	persisted := persistedSigningKey(*k)
+	if k.Configured {
+		persisted.Secret = nil
+	}
+	return json.Marshal(&persisted)
+}
+
+func newSigningKey(secret []byte, now time.Time) (*signingKey, error) {
+	id, err := randomString(9)
+	if err != nil {
+		return nil, err
+	}
+	return &signingKey{ID: id, Secret: secret, CreatedAt: now.UTC()}, nil
+}
+
+func (k *signingKey) auth(clock func() time.Time) *jwtauth.JWTAuth {
+	if k.jwtAuth == nil {
+		k.jwtAuth = jwtauth.New("HS256", k.Secret, nil, jwt.WithClock(jwt.ClockFunc(clock)))
+	}
+	return k.jwtAuth
+}
+
+type sessionsState struct {
+	// SeedFingerprint is the hash of the configured secret, the state is reset if the secret changes.
+	SeedFingerprint string               `json:"seedFingerprint"`
+	Keys            []*signingKey        `json:"keys"`
+	Sessions        []*storedSession     `json:"sessions"`
+	Blocklist       map[string]time.Time `json:"blocklist"`
+	sessions        map[string]*storedSession
+}
+
+// TokenPair is the result of a login or a refresh.
+type TokenPair struct {
+	AccessToken  string    `json:"token"`
+	RefreshToken string    `json:"refreshToken"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// Sessions issues short-lived access tokens (JWTs) with rotating refresh
+// tokens and keeps track of logged out sessions and signing keys.
+type Sessions struct {
+	store      store.Store
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	now        func() time.Time
+
+	mu    sync.Mutex
+	state *sessionsState
+}
+
+func fingerprint(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewSessions loads the sessions and signing keys from the store. If the
+// secret is empty, a random signing key is generated.
+func NewSessions(st store.Store, secret string, accessTTL, refreshTTL time.Duration) (*Sessions, error) {
+	s := &Sessions{
+		store:      st,
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+		now:        time.Now,
+	}
+	state := &sessionsState{}
+	err := st.Load(sessionsStoreKey, state)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("failed to load sessions: %w", err)
+	}
+	if err != nil || state.SeedFingerprint != fingerprint(secret) || len(state.Keys) == 0 {
+		// a new or changed secret invalidates all sessions
+		state = &sessionsState{SeedFingerprint: fingerprint(secret)}
+		seed := []byte(secret)
+		if secret == "" {
+			seed = make([]byte, 32)
+			if _, err := rand.Read(seed); err != nil {
+				return nil, err
+			}
+		}
+		key, err := newSigningKey(seed, s.now())
+		if err != nil {
+			return nil, err
+		}
+		key.Configured = secret != ""
+		state.Keys = []*signingKey{key}
+	}
+	for _, key := range state.Keys {
+		if key.Configured {
+			// the fingerprint matches, so the key was created from the configured secret
+			key.Secret = []byte(secret)
+		}
+	}
+	if state.Blocklist == nil {
+		state.Blocklist = make(map[string]time.Time)
+	}
+	state.sessions = make(map[string]*storedSession, len(state.Sessions))
+	for _, session := range state.Sessions {
+		state.sessions[session.ID] = session
+	}
+	s.state = state
+	if err := s.persist(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// prune removes expired sessions, blocklist entries and signing keys.
+func (s *Sessions) prune() {
+	now := s.now()
+	for id, session := range s.state.sessions {
+		if !now.Before(session.ExpiresAt) {
+			delete(s.state.sessions, id)
+		}
+	}
+	for jti, exp := range s.state.Blocklist {
+		if !now.Before(exp) {
+			delete(s.state.Blocklist, jti)
+		}
+	}
+	keys := s.state.Keys[:1]
+	for _, key := range s.state.Keys[1:] {
+		// retired keys are kept until all access tokens signed with them are expired
+		if key.RetiredAt == nil || now.Before(key.RetiredAt.Add(s.accessTTL)) {
+			keys = append(keys, key)
+		}
+	}
+	s.state.Keys = keys
+}
+
+func (s *Sessions) persist() error {
+	s.prune()
+	s.state.Sessions = make([]*storedSession, 0, len(s.state.sessions))
+	for _, session := range s.state.sessions {
+		s.state.Sessions = append(s.state.Sessions, session)
+	}
+	sort.Slice(s.state.Sessions, func(i, j int) bool {
+		return s.state.Sessions[i].CreatedAt.Before(s.state.Sessions[j].CreatedAt)
+	})
+	if err := s.store.Save(sessionsStoreKey, s.state); err != nil {
+		return fmt.Errorf("failed to persist sessions: %w", err)
+	}
+	return nil
+}
+
+// issue signs a new access token and rotates the refresh token of the session.
+func (s *Sessions) issue(session *storedSession) (*TokenPair, error) {
+	now := s.now()
+	jti, err := randomString(12)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken = RefreshTokenPrefix + refreshToken
+	expiresAt := now.Add(s.accessTTL)
+	claims := map[string]any{
+		"username": session.Username,
+		"role":     string(session.Role),
+		"sid":      session.ID,
+		"jti":      jti,
+	}
+	jwtauth.SetIssuedAt(claims, now)
+	jwtauth.SetExpiry(claims, expiresAt)
+	_, accessToken, err := s.state.Keys[0].auth(s.now).Encode(claims)
+	if err != nil {
+		return nil, err
+	}
+	if session.RefreshHash != "" {
+		session.PreviousHashes = append(session.PreviousHashes, session.RefreshHash)
+		if len(session.PreviousHashes) > maxPreviousRefreshTokens {
+			session.PreviousHashes = session.PreviousHashes[1:]
+		}
+	}
+	session.RefreshHash = hashToken(refreshToken)
+	session.RefreshedAt = now.UTC()
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt.UTC(),
+	}, nil
+}
+
+// Login creates a new session for the user.
+func (s *Sessions) Login(user *User) (*TokenPair, error) {
+	return s.LoginWithProvider(user, "")
+}
+
+// LoginWithProvider creates a session of a user that was authenticated by an external identity
+// provider. The role of the session is kept on refresh, because the user is not part of the local users.
+func (s *Sessions) LoginWithProvider(user *User, provider string) (*TokenPair, error) {
+	id, err := randomString(12)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	session := &storedSession{Session: &Session{
+		ID:        id,
+		Username:  user.Username,
+		Role:      user.Role,
+		Provider:  provider,
+		CreatedAt: now.UTC(),
+		ExpiresAt: now.Add(s.refreshTTL).UTC(),
+	}}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pair, err := s.issue(session)
+	if err != nil {
+		return nil, err
+	}
+	s.state.sessions[id] = session
+	if err := s.persist(); err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+// Refresh exchanges the refresh token for a new token pair. The role is
+// updated from the current users, so role changes apply on the next refresh.
+// If a rotated refresh token is used again, the whole session is revoked.
+func (s *Sessions) Refresh(refreshToken string, users *Users) (*TokenPair, error) {
+	hash := hashToken(refreshToken)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.state.sessions {
+		for _, previous := range session.PreviousHashes {
+			if previous == hash {
+				delete(s.state.sessions, id)
+				_ = s.persist()
+				return nil, ErrRefreshTokenReused
+			}
+		}
+		if session.RefreshHash != hash {
+			continue
+		}
+		if !s.now().Before(session.ExpiresAt) {
+			delete(s.state.sessions, id)
+			_ = s.persist()
+			return nil, ErrSessionExpired
+		}
+		if session.Provider == "" {
+			user, ok := users.Get(session.Username)
+			if !ok {
+				delete(s.state.sessions, id)
+				_ = s.persist()
+				return nil, ErrUserNotFound
+			}
+			session.Role = user.Role
+		}
+		pair, err := s.issue(session)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.persist(); err != nil {
+			return nil, err
+		}
+		return pair, nil
+	}
+	return nil, ErrInvalidRefreshToken
+}
+
+// Verify verifies the access token with the current and the retired signing keys
+// and checks that the token was not logged out and its session is not revoked.
+func (s *Sessions) Verify(accessToken string) (jwt.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var token jwt.Token
+	err := jwtauth.ErrUnauthorized
+	for _, key := range s.state.Keys {
+		token, err = jwtauth.VerifyToken(key.auth(s.now), accessToken)
+		if err == nil || errors.Is(err, jwtauth.ErrExpired) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, blocked := s.state.Blocklist[token.JwtID()]; blocked {
+		return nil, ErrSessionRevoked
+	}
+	sid, _ := token.Get("sid")
+	sessionID, _ := sid.(string)
+	if _, ok := s.state.sessions[sessionID]; !ok {
+		return nil, ErrSessionRevoked
+	}
+	return token, nil
+}
+
+// Logout blocklists the access token until it expires and revokes its session.
+func (s *Sessions) Logout(token jwt.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Blocklist[token.JwtID()] = token.Expiration()
+	sid, _ := token.Get("sid")
+	sessionID, _ := sid.(string)
+	delete(s.state.sessions, sessionID)
+	return s.persist()
+}
+
+// List returns all active sessions sorted by their creation time.
+func (s *Sessions) List() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	sessions := make([]*Session, 0, len(s.state.sessions))
+	for _, session := range s.state.sessions {
+		c := *session.Session
+		sessions = append(sessions, &c)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions
+}
+
+// RevokeAll revokes all sessions, their access and refresh tokens are no longer valid.
+func (s *Sessions) RevokeAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.sessions = make(map[string]*storedSession)
+	return s.persist()
+}
+
+// RotateKey signs all new access tokens with a new random key, tokens signed
+// with the previous key stay valid until they expire.
+func (s *Sessions) RotateKey() error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	now := s.now()
+	key, err := newSigningKey(secret, now)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	retiredAt := now.UTC()
+	s.state.Keys[0].RetiredAt = &retiredAt
+	s.state.Keys = append([]*signingKey{key}, s.state.Keys...)
+	return s.persist()
+}
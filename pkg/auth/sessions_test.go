@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func testSessions(t *testing.T, st store.Store, secret string, now *time.Time) *Sessions {
+	s, err := NewSessions(st, secret, 15*time.Minute, 24*time.Hour)
+	require.NoError(t, err)
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func TestSessions(t *testing.T) {
+	now := time.Now()
+	st := store.NewMemoryStore()
+	sessions := testSessions(t, st, "secret", &now)
+	users, err := NewUsers(&User{Username: "alice", PasswordHash: "x", Role: RoleOperator})
+	require.NoError(t, err)
+	alice, _ := users.Get("alice")
+
+	pair, err := sessions.Login(alice)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(15*time.Minute).UTC(), pair.ExpiresAt)
+	token, err := sessions.Verify(pair.AccessToken)
+	require.NoError(t, err)
+	role, _ := token.Get("role")
+	require.Equal(t, "operator", role)
+	require.Len(t, sessions.List(), 1)
+
+	// access tokens are short-lived
+	now = now.Add(16 * time.Minute)
+	_, err = sessions.Verify(pair.AccessToken)
+	require.ErrorIs(t, err, jwtauth.ErrExpired)
+
+	// refresh tokens are rotated
+	refreshed, err := sessions.Refresh(pair.RefreshToken, users)
+	require.NoError(t, err)
+	_, err = sessions.Verify(refreshed.AccessToken)
+	require.NoError(t, err)
+	_, err = sessions.Refresh("wgr_unknown", users)
+	require.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	// sessions are restored from the store
+	restored := testSessions(t, st, "secret", &now)
+	_, err = restored.Verify(refreshed.AccessToken)
+	require.NoError(t, err)
+
+	// reusing a rotated refresh token revokes the session
+	_, err = sessions.Refresh(pair.RefreshToken, users)
+	require.ErrorIs(t, err, ErrRefreshTokenReused)
+	_, err = sessions.Verify(refreshed.AccessToken)
+	require.ErrorIs(t, err, ErrSessionRevoked)
+	_, err = sessions.Refresh(refreshed.RefreshToken, users)
+	require.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	// sessions expire without refresh
+	pair, err = sessions.Login(alice)
+	require.NoError(t, err)
+	now = now.Add(25 * time.Hour)
+	_, err = sessions.Refresh(pair.RefreshToken, users)
+	require.ErrorIs(t, err, ErrSessionExpired)
+	require.Empty(t, sessions.List())
+
+	// removed users can not refresh their session
+	pair, err = sessions.Login(alice)
+	require.NoError(t, err)
+	noUsers, err := NewUsers()
+	require.NoError(t, err)
+	_, err = sessions.Refresh(pair.RefreshToken, noUsers)
+	require.ErrorIs(t, err, ErrUserNotFound)
+
+	// sessions of external providers keep their role without a local user
+	pair, err = sessions.LoginWithProvider(&User{Username: "bob", Role: RoleAdmin}, "oidc")
+	require.NoError(t, err)
+	_, err = sessions.Refresh(pair.RefreshToken, noUsers)
+	require.NoError(t, err)
+
+	// a changed secret invalidates all sessions
+	pair, err = sessions.Login(alice)
+	require.NoError(t, err)
+	changed := testSessions(t, st, "other-secret", &now)
+	_, err = changed.Verify(pair.AccessToken)
+	require.ErrorIs(t, err, jwtauth.ErrUnauthorized)
+}
+
+func TestSessionsLogout(t *testing.T) {
+	now := time.Now()
+	sessions := testSessions(t, store.NewMemoryStore(), "", &now)
+	user := &User{Username: "admin", Role: RoleAdmin}
+
+	pair, err := sessions.Login(user)
+	require.NoError(t, err)
+	otherPair, err := sessions.Login(user)
+	require.NoError(t, err)
+	token, err := sessions.Verify(pair.AccessToken)
+	require.NoError(t, err)
+	require.NoError(t, sessions.Logout(token))
+	_, err = sessions.Verify(pair.AccessToken)
+	require.ErrorIs(t, err, ErrSessionRevoked)
+	require.Contains(t, sessions.state.Blocklist, token.JwtID())
+	_, err = sessions.Verify(otherPair.AccessToken)
+	require.NoError(t, err)
+
+	require.NoError(t, sessions.RevokeAll())
+	_, err = sessions.Verify(otherPair.AccessToken)
+	require.ErrorIs(t, err, ErrSessionRevoked)
+	require.Empty(t, sessions.List())
+
+	// the blocklist entry is removed once the token expired
+	now = now.Add(time.Hour)
+	require.NoError(t, sessions.RevokeAll())
+	require.Empty(t, sessions.state.Blocklist)
+}
+
+func TestSessionsRotateKey(t *testing.T) {
+	now := time.Now()
+	sessions := testSessions(t, store.NewMemoryStore(), "secret", &now)
+	user := &User{Username: "admin", Role: RoleAdmin}
+
+	oldPair, err := sessions.Login(user)
+	require.NoError(t, err)
+	require.NoError(t, sessions.RotateKey())
+	newPair, err := sessions.Login(user)
+	require.NoError(t, err)
+	require.Len(t, sessions.state.Keys, 2)
+
+	// tokens of the previous key stay valid until they expire
+	_, err = sessions.Verify(oldPair.AccessToken)
+	require.NoError(t, err)
+	_, err = sessions.Verify(newPair.AccessToken)
+	require.NoError(t, err)
+
+	now = now.Add(16 * time.Minute)
+	require.NoError(t, sessions.RotateKey())
+	// the first key is removed, as all of its tokens are expired
+	require.Len(t, sessions.state.Keys, 2)
+	refreshed, err := sessions.Refresh(oldPair.RefreshToken, mustUsers(t, user))
+	require.NoError(t, err)
+	_, err = sessions.Verify(refreshed.AccessToken)
+	require.NoError(t, err)
+}
+
+func TestSessionsConfiguredSecretNotPersisted(t *testing.T) {
+	now := time.Now()
+	st := store.NewMemoryStore()
+	sessions := testSessions(t, st, "configured-secret", &now)
+	user := &User{Username: "admin", Role: RoleAdmin}
+	oldPair, err := sessions.Login(user)
+	require.NoError(t, err)
+	require.NoError(t, sessions.RotateKey())
+
+	var state struct {
+		Keys []struct {
+			Secret     []byte `json:"secret"`
+			Configured bool   `json:"configured"`
+		} `json:"keys"`
+	}
+	require.NoError(t, st.Load(sessionsStoreKey, &state))
+	require.Len(t, state.Keys, 2)
+	// only the generated key is persisted with its secret
+	require.NotEmpty(t, state.Keys[0].Secret)
+	require.False(t, state.Keys[0].Configured)
+	require.Empty(t, state.Keys[1].Secret)
+	require.True(t, state.Keys[1].Configured)
+
+	// the key of the configured secret is restored from the config
+	sessions = testSessions(t, st, "configured-secret", &now)
+	_, err = sessions.Verify(oldPair.AccessToken)
+	require.NoError(t, err)
+}
+
+func mustUsers(t *testing.T, users ...*User) *Users {
+	u, err := NewUsers(users...)
+	require.NoError(t, err)
+	return u
+}
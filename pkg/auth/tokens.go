@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/store"
+)
+
+// tokensStoreKey is the store key of the API tokens.
+const tokensStoreKey = "tokens"
+
+// APITokenPrefix is the prefix of all API tokens, it distinguishes them from JWTs.
+const APITokenPrefix = "wgh_"
+
+// lastUsedPersistInterval limits how often the last-used timestamp of a token is persisted.
+const lastUsedPersistInterval = time.Minute
+
+type Scope string
+
+const (
+	ScopePeersRead    Scope = "peers:read"
+	ScopePeersWrite   Scope = "peers:write"
+	ScopeHubRead      Scope = "hub:read"
+	ScopeConfigRead   Scope = "config:read"
+	ScopeUsersRead    Scope = "users:read"
+	ScopeAuditRead    Scope = "audit:read"
+	ScopeEventsRead   Scope = "events:read"
+	ScopeMetricsRead  Scope = "metrics:read"
+	ScopeCaptureRead  Scope = "capture:read"
+	ScopeShapingWrite Scope = "shaping:write"
+)
+
+// Scopes contains all valid scopes of API tokens.
+var Scopes = []Scope{ScopePeersRead, ScopePeersWrite, ScopeHubRead, ScopeConfigRead, ScopeUsersRead, ScopeAuditRead, ScopeEventsRead, ScopeMetricsRead, ScopeCaptureRead, ScopeShapingWrite}
+
+var (
+	ErrInvalidScope     = errors.New("invalid scope")
+	ErrInvalidTokenName = errors.New("invalid token name")
+	ErrInvalidExpiry    = errors.New("token expiry must be in the future")
+	ErrTokenNotFound    = errors.New("token not found")
+	ErrInvalidToken     = errors.New("invalid api token")
+	ErrTokenExpired     = errors.New("api token expired")
+)
+
+func ParseScope(s string) (Scope, error) {
+	scope := Scope(s)
+	if !slices.Contains(Scopes, scope) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidScope, s)
+	}
+	return scope, nil
+}
+
+// APIToken is a named token for automation, only the hash of the token is stored.
+type APIToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []Scope    `json:"scopes"`
+	CreatedBy  string     `json:"createdBy"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+func (t *APIToken) HasScope(scope Scope) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+func (t *APIToken) copy() *APIToken {
+	c := *t
+	c.Scopes = slices.Clone(t.Scopes)
+	return &c
+}
+
+type storedToken struct {
+	*APIToken
+	Hash string `json:"hash"`
+}
+
+// Tokens manages the API tokens and persists them in the store.
+type Tokens struct {
+	store store.Store
+	now   func() time.Time
+
+	mu            sync.Mutex
+	tokens        map[string]*storedToken // by hash
+	lastPersisted time.Time
+}
+
+// NewTokens loads the API tokens from the store.
+func NewTokens(st store.Store) (*Tokens, error) {
+	t := &Tokens{
+		store:  st,
+		now:    time.Now,
+		tokens: make(map[string]*storedToken),
+	}
+	var stored []*storedToken
+	err := st.Load(tokensStoreKey, &stored)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("failed to load api tokens: %w", err)
+	}
+	for _, token := range stored {
+		t.tokens[token.Hash] = token
+	}
+	return t, nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// IsAPIToken returns true if the bearer token is an API token and not a JWT.
+func IsAPIToken(bearer string) bool {
+	return strings.HasPrefix(bearer, APITokenPrefix)
+}
+
+func (t *Tokens) persist() error {
+	stored := make([]*storedToken, 0, len(t.tokens))
+	for _, token := range t.tokens {
+		stored = append(stored, token)
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].CreatedAt.Before(stored[j].CreatedAt)
+	})
+	t.lastPersisted = t.now()
+	return t.store.Save(tokensStoreKey, stored)
+}
+
+// Create creates a new API token and returns the secret, which is only available once.
+func (t *Tokens) Create(name string, scopes []Scope, expiresAt *time.Time, createdBy string) (string, *APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return "", nil, ErrInvalidTokenName
+	}
+	if len(scopes) == 0 {
+		return "", nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidScope)
+	}
+	for _, scope := range scopes {
+		if _, err := ParseScope(string(scope)); err != nil {
+			return "", nil, err
+		}
+	}
+	now := t.now()
+	if expiresAt != nil && !expiresAt.After(now) {
+		return "", nil, ErrInvalidExpiry
+	}
+	id, err := randomString(9)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", nil, err
+	}
+	secret = APITokenPrefix + secret
+	token := &APIToken{
+		ID:        id,
+		Name:      name,
+		Scopes:    slices.Compact(slices.Clone(scopes)),
+		CreatedBy: createdBy,
+		CreatedAt: now.UTC(),
+		ExpiresAt: expiresAt,
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens[hashToken(secret)] = &storedToken{APIToken: token, Hash: hashToken(secret)}
+	if err := t.persist(); err != nil {
+		return "", nil, fmt.Errorf("failed to persist api tokens: %w", err)
+	}
+	return secret, token.copy(), nil
+}
+
+// List returns all API tokens sorted by their creation time.
+func (t *Tokens) List() []*APIToken {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tokens := make([]*APIToken, 0, len(t.tokens))
+	for _, token := range t.tokens {
+		tokens = append(tokens, token.copy())
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens
+}
+
+// Revoke deletes the API token with the given id.
+func (t *Tokens) Revoke(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for hash, token := range t.tokens {
+		if token.ID != id {
+			continue
+		}
+		delete(t.tokens, hash)
+		if err := t.persist(); err != nil {
+			return fmt.Errorf("failed to persist api tokens: %w", err)
+		}
+		return nil
+	}
+	return ErrTokenNotFound
+}
+
+// Verify returns the API token of the secret and updates its last-used timestamp.
+func (t *Tokens) Verify(secret string) (*APIToken, error) {
+	if !IsAPIToken(secret) {
+		return nil, ErrInvalidToken
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	token, ok := t.tokens[hashToken(secret)]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	now := t.now()
+	if token.ExpiresAt != nil && !now.Before(*token.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	lastUsed := now.UTC()
+	token.LastUsedAt = &lastUsed
+	if now.Sub(t.lastPersisted) >= lastUsedPersistInterval {
+		// the last-used timestamp is best effort, the token is valid anyway
+		_ = t.persist()
+	}
+	return token.copy(), nil
+}
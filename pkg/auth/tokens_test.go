@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokens(t *testing.T) {
+	st := store.NewMemoryStore()
+	tokens, err := NewTokens(st)
+	require.NoError(t, err)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tokens.now = func() time.Time { return now }
+
+	_, _, err = tokens.Create("", []Scope{ScopePeersRead}, nil, "admin")
+	require.ErrorIs(t, err, ErrInvalidTokenName)
+	_, _, err = tokens.Create("ci", nil, nil, "admin")
+	require.ErrorIs(t, err, ErrInvalidScope)
+	_, _, err = tokens.Create("ci", []Scope{"peers:delete"}, nil, "admin")
+	require.ErrorIs(t, err, ErrInvalidScope)
+	past := now.Add(-time.Hour)
+	_, _, err = tokens.Create("ci", []Scope{ScopePeersRead}, &past, "admin")
+	require.ErrorIs(t, err, ErrInvalidExpiry)
+
+	secret, token, err := tokens.Create("ci", []Scope{ScopePeersRead, ScopePeersWrite}, nil, "admin")
+	require.NoError(t, err)
+	require.True(t, IsAPIToken(secret))
+	require.Equal(t, "ci", token.Name)
+	require.Equal(t, "admin", token.CreatedBy)
+	require.Nil(t, token.LastUsedAt)
+
+	expiry := now.Add(time.Hour)
+	now = now.Add(time.Second)
+	expiringSecret, _, err := tokens.Create("expiring", []Scope{ScopeHubRead}, &expiry, "admin")
+	require.NoError(t, err)
+	require.Len(t, tokens.List(), 2)
+	require.Equal(t, "ci", tokens.List()[0].Name)
+
+	verified, err := tokens.Verify(secret)
+	require.NoError(t, err)
+	require.Equal(t, token.ID, verified.ID)
+	require.True(t, verified.HasScope(ScopePeersWrite))
+	require.False(t, verified.HasScope(ScopeConfigRead))
+	require.Equal(t, now, *verified.LastUsedAt)
+	_, err = tokens.Verify(secret + "x")
+	require.ErrorIs(t, err, ErrInvalidToken)
+	_, err = tokens.Verify("eyJhbGciOiJIUzI1NiJ9")
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = tokens.Verify(expiringSecret)
+	require.NoError(t, err)
+	now = now.Add(2 * time.Hour)
+	_, err = tokens.Verify(expiringSecret)
+	require.ErrorIs(t, err, ErrTokenExpired)
+
+	// only the hash of the token is persisted
+	var stored []map[string]any
+	require.NoError(t, st.Load(tokensStoreKey, &stored))
+	require.Len(t, stored, 2)
+	require.Equal(t, hashToken(secret), stored[0]["hash"])
+	require.NotContains(t, stored[0], "token")
+
+	// tokens are restored from the store
+	restored, err := NewTokens(st)
+	require.NoError(t, err)
+	verified, err = restored.Verify(secret)
+	require.NoError(t, err)
+	require.Equal(t, token.ID, verified.ID)
+
+	require.ErrorIs(t, tokens.Revoke("unknown"), ErrTokenNotFound)
+	require.NoError(t, tokens.Revoke(token.ID))
+	_, err = tokens.Verify(secret)
+	require.ErrorIs(t, err, ErrInvalidToken)
+	require.Len(t, tokens.List(), 1)
+}
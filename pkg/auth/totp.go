@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/store"
+)
+
+const (
+	// totpStoreKey is the store key of the TOTP enrollments.
+	totpStoreKey = "totp"
+	// TOTPIssuer is the issuer that is shown in authenticator apps.
+	TOTPIssuer = "wg-hub"
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is the number of accepted time steps before and after the current one.
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrTOTPNotEnrolled     = errors.New("totp is not enrolled")
+	ErrTOTPAlreadyEnabled  = errors.New("totp is already enabled")
+	ErrTOTPCodeRequired    = errors.New("totp code required")
+	ErrInvalidTOTPCode     = errors.New("invalid totp code")
+	ErrTOTPCodeAlreadyUsed = errors.New("totp code already used")
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPCode returns the RFC 6238 code (HMAC-SHA1, 30 seconds, 6 digits) of the base32 secret at the given time.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("invalid totp secret: %w", err)
+	}
+	return hotp(key, uint64(t.Unix()/totpPeriod)), nil
+}
+
+// hotp returns the RFC 4226 code of the counter.
+func hotp(key []byte, counter uint64) string {
+	mac := hmac.New(sha1.New, key)
+	_ = binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+// TOTPEnrollment is the pending or enabled TOTP enrollment of a user.
+type TOTPEnrollment struct {
+	Secret         string    `json:"secret"`
+	Enabled        bool      `json:"enabled"`
+	CreatedAt      time.Time `json:"createdAt"`
+	LastStep       int64     `json:"lastStep"`
+	RecoveryHashes []string  `json:"recoveryHashes,omitempty"`
+}
+
+// TOTPStatus is the public state of the TOTP enrollment of a user.
+type TOTPStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+}
+
+// TOTP manages the TOTP enrollments of the users and persists them in the store.
+type TOTP struct {
+	store store.Store
+	now   func() time.Time
+
+	mu          sync.Mutex
+	enrollments map[string]*TOTPEnrollment // by username
+}
+
+// NewTOTP loads the TOTP enrollments from the store.
+func NewTOTP(st store.Store) (*TOTP, error) {
+	t := &TOTP{
+		store:       st,
+		now:         time.Now,
+		enrollments: make(map[string]*TOTPEnrollment),
+	}
+	err := st.Load(totpStoreKey, &t.enrollments)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("failed to load totp enrollments: %w", err)
+	}
+	return t, nil
+}
+
+func (t *TOTP) persist() error {
+	if err := t.store.Save(totpStoreKey, t.enrollments); err != nil {
+		return fmt.Errorf("failed to persist totp enrollments: %w", err)
+	}
+	return nil
+}
+
+// Enroll creates a new secret for the user and returns the secret and the otpauth:// URI.
+// The enrollment is pending until the first code is verified with Enable.
+func (t *TOTP) Enroll(username string) (secret, uri string, err error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", err
+	}
+	secret = base32NoPadding.EncodeToString(key)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.enrollments[username]; ok && e.Enabled {
+		return "", "", ErrTOTPAlreadyEnabled
+	}
+	t.enrollments[username] = &TOTPEnrollment{Secret: secret, CreatedAt: t.now().UTC()}
+	if err := t.persist(); err != nil {
+		return "", "", err
+	}
+	return secret, totpURI(username, secret), nil
+}
+
+func totpURI(username, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", TOTPIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + TOTPIssuer + ":" + username,
+		RawQuery: params.Encode(),
+	}).String()
+}
+
+// Enable verifies the first code of a pending enrollment, enables it and returns the recovery codes.
+func (t *TOTP) Enable(username, code string) ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.enrollments[username]
+	if !ok {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if e.Enabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if err := t.verifyCode(e, code); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	e.Enabled = true
+	e.RecoveryHashes = hashes
+	if err := t.persist(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func generateRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(b))
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// verifyCode checks the code against the current time steps, a code can only be used once.
+func (t *TOTP) verifyCode(e *TOTPEnrollment, code string) error {
+	key, err := base32NoPadding.DecodeString(e.Secret)
+	if err != nil {
+		return err
+	}
+	step := t.now().Unix() / totpPeriod
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(s))), []byte(code)) != 1 {
+			continue
+		}
+		if s <= e.LastStep {
+			return ErrTOTPCodeAlreadyUsed
+		}
+		e.LastStep = s
+		return nil
+	}
+	return ErrInvalidTOTPCode
+}
+
+// Enabled returns true if the user has an enabled TOTP enrollment.
+func (t *TOTP) Enabled(username string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.enrollments[username]
+	return ok && e.Enabled
+}
+
+// Status returns the TOTP state of the user.
+func (t *TOTP) Status(username string) *TOTPStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.enrollments[username]
+	if !ok || !e.Enabled {
+		return &TOTPStatus{}
+	}
+	return &TOTPStatus{Enabled: true, RecoveryCodesLeft: len(e.RecoveryHashes)}
+}
+
+// Verify checks the TOTP code or a recovery code of the user, a recovery code is removed after its use.
+func (t *TOTP) Verify(username, code string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.enrollments[username]
+	if !ok || !e.Enabled {
+		return ErrTOTPNotEnrolled
+	}
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return ErrTOTPCodeRequired
+	}
+	if len(code) == totpDigits {
+		if err := t.verifyCode(e, code); err != nil {
+			return err
+		}
+		return t.persist()
+	}
+	hash := hashToken(strings.ToLower(code))
+	for i, recoveryHash := range e.RecoveryHashes {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(recoveryHash)) == 1 {
+			e.RecoveryHashes = append(e.RecoveryHashes[:i], e.RecoveryHashes[i+1:]...)
+			return t.persist()
+		}
+	}
+	return ErrInvalidTOTPCode
+}
+
+// Disable removes the TOTP enrollment of the user.
+func (t *TOTP) Disable(username string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.enrollments[username]; !ok {
+		return ErrTOTPNotEnrolled
+	}
+	delete(t.enrollments, username)
+	return t.persist()
+}
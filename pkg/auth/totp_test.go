@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors of RFC 6238 (SHA1) truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for ts, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		got, err := TOTPCode(secret, time.Unix(ts, 0))
+		require.NoError(t, err)
+		require.Equal(t, code, got, "time %d", ts)
+	}
+	_, err := TOTPCode("invalid!", time.Now())
+	require.Error(t, err)
+}
+
+func TestTOTP(t *testing.T) {
+	st := store.NewMemoryStore()
+	totp, err := NewTOTP(st)
+	require.NoError(t, err)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	totp.now = func() time.Time { return now }
+
+	require.ErrorIs(t, totp.Verify("admin", "123456"), ErrTOTPNotEnrolled)
+	_, err = totp.Enable("admin", "123456")
+	require.ErrorIs(t, err, ErrTOTPNotEnrolled)
+
+	secret, uri, err := totp.Enroll("admin")
+	require.NoError(t, err)
+	parsed, err := url.Parse(uri)
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", parsed.Scheme)
+	require.Equal(t, "/wg-hub:admin", parsed.Path)
+	require.Equal(t, secret, parsed.Query().Get("secret"))
+	require.False(t, totp.Enabled("admin"))
+
+	_, err = totp.Enable("admin", "000000")
+	require.ErrorIs(t, err, ErrInvalidTOTPCode)
+	code, err := TOTPCode(secret, now)
+	require.NoError(t, err)
+	recoveryCodes, err := totp.Enable("admin", code)
+	require.NoError(t, err)
+	require.Len(t, recoveryCodes, recoveryCodeCount)
+	require.True(t, totp.Enabled("admin"))
+	_, _, err = totp.Enroll("admin")
+	require.ErrorIs(t, err, ErrTOTPAlreadyEnabled)
+
+	// codes can not be reused
+	require.ErrorIs(t, totp.Verify("admin", code), ErrTOTPCodeAlreadyUsed)
+	require.ErrorIs(t, totp.Verify("admin", ""), ErrTOTPCodeRequired)
+	now = now.Add(30 * time.Second)
+	code, _ = TOTPCode(secret, now)
+	require.NoError(t, totp.Verify("admin", code))
+	// the previous time step is accepted as well
+	now = now.Add(30 * time.Second)
+	code, _ = TOTPCode(secret, now.Add(-30*time.Second))
+	require.ErrorIs(t, totp.Verify("admin", code), ErrTOTPCodeAlreadyUsed)
+	code, _ = TOTPCode(secret, now.Add(-2*time.Minute))
+	require.ErrorIs(t, totp.Verify("admin", code), ErrInvalidTOTPCode)
+
+	// recovery codes can only be used once
+	require.NoError(t, totp.Verify("admin", recoveryCodes[0]))
+	require.ErrorIs(t, totp.Verify("admin", recoveryCodes[0]), ErrInvalidTOTPCode)
+	require.Equal(t, &TOTPStatus{Enabled: true, RecoveryCodesLeft: recoveryCodeCount - 1}, totp.Status("admin"))
+
+	// the enrollment is persisted
+	reloaded, err := NewTOTP(st)
+	require.NoError(t, err)
+	require.True(t, reloaded.Enabled("admin"))
+	require.NoError(t, reloaded.Disable("admin"))
+	require.False(t, reloaded.Enabled("admin"))
+	require.ErrorIs(t, reloaded.Disable("admin"), ErrTOTPNotEnrolled)
+}
@@ -0,0 +1,184 @@
+// Package auth contains the users and roles of the webui and API.
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Role string
+
+const (
+	// RoleViewer can list the peers and the hub info.
+	RoleViewer Role = "viewer"
+	// RoleOperator can additionally add and remove peers.
+	RoleOperator Role = "operator"
+	// RoleAdmin can additionally read the config and manage users.
+	RoleAdmin Role = "admin"
+)
+
+var roleLevels = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+var (
+	ErrInvalidRole       = errors.New("invalid role")
+	ErrInvalidUsername   = errors.New("invalid username")
+	ErrDuplicateUser     = errors.New("duplicate user")
+	ErrInvalidCredential = errors.New("invalid username or password")
+)
+
+func ParseRole(s string) (Role, error) {
+	role := Role(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := roleLevels[role]; !ok {
+		return "", fmt.Errorf("%w: %q", ErrInvalidRole, s)
+	}
+	return role, nil
+}
+
+// Allows returns true if the role has at least the permissions of the required role.
+func (r Role) Allows(required Role) bool {
+	level, ok := roleLevels[r]
+	return ok && level >= roleLevels[required]
+}
+
+type User struct {
+	Username     string `yaml:"username" json:"username"`
+	PasswordHash string `yaml:"passwordHash" json:"-"`
+	Role         Role   `yaml:"role" json:"role"`
+}
+
+// Validate checks the username and role of the user, an empty role defaults to viewer.
+func (u *User) Validate() error {
+	if u.Username == "" || strings.ContainsAny(u.Username, ": \t") {
+		return fmt.Errorf("%w: %q", ErrInvalidUsername, u.Username)
+	}
+	if u.Role == "" {
+		u.Role = RoleViewer
+	}
+	role, err := ParseRole(string(u.Role))
+	if err != nil {
+		return fmt.Errorf("user %s: %w", u.Username, err)
+	}
+	u.Role = role
+	return nil
+}
+
+// CheckPassword compares the password with the bcrypt hash of the user.
+func (u *User) CheckPassword(password string) bool {
+	if u.PasswordHash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// ParseHtpasswd parses htpasswd-style lines of the form `username:bcryptHash[:role]`.
+// Empty lines and lines starting with # are ignored, the role defaults to viewer.
+func ParseHtpasswd(r io.Reader) ([]*User, error) {
+	var users []*User
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("line %d: expected username:hash[:role]", lineNum)
+		}
+		u := &User{Username: parts[0], PasswordHash: parts[1]}
+		if len(parts) == 3 {
+			u.Role = Role(parts[2])
+		}
+		if err := u.Validate(); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		users = append(users, u)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// LoadHtpasswdFile reads the users of the given htpasswd-style file.
+func LoadHtpasswdFile(path string) ([]*User, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users, err := ParseHtpasswd(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return users, nil
+}
+
+// Users is a set of users indexed by their username.
+type Users struct {
+	users map[string]*User
+}
+
+// NewUsers validates the given users and returns an error if a username is used twice.
+func NewUsers(users ...*User) (*Users, error) {
+	u := &Users{users: make(map[string]*User, len(users))}
+	for _, user := range users {
+		if err := user.Validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := u.users[user.Username]; ok {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateUser, user.Username)
+		}
+		u.users[user.Username] = user
+	}
+	return u, nil
+}
+
+func (u *Users) Get(username string) (*User, bool) {
+	user, ok := u.users[username]
+	return user, ok
+}
+
+// dummyUser is checked for unknown usernames, so they take as long as a wrong password.
+var dummyUser = &User{PasswordHash: "$2a$10$qXMG88jqwGwLUB.69EYxMOLpxjCJKqf6uN7q.GVdf9CDn5AJXnXSy"}
+
+// Authenticate returns the user if the password matches.
+func (u *Users) Authenticate(username, password string) (*User, error) {
+	user, ok := u.users[username]
+	if !ok {
+		dummyUser.CheckPassword(password)
+		return nil, ErrInvalidCredential
+	}
+	if !user.CheckPassword(password) {
+		return nil, ErrInvalidCredential
+	}
+	return user, nil
+}
+
+// List returns all users sorted by their username.
+func (u *Users) List() []*User {
+	users := make([]*User, 0, len(u.users))
+	for _, user := range u.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+func (u *Users) Len() int {
+	return len(u.users)
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hashPassword(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(hash)
+}
+
+func TestRole(t *testing.T) {
+	role, err := ParseRole(" Operator")
+	require.NoError(t, err)
+	require.Equal(t, RoleOperator, role)
+	_, err = ParseRole("root")
+	require.ErrorIs(t, err, ErrInvalidRole)
+
+	require.True(t, RoleAdmin.Allows(RoleViewer))
+	require.True(t, RoleOperator.Allows(RoleOperator))
+	require.False(t, RoleOperator.Allows(RoleAdmin))
+	require.False(t, RoleViewer.Allows(RoleOperator))
+	require.False(t, Role("").Allows(RoleViewer))
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	hash := hashPassword(t, "secret")
+	users, err := ParseHtpasswd(strings.NewReader("# users\n\nalice:" + hash + ":admin\nbob:" + hash + "\n"))
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	require.Equal(t, "alice", users[0].Username)
+	require.Equal(t, RoleAdmin, users[0].Role)
+	require.Equal(t, RoleViewer, users[1].Role)
+
+	_, err = ParseHtpasswd(strings.NewReader("alice"))
+	require.Error(t, err)
+	_, err = ParseHtpasswd(strings.NewReader("alice:" + hash + ":root"))
+	require.ErrorIs(t, err, ErrInvalidRole)
+}
+
+func TestUsers(t *testing.T) {
+	hash := hashPassword(t, "secret")
+	_, err := NewUsers(&User{Username: "alice", PasswordHash: hash}, &User{Username: "alice", PasswordHash: hash})
+	require.ErrorIs(t, err, ErrDuplicateUser)
+	_, err = NewUsers(&User{Username: "", PasswordHash: hash})
+	require.ErrorIs(t, err, ErrInvalidUsername)
+
+	users, err := NewUsers(
+		&User{Username: "bob", PasswordHash: hash, Role: RoleOperator},
+		&User{Username: "alice", PasswordHash: hash, Role: RoleAdmin},
+		&User{Username: "carol"},
+	)
+	require.NoError(t, err)
+	require.Equal(t, 3, users.Len())
+	require.Equal(t, "alice", users.List()[0].Username)
+
+	user, err := users.Authenticate("bob", "secret")
+	require.NoError(t, err)
+	require.Equal(t, RoleOperator, user.Role)
+	_, err = users.Authenticate("bob", "wrong")
+	require.ErrorIs(t, err, ErrInvalidCredential)
+	_, err = users.Authenticate("dave", "secret")
+	require.ErrorIs(t, err, ErrInvalidCredential)
+	// users without a password hash can not log in
+	_, err = users.Authenticate("carol", "")
+	require.ErrorIs(t, err, ErrInvalidCredential)
+}
@@ -0,0 +1,92 @@
+// Package capture copies the decrypted packets that pass the hub to capture sessions and writes them as pcapng.
+package capture
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Packet is a captured packet.
+type Packet struct {
+	Time time.Time
+	Data []byte
+}
+
+// Session receives the packets that match its filter until it is closed.
+type Session struct {
+	capturer *Capturer
+	filter   *Filter
+	packets  chan *Packet
+	dropped  atomic.Uint64
+}
+
+// Packets returns the channel of the captured packets, it is closed by Close.
+func (s *Session) Packets() <-chan *Packet {
+	return s.packets
+}
+
+// Dropped returns the number of matching packets that were dropped because the buffer was full.
+func (s *Session) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close ends the session.
+func (s *Session) Close() {
+	s.capturer.remove(s)
+}
+
+// Capturer observes the packets of the loopback device and copies them to the
+// capture sessions. Packets are dropped for sessions with a full buffer, so a
+// slow client never delays the forwarding.
+type Capturer struct {
+	mu       sync.RWMutex
+	sessions map[*Session]struct{}
+}
+
+func NewCapturer() *Capturer {
+	return &Capturer{sessions: make(map[*Session]struct{})}
+}
+
+// Start starts a capture session with the given filter and buffer size.
+func (c *Capturer) Start(filter *Filter, buffer int) *Session {
+	s := &Session{capturer: c, filter: filter, packets: make(chan *Packet, buffer)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessions[s] = struct{}{}
+	return s
+}
+
+func (c *Capturer) remove(s *Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.sessions[s]; !ok {
+		return
+	}
+	delete(c.sessions, s)
+	close(s.packets)
+}
+
+// Observe copies the packet to the matching sessions.
+func (c *Capturer) Observe(packet []byte) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.sessions) == 0 {
+		return
+	}
+	now := time.Now()
+	var p *Packet
+	for s := range c.sessions {
+		if !s.filter.Match(packet) {
+			continue
+		}
+		if p == nil {
+			p = &Packet{Time: now, Data: append([]byte(nil), packet...)}
+		}
+		select {
+		case s.packets <- p:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func tcpPacket(src, dst string, srcPort, dstPort uint16, size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = 0x45
+	packet[9] = 6
+	copy(packet[12:16], netip.MustParseAddr(src).AsSlice())
+	copy(packet[16:20], netip.MustParseAddr(dst).AsSlice())
+	binary.BigEndian.PutUint16(packet[20:], srcPort)
+	binary.BigEndian.PutUint16(packet[22:], dstPort)
+	return packet
+}
+
+func TestFilter(t *testing.T) {
+	packet := tcpPacket("192.168.0.1", "192.168.0.2", 40000, 443, 60)
+	for expr, expected := range map[string]bool{
+		"":                                 true,
+		"host 192.168.0.1":                 true,
+		"dst host 192.168.0.1":             false,
+		"src net 192.168.0.0/24":           true,
+		"port 443":                         true,
+		"src port 443":                     false,
+		"proto tcp and dst port 443":       true,
+		"proto udp":                        false,
+		"PROTO 6 AND NOT host 192.168.0.3": true,
+		"not net 192.168.0.0/16":           false,
+	} {
+		f, err := ParseFilter(expr)
+		require.NoError(t, err, expr)
+		require.Equal(t, expected, f.Match(packet), expr)
+	}
+	for _, expr := range []string{"host", "host foo", "port 70000", "src proto tcp", "port 1 or port 2", "port 1 and", "mac 1"} {
+		_, err := ParseFilter(expr)
+		require.Error(t, err, expr)
+	}
+
+	f, err := ParseFilter("")
+	require.NoError(t, err)
+	f.ExcludeConnection(netip.MustParseAddrPort("192.168.0.2:443"), netip.MustParseAddrPort("192.168.0.1:40000"))
+	require.False(t, f.Match(packet))
+	require.True(t, f.Match(tcpPacket("192.168.0.1", "192.168.0.2", 40001, 443, 60)))
+	require.False(t, f.Match([]byte{0x45}))
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewWriter(&buf, 64)
+	require.NoError(t, err)
+	header := buf.Len()
+	require.Equal(t, int64(header), pw.Size)
+	require.Equal(t, uint32(blockTypeSectionHeader), binary.LittleEndian.Uint32(buf.Bytes()))
+	require.Equal(t, uint32(byteOrderMagic), binary.LittleEndian.Uint32(buf.Bytes()[8:]))
+	shbLen := binary.LittleEndian.Uint32(buf.Bytes()[4:])
+	require.Equal(t, uint32(blockTypeInterface), binary.LittleEndian.Uint32(buf.Bytes()[shbLen:]))
+	require.Equal(t, uint16(linkTypeRaw), binary.LittleEndian.Uint16(buf.Bytes()[shbLen+8:]))
+
+	ts := time.UnixMicro(1700000000123456)
+	require.NoError(t, pw.WritePacket(ts, tcpPacket("192.168.0.1", "192.168.0.2", 1, 2, 100)))
+	epb := buf.Bytes()[header:]
+	require.Equal(t, uint32(blockTypeEnhancedPacket), binary.LittleEndian.Uint32(epb))
+	// the packet is truncated to the snaplen
+	require.Equal(t, uint32(12+20+64), binary.LittleEndian.Uint32(epb[4:]))
+	require.Equal(t, uint64(ts.UnixMicro()), uint64(binary.LittleEndian.Uint32(epb[12:]))<<32|uint64(binary.LittleEndian.Uint32(epb[16:])))
+	require.Equal(t, uint32(64), binary.LittleEndian.Uint32(epb[20:]))
+	require.Equal(t, uint32(100), binary.LittleEndian.Uint32(epb[24:]))
+	require.Equal(t, int64(buf.Len()), pw.Size)
+
+	pw.MaxSize = pw.Size + 50
+	require.True(t, errors.Is(pw.WritePacket(ts, make([]byte, 20)), ErrMaxSize))
+	require.Equal(t, int64(buf.Len()), pw.Size)
+}
+
+func TestCapturer(t *testing.T) {
+	c := NewCapturer()
+	c.Observe(tcpPacket("192.168.0.1", "192.168.0.2", 1, 2, 40))
+	f, err := ParseFilter("port 80")
+	require.NoError(t, err)
+	s := c.Start(f, 1)
+	c.Observe(tcpPacket("192.168.0.1", "192.168.0.2", 1, 2, 40))
+	c.Observe(tcpPacket("192.168.0.1", "192.168.0.2", 1, 80, 40))
+	c.Observe(tcpPacket("192.168.0.1", "192.168.0.2", 80, 1, 40))
+	require.Equal(t, uint64(1), s.Dropped())
+	p := <-s.Packets()
+	require.Equal(t, uint16(80), binary.BigEndian.Uint16(p.Data[22:]))
+	s.Close()
+	s.Close()
+	_, ok := <-s.Packets()
+	require.False(t, ok)
+}
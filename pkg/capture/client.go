@@ -0,0 +1,64 @@
+package capture
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request contains the parameters of GET /api/capture, empty fields use the defaults of the hub.
+type Request struct {
+	// Peer is the public key of the captured peer.
+	Peer     string
+	Filter   string
+	Duration time.Duration
+	MaxSize  int64
+}
+
+// Fetch requests a capture from the API of the hub (e.g. http://192.168.0.254) and
+// copies the pcapng stream to w. It returns the number of written bytes.
+func Fetch(ctx context.Context, apiURL, token string, req *Request, w io.Writer) (int64, error) {
+	q := url.Values{}
+	if req.Peer != "" {
+		q.Set("peer", req.Peer)
+	}
+	if req.Filter != "" {
+		q.Set("filter", req.Filter)
+	}
+	if req.Duration > 0 {
+		q.Set("duration", req.Duration.String())
+	}
+	if req.MaxSize > 0 {
+		q.Set("maxSize", strconv.FormatInt(req.MaxSize, 10))
+	}
+	u := strings.TrimSuffix(apiURL, "/") + "/api/capture?" + q.Encode()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return 0, fmt.Errorf("capture failed with status code %d: %s", resp.StatusCode, apiErr.Error)
+	}
+	n, err := io.Copy(w, resp.Body)
+	// the capture ends when the context is canceled
+	if ctx.Err() != nil {
+		return n, nil
+	}
+	return n, err
+}
@@ -0,0 +1,157 @@
+package capture
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/christophwitzko/wg-hub/pkg/flows"
+)
+
+var protocols = map[string]uint8{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"icmpv6": 58,
+}
+
+type direction int
+
+const (
+	either direction = iota
+	src
+	dst
+)
+
+type term struct {
+	negate    bool
+	direction direction
+	// exactly one of prefix, port and protocol is used
+	prefix   netip.Prefix
+	port     uint16
+	protocol uint8
+	kind     string
+}
+
+func (t *term) match(key *flows.Key) bool {
+	var matched bool
+	switch t.kind {
+	case "net":
+		matched = (t.direction != dst && t.prefix.Contains(key.Src)) || (t.direction != src && t.prefix.Contains(key.Dst))
+	case "port":
+		matched = (key.Protocol == protocols["tcp"] || key.Protocol == protocols["udp"]) &&
+			((t.direction != dst && key.SrcPort == t.port) || (t.direction != src && key.DstPort == t.port))
+	case "proto":
+		matched = key.Protocol == t.protocol
+	}
+	return matched != t.negate
+}
+
+// Filter matches packets by a simple expression of terms that are joined with and:
+//
+//	[not] [src|dst] host <ip>
+//	[not] [src|dst] net <cidr>
+//	[not] [src|dst] port <port>
+//	[not] proto <tcp|udp|icmp|icmpv6|number>
+//
+// An empty filter matches all packets.
+type Filter struct {
+	terms    []*term
+	excluded [][2]netip.AddrPort
+}
+
+// ParseFilter parses the filter expression.
+func ParseFilter(expr string) (*Filter, error) {
+	f := &Filter{}
+	fields := strings.Fields(strings.ToLower(expr))
+	for len(fields) > 0 {
+		t := &term{}
+		if fields[0] == "not" {
+			t.negate = true
+			fields = fields[1:]
+		}
+		if len(fields) > 0 && (fields[0] == "src" || fields[0] == "dst") {
+			t.direction = src
+			if fields[0] == "dst" {
+				t.direction = dst
+			}
+			fields = fields[1:]
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("incomplete filter term: %q", expr)
+		}
+		keyword, value := fields[0], fields[1]
+		fields = fields[2:]
+		switch keyword {
+		case "host":
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid host: %q", value)
+			}
+			t.kind, t.prefix = "net", netip.PrefixFrom(addr, addr.BitLen())
+		case "net":
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid net: %q", value)
+			}
+			t.kind, t.prefix = "net", prefix.Masked()
+		case "port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port: %q", value)
+			}
+			t.kind, t.port = "port", uint16(port)
+		case "proto":
+			if t.direction != either {
+				return nil, fmt.Errorf("proto does not support src or dst")
+			}
+			protocol, ok := protocols[value]
+			if !ok {
+				n, err := strconv.ParseUint(value, 10, 8)
+				if err != nil {
+					return nil, fmt.Errorf("invalid proto: %q", value)
+				}
+				protocol = uint8(n)
+			}
+			t.kind, t.protocol = "proto", protocol
+		default:
+			return nil, fmt.Errorf("unknown filter keyword: %q", keyword)
+		}
+		f.terms = append(f.terms, t)
+		if len(fields) > 0 {
+			if fields[0] != "and" || len(fields) == 1 {
+				return nil, fmt.Errorf("filter terms must be joined with and: %q", expr)
+			}
+			fields = fields[1:]
+		}
+	}
+	return f, nil
+}
+
+// ExcludeConnection excludes the TCP/UDP packets between both addresses in
+// both directions, e.g. the connection of the capture stream itself.
+func (f *Filter) ExcludeConnection(a, b netip.AddrPort) {
+	f.excluded = append(f.excluded, [2]netip.AddrPort{a, b})
+}
+
+// Match reports whether the IPv4 or IPv6 packet matches all terms of the filter.
+func (f *Filter) Match(packet []byte) bool {
+	key, _, ok := flows.ParsePacket(packet)
+	if !ok {
+		return false
+	}
+	srcAddr := netip.AddrPortFrom(key.Src, key.SrcPort)
+	dstAddr := netip.AddrPortFrom(key.Dst, key.DstPort)
+	for _, c := range f.excluded {
+		if (srcAddr == c[0] && dstAddr == c[1]) || (srcAddr == c[1] && dstAddr == c[0]) {
+			return false
+		}
+	}
+	for _, t := range f.terms {
+		if !t.match(&key) {
+			return false
+		}
+	}
+	return true
+}
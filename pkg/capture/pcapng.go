@@ -0,0 +1,107 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrMaxSize is returned if a packet would exceed the maximum size of the capture.
+var ErrMaxSize = errors.New("maximum capture size reached")
+
+const (
+	blockTypeSectionHeader   = 0x0a0d0d0a
+	blockTypeInterface       = 0x00000001
+	blockTypeEnhancedPacket  = 0x00000006
+	byteOrderMagic           = 0x1a2b3c4d
+	optionEndOfOpt           = 0
+	optionInterfaceName      = 2
+	optionShbUserApplication = 4
+	linkTypeRaw              = 101
+	timestampResolution      = time.Microsecond
+)
+
+// Writer writes the packets as pcapng (little endian, one raw IP interface with microsecond timestamps).
+type Writer struct {
+	w       io.Writer
+	snaplen uint32
+	// Size is the number of written bytes.
+	Size int64
+	// MaxSize limits the written bytes if it is greater than zero.
+	MaxSize int64
+}
+
+func appendOption(b []byte, code uint16, value string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, padding(len(value)))...)
+}
+
+func padding(n int) int {
+	return (4 - n%4) % 4
+}
+
+// block frames the body with the block type and the total length.
+func block(blockType uint32, body []byte) []byte {
+	total := uint32(12 + len(body))
+	b := make([]byte, 0, total)
+	b = binary.LittleEndian.AppendUint32(b, blockType)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	b = append(b, body...)
+	return binary.LittleEndian.AppendUint32(b, total)
+}
+
+// NewWriter writes the section header and the interface description to w.
+func NewWriter(w io.Writer, snaplen uint32) (*Writer, error) {
+	pw := &Writer{w: w, snaplen: snaplen}
+	var shb []byte
+	shb = binary.LittleEndian.AppendUint32(shb, byteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // minor version
+	// the section length is not known
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	shb = appendOption(shb, optionShbUserApplication, "wg-hub")
+	shb = binary.LittleEndian.AppendUint32(shb, optionEndOfOpt)
+
+	var idb []byte
+	idb = binary.LittleEndian.AppendUint16(idb, linkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0) // reserved
+	idb = binary.LittleEndian.AppendUint32(idb, snaplen)
+	idb = appendOption(idb, optionInterfaceName, "wg-hub")
+	idb = binary.LittleEndian.AppendUint32(idb, optionEndOfOpt)
+
+	if err := pw.write(append(block(blockTypeSectionHeader, shb), block(blockTypeInterface, idb)...)); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func (pw *Writer) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.Size += int64(n)
+	return err
+}
+
+// WritePacket writes the packet as enhanced packet block, packets longer than the snaplen are truncated.
+func (pw *Writer) WritePacket(t time.Time, packet []byte) error {
+	captured := packet
+	if uint32(len(captured)) > pw.snaplen {
+		captured = captured[:pw.snaplen]
+	}
+	ts := uint64(t.UnixNano() / int64(timestampResolution))
+	body := make([]byte, 0, 20+len(captured)+3)
+	body = binary.LittleEndian.AppendUint32(body, 0) // interface id
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(captured)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet)))
+	body = append(body, captured...)
+	body = append(body, make([]byte, padding(len(captured)))...)
+	b := block(blockTypeEnhancedPacket, body)
+	if pw.MaxSize > 0 && pw.Size+int64(len(b)) > pw.MaxSize {
+		return ErrMaxSize
+	}
+	return pw.write(b)
+}
@@ -1,15 +1,19 @@
 package config
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/christophwitzko/wg-hub/pkg/auth"
 	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/wgconn"
 	externalip "github.com/glendc/go-external-ip"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -94,7 +98,35 @@ func SetFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().Bool("webui", false, "start on <hubIP>:80 the webui and api")
 	cmd.PersistentFlags().String("webui-jwt-secret", "", "secret for JWT authentication")
 	cmd.PersistentFlags().String("webui-admin-password-hash", "", "bcrypt hash of the admin password")
+	cmd.PersistentFlags().Duration("webui-access-token-ttl", 15*time.Minute, "lifetime of webui and api access tokens")
+	cmd.PersistentFlags().Duration("webui-refresh-token-ttl", 7*24*time.Hour, "lifetime of webui sessions without refresh")
+	cmd.PersistentFlags().Int("webui-login-max-attempts", 5, "failed logins per source ip or username before a lockout")
+	cmd.PersistentFlags().Duration("webui-login-lockout", time.Minute, "duration of the first login lockout, doubled with every further failure")
+	cmd.PersistentFlags().Duration("webui-login-max-lockout", time.Hour, "maximum duration of a login lockout")
+	cmd.PersistentFlags().String("webui-users-file", "", "htpasswd-style file with webui users (username:bcryptHash[:role])")
 	cmd.PersistentFlags().String("external-address", "auto", "external address of the hub (used for configuration generation)")
+	cmd.PersistentFlags().String("stream-address", "", "address of the optional TCP/WebSocket listener for clients without UDP connectivity")
+	cmd.PersistentFlags().String("stream-protocol", "tcp", "protocol of the stream listener (tcp, websocket)")
+	cmd.PersistentFlags().StringSlice("allowed-source", nil, "CIDR ranges that are allowed to send packets to the hub (default allows all)")
+	cmd.PersistentFlags().Float64("source-rate-limit", 0, "maximum packets per second per source ip (0 disables the limit)")
+	cmd.PersistentFlags().Int("source-rate-burst", 100, "maximum packet burst per source ip")
+	cmd.PersistentFlags().String("state-dir", "", "directory to persist the hub state (kept in memory if empty)")
+	cmd.PersistentFlags().Duration("peer-watch-interval", 5*time.Second, "interval of the peer handshake and endpoint checks")
+	cmd.PersistentFlags().Duration("peer-offline-timeout", 3*time.Minute, "time since the last handshake after which a peer is considered offline")
+	cmd.PersistentFlags().Duration("peer-idle-timeout", 2*time.Minute, "time without traffic after which a connected peer is considered idle")
+	cmd.PersistentFlags().Bool("peer-stats-persist", false, "persist the traffic history of the peers in the state dir")
+	cmd.PersistentFlags().String("flow-log-file", "", "JSON-lines file of the flow records of the connections between the peers")
+	cmd.PersistentFlags().String("flow-ipfix-collector", "", "address (host:port) of an IPFIX collector that receives the flow records over UDP")
+	cmd.PersistentFlags().Duration("flow-idle-timeout", 15*time.Second, "time without packets after which a flow is exported")
+	cmd.PersistentFlags().Duration("flow-active-timeout", 5*time.Minute, "time after which a long-running flow is exported")
+	cmd.PersistentFlags().String("audit-log-file", "", "JSON-lines file of the audit log (defaults to audit.jsonl in the state dir, kept in memory if both are empty)")
+	cmd.PersistentFlags().String("enroll-address", "", "address (host:port) outside of the hub network that serves the enrollment endpoint for pre-auth keys")
+	cmd.PersistentFlags().String("enroll-tls-cert", "", "TLS certificate file of the enrollment endpoint")
+	cmd.PersistentFlags().String("enroll-tls-key", "", "TLS key file of the enrollment endpoint")
+	cmd.PersistentFlags().Bool("registrations", false, "accept registration requests of devices that need to be approved by an admin")
+	cmd.PersistentFlags().Duration("registration-ttl", 24*time.Hour, "time after which the results of decided registration requests are dropped")
+	cmd.PersistentFlags().Duration("registration-pending-ttl", time.Hour, "time after which pending registration requests are dropped")
+	cmd.PersistentFlags().Duration("shutdown-timeout", 10*time.Second, "time to wait for in-flight webui and api requests on shutdown")
 	cmd.PersistentFlags().SortFlags = true
 
 	Must(viper.BindPFlag("privateKey", cmd.PersistentFlags().Lookup("private-key")))
@@ -115,27 +147,144 @@ func SetFlags(cmd *cobra.Command) {
 	viper.MustBindEnv("webui-jwt-secret", "WEBUI_JWT_SECRET")
 	Must(viper.BindPFlag("webuiAdminPasswordHash", cmd.PersistentFlags().Lookup("webui-admin-password-hash")))
 	viper.MustBindEnv("webui-admin-password-hash", "WEBUI_ADMIN_PASSWORD_HASH")
+	Must(viper.BindPFlag("webuiAccessTokenTTL", cmd.PersistentFlags().Lookup("webui-access-token-ttl")))
+	viper.MustBindEnv("webuiAccessTokenTTL", "WEBUI_ACCESS_TOKEN_TTL")
+	Must(viper.BindPFlag("webuiRefreshTokenTTL", cmd.PersistentFlags().Lookup("webui-refresh-token-ttl")))
+	viper.MustBindEnv("webuiRefreshTokenTTL", "WEBUI_REFRESH_TOKEN_TTL")
+	Must(viper.BindPFlag("webuiLoginMaxAttempts", cmd.PersistentFlags().Lookup("webui-login-max-attempts")))
+	viper.MustBindEnv("webuiLoginMaxAttempts", "WEBUI_LOGIN_MAX_ATTEMPTS")
+	Must(viper.BindPFlag("webuiLoginLockout", cmd.PersistentFlags().Lookup("webui-login-lockout")))
+	viper.MustBindEnv("webuiLoginLockout", "WEBUI_LOGIN_LOCKOUT")
+	Must(viper.BindPFlag("webuiLoginMaxLockout", cmd.PersistentFlags().Lookup("webui-login-max-lockout")))
+	viper.MustBindEnv("webuiLoginMaxLockout", "WEBUI_LOGIN_MAX_LOCKOUT")
+	Must(viper.BindPFlag("webuiUsersFile", cmd.PersistentFlags().Lookup("webui-users-file")))
+	viper.MustBindEnv("webuiUsersFile", "WEBUI_USERS_FILE")
 	Must(viper.BindPFlag("externalAddress", cmd.PersistentFlags().Lookup("external-address")))
 	viper.MustBindEnv("externalAddress", "EXTERNAL_ADDRESS")
+	Must(viper.BindPFlag("streamAddress", cmd.PersistentFlags().Lookup("stream-address")))
+	viper.MustBindEnv("streamAddress", "STREAM_ADDRESS")
+	Must(viper.BindPFlag("streamProtocol", cmd.PersistentFlags().Lookup("stream-protocol")))
+	viper.MustBindEnv("streamProtocol", "STREAM_PROTOCOL")
+	Must(viper.BindPFlag("allowedSources", cmd.PersistentFlags().Lookup("allowed-source")))
+	viper.MustBindEnv("allowedSources", "ALLOWED_SOURCES")
+	Must(viper.BindPFlag("sourceRateLimit", cmd.PersistentFlags().Lookup("source-rate-limit")))
+	viper.MustBindEnv("sourceRateLimit", "SOURCE_RATE_LIMIT")
+	Must(viper.BindPFlag("sourceRateBurst", cmd.PersistentFlags().Lookup("source-rate-burst")))
+	viper.MustBindEnv("sourceRateBurst", "SOURCE_RATE_BURST")
+	Must(viper.BindPFlag("stateDir", cmd.PersistentFlags().Lookup("state-dir")))
+	viper.MustBindEnv("stateDir", "STATE_DIR")
+	Must(viper.BindPFlag("peerWatchInterval", cmd.PersistentFlags().Lookup("peer-watch-interval")))
+	viper.MustBindEnv("peerWatchInterval", "PEER_WATCH_INTERVAL")
+	Must(viper.BindPFlag("peerOfflineTimeout", cmd.PersistentFlags().Lookup("peer-offline-timeout")))
+	viper.MustBindEnv("peerOfflineTimeout", "PEER_OFFLINE_TIMEOUT")
+	Must(viper.BindPFlag("peerIdleTimeout", cmd.PersistentFlags().Lookup("peer-idle-timeout")))
+	viper.MustBindEnv("peerIdleTimeout", "PEER_IDLE_TIMEOUT")
+	Must(viper.BindPFlag("peerStatsPersist", cmd.PersistentFlags().Lookup("peer-stats-persist")))
+	viper.MustBindEnv("peerStatsPersist", "PEER_STATS_PERSIST")
+	Must(viper.BindPFlag("flowLogFile", cmd.PersistentFlags().Lookup("flow-log-file")))
+	viper.MustBindEnv("flowLogFile", "FLOW_LOG_FILE")
+	Must(viper.BindPFlag("flowIPFIXCollector", cmd.PersistentFlags().Lookup("flow-ipfix-collector")))
+	viper.MustBindEnv("flowIPFIXCollector", "FLOW_IPFIX_COLLECTOR")
+	Must(viper.BindPFlag("flowIdleTimeout", cmd.PersistentFlags().Lookup("flow-idle-timeout")))
+	viper.MustBindEnv("flowIdleTimeout", "FLOW_IDLE_TIMEOUT")
+	Must(viper.BindPFlag("flowActiveTimeout", cmd.PersistentFlags().Lookup("flow-active-timeout")))
+	viper.MustBindEnv("flowActiveTimeout", "FLOW_ACTIVE_TIMEOUT")
+	Must(viper.BindPFlag("auditLogFile", cmd.PersistentFlags().Lookup("audit-log-file")))
+	viper.MustBindEnv("auditLogFile", "AUDIT_LOG_FILE")
+	Must(viper.BindPFlag("enrollAddress", cmd.PersistentFlags().Lookup("enroll-address")))
+	viper.MustBindEnv("enrollAddress", "ENROLL_ADDRESS")
+	Must(viper.BindPFlag("enrollTLSCert", cmd.PersistentFlags().Lookup("enroll-tls-cert")))
+	viper.MustBindEnv("enrollTLSCert", "ENROLL_TLS_CERT")
+	Must(viper.BindPFlag("enrollTLSKey", cmd.PersistentFlags().Lookup("enroll-tls-key")))
+	viper.MustBindEnv("enrollTLSKey", "ENROLL_TLS_KEY")
+	Must(viper.BindPFlag("registrations", cmd.PersistentFlags().Lookup("registrations")))
+	viper.MustBindEnv("registrations", "REGISTRATIONS")
+	Must(viper.BindPFlag("registrationTTL", cmd.PersistentFlags().Lookup("registration-ttl")))
+	viper.MustBindEnv("registrationTTL", "REGISTRATION_TTL")
+	Must(viper.BindPFlag("registrationPendingTTL", cmd.PersistentFlags().Lookup("registration-pending-ttl")))
+	viper.MustBindEnv("registrationPendingTTL", "REGISTRATION_PENDING_TTL")
+	Must(viper.BindPFlag("shutdownTimeout", cmd.PersistentFlags().Lookup("shutdown-timeout")))
+	viper.MustBindEnv("shutdownTimeout", "SHUTDOWN_TIMEOUT")
 }
 
 type Config struct {
-	PrivateKeyHex          string      `yaml:"-"`
-	PrivateKey             wgtypes.Key `yaml:"-"`
-	Port                   uint16      `yaml:"port"`
-	BindAddress            string      `yaml:"bindAddress,omitempty"`
-	LogLevel               string      `yaml:"logLevel"`
-	HubAddress             string      `yaml:"hubAddress,omitempty"`
-	ExternalAddress        string      `yaml:"externalAddress,omitempty"`
-	DebugServer            bool        `yaml:"debugServer,omitempty"`
-	Webui                  bool        `yaml:"webui,omitempty"`
-	WebuiJWTSecret         string      `yaml:"webuiJWTSecret,omitempty"`
-	WebuiAdminPasswordHash string      `yaml:"webuiAdminPasswordHash,omitempty"`
-	Peers                  []*Peer     `yaml:"peers"`
-	cachedExternalAddress  string      `yaml:"-"`
+	PrivateKeyHex          string           `yaml:"-"`
+	PrivateKey             wgtypes.Key      `yaml:"-"`
+	Port                   uint16           `yaml:"port"`
+	BindAddress            string           `yaml:"bindAddress,omitempty"`
+	LogLevel               string           `yaml:"logLevel"`
+	HubAddress             string           `yaml:"hubAddress,omitempty"`
+	ExternalAddress        string           `yaml:"externalAddress,omitempty"`
+	DebugServer            bool             `yaml:"debugServer,omitempty"`
+	Webui                  bool             `yaml:"webui,omitempty"`
+	WebuiJWTSecret         string           `yaml:"webuiJWTSecret,omitempty"`
+	WebuiAdminPasswordHash string           `yaml:"webuiAdminPasswordHash,omitempty"`
+	WebuiAccessTokenTTL    time.Duration    `yaml:"webuiAccessTokenTTL,omitempty"`
+	WebuiRefreshTokenTTL   time.Duration    `yaml:"webuiRefreshTokenTTL,omitempty"`
+	WebuiLoginMaxAttempts  int              `yaml:"webuiLoginMaxAttempts,omitempty"`
+	WebuiLoginLockout      time.Duration    `yaml:"webuiLoginLockout,omitempty"`
+	WebuiLoginMaxLockout   time.Duration    `yaml:"webuiLoginMaxLockout,omitempty"`
+	WebuiUsers             []*auth.User     `yaml:"webuiUsers,omitempty"`
+	WebuiUsersFile         string           `yaml:"webuiUsersFile,omitempty"`
+	WebuiOIDC              *OIDCConfig      `yaml:"webuiOIDC,omitempty"`
+	StreamAddress          string           `yaml:"streamAddress,omitempty"`
+	StreamProtocol         string           `yaml:"streamProtocol,omitempty"`
+	AllowedSources         []string         `yaml:"allowedSources,omitempty"`
+	SourceRateLimit        float64          `yaml:"sourceRateLimit,omitempty"`
+	SourceRateBurst        int              `yaml:"sourceRateBurst,omitempty"`
+	StateDir               string           `yaml:"stateDir,omitempty"`
+	AuditLogFile           string           `yaml:"auditLogFile,omitempty"`
+	PeerWatchInterval      time.Duration    `yaml:"peerWatchInterval,omitempty"`
+	PeerOfflineTimeout     time.Duration    `yaml:"peerOfflineTimeout,omitempty"`
+	PeerIdleTimeout        time.Duration    `yaml:"peerIdleTimeout,omitempty"`
+	PeerStatsPersist       bool             `yaml:"peerStatsPersist,omitempty"`
+	FlowLogFile            string           `yaml:"flowLogFile,omitempty"`
+	FlowIPFIXCollector     string           `yaml:"flowIPFIXCollector,omitempty"`
+	FlowIdleTimeout        time.Duration    `yaml:"flowIdleTimeout,omitempty"`
+	FlowActiveTimeout      time.Duration    `yaml:"flowActiveTimeout,omitempty"`
+	Webhooks               []*WebhookConfig `yaml:"webhooks,omitempty"`
+	Shaping                *ShapingConfig   `yaml:"shaping,omitempty"`
+	Quotas                 []*PeerQuota     `yaml:"quotas,omitempty"`
+	Schedules              []*PeerSchedule  `yaml:"schedules,omitempty"`
+	EnrollAddress          string           `yaml:"enrollAddress,omitempty"`
+	EnrollTLSCert          string           `yaml:"enrollTLSCert,omitempty"`
+	EnrollTLSKey           string           `yaml:"enrollTLSKey,omitempty"`
+	Registrations          bool             `yaml:"registrations,omitempty"`
+	RegistrationTTL        time.Duration    `yaml:"registrationTTL,omitempty"`
+	RegistrationPendingTTL time.Duration    `yaml:"registrationPendingTTL,omitempty"`
+	ShutdownTimeout        time.Duration    `yaml:"shutdownTimeout,omitempty"`
+	Peers                  []*Peer          `yaml:"peers"`
+	cachedExternalAddress  string           `yaml:"-"`
 	eipConsensus           *externalip.Consensus
 }
 
+// NewConfig creates a config with the given private key and port for programmatic use,
+// all other options and the peers can be set on the returned config.
+func NewConfig(privateKey wgtypes.Key, port uint16) *Config {
+	return &Config{
+		PrivateKeyHex:          hex.EncodeToString(privateKey[:]),
+		PrivateKey:             privateKey,
+		Port:                   port,
+		LogLevel:               "info",
+		ExternalAddress:        "auto",
+		StreamProtocol:         wgconn.StreamProtocolTCP,
+		WebuiAccessTokenTTL:    15 * time.Minute,
+		WebuiRefreshTokenTTL:   7 * 24 * time.Hour,
+		WebuiLoginMaxAttempts:  5,
+		WebuiLoginLockout:      time.Minute,
+		WebuiLoginMaxLockout:   time.Hour,
+		ShutdownTimeout:        10 * time.Second,
+		PeerWatchInterval:      5 * time.Second,
+		PeerOfflineTimeout:     3 * time.Minute,
+		PeerIdleTimeout:        2 * time.Minute,
+		FlowIdleTimeout:        15 * time.Second,
+		FlowActiveTimeout:      5 * time.Minute,
+		RegistrationTTL:        24 * time.Hour,
+		RegistrationPendingTTL: time.Hour,
+		eipConsensus:           externalip.DefaultConsensus(&externalip.ConsensusConfig{Timeout: 3 * time.Second}, nil),
+	}
+}
+
 func (c *Config) GetPort() string {
 	return strconv.FormatUint(uint64(c.Port), 10)
 }
@@ -168,6 +317,63 @@ func (c *Config) GetExternalAddress() string {
 	return c.ExternalAddress
 }
 
+// LoadUsers returns the users of the webui and API. The admin password hash
+// adds the user admin, further users are read from the config and the users file.
+func (c *Config) LoadUsers() (*auth.Users, error) {
+	users := make([]*auth.User, 0, len(c.WebuiUsers)+1)
+	if c.WebuiAdminPasswordHash != "" {
+		users = append(users, &auth.User{
+			Username:     "admin",
+			PasswordHash: c.WebuiAdminPasswordHash,
+			Role:         auth.RoleAdmin,
+		})
+	}
+	for _, u := range c.WebuiUsers {
+		user := *u
+		users = append(users, &user)
+	}
+	if c.WebuiUsersFile != "" {
+		fileUsers, err := auth.LoadHtpasswdFile(c.WebuiUsersFile)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, fileUsers...)
+	}
+	return auth.NewUsers(users...)
+}
+
+type peerConfig struct {
+	PublicKey      string   `mapstructure:"publicKey"`
+	AllowedIP      string   `mapstructure:"allowedIP"`
+	AllowedIPs     string   `mapstructure:"allowedIPs"`
+	AllowedSources []string `mapstructure:"allowedSources"`
+	Enabled        *bool    `mapstructure:"enabled"`
+}
+
+// GetSourceFilterConfig returns the source filter config of the hub, the allowed
+// sources of the peers can be changed at runtime even if none are configured.
+func (c *Config) GetSourceFilterConfig() *wgconn.SourceFilterConfig {
+	filterCfg := &wgconn.SourceFilterConfig{
+		PrivateKey:     c.PrivateKey,
+		AllowedSources: mustParsePrefixes(c.AllowedSources),
+		PeerSources:    make(map[[32]byte][]netip.Prefix),
+		RateLimit:      c.SourceRateLimit,
+		RateBurst:      c.SourceRateBurst,
+	}
+	for _, peer := range c.Peers {
+		if len(peer.AllowedSources) == 0 {
+			continue
+		}
+		publicKey := MustGet(wgtypes.ParseKey(peer.PublicKey))
+		filterCfg.PeerSources[publicKey] = mustParsePrefixes(peer.AllowedSources)
+	}
+	// packets of the hub instance are sent from the bind address
+	if bindAddr, err := netip.ParseAddr(c.ResolvedBindAddr()); err == nil {
+		filterCfg.ExemptAddrs = append(filterCfg.ExemptAddrs, bindAddr)
+	}
+	return filterCfg
+}
+
 //gocyclo:ignore
 func ParseConfig(log *logrus.Logger, cmd *cobra.Command) (*Config, error) {
 	privateKey := viper.GetString("privateKey")
@@ -188,6 +394,15 @@ func ParseConfig(log *logrus.Logger, cmd *cobra.Command) (*Config, error) {
 	bindAddr := viper.GetString("bindAddress")
 	log.Infof("listening on %s:%d", bindAddr, port)
 
+	streamAddr := viper.GetString("streamAddress")
+	streamProtocol := viper.GetString("streamProtocol")
+	if streamAddr != "" {
+		if err := wgconn.ValidateStreamProtocol(streamProtocol); err != nil {
+			return nil, err
+		}
+		log.Infof("listening for %s streams on %s", streamProtocol, streamAddr)
+	}
+
 	inputPeers := MustGet(cmd.Flags().GetStringArray("peer"))
 	for _, s := range os.Environ() {
 		if !strings.HasPrefix(s, "PEER_") {
@@ -196,17 +411,21 @@ func ParseConfig(log *logrus.Logger, cmd *cobra.Command) (*Config, error) {
 		_, peer, _ := strings.Cut(s, "=")
 		inputPeers = append(inputPeers, peer)
 	}
-	var configPeers []map[string]string
+	var configPeers []peerConfig
 	err = viper.UnmarshalKey("peers", &configPeers)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse peers from config: %w", err)
 	}
+	peerSources := make([][]string, len(inputPeers), len(inputPeers)+len(configPeers))
+	peerEnabled := make([]*bool, len(inputPeers), len(inputPeers)+len(configPeers))
 	for _, peer := range configPeers {
-		allowedIP := peer["allowedip"]
+		allowedIP := peer.AllowedIP
 		if allowedIP == "" {
-			allowedIP = peer["allowedips"]
+			allowedIP = peer.AllowedIPs
 		}
-		inputPeers = append(inputPeers, fmt.Sprintf("%s,%s", peer["publickey"], allowedIP))
+		inputPeers = append(inputPeers, fmt.Sprintf("%s,%s", peer.PublicKey, allowedIP))
+		peerSources = append(peerSources, peer.AllowedSources)
+		peerEnabled = append(peerEnabled, peer.Enabled)
 	}
 	if len(inputPeers) == 0 {
 		return nil, fmt.Errorf("at least one peer is required")
@@ -217,9 +436,75 @@ func ParseConfig(log *logrus.Logger, cmd *cobra.Command) (*Config, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse peer %d: %w", i, err)
 		}
+		p.AllowedSources, err = NormalizePrefixes(peerSources[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse allowed sources of peer %d: %w", i, err)
+		}
+		p.Enabled = peerEnabled[i]
 		peers[i] = p
 	}
 
+	allowedSources, err := NormalizePrefixes(viper.GetStringSlice("allowedSources"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse allowed sources: %w", err)
+	}
+
+	var webuiOIDC *OIDCConfig
+	err = viper.UnmarshalKey("webuiOIDC", &webuiOIDC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse webui oidc config: %w", err)
+	}
+
+	var webhooks []*WebhookConfig
+	err = viper.UnmarshalKey("webhooks", &webhooks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse webhooks config: %w", err)
+	}
+	for _, webhook := range webhooks {
+		if err := webhook.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	var shaping *ShapingConfig
+	err = viper.UnmarshalKey("shaping", &shaping)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse shaping config: %w", err)
+	}
+	if shaping != nil {
+		if err := shaping.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	var quotas []*PeerQuota
+	err = viper.UnmarshalKey("quotas", &quotas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse quotas config: %w", err)
+	}
+	for _, quota := range quotas {
+		if err := quota.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	var schedules []*PeerSchedule
+	err = viper.UnmarshalKey("schedules", &schedules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schedules config: %w", err)
+	}
+	for _, schedule := range schedules {
+		if err := schedule.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	var webuiUsers []*auth.User
+	err = viper.UnmarshalKey("webuiUsers", &webuiUsers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse webui users from config: %w", err)
+	}
+
 	c := &Config{
 		PrivateKeyHex:          privateKeyHex,
 		PrivateKey:             wgPrivateKey,
@@ -232,10 +517,58 @@ func ParseConfig(log *logrus.Logger, cmd *cobra.Command) (*Config, error) {
 		Webui:                  viper.GetBool("webui"),
 		WebuiJWTSecret:         viper.GetString("webuiJWTSecret"),
 		WebuiAdminPasswordHash: viper.GetString("webuiAdminPasswordHash"),
+		WebuiAccessTokenTTL:    viper.GetDuration("webuiAccessTokenTTL"),
+		WebuiRefreshTokenTTL:   viper.GetDuration("webuiRefreshTokenTTL"),
+		WebuiLoginMaxAttempts:  viper.GetInt("webuiLoginMaxAttempts"),
+		WebuiLoginLockout:      viper.GetDuration("webuiLoginLockout"),
+		WebuiLoginMaxLockout:   viper.GetDuration("webuiLoginMaxLockout"),
+		WebuiUsers:             webuiUsers,
+		WebuiUsersFile:         viper.GetString("webuiUsersFile"),
+		WebuiOIDC:              webuiOIDC,
+		StreamAddress:          streamAddr,
+		StreamProtocol:         streamProtocol,
+		AllowedSources:         allowedSources,
+		SourceRateLimit:        viper.GetFloat64("sourceRateLimit"),
+		SourceRateBurst:        viper.GetInt("sourceRateBurst"),
+		StateDir:               viper.GetString("stateDir"),
+		AuditLogFile:           viper.GetString("auditLogFile"),
+		PeerWatchInterval:      viper.GetDuration("peerWatchInterval"),
+		PeerOfflineTimeout:     viper.GetDuration("peerOfflineTimeout"),
+		PeerIdleTimeout:        viper.GetDuration("peerIdleTimeout"),
+		PeerStatsPersist:       viper.GetBool("peerStatsPersist"),
+		FlowLogFile:            viper.GetString("flowLogFile"),
+		FlowIPFIXCollector:     viper.GetString("flowIPFIXCollector"),
+		FlowIdleTimeout:        viper.GetDuration("flowIdleTimeout"),
+		FlowActiveTimeout:      viper.GetDuration("flowActiveTimeout"),
+		Webhooks:               webhooks,
+		Shaping:                shaping,
+		Quotas:                 quotas,
+		Schedules:              schedules,
+		EnrollAddress:          viper.GetString("enrollAddress"),
+		EnrollTLSCert:          viper.GetString("enrollTLSCert"),
+		EnrollTLSKey:           viper.GetString("enrollTLSKey"),
+		Registrations:          viper.GetBool("registrations"),
+		RegistrationTTL:        viper.GetDuration("registrationTTL"),
+		RegistrationPendingTTL: viper.GetDuration("registrationPendingTTL"),
+		ShutdownTimeout:        viper.GetDuration("shutdownTimeout"),
 		Peers:                  peers,
 		eipConsensus:           externalip.DefaultConsensus(&externalip.ConsensusConfig{Timeout: 3 * time.Second}, nil),
 	}
 
+	if c.Webui {
+		users, err := c.LoadUsers()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load webui users: %w", err)
+		}
+		log.Infof("loaded %d webui users", users.Len())
+		if c.WebuiOIDC != nil {
+			if err := c.WebuiOIDC.Validate(c.HubAddress); err != nil {
+				return nil, fmt.Errorf("invalid webui oidc config: %w", err)
+			}
+			log.Infof("webui oidc login enabled (issuer: %s)", c.WebuiOIDC.Issuer)
+		}
+	}
+
 	for _, a := range peers {
 		hubOverlap, err := CheckIPOverlap(a.AllowedIP, c.GetHubAddress())
 		if err != nil {
@@ -258,5 +591,9 @@ func ParseConfig(log *logrus.Logger, cmd *cobra.Command) (*Config, error) {
 		}
 		log.Infof("adding %s", a)
 	}
+
+	if (c.EnrollTLSCert == "") != (c.EnrollTLSKey == "") {
+		return nil, fmt.Errorf("enroll-tls-cert and enroll-tls-key must be set together")
+	}
 	return c, nil
 }
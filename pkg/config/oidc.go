@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/christophwitzko/wg-hub/pkg/auth"
+)
+
+// OIDCConfig configures the OpenID Connect login of the webui.
+type OIDCConfig struct {
+	// Issuer is the issuer URL of the identity provider, the endpoints are discovered.
+	Issuer       string `yaml:"issuer" mapstructure:"issuer"`
+	ClientID     string `yaml:"clientID" mapstructure:"clientID"`
+	ClientSecret string `yaml:"clientSecret,omitempty" mapstructure:"clientSecret"`
+	// RedirectURL defaults to http://<hubAddress>/api/auth/oidc/callback.
+	RedirectURL   string   `yaml:"redirectURL,omitempty" mapstructure:"redirectURL"`
+	Scopes        []string `yaml:"scopes,omitempty" mapstructure:"scopes"`
+	UsernameClaim string   `yaml:"usernameClaim,omitempty" mapstructure:"usernameClaim"`
+	GroupsClaim   string   `yaml:"groupsClaim,omitempty" mapstructure:"groupsClaim"`
+	// AdminGroups, OperatorGroups and ViewerGroups map the groups of the users to roles,
+	// users without any of the groups can not log in.
+	AdminGroups    []string `yaml:"adminGroups,omitempty" mapstructure:"adminGroups"`
+	OperatorGroups []string `yaml:"operatorGroups,omitempty" mapstructure:"operatorGroups"`
+	ViewerGroups   []string `yaml:"viewerGroups,omitempty" mapstructure:"viewerGroups"`
+}
+
+// Validate checks the required options and sets the defaults of the optional ones.
+func (o *OIDCConfig) Validate(hubAddress string) error {
+	if o.Issuer == "" {
+		return fmt.Errorf("oidc issuer is required")
+	}
+	if o.ClientID == "" {
+		return fmt.Errorf("oidc client id is required")
+	}
+	if len(o.AdminGroups)+len(o.OperatorGroups)+len(o.ViewerGroups) == 0 {
+		return fmt.Errorf("at least one oidc group is required")
+	}
+	if o.RedirectURL == "" {
+		o.RedirectURL = fmt.Sprintf("http://%s/api/auth/oidc/callback", hubAddress)
+	}
+	if len(o.Scopes) == 0 {
+		o.Scopes = []string{"openid", "profile", "email", "groups"}
+	}
+	if !slices.Contains(o.Scopes, "openid") {
+		o.Scopes = append([]string{"openid"}, o.Scopes...)
+	}
+	if o.UsernameClaim == "" {
+		o.UsernameClaim = "preferred_username"
+	}
+	if o.GroupsClaim == "" {
+		o.GroupsClaim = "groups"
+	}
+	return nil
+}
+
+// RoleForGroups returns the highest role of the groups.
+func (o *OIDCConfig) RoleForGroups(groups []string) (auth.Role, bool) {
+	hasGroup := func(roleGroups []string) bool {
+		for _, g := range groups {
+			if slices.Contains(roleGroups, g) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case hasGroup(o.AdminGroups):
+		return auth.RoleAdmin, true
+	case hasGroup(o.OperatorGroups):
+		return auth.RoleOperator, true
+	case hasGroup(o.ViewerGroups):
+		return auth.RoleViewer, true
+	}
+	return "", false
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/binary"
 	"fmt"
 	"math/rand"
 	"net"
@@ -19,9 +20,12 @@ var (
 )
 
 type Peer struct {
-	PublicKey    string `yaml:"publicKey"`
-	PublicKeyHex string `yaml:"-"`
-	AllowedIP    string `yaml:"allowedIP"`
+	PublicKey      string   `yaml:"publicKey"`
+	PublicKeyHex   string   `yaml:"-"`
+	AllowedIP      string   `yaml:"allowedIP"`
+	AllowedSources []string `yaml:"allowedSources,omitempty"`
+	// Enabled disables the peer if false, the peer keeps its state if unset.
+	Enabled *bool `yaml:"enabled,omitempty"`
 }
 
 func NormalizeAllowedIP(ip string) (string, error) {
@@ -38,6 +42,39 @@ func NormalizeAllowedIP(ip string) (string, error) {
 	return ipPrefix.String(), nil
 }
 
+// NormalizePrefixes parses the given CIDR ranges, single IP addresses are converted to /32 or /128 ranges.
+func NormalizePrefixes(prefixes []string) ([]string, error) {
+	normalized := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return nil, err
+			}
+			normalized = append(normalized, netip.PrefixFrom(addr, addr.BitLen()).String())
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, prefix.Masked().String())
+	}
+	return normalized, nil
+}
+
+func mustParsePrefixes(prefixes []string) []netip.Prefix {
+	parsed := make([]netip.Prefix, len(prefixes))
+	for i, p := range prefixes {
+		parsed[i] = netip.MustParsePrefix(p)
+	}
+	return parsed
+}
+
 func equalBytes(a, b []byte) int {
 	cnt := 0
 	for i := 0; i < 4; i++ {
@@ -137,6 +174,39 @@ func GenerateRandomIP(ipRanges []string) (string, string, error) {
 	return generateRandomIP(globalRand, minNet, ipRanges)
 }
 
+// GenerateRandomIPInPool returns a random free ip of the pool (an ipv4 network of at most /30)
+// and the hub network including the ip. The network and broadcast address are not used.
+func GenerateRandomIPInPool(pool string, ipRanges []string) (string, string, error) {
+	prefix, err := netip.ParsePrefix(pool)
+	if err != nil || !prefix.Addr().Is4() || prefix.Bits() > 30 {
+		return "", "", fmt.Errorf("invalid address pool: %q", pool)
+	}
+	prefix = prefix.Masked()
+	hosts := uint32(1)<<(32-prefix.Bits()) - 2
+	network := binary.BigEndian.Uint32(prefix.Addr().AsSlice())
+	globalRandMutex.Lock()
+	start := uint32(globalRand.Int63n(int64(hosts)))
+	globalRandMutex.Unlock()
+	for i := uint32(0); i < hosts; i++ {
+		var addr [4]byte
+		binary.BigEndian.PutUint32(addr[:], network+1+(start+i)%hosts)
+		newIP := netip.PrefixFrom(netip.AddrFrom4(addr), 32).String()
+		overlapCheck := func(ip string) bool {
+			overlap, _ := CheckIPOverlap(ip, newIP)
+			return overlap
+		}
+		if slices.ContainsFunc(ipRanges, overlapCheck) {
+			continue
+		}
+		hubNetwork, err := FindMinimalNetwork(append(slices.Clone(ipRanges), newIP))
+		if err != nil {
+			return "", "", err
+		}
+		return newIP, hubNetwork, nil
+	}
+	return "", "", fmt.Errorf("no free ip in address pool %s", prefix)
+}
+
 func CheckIPOverlap(a, b string) (bool, error) {
 	aNet, err := netip.ParsePrefix(a)
 	if err != nil {
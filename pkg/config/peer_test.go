@@ -77,3 +77,35 @@ func TestGenerateRandomIPLoop(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "", randIP)
 }
+
+func TestNormalizePrefixes(t *testing.T) {
+	prefixes, err := NormalizePrefixes([]string{"10.1.2.3/8", "1.2.3.4", " 2001:db8::1 ", "", "2001:db8::1/32"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.0/8", "1.2.3.4/32", "2001:db8::1/128", "2001:db8::/32"}, prefixes)
+
+	_, err = NormalizePrefixes([]string{"10.0.0.0/33"})
+	require.Error(t, err)
+	_, err = NormalizePrefixes([]string{"invalid"})
+	require.Error(t, err)
+}
+
+func TestGenerateRandomIPInPool(t *testing.T) {
+	ipRanges := []string{"10.0.0.1/32", "10.0.1.17/32"}
+	seen := make(map[string]bool)
+	for i := 0; i < 13; i++ {
+		randIP, hubNetwork, err := GenerateRandomIPInPool("10.0.1.16/28", ipRanges)
+		require.NoError(t, err)
+		overlap, err := CheckIPOverlap("10.0.1.16/28", randIP)
+		require.NoError(t, err)
+		require.True(t, overlap, randIP)
+		require.NotContains(t, []string{"10.0.1.16/32", "10.0.1.31/32", "10.0.1.17/32"}, randIP)
+		require.Equal(t, "10.0.0.0/16", hubNetwork)
+		require.False(t, seen[randIP])
+		seen[randIP] = true
+		ipRanges = append(ipRanges, randIP)
+	}
+	_, _, err := GenerateRandomIPInPool("10.0.1.16/28", ipRanges)
+	require.Error(t, err)
+	_, _, err = GenerateRandomIPInPool("10.0.1.16/31", ipRanges)
+	require.Error(t, err)
+}
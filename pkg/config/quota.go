@@ -0,0 +1,57 @@
+package config
+
+import "fmt"
+
+type QuotaPeriod string
+
+const (
+	// QuotaMonthly quotas reset at the start of every calendar month.
+	QuotaMonthly QuotaPeriod = "monthly"
+	// QuotaOnce quotas are only reset manually.
+	QuotaOnce QuotaPeriod = "once"
+)
+
+const DefaultQuotaWarnAt = 0.8
+
+// PeerQuota limits the traffic (received and sent bytes) of a peer, the peer is suspended once the limit is reached.
+type PeerQuota struct {
+	PublicKey string `yaml:"publicKey" mapstructure:"publicKey" json:"publicKey"`
+	// Limit is the number of bytes (e.g. 50GB).
+	Limit  string      `yaml:"limit" mapstructure:"limit" json:"limit"`
+	Period QuotaPeriod `yaml:"period,omitempty" mapstructure:"period" json:"period"`
+	// WarnAt is the used fraction of the limit that triggers a warning (e.g. 0.8).
+	WarnAt float64 `yaml:"warnAt,omitempty" mapstructure:"warnAt" json:"warnAt"`
+
+	limit uint64
+}
+
+// Validate checks the public key and the limit and sets the defaults of the optional options.
+func (q *PeerQuota) Validate() error {
+	if err := validatePublicKey(q.PublicKey); err != nil {
+		return err
+	}
+	var err error
+	q.limit, err = ParseBytes(q.Limit)
+	if err != nil || q.limit == 0 {
+		return fmt.Errorf("invalid quota limit: %q", q.Limit)
+	}
+	switch q.Period {
+	case "":
+		q.Period = QuotaMonthly
+	case QuotaMonthly, QuotaOnce:
+	default:
+		return fmt.Errorf("invalid quota period: %q", q.Period)
+	}
+	if q.WarnAt == 0 {
+		q.WarnAt = DefaultQuotaWarnAt
+	}
+	if q.WarnAt < 0 || q.WarnAt > 1 {
+		return fmt.Errorf("quota warnAt must be between 0 and 1: %v", q.WarnAt)
+	}
+	return nil
+}
+
+// Bytes returns the limit in bytes, Validate must be called first.
+func (q *PeerQuota) Bytes() uint64 {
+	return q.limit
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseTimeOfDay parses HH:MM (00:00 to 24:00) and returns the minutes since midnight.
+func parseTimeOfDay(s string) (int, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(s, "%d:%d", &hours, &minutes); err != nil || len(s) != 5 {
+		return 0, fmt.Errorf("invalid time of day: %q", s)
+	}
+	if hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("invalid time of day: %q", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// AccessWindow is a recurring window in which a peer has access. A window with an end
+// before its start ends on the next day, the days are the days the window starts.
+type AccessWindow struct {
+	// Days are the weekdays (mon, tue, ...), every day if empty.
+	Days  []string `yaml:"days,omitempty" mapstructure:"days" json:"days,omitempty"`
+	Start string   `yaml:"start" mapstructure:"start" json:"start"`
+	End   string   `yaml:"end" mapstructure:"end" json:"end"`
+
+	days       []time.Weekday
+	start, end int
+}
+
+// Validate parses the days and the start and end time of the window.
+func (w *AccessWindow) Validate() error {
+	w.days = w.days[:0]
+	for _, day := range w.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("invalid access window day: %q", day)
+		}
+		w.days = append(w.days, weekday)
+	}
+	var err error
+	if w.start, err = parseTimeOfDay(w.Start); err != nil {
+		return err
+	}
+	if w.end, err = parseTimeOfDay(w.End); err != nil {
+		return err
+	}
+	if w.start == w.end {
+		return fmt.Errorf("access window start and end must differ: %s", w.Start)
+	}
+	return nil
+}
+
+func (w *AccessWindow) onDay(day time.Weekday) bool {
+	return len(w.days) == 0 || slices.Contains(w.days, day)
+}
+
+// contains reports whether the local time is within the window.
+func (w *AccessWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.onDay(t.Weekday()) && minute >= w.start && minute < w.end
+	}
+	previousDay := (t.Weekday() + 6) % 7
+	return (w.onDay(t.Weekday()) && minute >= w.start) || (w.onDay(previousDay) && minute < w.end)
+}
+
+// PeerSchedule limits the access of a peer to a point in time and/or recurring windows,
+// the peer is suspended once it expired and outside of its access windows.
+type PeerSchedule struct {
+	PublicKey string `yaml:"publicKey" mapstructure:"publicKey" json:"publicKey"`
+	// ExpiresAt is a RFC 3339 timestamp (e.g. 2024-02-09T18:00:00Z).
+	ExpiresAt string `yaml:"expiresAt,omitempty" mapstructure:"expiresAt" json:"expiresAt,omitempty"`
+	// Timezone is the IANA time zone of the access windows (default: local time).
+	Timezone string          `yaml:"timezone,omitempty" mapstructure:"timezone" json:"timezone,omitempty"`
+	Windows  []*AccessWindow `yaml:"windows,omitempty" mapstructure:"windows" json:"windows,omitempty"`
+
+	expiresAt time.Time
+	location  *time.Location
+}
+
+// Validate checks the public key, the expiry and the access windows.
+func (s *PeerSchedule) Validate() error {
+	if err := validatePublicKey(s.PublicKey); err != nil {
+		return err
+	}
+	if s.ExpiresAt == "" && len(s.Windows) == 0 {
+		return fmt.Errorf("schedule of peer %s requires expiresAt or access windows", s.PublicKey)
+	}
+	s.expiresAt = time.Time{}
+	if s.ExpiresAt != "" {
+		var err error
+		s.expiresAt, err = time.Parse(time.RFC3339, s.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("invalid expiresAt: %q", s.ExpiresAt)
+		}
+	}
+	s.location = time.Local
+	if s.Timezone != "" {
+		var err error
+		s.location, err = time.LoadLocation(s.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone: %q", s.Timezone)
+		}
+	}
+	for _, w := range s.Windows {
+		if err := w.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expired reports whether the access of the peer expired, Validate must be called first.
+func (s *PeerSchedule) Expired(t time.Time) bool {
+	return !s.expiresAt.IsZero() && !t.Before(s.expiresAt)
+}
+
+// InWindow reports whether the time is within an access window or no windows are configured.
+func (s *PeerSchedule) InWindow(t time.Time) bool {
+	if len(s.Windows) == 0 {
+		return true
+	}
+	local := t.In(s.location)
+	return slices.ContainsFunc(s.Windows, func(w *AccessWindow) bool { return w.contains(local) })
+}
+
+// Active reports whether the peer has access at the given time.
+func (s *PeerSchedule) Active(t time.Time) bool {
+	return !s.Expired(t) && s.InWindow(t)
+}
+
+// NextChange returns the next time the access of the peer changes, nil if it never changes.
+func (s *PeerSchedule) NextChange(t time.Time) *time.Time {
+	if s.Expired(t) {
+		return nil
+	}
+	var candidates []time.Time
+	if !s.expiresAt.IsZero() {
+		candidates = append(candidates, s.expiresAt)
+	}
+	local := t.In(s.location)
+	for day := 0; day <= 7; day++ {
+		for _, w := range s.Windows {
+			for _, minute := range []int{w.start, w.end} {
+				candidates = append(candidates, time.Date(local.Year(), local.Month(), local.Day()+day, 0, minute, 0, 0, s.location))
+			}
+		}
+	}
+	slices.SortFunc(candidates, func(a, b time.Time) int { return a.Compare(b) })
+	active := s.Active(t)
+	for _, c := range candidates {
+		if c.After(t) && s.Active(c) != active {
+			return &c
+		}
+	}
+	return nil
+}
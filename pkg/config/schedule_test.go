@@ -0,0 +1,64 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerSchedule(t *testing.T) {
+	s := &PeerSchedule{
+		PublicKey: "h1/wJ5KoQX1fQzQ25rlHb18wgAG80vkDLtn8B7pxOW0=",
+		ExpiresAt: "2024-02-16T12:00:00Z",
+		Timezone:  "UTC",
+		Windows: []*AccessWindow{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "18:00"},
+			{Days: []string{"Sat"}, Start: "22:00", End: "02:00"},
+		},
+	}
+	require.NoError(t, s.Validate())
+
+	// 2024-02-05 is a monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 2, day, hour, minute, 0, 0, time.UTC)
+	}
+	require.True(t, s.Active(at(5, 9, 0)))
+	require.True(t, s.Active(at(5, 17, 59)))
+	require.False(t, s.Active(at(5, 18, 0)))
+	require.False(t, s.Active(at(5, 8, 59)))
+	require.Equal(t, at(5, 18, 0), *s.NextChange(at(5, 12, 0)))
+	require.Equal(t, at(6, 9, 0), *s.NextChange(at(5, 18, 0)))
+
+	// the saturday window ends on sunday
+	require.False(t, s.Active(at(10, 12, 0)))
+	require.True(t, s.Active(at(10, 23, 0)))
+	require.True(t, s.Active(at(11, 1, 59)))
+	require.False(t, s.Active(at(11, 2, 0)))
+	require.Equal(t, at(10, 22, 0), *s.NextChange(at(9, 18, 0)))
+	require.Equal(t, at(11, 2, 0), *s.NextChange(at(10, 22, 0)))
+
+	// the access expires within the window
+	require.True(t, s.InWindow(at(16, 12, 0)))
+	require.False(t, s.Active(at(16, 12, 0)))
+	require.Equal(t, at(16, 12, 0), *s.NextChange(at(16, 9, 0)))
+	require.Nil(t, s.NextChange(at(16, 12, 0)))
+
+	// a peer that only expires
+	s = &PeerSchedule{PublicKey: s.PublicKey, ExpiresAt: "2024-02-07T00:00:00+01:00"}
+	require.NoError(t, s.Validate())
+	require.True(t, s.Active(at(6, 22, 59)))
+	require.False(t, s.Active(at(6, 23, 0)))
+
+	for _, invalid := range []*PeerSchedule{
+		{PublicKey: s.PublicKey},
+		{PublicKey: s.PublicKey, ExpiresAt: "tomorrow"},
+		{PublicKey: s.PublicKey, Timezone: "Mars/Olympus", Windows: []*AccessWindow{{Start: "09:00", End: "18:00"}}},
+		{PublicKey: s.PublicKey, Windows: []*AccessWindow{{Start: "9:00", End: "18:00"}}},
+		{PublicKey: s.PublicKey, Windows: []*AccessWindow{{Start: "09:00", End: "24:01"}}},
+		{PublicKey: s.PublicKey, Windows: []*AccessWindow{{Start: "09:00", End: "09:00"}}},
+		{PublicKey: s.PublicKey, Windows: []*AccessWindow{{Days: []string{"someday"}, Start: "09:00", End: "18:00"}}},
+	} {
+		require.Error(t, invalid.Validate())
+	}
+}
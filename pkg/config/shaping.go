@@ -0,0 +1,172 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DefaultInteractivePorts are the TCP/UDP ports of the interactive priority class (ssh, dns, rdp).
+var DefaultInteractivePorts = []uint16{22, 53, 3389}
+
+const (
+	DefaultShapingQueueLength = 512
+	// minBurst allows at least a few full-sized packets to pass at once.
+	minBurst = 16 << 10
+)
+
+var rateUnits = map[string]float64{
+	"":     1,
+	"b":    1,
+	"kb":   1e3,
+	"mb":   1e6,
+	"gb":   1e9,
+	"kib":  1 << 10,
+	"mib":  1 << 20,
+	"gib":  1 << 30,
+	"bit":  1.0 / 8,
+	"kbit": 1e3 / 8,
+	"mbit": 1e6 / 8,
+	"gbit": 1e9 / 8,
+}
+
+// ParseBytes parses a number of bytes with an optional unit (e.g. 64KiB, 10mbit or 1.5MB).
+func ParseBytes(s string) (uint64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := rateUnits[strings.TrimSpace(s[i:])]
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if !ok || err != nil || n < 0 || n*unit > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return uint64(n * unit), nil
+}
+
+// RateLimit is a token bucket of a traffic direction.
+type RateLimit struct {
+	// Rate is the sustained rate per second (e.g. 10mbit or 2MB).
+	Rate string `yaml:"rate" mapstructure:"rate" json:"rate"`
+	// Burst is the bucket size (e.g. 256KiB), defaults to 100ms of the rate.
+	Burst string `yaml:"burst,omitempty" mapstructure:"burst" json:"burst,omitempty"`
+
+	rate, burst uint64
+}
+
+// Validate parses the rate and the burst.
+func (l *RateLimit) Validate() error {
+	var err error
+	l.rate, err = ParseBytes(l.Rate)
+	if err != nil || l.rate == 0 {
+		return fmt.Errorf("invalid rate: %q", l.Rate)
+	}
+	l.burst = l.rate / 10
+	if l.Burst != "" {
+		l.burst, err = ParseBytes(l.Burst)
+		if err != nil {
+			return fmt.Errorf("invalid burst: %q", l.Burst)
+		}
+	}
+	l.burst = max(l.burst, minBurst)
+	return nil
+}
+
+// Bytes returns the rate in bytes per second and the burst in bytes, Validate must be called first.
+func (l *RateLimit) Bytes() (rate, burst uint64) {
+	return l.rate, l.burst
+}
+
+// ShapingPolicy limits the traffic a peer sends to the hub (ingress) and receives from the hub (egress).
+type ShapingPolicy struct {
+	Ingress *RateLimit `yaml:"ingress,omitempty" mapstructure:"ingress" json:"ingress,omitempty"`
+	Egress  *RateLimit `yaml:"egress,omitempty" mapstructure:"egress" json:"egress,omitempty"`
+}
+
+func (p *ShapingPolicy) validate() error {
+	for _, l := range []*RateLimit{p.Ingress, p.Egress} {
+		if l == nil {
+			continue
+		}
+		if err := l.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PeerShaping is the shaping policy of a single peer.
+type PeerShaping struct {
+	PublicKey     string `yaml:"publicKey" mapstructure:"publicKey" json:"publicKey"`
+	ShapingPolicy `yaml:",inline" mapstructure:",squash"`
+}
+
+// GroupShaping is a shaping policy that is shared by all peers of the group.
+type GroupShaping struct {
+	Name          string   `yaml:"name" mapstructure:"name" json:"name"`
+	Peers         []string `yaml:"peers" mapstructure:"peers" json:"peers"`
+	ShapingPolicy `yaml:",inline" mapstructure:",squash"`
+}
+
+// ShapingConfig configures the bandwidth limits of the loopback forwarding.
+type ShapingConfig struct {
+	Peers  []*PeerShaping  `yaml:"peers,omitempty" mapstructure:"peers" json:"peers"`
+	Groups []*GroupShaping `yaml:"groups,omitempty" mapstructure:"groups" json:"groups"`
+	// InteractivePorts are the TCP/UDP ports whose packets (and all ICMP packets) are forwarded first.
+	InteractivePorts []uint16 `yaml:"interactivePorts,omitempty" mapstructure:"interactivePorts" json:"interactivePorts"`
+	// QueueLength is the maximum number of queued packets between two peers, further packets are dropped.
+	QueueLength int `yaml:"queueLength,omitempty" mapstructure:"queueLength" json:"queueLength"`
+}
+
+func validatePublicKey(publicKey string) error {
+	if _, err := wgtypes.ParseKey(publicKey); err != nil {
+		return fmt.Errorf("invalid public key: %q", publicKey)
+	}
+	return nil
+}
+
+// Validate checks the public keys and the limits and sets the defaults of the optional options.
+func (c *ShapingConfig) Validate() error {
+	peers := make(map[string]bool, len(c.Peers))
+	for _, p := range c.Peers {
+		if err := validatePublicKey(p.PublicKey); err != nil {
+			return err
+		}
+		if peers[p.PublicKey] {
+			return fmt.Errorf("duplicate shaping policy for peer %q", p.PublicKey)
+		}
+		peers[p.PublicKey] = true
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("invalid shaping policy for peer %q: %w", p.PublicKey, err)
+		}
+	}
+	groups := make(map[string]bool, len(c.Groups))
+	for _, g := range c.Groups {
+		if g.Name == "" || groups[g.Name] {
+			return fmt.Errorf("shaping group names must be unique and not empty: %q", g.Name)
+		}
+		groups[g.Name] = true
+		for _, publicKey := range g.Peers {
+			if err := validatePublicKey(publicKey); err != nil {
+				return err
+			}
+		}
+		if err := g.validate(); err != nil {
+			return fmt.Errorf("invalid shaping policy for group %q: %w", g.Name, err)
+		}
+	}
+	if c.InteractivePorts == nil {
+		c.InteractivePorts = slices.Clone(DefaultInteractivePorts)
+	}
+	if c.QueueLength <= 0 {
+		c.QueueLength = DefaultShapingQueueLength
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBytes(t *testing.T) {
+	for s, expected := range map[string]uint64{
+		"1000":   1000,
+		"10mbit": 1250000,
+		"1.5MB":  1500000,
+		"64KiB":  65536,
+		"2 gbit": 250000000,
+	} {
+		n, err := ParseBytes(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, n, s)
+	}
+	for _, s := range []string{"", "fast", "10 mbits", "-1", "1e3"} {
+		_, err := ParseBytes(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestShapingConfig(t *testing.T) {
+	cfg := &ShapingConfig{
+		Peers: []*PeerShaping{{
+			PublicKey:     "h1/wJ5KoQX1fQzQ25rlHb18wgAG80vkDLtn8B7pxOW0=",
+			ShapingPolicy: ShapingPolicy{Ingress: &RateLimit{Rate: "100mbit"}, Egress: &RateLimit{Rate: "1mbit"}},
+		}},
+	}
+	require.NoError(t, cfg.Validate())
+	rate, burst := cfg.Peers[0].Ingress.Bytes()
+	require.Equal(t, uint64(12500000), rate)
+	require.Equal(t, uint64(1250000), burst)
+	// the burst is at least 16KiB
+	_, burst = cfg.Peers[0].Egress.Bytes()
+	require.Equal(t, uint64(16<<10), burst)
+	require.Equal(t, DefaultInteractivePorts, cfg.InteractivePorts)
+	require.Equal(t, DefaultShapingQueueLength, cfg.QueueLength)
+
+	for _, invalid := range []*ShapingConfig{
+		{Peers: []*PeerShaping{{PublicKey: "invalid"}}},
+		{Peers: []*PeerShaping{{PublicKey: cfg.Peers[0].PublicKey, ShapingPolicy: ShapingPolicy{Ingress: &RateLimit{Rate: "0"}}}}},
+		{Peers: []*PeerShaping{cfg.Peers[0], cfg.Peers[0]}},
+		{Groups: []*GroupShaping{{Name: ""}}},
+		{Groups: []*GroupShaping{{Name: "a"}, {Name: "a"}}},
+		{Groups: []*GroupShaping{{Name: "a", Peers: []string{"invalid"}}}},
+	} {
+		require.Error(t, invalid.Validate())
+	}
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// WebhookConfig configures an endpoint that receives the hub events.
+type WebhookConfig struct {
+	URL string `yaml:"url" mapstructure:"url"`
+	// Secret is the HMAC-SHA256 key of the payload signature, the payload is not signed if empty.
+	Secret string `yaml:"secret,omitempty" mapstructure:"secret"`
+	// Events filters the event types (e.g. peer.added or peer.*), all events except
+	// the frequent traffic.* events are sent if empty.
+	Events       []string      `yaml:"events,omitempty" mapstructure:"events"`
+	MaxAttempts  int           `yaml:"maxAttempts,omitempty" mapstructure:"maxAttempts"`
+	RetryBackoff time.Duration `yaml:"retryBackoff,omitempty" mapstructure:"retryBackoff"`
+	Timeout      time.Duration `yaml:"timeout,omitempty" mapstructure:"timeout"`
+}
+
+// Validate checks the URL and the event patterns and sets the defaults of the optional options.
+func (w *WebhookConfig) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url: %q", w.URL)
+	}
+	for _, pattern := range w.Events {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid webhook event pattern: %q", pattern)
+		}
+	}
+	if w.MaxAttempts <= 0 {
+		w.MaxAttempts = 5
+	}
+	if w.RetryBackoff <= 0 {
+		w.RetryBackoff = time.Second
+	}
+	if w.Timeout <= 0 {
+		w.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+// Matches reports whether the event type passes the event filter.
+func (w *WebhookConfig) Matches(eventType string) bool {
+	if len(w.Events) == 0 {
+		return !strings.HasPrefix(eventType, "traffic.")
+	}
+	for _, pattern := range w.Events {
+		if ok, _ := path.Match(pattern, eventType); ok {
+			return true
+		}
+	}
+	return false
+}
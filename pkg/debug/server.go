@@ -1,12 +1,12 @@
 package debug
 
 import (
-	"errors"
 	"io"
 	"net"
 	"net/http"
 	"strings"
 
+	"github.com/christophwitzko/wg-hub/pkg/httpserver"
 	"github.com/sirupsen/logrus"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun/netstack"
@@ -37,17 +37,10 @@ func debugHandler(log *logrus.Logger, dev *device.Device) http.Handler {
 	})
 }
 
-func StartServer(log *logrus.Logger, dev *device.Device, tunNet *netstack.Net) error {
+func StartServer(log *logrus.Logger, dev *device.Device, tunNet *netstack.Net) (*httpserver.Server, error) {
 	listener, err := tunNet.ListenTCP(&net.TCPAddr{Port: 8080})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	server := &http.Server{Handler: debugHandler(log, dev)}
-	go func() {
-		err := server.Serve(listener)
-		if !errors.Is(err, http.ErrServerClosed) {
-			log.Errorf("failed to start debug server: %v", err)
-		}
-	}()
-	return nil
+	return httpserver.Serve("debug server", listener, debugHandler(log, dev)), nil
 }
@@ -0,0 +1,127 @@
+package enroll
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// PrivateKeyPlaceholder replaces the private key in the client config of the hub,
+// the private key of the device never leaves the device.
+const PrivateKeyPlaceholder = "<private key>"
+
+// Request is the body of POST /api/enroll.
+type Request struct {
+	// Key is the pre-auth key.
+	Key       string `json:"key"`
+	PublicKey string `json:"publicKey"`
+}
+
+// Response contains the address of the enrolled device and its client config.
+type Response struct {
+	PublicKey    string `json:"publicKey"`
+	AllowedIP    string `json:"allowedIP"`
+	HubNetwork   string `json:"hubNetwork"`
+	HubPublicKey string `json:"hubPublicKey"`
+	Endpoint     string `json:"endpoint"`
+	Tag          string `json:"tag,omitempty"`
+	// Config is the wg-quick config of the device with PrivateKeyPlaceholder as private key.
+	Config string `json:"config"`
+}
+
+// ClientConfig returns the wg-quick config of the device.
+func (r *Response) ClientConfig(privateKey string) string {
+	return fmt.Sprintf(`[Interface]
+Address = %s
+PrivateKey = %s
+
+[Peer]
+PublicKey = %s
+AllowedIPs = %s
+Endpoint = %s
+PersistentKeepalive = 25
+`, r.AllowedIP, privateKey, r.HubPublicKey, r.HubNetwork, r.Endpoint)
+}
+
+// Enroll enrolls the device at the enrollment endpoint of the hub (e.g. https://hub.example.com:8443).
+func Enroll(ctx context.Context, enrollURL string, req *Request) (*Response, error) {
+	var res Response
+	if err := do(ctx, http.MethodPost, enrollURL, "/api/enroll", req, &res); err != nil {
+		return nil, fmt.Errorf("enrollment failed: %w", err)
+	}
+	return &res, nil
+}
+
+// RegistrationRequest is the body of POST /api/register.
+type RegistrationRequest struct {
+	PublicKey string `json:"publicKey"`
+	Hostname  string `json:"hostname"`
+	// Name is the requested name of the device.
+	Name string `json:"name"`
+}
+
+// RegistrationResult is the state of a registration, the response is only set once it was approved.
+type RegistrationResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	*Response
+}
+
+// Register submits a registration request that needs to be approved by an admin of the hub.
+func Register(ctx context.Context, enrollURL string, req *RegistrationRequest) (*RegistrationResult, error) {
+	var res RegistrationResult
+	if err := do(ctx, http.MethodPost, enrollURL, "/api/register", req, &res); err != nil {
+		return nil, fmt.Errorf("registration failed: %w", err)
+	}
+	return &res, nil
+}
+
+// Poll returns the current state of the registration.
+func Poll(ctx context.Context, enrollURL, id string) (*RegistrationResult, error) {
+	var res RegistrationResult
+	if err := do(ctx, http.MethodGet, enrollURL, "/api/register/"+url.PathEscape(id), nil, &res); err != nil {
+		return nil, fmt.Errorf("failed to poll registration: %w", err)
+	}
+	return &res, nil
+}
+
+func do(ctx context.Context, method, enrollURL, path string, body, res any) error {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+	u := strings.TrimSuffix(enrollURL, "/") + path
+	httpReq, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("status code %d: %s", resp.StatusCode, apiErr.Error)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Package events distributes hub events (peer changes, handshakes, failed logins) to subscribers.
+package events
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Type string
+
+const (
+	PeerAdded           Type = "peer.added"
+	PeerUpdated         Type = "peer.updated"
+	PeerRemoved         Type = "peer.removed"
+	PeerFirstHandshake  Type = "peer.first_handshake"
+	PeerHandshake       Type = "peer.handshake"
+	PeerOffline         Type = "peer.offline"
+	PeerEndpointChanged Type = "peer.endpoint_changed"
+	PeerSuspended       Type = "peer.suspended"
+	PeerResumed         Type = "peer.resumed"
+	PeerQuotaWarning    Type = "peer.quota_warning"
+	PeerQuotaExhausted  Type = "peer.quota_exhausted"
+	// PeerRegistration is published with the registration when a device submitted a registration request.
+	PeerRegistration Type = "peer.registration"
+	LoginFailed      Type = "auth.login_failed"
+	ConfigChanged    Type = "config.changed"
+	// TrafficRates is published with the traffic of all peers whenever a rate changed.
+	TrafficRates Type = "traffic.rates"
+)
+
+// Types contains all event types.
+var Types = []Type{
+	PeerAdded, PeerUpdated, PeerRemoved, PeerFirstHandshake, PeerHandshake, PeerOffline, PeerEndpointChanged,
+	PeerSuspended, PeerResumed, PeerQuotaWarning, PeerQuotaExhausted, PeerRegistration, LoginFailed, ConfigChanged,
+	TrafficRates,
+}
+
+// Event is a single hub event, Data is encoded as JSON.
+type Event struct {
+	ID   string    `json:"id"`
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data,omitempty"`
+}
+
+// PeerData is the data of the peer events.
+type PeerData struct {
+	PublicKey string `json:"publicKey"`
+	AllowedIP string `json:"allowedIP,omitempty"`
+	Endpoint  string `json:"endpoint,omitempty"`
+	// PreviousAllowedIP is only set for updates.
+	PreviousAllowedIP string `json:"previousAllowedIP,omitempty"`
+	// PreviousEndpoint is only set for endpoint changes.
+	PreviousEndpoint string `json:"previousEndpoint,omitempty"`
+	// LastHandshake is only set for handshake and offline events.
+	LastHandshake *time.Time `json:"lastHandshake,omitempty"`
+	// Reason is only set for suspend and resume events.
+	Reason string `json:"reason,omitempty"`
+}
+
+// QuotaData is the data of the quota events.
+type QuotaData struct {
+	PublicKey string `json:"publicKey"`
+	Limit     uint64 `json:"limit"`
+	Used      uint64 `json:"used"`
+}
+
+// PeerTraffic is the data of the traffic events, the rates are in bytes per second.
+type PeerTraffic struct {
+	PublicKey string  `json:"publicKey"`
+	RxBytes   uint64  `json:"rxBytes"`
+	TxBytes   uint64  `json:"txBytes"`
+	RxRate    float64 `json:"rxRate"`
+	TxRate    float64 `json:"txRate"`
+}
+
+// ConfigData is the data of the config events.
+type ConfigData struct {
+	Target string `json:"target"`
+}
+
+// LoginData is the data of the login events.
+type LoginData struct {
+	Username string `json:"username"`
+	RemoteIP string `json:"remoteIP"`
+	Reason   string `json:"reason"`
+}
+
+// Subscription receives the published events until it is closed.
+type Subscription struct {
+	bus     *Bus
+	ch      chan *Event
+	dropped atomic.Bool
+}
+
+// Events returns the channel of the subscription, it is closed by Close.
+func (s *Subscription) Events() <-chan *Event {
+	return s.ch
+}
+
+// Dropped reports whether events were dropped because of a full buffer since the last call.
+func (s *Subscription) Dropped() bool {
+	return s.dropped.Swap(false)
+}
+
+// Close removes the subscription from the bus.
+func (s *Subscription) Close() {
+	s.bus.unsubscribe(s)
+}
+
+// Bus publishes the events to all subscribers without blocking, events are
+// dropped for subscribers with a full buffer.
+type Bus struct {
+	// now is replaced in tests
+	now func() time.Time
+
+	mu     sync.Mutex
+	nextID uint64
+	subs   map[*Subscription]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		now:  time.Now,
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe creates a subscription with the given buffer size.
+func (b *Bus) Subscribe(buffer int) *Subscription {
+	s := &Subscription{bus: b, ch: make(chan *Event, buffer)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[s] = struct{}{}
+	return s
+}
+
+func (b *Bus) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+	delete(b.subs, s)
+	close(s.ch)
+}
+
+// Publish sends a new event with the given type and data to all subscribers.
+func (b *Bus) Publish(t Type, data any) *Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	e := &Event{
+		ID:   strconv.FormatUint(b.nextID, 10),
+		Type: t,
+		Time: b.now().UTC(),
+		Data: data,
+	}
+	for s := range b.subs {
+		select {
+		case s.ch <- e:
+		default:
+			s.dropped.Store(true)
+		}
+	}
+	return e
+}
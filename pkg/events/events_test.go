@@ -0,0 +1,33 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe(1)
+	other := bus.Subscribe(2)
+
+	first := bus.Publish(PeerAdded, &PeerData{PublicKey: "a"})
+	second := bus.Publish(PeerRemoved, &PeerData{PublicKey: "a"})
+	require.NotEqual(t, first.ID, second.ID)
+
+	// the second event is dropped for the subscriber with the full buffer
+	require.Equal(t, first, <-sub.Events())
+	require.Empty(t, sub.Events())
+	require.True(t, sub.Dropped())
+	require.False(t, sub.Dropped())
+	require.False(t, other.Dropped())
+	require.Equal(t, first, <-other.Events())
+	require.Equal(t, second, <-other.Events())
+
+	sub.Close()
+	sub.Close()
+	_, ok := <-sub.Events()
+	require.False(t, ok)
+	bus.Publish(PeerAdded, nil)
+	require.Len(t, other.Events(), 1)
+}
@@ -0,0 +1,202 @@
+package flows
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileExporter appends the records as JSON lines to a file.
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open flow log: %w", err)
+	}
+	return &FileExporter{file: f}, nil
+}
+
+func (e *FileExporter) Export(records []*Record) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	w := bufio.NewWriter(e.file)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
+
+const (
+	ipfixVersion = 10
+	// ipfixTemplateSetID is the set id of template sets.
+	ipfixTemplateSetID = 2
+	// IPFIXTemplateIPv4 and IPFIXTemplateIPv6 are the template ids of the data records.
+	IPFIXTemplateIPv4 = 256
+	IPFIXTemplateIPv6 = 257
+	// ipfixMaxMessageSize keeps the messages below the usual MTU.
+	ipfixMaxMessageSize = 1400
+	// ipfixTemplateRefresh is the interval of the template retransmission, the collector may restart.
+	ipfixTemplateRefresh = time.Minute
+)
+
+// ipfixField is an information element of the IANA IPFIX registry.
+type ipfixField struct {
+	id, length uint16
+}
+
+func ipfixFields(addrLen, srcAddrID, dstAddrID uint16) []ipfixField {
+	return []ipfixField{
+		{srcAddrID, addrLen},
+		{dstAddrID, addrLen},
+		{7, 2},   // sourceTransportPort
+		{11, 2},  // destinationTransportPort
+		{4, 1},   // protocolIdentifier
+		{6, 2},   // tcpControlBits
+		{1, 8},   // octetDeltaCount
+		{2, 8},   // packetDeltaCount
+		{152, 8}, // flowStartMilliseconds
+		{153, 8}, // flowEndMilliseconds
+	}
+}
+
+var ipfixTemplates = map[uint16][]ipfixField{
+	IPFIXTemplateIPv4: ipfixFields(4, 8, 12),   // sourceIPv4Address, destinationIPv4Address
+	IPFIXTemplateIPv6: ipfixFields(16, 27, 28), // sourceIPv6Address, destinationIPv6Address
+}
+
+func ipfixRecordSize(templateID uint16) int {
+	size := 0
+	for _, f := range ipfixTemplates[templateID] {
+		size += int(f.length)
+	}
+	return size
+}
+
+// IPFIXExporter sends the records as IPFIX (RFC 7011) messages over UDP to a collector.
+type IPFIXExporter struct {
+	conn          net.Conn
+	domainID      uint32
+	mu            sync.Mutex
+	sequence      uint32
+	lastTemplates time.Time
+}
+
+// NewIPFIXExporter creates an exporter for the collector address (host:port).
+func NewIPFIXExporter(collector string, domainID uint32) (*IPFIXExporter, error) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ipfix collector: %w", err)
+	}
+	return &IPFIXExporter{conn: conn, domainID: domainID}, nil
+}
+
+func appendTemplateSet(b []byte) []byte {
+	start := len(b)
+	b = binary.BigEndian.AppendUint16(b, ipfixTemplateSetID)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	for _, id := range []uint16{IPFIXTemplateIPv4, IPFIXTemplateIPv6} {
+		b = binary.BigEndian.AppendUint16(b, id)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(ipfixTemplates[id])))
+		for _, f := range ipfixTemplates[id] {
+			b = binary.BigEndian.AppendUint16(b, f.id)
+			b = binary.BigEndian.AppendUint16(b, f.length)
+		}
+	}
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b
+}
+
+func appendRecord(b []byte, r *Record) []byte {
+	b = append(b, r.key.Src.AsSlice()...)
+	b = append(b, r.key.Dst.AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, r.SrcPort)
+	b = binary.BigEndian.AppendUint16(b, r.DstPort)
+	b = append(b, r.Protocol)
+	b = binary.BigEndian.AppendUint16(b, uint16(r.TCPFlags))
+	b = binary.BigEndian.AppendUint64(b, r.Bytes)
+	b = binary.BigEndian.AppendUint64(b, r.Packets)
+	b = binary.BigEndian.AppendUint64(b, uint64(r.Start.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.End.UnixMilli()))
+	return b
+}
+
+// send sends a message with the data sets of the records, the templates are included if needed.
+func (e *IPFIXExporter) send(templateID uint16, records []*Record) error {
+	now := time.Now()
+	b := make([]byte, 16, ipfixMaxMessageSize)
+	if now.Sub(e.lastTemplates) >= ipfixTemplateRefresh {
+		b = appendTemplateSet(b)
+		e.lastTemplates = now
+	}
+	if len(records) > 0 {
+		start := len(b)
+		b = binary.BigEndian.AppendUint16(b, templateID)
+		b = binary.BigEndian.AppendUint16(b, 0)
+		for _, r := range records {
+			b = appendRecord(b, r)
+		}
+		binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	}
+	binary.BigEndian.PutUint16(b[0:], ipfixVersion)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint32(b[4:], uint32(now.Unix()))
+	// the sequence number counts the data records sent before this message
+	binary.BigEndian.PutUint32(b[8:], e.sequence)
+	binary.BigEndian.PutUint32(b[12:], e.domainID)
+	e.sequence += uint32(len(records))
+	_, err := e.conn.Write(b)
+	return err
+}
+
+// Export sends the records grouped by the address family in messages that fit the MTU.
+func (e *IPFIXExporter) Export(records []*Record) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	byTemplate := map[uint16][]*Record{}
+	for _, r := range records {
+		templateID := uint16(IPFIXTemplateIPv4)
+		if r.key.Src.Is6() {
+			templateID = IPFIXTemplateIPv6
+		}
+		byTemplate[templateID] = append(byTemplate[templateID], r)
+	}
+	// the template set may be part of the first message
+	templateSetSize := 4
+	for _, id := range []uint16{IPFIXTemplateIPv4, IPFIXTemplateIPv6} {
+		templateSetSize += 4 + 4*len(ipfixTemplates[id])
+	}
+	for _, id := range []uint16{IPFIXTemplateIPv4, IPFIXTemplateIPv6} {
+		pending := byTemplate[id]
+		perMessage := (ipfixMaxMessageSize - 16 - templateSetSize - 4) / ipfixRecordSize(id)
+		for len(pending) > 0 {
+			n := min(perMessage, len(pending))
+			if err := e.send(id, pending[:n]); err != nil {
+				return err
+			}
+			pending = pending[n:]
+		}
+	}
+	return nil
+}
+
+func (e *IPFIXExporter) Close() error {
+	return e.conn.Close()
+}
@@ -0,0 +1,240 @@
+// Package flows tracks the connections between the peers and exports them as flow records.
+package flows
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	protocolICMP   = 1
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+
+	tcpFIN = 0x01
+	tcpRST = 0x04
+)
+
+// Key is the 5-tuple of a unidirectional flow, for ICMP the destination port contains the type and code.
+type Key struct {
+	Src      netip.Addr
+	Dst      netip.Addr
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol uint8
+}
+
+// Record is an exported flow.
+type Record struct {
+	Src      string    `json:"src"`
+	Dst      string    `json:"dst"`
+	SrcPort  uint16    `json:"srcPort"`
+	DstPort  uint16    `json:"dstPort"`
+	Protocol uint8     `json:"protocol"`
+	Bytes    uint64    `json:"bytes"`
+	Packets  uint64    `json:"packets"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	// TCPFlags is the union of the TCP flags of all packets of the flow.
+	TCPFlags uint8 `json:"tcpFlags,omitempty"`
+
+	key Key
+}
+
+// Exporter exports the flow records, e.g. to a file or an IPFIX collector.
+type Exporter interface {
+	Export(records []*Record) error
+	Close() error
+}
+
+type Config struct {
+	// IdleTimeout is the time without packets after which a flow is exported.
+	IdleTimeout time.Duration
+	// ActiveTimeout is the time after which a long-running flow is exported and counted from zero again.
+	ActiveTimeout time.Duration
+	// MaxFlows limits the tracked flows, packets of new flows are not tracked if the limit is reached.
+	MaxFlows int
+}
+
+type flow struct {
+	record *Record
+	// finished is set if a FIN or RST was seen
+	finished bool
+}
+
+// Tracker builds flow records from the observed packets and exports them once they
+// ended (idle, FIN or RST) or exceeded the active timeout.
+type Tracker struct {
+	// now is replaced in tests
+	now       func() time.Time
+	log       *logrus.Logger
+	cfg       Config
+	exporters []Exporter
+
+	mu      sync.Mutex
+	flows   map[Key]*flow
+	dropped uint64
+}
+
+func NewTracker(log *logrus.Logger, cfg *Config, exporters ...Exporter) *Tracker {
+	t := &Tracker{
+		now:       time.Now,
+		log:       log,
+		cfg:       *cfg,
+		exporters: exporters,
+		flows:     make(map[Key]*flow),
+	}
+	if t.cfg.IdleTimeout <= 0 {
+		t.cfg.IdleTimeout = 15 * time.Second
+	}
+	if t.cfg.ActiveTimeout <= 0 {
+		t.cfg.ActiveTimeout = 5 * time.Minute
+	}
+	if t.cfg.MaxFlows <= 0 {
+		t.cfg.MaxFlows = 65536
+	}
+	return t
+}
+
+// ParsePacket returns the flow key, the TCP flags and whether the packet is an IPv4 or IPv6 packet.
+func ParsePacket(packet []byte) (key Key, tcpFlags uint8, ok bool) {
+	if len(packet) == 0 {
+		return key, 0, false
+	}
+	var l4 []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return key, 0, false
+		}
+		headerLen := int(packet[0]&0x0f) * 4
+		key.Src = netip.AddrFrom4([4]byte(packet[12:16]))
+		key.Dst = netip.AddrFrom4([4]byte(packet[16:20]))
+		key.Protocol = packet[9]
+		// only the first fragment contains the transport header
+		if fragmentOffset := binary.BigEndian.Uint16(packet[6:8]) & 0x1fff; fragmentOffset == 0 && headerLen <= len(packet) {
+			l4 = packet[headerLen:]
+		}
+	case 6:
+		if len(packet) < 40 {
+			return key, 0, false
+		}
+		key.Src = netip.AddrFrom16([16]byte(packet[8:24]))
+		key.Dst = netip.AddrFrom16([16]byte(packet[24:40]))
+		// extension headers are not followed
+		key.Protocol = packet[6]
+		l4 = packet[40:]
+	default:
+		return key, 0, false
+	}
+	switch key.Protocol {
+	case protocolTCP, protocolUDP:
+		if len(l4) >= 4 {
+			key.SrcPort = binary.BigEndian.Uint16(l4[0:2])
+			key.DstPort = binary.BigEndian.Uint16(l4[2:4])
+		}
+		if key.Protocol == protocolTCP && len(l4) >= 14 {
+			tcpFlags = l4[13]
+		}
+	case protocolICMP, protocolICMPv6:
+		if len(l4) >= 2 {
+			key.DstPort = uint16(l4[0])<<8 | uint16(l4[1])
+		}
+	}
+	return key, tcpFlags, true
+}
+
+// Observe adds the packet to its flow.
+func (t *Tracker) Observe(packet []byte) {
+	key, tcpFlags, ok := ParsePacket(packet)
+	if !ok {
+		return
+	}
+	now := t.now().UTC()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.flows[key]
+	if !ok {
+		if len(t.flows) >= t.cfg.MaxFlows {
+			t.dropped++
+			return
+		}
+		f = &flow{record: &Record{
+			Src:      key.Src.String(),
+			Dst:      key.Dst.String(),
+			SrcPort:  key.SrcPort,
+			DstPort:  key.DstPort,
+			Protocol: key.Protocol,
+			Start:    now,
+			key:      key,
+		}}
+		t.flows[key] = f
+	}
+	f.record.Bytes += uint64(len(packet))
+	f.record.Packets++
+	f.record.End = now
+	f.record.TCPFlags |= tcpFlags
+	if tcpFlags&(tcpFIN|tcpRST) != 0 {
+		f.finished = true
+	}
+}
+
+// expire removes the ended flows or all flows if all is set and returns their records.
+func (t *Tracker) expire(all bool) []*Record {
+	now := t.now().UTC()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var records []*Record
+	for key, f := range t.flows {
+		idle := now.Sub(f.record.End) >= t.cfg.IdleTimeout
+		active := now.Sub(f.record.Start) >= t.cfg.ActiveTimeout
+		if !all && !idle && !f.finished && !active {
+			continue
+		}
+		records = append(records, f.record)
+		delete(t.flows, key)
+	}
+	if t.dropped > 0 {
+		t.log.Warnf("flow table is full, %d packets were not tracked", t.dropped)
+		t.dropped = 0
+	}
+	return records
+}
+
+func (t *Tracker) export(records []*Record) {
+	if len(records) == 0 {
+		return
+	}
+	for _, e := range t.exporters {
+		if err := e.Export(records); err != nil {
+			t.log.Errorf("failed to export %d flow records: %v", len(records), err)
+		}
+	}
+}
+
+// Run exports the ended flows every second until the context is done, then all
+// remaining flows are exported and the exporters are closed.
+func (t *Tracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			t.export(t.expire(true))
+			for _, e := range t.exporters {
+				if err := e.Close(); err != nil {
+					t.log.Errorf("failed to close flow exporter: %v", err)
+				}
+			}
+			return
+		case <-ticker.C:
+			t.export(t.expire(false))
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package flows
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func tcpPacket(src, dst string, srcPort, dstPort uint16, flags uint8, size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = 0x45
+	packet[9] = protocolTCP
+	copy(packet[12:16], netip.MustParseAddr(src).AsSlice())
+	copy(packet[16:20], netip.MustParseAddr(dst).AsSlice())
+	binary.BigEndian.PutUint16(packet[20:], srcPort)
+	binary.BigEndian.PutUint16(packet[22:], dstPort)
+	packet[33] = flags
+	return packet
+}
+
+func udp6Packet(src, dst string, srcPort, dstPort uint16, size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = 0x60
+	packet[6] = protocolUDP
+	copy(packet[8:24], netip.MustParseAddr(src).AsSlice())
+	copy(packet[24:40], netip.MustParseAddr(dst).AsSlice())
+	binary.BigEndian.PutUint16(packet[40:], srcPort)
+	binary.BigEndian.PutUint16(packet[42:], dstPort)
+	return packet
+}
+
+type memoryExporter struct {
+	records []*Record
+	closed  bool
+}
+
+func (e *memoryExporter) Export(records []*Record) error {
+	e.records = append(e.records, records...)
+	return nil
+}
+
+func (e *memoryExporter) Close() error {
+	e.closed = true
+	return nil
+}
+
+func newTestTracker(now *time.Time, exporters ...Exporter) *Tracker {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	t := NewTracker(log, &Config{IdleTimeout: 10 * time.Second, ActiveTimeout: time.Minute, MaxFlows: 3}, exporters...)
+	t.now = func() time.Time { return *now }
+	return t
+}
+
+func TestTracker(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	tracker := newTestTracker(&now)
+
+	tracker.Observe(tcpPacket("10.0.0.1", "10.0.0.2", 40000, 80, 0x02, 60))
+	now = now.Add(time.Second)
+	tracker.Observe(tcpPacket("10.0.0.1", "10.0.0.2", 40000, 80, 0x10, 100))
+	tracker.Observe(tcpPacket("10.0.0.2", "10.0.0.1", 80, 40000, 0x12, 60))
+	tracker.Observe(udp6Packet("fd00::1", "fd00::2", 5353, 53, 80))
+	// the flow table is full
+	tracker.Observe(tcpPacket("10.0.0.3", "10.0.0.2", 40000, 80, 0x02, 60))
+	tracker.Observe([]byte{0x45})
+	require.Empty(t, tracker.expire(false))
+
+	// FIN ends the flow
+	tracker.Observe(tcpPacket("10.0.0.1", "10.0.0.2", 40000, 80, 0x11, 40))
+	records := tracker.expire(false)
+	require.Len(t, records, 1)
+	r := records[0]
+	require.Equal(t, "10.0.0.1", r.Src)
+	require.Equal(t, "10.0.0.2", r.Dst)
+	require.Equal(t, uint16(40000), r.SrcPort)
+	require.Equal(t, uint16(80), r.DstPort)
+	require.Equal(t, uint8(protocolTCP), r.Protocol)
+	require.Equal(t, uint64(200), r.Bytes)
+	require.Equal(t, uint64(3), r.Packets)
+	require.Equal(t, uint8(0x13), r.TCPFlags)
+	require.Equal(t, now.Add(-time.Second).UTC(), r.Start)
+	require.Equal(t, now.UTC(), r.End)
+
+	// idle flows end after the idle timeout
+	now = now.Add(5 * time.Second)
+	tracker.Observe(udp6Packet("fd00::1", "fd00::2", 5353, 53, 80))
+	now = now.Add(6 * time.Second)
+	records = tracker.expire(false)
+	require.Len(t, records, 1)
+	require.Equal(t, "10.0.0.2", records[0].Src)
+
+	// long-running flows are exported after the active timeout
+	for i := 0; i < 60; i++ {
+		now = now.Add(time.Second)
+		tracker.Observe(udp6Packet("fd00::1", "fd00::2", 5353, 53, 80))
+	}
+	records = tracker.expire(false)
+	require.Len(t, records, 1)
+	require.Equal(t, "fd00::1", records[0].Src)
+	require.Equal(t, uint64(62), records[0].Packets)
+}
+
+func TestTrackerRun(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	exporter := &memoryExporter{}
+	tracker := newTestTracker(&now, exporter)
+	tracker.Observe(tcpPacket("10.0.0.1", "10.0.0.2", 40000, 80, 0x02, 60))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tracker.Run(ctx)
+	require.Len(t, exporter.records, 1)
+	require.True(t, exporter.closed)
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.jsonl")
+	exporter, err := NewFileExporter(path)
+	require.NoError(t, err)
+	now := time.Unix(1_700_000_000, 0)
+	tracker := newTestTracker(&now, exporter)
+	tracker.Observe(tcpPacket("10.0.0.1", "10.0.0.2", 40000, 80, 0x02, 60))
+	tracker.Observe(udp6Packet("fd00::1", "fd00::2", 5353, 53, 80))
+	tracker.export(tracker.expire(true))
+	require.NoError(t, exporter.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var records []*Record
+	for scanner.Scan() {
+		var r Record
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, &r)
+	}
+	require.Len(t, records, 2)
+	require.ElementsMatch(t, []string{"10.0.0.1", "fd00::1"}, []string{records[0].Src, records[1].Src})
+}
+
+// ipfixSet is a set of a received IPFIX message.
+type ipfixSet struct {
+	id   uint16
+	data []byte
+}
+
+func readIPFIX(t *testing.T, collector net.PacketConn) (uint32, []ipfixSet) {
+	require.NoError(t, collector.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 65535)
+	n, _, err := collector.ReadFrom(buf)
+	require.NoError(t, err)
+	msg := buf[:n]
+	require.Equal(t, uint16(ipfixVersion), binary.BigEndian.Uint16(msg[0:]))
+	require.Equal(t, uint16(n), binary.BigEndian.Uint16(msg[2:]))
+	require.LessOrEqual(t, n, ipfixMaxMessageSize)
+	sequence := binary.BigEndian.Uint32(msg[8:])
+	var sets []ipfixSet
+	for rest := msg[16:]; len(rest) > 0; {
+		length := binary.BigEndian.Uint16(rest[2:])
+		sets = append(sets, ipfixSet{id: binary.BigEndian.Uint16(rest), data: rest[4:length]})
+		rest = rest[length:]
+	}
+	return sequence, sets
+}
+
+func TestIPFIXExporter(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer collector.Close()
+	exporter, err := NewIPFIXExporter(collector.LocalAddr().String(), 42)
+	require.NoError(t, err)
+	defer exporter.Close()
+
+	now := time.Unix(1_700_000_000, 0)
+	tracker := newTestTracker(&now, exporter)
+	tracker.cfg.MaxFlows = 100
+	tracker.Observe(tcpPacket("10.0.0.1", "10.0.0.2", 40000, 80, 0x12, 60))
+	tracker.Observe(tcpPacket("10.0.0.1", "10.0.0.2", 40000, 80, 0x10, 40))
+	tracker.export(tracker.expire(true))
+
+	sequence, sets := readIPFIX(t, collector)
+	require.Zero(t, sequence)
+	require.Len(t, sets, 2)
+	require.Equal(t, uint16(ipfixTemplateSetID), sets[0].id)
+	require.Equal(t, uint16(IPFIXTemplateIPv4), binary.BigEndian.Uint16(sets[0].data))
+	require.Equal(t, uint16(IPFIXTemplateIPv4), sets[1].id)
+	record := sets[1].data
+	require.Len(t, record, ipfixRecordSize(IPFIXTemplateIPv4))
+	require.Equal(t, []byte{10, 0, 0, 1, 10, 0, 0, 2}, record[0:8])
+	require.Equal(t, uint16(40000), binary.BigEndian.Uint16(record[8:]))
+	require.Equal(t, uint16(80), binary.BigEndian.Uint16(record[10:]))
+	require.Equal(t, uint8(protocolTCP), record[12])
+	require.Equal(t, uint16(0x12), binary.BigEndian.Uint16(record[13:]))
+	require.Equal(t, uint64(100), binary.BigEndian.Uint64(record[15:]))
+	require.Equal(t, uint64(2), binary.BigEndian.Uint64(record[23:]))
+	require.Equal(t, uint64(now.UnixMilli()), binary.BigEndian.Uint64(record[31:]))
+
+	// many records are split into multiple messages without templates
+	for i := 0; i < 50; i++ {
+		tracker.Observe(udp6Packet("fd00::1", "fd00::2", uint16(10000+i), 53, 80))
+	}
+	tracker.export(tracker.expire(true))
+	received := 0
+	for received < 50 {
+		sequence, sets = readIPFIX(t, collector)
+		require.Equal(t, uint32(1+received), sequence)
+		require.Len(t, sets, 1)
+		require.Equal(t, uint16(IPFIXTemplateIPv6), sets[0].id)
+		received += len(sets[0].data) / ipfixRecordSize(IPFIXTemplateIPv6)
+	}
+	require.Equal(t, 50, received)
+}
@@ -0,0 +1,63 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Server is a running http server that can be shut down gracefully.
+type Server struct {
+	name   string
+	server *http.Server
+	errCh  chan error
+	done   chan struct{}
+}
+
+// Serve starts serving the handler on the listener in the background.
+func Serve(name string, listener net.Listener, handler http.Handler) *Server {
+	s := &Server{
+		name:   name,
+		server: &http.Server{Handler: handler},
+		errCh:  make(chan error, 1),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		err := s.server.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			s.errCh <- err
+		}
+		close(s.errCh)
+	}()
+	return s
+}
+
+// RegisterOnShutdown registers a function that is called when the shutdown
+// starts, e.g. to end long-lived requests.
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.server.RegisterOnShutdown(f)
+}
+
+func (s *Server) Name() string {
+	return s.name
+}
+
+// Err returns a channel that receives the error if the server stops serving
+// unexpectedly, the channel is closed once the server stopped.
+func (s *Server) Err() <-chan error {
+	return s.errCh
+}
+
+// Shutdown stops accepting new connections and waits until all active
+// requests are finished or the context is done. If the context is done before,
+// all remaining connections are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.server.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		_ = s.server.Close()
+	}
+	<-s.done
+	return err
+}
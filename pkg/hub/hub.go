@@ -46,7 +46,7 @@ func createWgDevice(log *logrus.Logger, cfg *config.Config, pkey wgtypes.Key) (f
 	if err != nil {
 		return nil, nil, err
 	}
-	dev := device.NewDevice(tunDev, wgconn.NewStdNetBind(cfg.BindAddress), &device.Logger{
+	dev := device.NewDevice(tunDev, wgconn.NewStdNetBind(cfg.BindAddress, nil), &device.Logger{
 		Errorf:   log.Errorf,
 		Verbosef: device.DiscardLogf,
 	})
@@ -0,0 +1,418 @@
+// Package hubtest starts an in-process hub with simulated WireGuard® peers
+// for end-to-end tests.
+package hubtest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/wgconn"
+	"github.com/christophwitzko/wg-hub/pkg/wghub"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// HubAddress is the address of the hub instance inside the hub network.
+	HubAddress = "10.0.0.254"
+	// AdminPassword is the password of the admin user of the API.
+	AdminPassword = "admin"
+	// ConnectTimeout is the time to wait for the handshakes of the peers.
+	ConnectTimeout = 10 * time.Second
+)
+
+// PeerAddress returns the address of the i-th peer (starting at 0) inside the hub network.
+func PeerAddress(i int) netip.Addr {
+	return netip.AddrFrom4([4]byte{10, 0, 0, byte(i + 1)})
+}
+
+// Hub is a running hub that listens on a random loopback port.
+type Hub struct {
+	t      testing.TB
+	log    *logrus.Logger
+	Config *config.Config
+	Server *wghub.Server
+	// Peers are the simulated peers that are part of the hub config.
+	Peers []*Peer
+
+	mu       sync.Mutex
+	allPeers []*Peer
+}
+
+// Peer is a simulated WireGuard® client with its own netstack.
+type Peer struct {
+	PrivateKey wgtypes.Key
+	Address    netip.Addr
+	Net        *netstack.Net
+	dev        *device.Device
+
+	mu      sync.Mutex
+	closers []io.Closer
+}
+
+func freeUDPPort(t testing.TB) uint16 {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer c.Close()
+	return uint16(c.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func generateKey(t testing.TB) wgtypes.Key {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	return key
+}
+
+// New starts a hub with the webui/API enabled and n connected peers. The
+// configure functions can modify the hub config before the hub is started.
+// The hub and all peers are closed when the test finishes.
+func New(t testing.TB, n int, configure ...func(cfg *config.Config)) *Hub {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(AdminPassword), bcrypt.MinCost)
+	require.NoError(t, err)
+	cfg := config.NewConfig(generateKey(t), freeUDPPort(t))
+	cfg.BindAddress = "127.0.0.1"
+	cfg.ExternalAddress = "127.0.0.1"
+	cfg.HubAddress = HubAddress
+	cfg.Webui = true
+	cfg.WebuiJWTSecret = "hubtest"
+	cfg.WebuiAdminPasswordHash = string(passwordHash)
+	cfg.ShutdownTimeout = time.Second
+
+	peerKeys := make([]wgtypes.Key, n)
+	for i := range peerKeys {
+		peerKeys[i] = generateKey(t)
+		peer, err := config.NewPeer(fmt.Sprintf("%s,%s", peerKeys[i].PublicKey(), PeerAddress(i)))
+		require.NoError(t, err)
+		cfg.Peers = append(cfg.Peers, peer)
+	}
+	for _, fn := range configure {
+		fn(cfg)
+	}
+
+	srv, err := wghub.New(wghub.WithConfig(cfg), wghub.WithLogger(log))
+	require.NoError(t, err)
+	require.NoError(t, srv.Start(context.Background()))
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	h := &Hub{
+		t:      t,
+		log:    log,
+		Config: cfg,
+		Server: srv,
+	}
+	t.Cleanup(h.closePeers)
+	for i, key := range peerKeys {
+		h.Peers = append(h.Peers, h.NewPeer(key, PeerAddress(i)))
+	}
+	for _, p := range h.Peers {
+		h.WaitConnected(p)
+	}
+	return h
+}
+
+// NewPeer starts a simulated peer that connects to the hub. The peer is not
+// added to the hub, this needs to be done via the config or the API.
+func (h *Hub) NewPeer(privateKey wgtypes.Key, address netip.Addr) *Peer {
+	tunDev, tunNet, err := netstack.CreateNetTUN([]netip.Addr{address}, nil, device.DefaultMTU)
+	require.NoError(h.t, err)
+	dev := device.NewDevice(tunDev, wgconn.NewStdNetBind("127.0.0.1", nil), &device.Logger{
+		Verbosef: device.DiscardLogf,
+		Errorf:   h.log.Errorf,
+	})
+
+	wgConf := &bytes.Buffer{}
+	wgConf.WriteString("private_key=" + hex.EncodeToString(privateKey[:]) + "\n")
+	wgConf.WriteString("public_key=" + config.MustGet(ipc.Base64ToHex(h.Config.PrivateKey.PublicKey().String())) + "\n")
+	wgConf.WriteString("endpoint=127.0.0.1:" + h.Config.GetPort() + "\n")
+	wgConf.WriteString("allowed_ip=" + netip.PrefixFrom(address, 24).Masked().String() + "\n")
+	// the keepalive triggers the handshake, so the hub knows the endpoint of the peer
+	wgConf.WriteString("persistent_keepalive_interval=1\n")
+	p := &Peer{
+		PrivateKey: privateKey,
+		Address:    address,
+		Net:        tunNet,
+		dev:        dev,
+	}
+	h.mu.Lock()
+	h.allPeers = append(h.allPeers, p)
+	h.mu.Unlock()
+	require.NoError(h.t, dev.IpcSetOperation(wgConf))
+	require.NoError(h.t, dev.Up())
+	return p
+}
+
+// closePeers closes the connections of all peers before their devices are closed,
+// because the netstack panics if a connection sends a packet after the device was closed.
+func (h *Hub) closePeers() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, p := range h.allPeers {
+		p.closeConns()
+	}
+	for _, p := range h.allPeers {
+		p.dev.Close()
+	}
+	h.allPeers = nil
+}
+
+func (p *Peer) track(c io.Closer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closers = append(p.closers, c)
+}
+
+func (p *Peer) closeConns() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := len(p.closers) - 1; i >= 0; i-- {
+		_ = p.closers[i].Close()
+	}
+	p.closers = nil
+}
+
+// trackingListener tracks the accepted connections, so they are closed with the peer.
+type trackingListener struct {
+	net.Listener
+	peer *Peer
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.peer.track(c)
+	return c, nil
+}
+
+func (p *Peer) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	c, err := p.Net.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	p.track(c)
+	return c, nil
+}
+
+// WaitConnected waits until the hub completed a handshake with the peer.
+func (h *Hub) WaitConnected(p *Peer) {
+	publicKey := p.PrivateKey.PublicKey().String()
+	require.Eventually(h.t, func() bool {
+		hubPeers, err := h.Server.Peers()
+		if err != nil {
+			return false
+		}
+		for _, hubPeer := range hubPeers {
+			if hubPeer.PublicKey == publicKey {
+				return hubPeer.LastHandshake != 0
+			}
+		}
+		return false
+	}, ConnectTimeout, 10*time.Millisecond, "peer %s did not connect", p.Address)
+}
+
+// ListenTCP listens on the given TCP port of the peer. The listener and all
+// accepted connections are closed when the test finishes.
+func (p *Peer) ListenTCP(port uint16) (net.Listener, error) {
+	listener, err := p.Net.ListenTCPAddrPort(netip.AddrPortFrom(p.Address, port))
+	if err != nil {
+		return nil, err
+	}
+	p.track(listener)
+	return &trackingListener{Listener: listener, peer: p}, nil
+}
+
+// DialTCP connects to the given TCP port of the other peer.
+func (p *Peer) DialTCP(ctx context.Context, to *Peer, port uint16) (net.Conn, error) {
+	return p.dialContext(ctx, "tcp", netip.AddrPortFrom(to.Address, port).String())
+}
+
+// ListenUDP listens on the given UDP port of the peer.
+func (p *Peer) ListenUDP(port uint16) (net.PacketConn, error) {
+	c, err := p.Net.ListenUDPAddrPort(netip.AddrPortFrom(p.Address, port))
+	if err != nil {
+		return nil, err
+	}
+	p.track(c)
+	return c, nil
+}
+
+// DialUDP creates a UDP connection to the given port of the other peer.
+func (p *Peer) DialUDP(to *Peer, port uint16) (net.Conn, error) {
+	return p.dialContext(context.Background(), "udp", netip.AddrPortFrom(to.Address, port).String())
+}
+
+// APIClient calls the hub API from inside the hub network.
+type APIClient struct {
+	t      testing.TB
+	client *http.Client
+	token  string
+}
+
+// Client returns an unauthenticated client that calls the API through the netstack of the peer.
+func (h *Hub) Client(p *Peer) *APIClient {
+	return &APIClient{
+		t: h.t,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:       p.dialContext,
+				DisableKeepAlives: true,
+			},
+			Timeout: ConnectTimeout,
+		},
+	}
+}
+
+// API returns a client that calls the API through the netstack of the peer as admin.
+func (h *Hub) API(p *Peer) *APIClient {
+	c := h.Client(p)
+	require.Equal(h.t, http.StatusOK, c.Login("admin", AdminPassword))
+	return c
+}
+
+// SetToken sets the bearer token (JWT or API token) of the client.
+func (c *APIClient) SetToken(token string) {
+	c.token = token
+}
+
+// Login authenticates the client with the given credentials and returns the status code.
+func (c *APIClient) Login(username, password string) int {
+	var res struct {
+		Token string `json:"token"`
+	}
+	status := c.Do(http.MethodPost, "/auth", map[string]string{
+		"username": username,
+		"password": password,
+	}, &res)
+	c.token = res.Token
+	return status
+}
+
+// Do sends a request with the JSON encoded body (if not nil) to the given API path and decodes
+// the response into res (if not nil), a *string receives the raw body. The status code of the
+// response is returned.
+func (c *APIClient) Do(method, path string, body, res any) int {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		require.NoError(c.t, err)
+		reqBody = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, "http://"+HubAddress+"/api"+path, reqBody)
+	require.NoError(c.t, err)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	require.NoError(c.t, err)
+	defer resp.Body.Close()
+	switch res := res.(type) {
+	case nil:
+	case *string:
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(c.t, err)
+		*res = string(raw)
+	default:
+		require.NoError(c.t, json.NewDecoder(resp.Body).Decode(res))
+	}
+	return resp.StatusCode
+}
+
+// EventStream reads the Server-Sent Events of GET /api/events.
+type EventStream struct {
+	t         testing.TB
+	body      io.ReadCloser
+	events    chan *events.Event
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Events opens the event stream with the given types filter (all events if empty).
+// The stream is closed when the test finishes.
+func (c *APIClient) Events(types string) *EventStream {
+	req, err := http.NewRequest(http.MethodGet, "http://"+HubAddress+"/api/events?types="+url.QueryEscape(types), nil)
+	require.NoError(c.t, err)
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	// the timeout of the client would end the stream
+	resp, err := (&http.Client{Transport: c.client.Transport}).Do(req)
+	require.NoError(c.t, err)
+	require.Equal(c.t, http.StatusOK, resp.StatusCode)
+	s := &EventStream{t: c.t, body: resp.Body, events: make(chan *events.Event, 256), done: make(chan struct{})}
+	go func() {
+		defer close(s.events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var e events.Event
+			if json.Unmarshal([]byte(data), &e) != nil {
+				continue
+			}
+			select {
+			case s.events <- &e:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	c.t.Cleanup(s.Close)
+	return s
+}
+
+// Next returns the next event or fails the test if no event is received within the connect timeout.
+// The stream is closed if nil is returned.
+func (s *EventStream) Next() *events.Event {
+	select {
+	case e := <-s.events:
+		return e
+	case <-time.After(ConnectTimeout):
+		require.FailNow(s.t, "no event received")
+		return nil
+	}
+}
+
+// Wait returns the next event of the given type, other events are skipped.
+func (s *EventStream) Wait(t events.Type) *events.Event {
+	for {
+		e := s.Next()
+		require.NotNil(s.t, e, "stream closed while waiting for %s", t)
+		if e.Type == t {
+			return e
+		}
+	}
+}
+
+// Close closes the stream.
+func (s *EventStream) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		_ = s.body.Close()
+	})
+}
@@ -0,0 +1,1164 @@
+package hubtest
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/api"
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/auth"
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/enroll"
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/christophwitzko/wg-hub/pkg/flows"
+	"github.com/christophwitzko/wg-hub/pkg/loopback"
+	"github.com/christophwitzko/wg-hub/pkg/peers"
+	"github.com/christophwitzko/wg-hub/pkg/shaping"
+	"github.com/christophwitzko/wg-hub/pkg/webhook"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func echoTCP(t *testing.T, listener net.Listener) {
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+}
+
+func requireTCPEcho(t *testing.T, from, to *Peer, port uint16) {
+	ctx, cancel := context.WithTimeout(context.Background(), ConnectTimeout)
+	defer cancel()
+	c, err := from.DialTCP(ctx, to, port)
+	require.NoError(t, err)
+	defer c.Close()
+	msg := []byte("hello from " + from.Address.String())
+	_, err = c.Write(msg)
+	require.NoError(t, err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, msg, buf)
+}
+
+func TestForwarding(t *testing.T) {
+	h := New(t, 3)
+	a, b, c := h.Peers[0], h.Peers[1], h.Peers[2]
+
+	listener, err := b.ListenTCP(8000)
+	require.NoError(t, err)
+	echoTCP(t, listener)
+	requireTCPEcho(t, a, b, 8000)
+	requireTCPEcho(t, c, b, 8000)
+
+	pc, err := c.ListenUDP(9000)
+	require.NoError(t, err)
+	defer pc.Close()
+	uc, err := a.DialUDP(c, 9000)
+	require.NoError(t, err)
+	defer uc.Close()
+	_, err = uc.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, pc.SetReadDeadline(time.Now().Add(ConnectTimeout)))
+	buf := make([]byte, 16)
+	n, from, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf[:n]))
+	require.Equal(t, a.Address.String(), from.(*net.UDPAddr).IP.String())
+}
+
+func TestAPIPeers(t *testing.T) {
+	h := New(t, 1)
+	a := h.Peers[0]
+
+	status := h.Client(a).Do(http.MethodGet, "/peers", nil, nil)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	client := h.API(a)
+	var peers api.AnnotatedPeers
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers", nil, &peers))
+	require.Len(t, peers, 2)
+
+	var generated api.GeneratePeerResponse
+	status = client.Do(http.MethodPost, "/peers", api.GeneratePeerRequest{AllowedIP: "10.0.0.50"}, &generated)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "10.0.0.50/32", generated.AllowedIP)
+	require.Equal(t, "10.0.0.0/24", generated.HubNetwork)
+
+	// the generated peer can reach the existing peer
+	privateKey, err := wgtypes.ParseKey(generated.PrivateKey)
+	require.NoError(t, err)
+	newPeer := h.NewPeer(privateKey, netip.MustParseAddr("10.0.0.50"))
+	h.WaitConnected(newPeer)
+	listener, err := a.ListenTCP(8000)
+	require.NoError(t, err)
+	echoTCP(t, listener)
+	requireTCPEcho(t, newPeer, a, 8000)
+
+	require.Equal(t, http.StatusOK, client.Do(http.MethodDelete, "/peers/"+generated.PublicKey, nil, nil))
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers", nil, &peers))
+	require.Len(t, peers, 2)
+
+	// the removed peer can no longer reach the existing peer
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = newPeer.DialTCP(ctx, a, 8000)
+	require.Error(t, err)
+}
+
+func TestAPIOverlapRejection(t *testing.T) {
+	h := New(t, 2)
+	client := h.API(h.Peers[0])
+
+	publicKey := generateKey(t).PublicKey().String()
+	for _, allowedIP := range []string{
+		h.Peers[1].Address.String(),
+		HubAddress,
+		"10.0.0.0/24",
+		"invalid",
+	} {
+		var res map[string]string
+		status := client.Do(http.MethodPut, "/peers/"+publicKey, api.AddPeerRequest{AllowedIP: allowedIP}, &res)
+		require.Equal(t, http.StatusBadRequest, status, allowedIP)
+		require.NotEmpty(t, res["error"])
+	}
+	status := client.Do(http.MethodPut, "/peers/invalid", api.AddPeerRequest{AllowedIP: "10.0.0.60"}, nil)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	var peers api.AnnotatedPeers
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers", nil, &peers))
+	require.Len(t, peers, 3)
+}
+
+func TestAPIRoles(t *testing.T) {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	h := New(t, 1, func(cfg *config.Config) {
+		cfg.WebuiUsers = []*auth.User{
+			{Username: "viewer", PasswordHash: string(passwordHash), Role: auth.RoleViewer},
+			{Username: "operator", PasswordHash: string(passwordHash), Role: auth.RoleOperator},
+		}
+	})
+	a := h.Peers[0]
+
+	require.Equal(t, http.StatusBadRequest, h.Client(a).Login("viewer", "wrong"))
+	viewer := h.Client(a)
+	require.Equal(t, http.StatusOK, viewer.Login("viewer", "secret"))
+	operator := h.Client(a)
+	require.Equal(t, http.StatusOK, operator.Login("operator", "secret"))
+	admin := h.API(a)
+
+	var claims map[string]any
+	require.Equal(t, http.StatusOK, viewer.Do(http.MethodGet, "/auth", nil, &claims))
+	require.Equal(t, "viewer", claims["username"])
+	require.Equal(t, "viewer", claims["role"])
+
+	for i, tc := range []struct {
+		client   *APIClient
+		role     auth.Role
+		operator int
+		admin    int
+	}{
+		{viewer, auth.RoleViewer, http.StatusForbidden, http.StatusForbidden},
+		{operator, auth.RoleOperator, http.StatusOK, http.StatusForbidden},
+		{admin, auth.RoleAdmin, http.StatusOK, http.StatusOK},
+	} {
+		require.Equal(t, http.StatusOK, tc.client.Do(http.MethodGet, "/peers", nil, nil), tc.role)
+		require.Equal(t, http.StatusOK, tc.client.Do(http.MethodGet, "/hub", nil, nil), tc.role)
+		publicKey := generateKey(t).PublicKey().String()
+		peer := api.AddPeerRequest{AllowedIP: PeerAddress(100 + i).String()}
+		require.Equal(t, tc.operator, tc.client.Do(http.MethodPut, "/peers/"+publicKey, peer, nil), tc.role)
+		require.Equal(t, tc.operator, tc.client.Do(http.MethodDelete, "/peers/"+publicKey, nil, nil), tc.role)
+		require.Equal(t, tc.admin, tc.client.Do(http.MethodGet, "/config", nil, nil), tc.role)
+		require.Equal(t, tc.admin, tc.client.Do(http.MethodGet, "/users", nil, nil), tc.role)
+	}
+
+	var users []map[string]string
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodGet, "/users", nil, &users))
+	require.Equal(t, []map[string]string{
+		{"username": "admin", "role": "admin"},
+		{"username": "operator", "role": "operator"},
+		{"username": "viewer", "role": "viewer"},
+	}, users)
+}
+
+func TestAPITokens(t *testing.T) {
+	h := New(t, 1)
+	a := h.Peers[0]
+	admin := h.API(a)
+
+	var created api.CreateTokenResponse
+	status := admin.Do(http.MethodPost, "/tokens", api.CreateTokenRequest{
+		Name:   "provisioning",
+		Scopes: []auth.Scope{auth.ScopePeersRead, auth.ScopePeersWrite},
+	}, &created)
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, auth.IsAPIToken(created.Token))
+	require.Equal(t, "admin", created.CreatedBy)
+	status = admin.Do(http.MethodPost, "/tokens", api.CreateTokenRequest{Name: "invalid", Scopes: []auth.Scope{"root"}}, nil)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	client := h.Client(a)
+	client.SetToken(created.Token)
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers", nil, nil))
+	var tokenInfo auth.APIToken
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/auth", nil, &tokenInfo))
+	require.Equal(t, created.ID, tokenInfo.ID)
+	publicKey := generateKey(t).PublicKey().String()
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPut, "/peers/"+publicKey, api.AddPeerRequest{AllowedIP: "10.0.0.80"}, nil))
+	require.Equal(t, http.StatusForbidden, client.Do(http.MethodGet, "/hub", nil, nil))
+	require.Equal(t, http.StatusForbidden, client.Do(http.MethodGet, "/config", nil, nil))
+	// api tokens can not manage api tokens
+	require.Equal(t, http.StatusForbidden, client.Do(http.MethodGet, "/tokens", nil, nil))
+
+	var tokens []*auth.APIToken
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodGet, "/tokens", nil, &tokens))
+	require.Len(t, tokens, 1)
+	require.NotNil(t, tokens[0].LastUsedAt)
+
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodDelete, "/tokens/"+created.ID, nil, nil))
+	require.Equal(t, http.StatusNotFound, admin.Do(http.MethodDelete, "/tokens/"+created.ID, nil, nil))
+	require.Equal(t, http.StatusUnauthorized, client.Do(http.MethodGet, "/peers", nil, nil))
+}
+
+func TestAPISessions(t *testing.T) {
+	h := New(t, 1)
+	a := h.Peers[0]
+
+	var pair auth.TokenPair
+	status := h.Client(a).Do(http.MethodPost, "/auth", api.AuthRequest{Username: "admin", Password: AdminPassword}, &pair)
+	require.Equal(t, http.StatusOK, status)
+	require.NotEmpty(t, pair.RefreshToken)
+	require.WithinDuration(t, time.Now().Add(15*time.Minute), pair.ExpiresAt, time.Minute)
+
+	var refreshed auth.TokenPair
+	status = h.Client(a).Do(http.MethodPost, "/auth/refresh", api.RefreshAuthRequest{RefreshToken: pair.RefreshToken}, &refreshed)
+	require.Equal(t, http.StatusOK, status)
+	client := h.Client(a)
+	client.SetToken(refreshed.AccessToken)
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers", nil, nil))
+
+	// logout revokes the access and the refresh token
+	require.Equal(t, http.StatusOK, client.Do(http.MethodDelete, "/auth", nil, nil))
+	require.Equal(t, http.StatusUnauthorized, client.Do(http.MethodGet, "/peers", nil, nil))
+	status = h.Client(a).Do(http.MethodPost, "/auth/refresh", api.RefreshAuthRequest{RefreshToken: refreshed.RefreshToken}, nil)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	// tokens signed with the previous key stay valid after a rotation
+	admin := h.API(a)
+	other := h.API(a)
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodPost, "/auth/keys/rotate", nil, nil))
+	require.Equal(t, http.StatusOK, other.Do(http.MethodGet, "/peers", nil, nil))
+
+	var sessions []*auth.Session
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodGet, "/auth/sessions", nil, &sessions))
+	require.Len(t, sessions, 2)
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodDelete, "/auth/sessions", nil, nil))
+	require.Equal(t, http.StatusUnauthorized, other.Do(http.MethodGet, "/peers", nil, nil))
+	require.Equal(t, http.StatusUnauthorized, admin.Do(http.MethodGet, "/peers", nil, nil))
+}
+
+func TestAPILoginLockout(t *testing.T) {
+	h := New(t, 1, func(cfg *config.Config) {
+		cfg.WebuiLoginMaxAttempts = 2
+	})
+	a := h.Peers[0]
+	admin := h.API(a)
+
+	client := h.Client(a)
+	require.Equal(t, http.StatusBadRequest, client.Login("admin", "wrong"))
+	require.Equal(t, http.StatusBadRequest, client.Login("admin", "wrong"))
+	// the correct password is rejected during the lockout
+	require.Equal(t, http.StatusTooManyRequests, client.Login("admin", AdminPassword))
+
+	var lockouts []*auth.Lockout
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodGet, "/auth/lockouts", nil, &lockouts))
+	require.Len(t, lockouts, 2)
+	for _, lockout := range lockouts {
+		require.Equal(t, 2, lockout.Failures)
+		require.NotNil(t, lockout.LockedUntil)
+	}
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodDelete, "/auth/lockouts/username:admin", nil, nil))
+	require.Equal(t, http.StatusTooManyRequests, client.Login("admin", AdminPassword))
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodDelete, "/auth/lockouts", nil, nil))
+	require.Equal(t, http.StatusOK, client.Login("admin", AdminPassword))
+	require.Equal(t, http.StatusNotFound, admin.Do(http.MethodDelete, "/auth/lockouts/ip:"+a.Address.String(), nil, nil))
+}
+
+func TestAPITOTP(t *testing.T) {
+	h := New(t, 1)
+	a := h.Peers[0]
+	admin := h.API(a)
+
+	var enrollment api.EnrollTOTPResponse
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodPost, "/auth/totp", nil, &enrollment))
+	require.Contains(t, enrollment.URI, "otpauth://totp/wg-hub:admin?")
+	code, err := auth.TOTPCode(enrollment.Secret, time.Now())
+	require.NoError(t, err)
+	var enabled api.EnableTOTPResponse
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodPost, "/auth/totp/enable", api.TOTPCodeRequest{Code: code}, &enabled))
+	require.NotEmpty(t, enabled.RecoveryCodes)
+
+	login := func(code string) int {
+		return h.Client(a).Do(http.MethodPost, "/auth", api.AuthRequest{Username: "admin", Password: AdminPassword, Code: code}, nil)
+	}
+	require.Equal(t, http.StatusUnauthorized, login(""))
+	require.Equal(t, http.StatusBadRequest, login("000000"))
+	require.Equal(t, http.StatusOK, login(enabled.RecoveryCodes[0]))
+	require.Equal(t, http.StatusBadRequest, login(enabled.RecoveryCodes[0]))
+	// the next time step is accepted, the step of the enrollment was already used
+	code, err = auth.TOTPCode(enrollment.Secret, time.Now().Add(30*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, login(code))
+
+	var status auth.TOTPStatus
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodGet, "/auth/totp", nil, &status))
+	require.True(t, status.Enabled)
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodDelete, "/users/admin/totp", nil, nil))
+	require.Equal(t, http.StatusOK, login(""))
+}
+
+func TestAPITOTPLockout(t *testing.T) {
+	h := New(t, 1, func(cfg *config.Config) {
+		cfg.WebuiLoginMaxAttempts = 2
+	})
+	admin := h.API(h.Peers[0])
+
+	var enrollment api.EnrollTOTPResponse
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodPost, "/auth/totp", nil, &enrollment))
+	code, err := auth.TOTPCode(enrollment.Secret, time.Now())
+	require.NoError(t, err)
+	wrongCode := api.TOTPCodeRequest{Code: "000000"}
+	if code == wrongCode.Code {
+		wrongCode.Code = "000001"
+	}
+	// invalid codes count as failed logins of the user
+	require.Equal(t, http.StatusBadRequest, admin.Do(http.MethodPost, "/auth/totp/enable", wrongCode, nil))
+	require.Equal(t, http.StatusBadRequest, admin.Do(http.MethodPost, "/auth/totp/enable", wrongCode, nil))
+	require.Equal(t, http.StatusTooManyRequests, admin.Do(http.MethodPost, "/auth/totp/enable", api.TOTPCodeRequest{Code: code}, nil))
+
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodDelete, "/auth/lockouts", nil, nil))
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodPost, "/auth/totp/enable", api.TOTPCodeRequest{Code: code}, nil))
+	require.Equal(t, http.StatusBadRequest, admin.Do(http.MethodDelete, "/auth/totp", wrongCode, nil))
+	require.Equal(t, http.StatusBadRequest, admin.Do(http.MethodDelete, "/auth/totp", wrongCode, nil))
+	require.Equal(t, http.StatusTooManyRequests, admin.Do(http.MethodDelete, "/auth/totp", wrongCode, nil))
+	require.Equal(t, http.StatusTooManyRequests, h.Client(h.Peers[0]).Login("admin", AdminPassword))
+}
+
+func TestAPIOIDC(t *testing.T) {
+	idp := NewOIDCProvider(t)
+	h := New(t, 1, func(cfg *config.Config) {
+		cfg.WebuiOIDC = idp.Config()
+	})
+	a := h.Peers[0]
+
+	var oidcInfo map[string]bool
+	require.Equal(t, http.StatusOK, h.Client(a).Do(http.MethodGet, "/auth/oidc", nil, &oidcInfo))
+	require.True(t, oidcInfo["enabled"])
+
+	idp.SetUser("alice", "staff", "operators")
+	values := h.OIDCLogin(a)
+	require.Empty(t, values.Get("error"))
+	client := h.Client(a)
+	client.SetToken(values.Get("token"))
+	var claims map[string]any
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/auth", nil, &claims))
+	// oidc users are separated from the local users
+	require.Equal(t, "oidc:alice", claims["username"])
+	require.Equal(t, "operator", claims["role"])
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers", nil, nil))
+	require.Equal(t, http.StatusForbidden, client.Do(http.MethodGet, "/config", nil, nil))
+
+	// the session can be refreshed without a local user
+	var refreshed auth.TokenPair
+	status := h.Client(a).Do(http.MethodPost, "/auth/refresh", api.RefreshAuthRequest{RefreshToken: values.Get("refreshToken")}, &refreshed)
+	require.Equal(t, http.StatusOK, status)
+
+	// users without an allowed group are rejected
+	idp.SetUser("mallory", "staff")
+	values = h.OIDCLogin(a)
+	require.Empty(t, values.Get("token"))
+	require.NotEmpty(t, values.Get("error"))
+
+	// an oidc user with the name of a local user can not enable totp for the local user
+	idp.SetUser("admin", "staff", "operators")
+	values = h.OIDCLogin(a)
+	require.Empty(t, values.Get("error"))
+	client = h.Client(a)
+	client.SetToken(values.Get("token"))
+	var enrollment api.EnrollTOTPResponse
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPost, "/auth/totp", nil, &enrollment))
+	code, err := auth.TOTPCode(enrollment.Secret, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPost, "/auth/totp/enable", api.TOTPCodeRequest{Code: code}, nil))
+
+	// the password login is still available
+	require.Equal(t, http.StatusOK, h.Client(a).Login("admin", AdminPassword))
+}
+
+func TestAPIAudit(t *testing.T) {
+	h := New(t, 1)
+	a := h.Peers[0]
+	admin := h.API(a)
+
+	publicKey := generateKey(t).PublicKey().String()
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodPut, "/peers/"+publicKey, api.AddPeerRequest{AllowedIP: "10.0.0.70"}, nil))
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodPut, "/peers/"+publicKey, api.AddPeerRequest{AllowedIP: "10.0.0.71"}, nil))
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodDelete, "/peers/"+publicKey, nil, nil))
+	require.Equal(t, http.StatusBadRequest, h.Client(a).Login("admin", "wrong"))
+
+	var page audit.Page
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodGet, "/audit?target="+url.QueryEscape(publicKey), nil, &page))
+	require.Equal(t, 3, page.Total)
+	require.Equal(t, audit.ActionPeerRemove, page.Events[0].Action)
+	require.Equal(t, map[string]any{"allowedIP": "10.0.0.71/32"}, page.Events[0].Before)
+	require.Equal(t, audit.ActionPeerUpdate, page.Events[1].Action)
+	require.Equal(t, map[string]any{"allowedIP": "10.0.0.70/32"}, page.Events[1].Before)
+	require.Equal(t, audit.ActionPeerAdd, page.Events[2].Action)
+	for _, e := range page.Events {
+		require.Equal(t, "admin", e.Actor)
+		require.Equal(t, a.Address.String(), e.RemoteIP)
+	}
+
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodGet, "/audit?action=auth.login_failed", nil, &page))
+	require.Equal(t, 1, page.Total)
+	require.Equal(t, "admin", page.Events[0].Actor)
+
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodGet, "/audit?limit=2&offset=1", nil, &page))
+	require.Len(t, page.Events, 2)
+	require.Equal(t, audit.ActionPeerRemove, page.Events[0].Action)
+	require.Equal(t, http.StatusBadRequest, admin.Do(http.MethodGet, "/audit?since=yesterday", nil, nil))
+}
+
+func TestWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	var received []*events.Event
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		if !webhook.Verify("secret", payload, r.Header.Get(webhook.SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var e events.Event
+		require.NoError(t, json.Unmarshal(payload, &e))
+		mu.Lock()
+		received = append(received, &e)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+	receivedTypes := func() []events.Type {
+		mu.Lock()
+		defer mu.Unlock()
+		types := make([]events.Type, 0, len(received))
+		for _, e := range received {
+			types = append(types, e.Type)
+		}
+		return types
+	}
+
+	h := New(t, 1, func(cfg *config.Config) {
+		cfg.PeerWatchInterval = 50 * time.Millisecond
+		cfg.PeerOfflineTimeout = 2 * time.Second
+		cfg.Webhooks = []*config.WebhookConfig{
+			{URL: receiver.URL, Secret: "secret", Events: []string{"peer.*", "auth.login_failed"}},
+		}
+	})
+	a := h.Peers[0]
+	admin := h.API(a)
+
+	require.Eventually(t, func() bool {
+		return slices.Contains(receivedTypes(), events.PeerFirstHandshake)
+	}, ConnectTimeout, 50*time.Millisecond)
+
+	publicKey := generateKey(t).PublicKey().String()
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodPut, "/peers/"+publicKey, api.AddPeerRequest{AllowedIP: "10.0.0.90"}, nil))
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodDelete, "/peers/"+publicKey, nil, nil))
+	require.Equal(t, http.StatusBadRequest, h.Client(a).Login("admin", "wrong"))
+	// no further handshake happens within the offline timeout
+	require.Eventually(t, func() bool {
+		types := receivedTypes()
+		return slices.Contains(types, events.PeerOffline) && slices.Contains(types, events.LoginFailed)
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Subset(t, receivedTypes(), []events.Type{events.PeerAdded, events.PeerRemoved})
+
+	mu.Lock()
+	for _, e := range received {
+		if e.Type == events.PeerFirstHandshake || e.Type == events.PeerOffline {
+			require.Equal(t, a.PrivateKey.PublicKey().String(), e.Data.(map[string]any)["publicKey"])
+		}
+	}
+	mu.Unlock()
+
+	var status []*webhook.EndpointStatus
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodGet, "/webhooks", nil, &status))
+	require.Len(t, status, 1)
+	require.Equal(t, receiver.URL, status[0].URL)
+	require.GreaterOrEqual(t, status[0].Delivered, uint64(5))
+	require.Zero(t, status[0].Failed)
+	require.Equal(t, webhook.StatusDelivered, status[0].Deliveries[0].Status)
+}
+
+func TestAPIEvents(t *testing.T) {
+	h := New(t, 1, func(cfg *config.Config) {
+		cfg.PeerWatchInterval = 50 * time.Millisecond
+	})
+	a := h.Peers[0]
+	admin := h.API(a)
+
+	var created api.CreateTokenResponse
+	status := admin.Do(http.MethodPost, "/tokens", api.CreateTokenRequest{Name: "events", Scopes: []auth.Scope{auth.ScopeEventsRead}}, &created)
+	require.Equal(t, http.StatusOK, status)
+	tokenClient := h.Client(a)
+	tokenClient.SetToken(created.Token)
+
+	adminStream := admin.Events("")
+	snapshot := adminStream.Next()
+	require.Equal(t, api.PeersSnapshot, snapshot.Type)
+	require.Len(t, snapshot.Data, 2)
+	tokenStream := tokenClient.Events("peer.*,auth.*")
+	require.Equal(t, api.PeersSnapshot, tokenStream.Next().Type)
+	require.Equal(t, http.StatusBadRequest, admin.Do(http.MethodGet, "/events?types=[", nil, nil))
+
+	// the api requests of the peer are reported as traffic
+	traffic := adminStream.Wait(events.TrafficRates)
+	require.Equal(t, a.PrivateKey.PublicKey().String(), traffic.Data.([]any)[0].(map[string]any)["publicKey"])
+
+	publicKey := generateKey(t).PublicKey().String()
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodPut, "/peers/"+publicKey, api.AddPeerRequest{AllowedIP: "10.0.0.90"}, nil))
+	require.Equal(t, publicKey, adminStream.Wait(events.PeerAdded).Data.(map[string]any)["publicKey"])
+	require.Equal(t, http.StatusBadRequest, h.Client(a).Login("admin", "wrong"))
+	require.Equal(t, "admin", adminStream.Wait(events.LoginFailed).Data.(map[string]any)["username"])
+	require.Equal(t, http.StatusOK, admin.Do(http.MethodDelete, "/peers/"+publicKey, nil, nil))
+
+	// the failed login is not sent to the token without the audit:read scope
+	tokenStream.Wait(events.PeerAdded)
+	require.Equal(t, events.PeerRemoved, tokenStream.Next().Type)
+}
+
+func TestAPIPeerState(t *testing.T) {
+	h := New(t, 1, func(cfg *config.Config) {
+		cfg.PeerWatchInterval = 50 * time.Millisecond
+	})
+	a := h.Peers[0]
+	client := h.API(a)
+	publicKey := a.PrivateKey.PublicKey().String()
+
+	// the api requests of the peer keep it online
+	var details api.PeerDetails
+	require.Eventually(t, func() bool {
+		status := client.Do(http.MethodGet, "/peers/"+publicKey, nil, &details)
+		return status == http.StatusOK && details.State == peers.StateOnline
+	}, ConnectTimeout, 50*time.Millisecond)
+	require.NotNil(t, details.Status.LastHandshakeAt)
+	require.NotNil(t, details.Status.LastActivityAt)
+	require.True(t, details.IsRequester)
+
+	var annotatedPeers api.AnnotatedPeers
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers", nil, &annotatedPeers))
+	for _, peer := range annotatedPeers {
+		if peer.IsHub {
+			require.Empty(t, peer.State)
+		} else {
+			require.Equal(t, peers.StateOnline, peer.State)
+		}
+	}
+
+	var sessions []*peers.Session
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers/"+publicKey+"/sessions", nil, &sessions))
+	require.Len(t, sessions, 1)
+	require.Nil(t, sessions[0].End)
+	require.NotEmpty(t, sessions[0].Endpoint)
+
+	unknown := generateKey(t).PublicKey().String()
+	require.Equal(t, http.StatusNotFound, client.Do(http.MethodGet, "/peers/"+unknown, nil, nil))
+	require.Equal(t, http.StatusNotFound, client.Do(http.MethodGet, "/peers/"+unknown+"/sessions", nil, nil))
+}
+
+func TestAPIPeerStats(t *testing.T) {
+	h := New(t, 1)
+	a := h.Peers[0]
+	client := h.API(a)
+	publicKey := a.PrivateKey.PublicKey().String()
+
+	// the api requests of the peer are sampled
+	var stats peers.Stats
+	require.Eventually(t, func() bool {
+		status := client.Do(http.MethodGet, "/peers/"+publicKey+"/stats?range=1m", nil, &stats)
+		return status == http.StatusOK && stats.TotalRxBytes > 0
+	}, ConnectTimeout, 100*time.Millisecond)
+	require.Equal(t, int64(1), stats.Resolution)
+	require.Len(t, stats.Samples, 60)
+
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers/"+publicKey+"/stats?range=30d", nil, &stats))
+	require.Equal(t, int64(3600), stats.Resolution)
+	require.Equal(t, http.StatusBadRequest, client.Do(http.MethodGet, "/peers/"+publicKey+"/stats?range=31d", nil, nil))
+	require.Equal(t, http.StatusBadRequest, client.Do(http.MethodGet, "/peers/"+publicKey+"/stats?range=abc", nil, nil))
+}
+
+func TestAPITrafficMatrix(t *testing.T) {
+	h := New(t, 2)
+	a, b := h.Peers[0], h.Peers[1]
+	listener, err := b.ListenTCP(8000)
+	require.NoError(t, err)
+	echoTCP(t, listener)
+	requireTCPEcho(t, a, b, 8000)
+
+	keyA, keyB := a.PrivateKey.PublicKey().String(), b.PrivateKey.PublicKey().String()
+	client := h.API(a)
+	var matrix []*loopback.MatrixEntry
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/traffic/matrix", nil, &matrix))
+	find := func(src, dst string) *loopback.MatrixEntry {
+		for _, e := range matrix {
+			if e.Source == src && e.Destination == dst && e.Protocol == "tcp" {
+				return e
+			}
+		}
+		return nil
+	}
+	for _, pair := range [][2]string{{keyA, keyB}, {keyB, keyA}} {
+		e := find(pair[0], pair[1])
+		require.NotNil(t, e)
+		require.Positive(t, e.Bytes)
+		require.Positive(t, e.Packets)
+	}
+	// the api requests of the peer are sent to the hub instance
+	var annotatedPeers api.AnnotatedPeers
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers", nil, &annotatedPeers))
+	hubIdx := slices.IndexFunc(annotatedPeers, func(p *api.AnnotatedPeer) bool { return p.IsHub })
+	require.NotNil(t, find(keyA, annotatedPeers[hubIdx].PublicKey))
+
+	var metrics string
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/metrics", nil, &metrics))
+	require.Contains(t, metrics, "# TYPE wghub_peer_traffic_bytes_total counter\n")
+	require.Contains(t, metrics, fmt.Sprintf(`wghub_peer_traffic_packets_total{source="%s",destination="%s",protocol="tcp"} `, keyA, keyB))
+}
+
+func TestFlowExport(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer collector.Close()
+	flowLog := filepath.Join(t.TempDir(), "flows.jsonl")
+	h := New(t, 2, func(cfg *config.Config) {
+		cfg.FlowLogFile = flowLog
+		cfg.FlowIPFIXCollector = collector.LocalAddr().String()
+		cfg.FlowIdleTimeout = time.Second
+	})
+	a, b := h.Peers[0], h.Peers[1]
+	listener, err := b.ListenTCP(8000)
+	require.NoError(t, err)
+	echoTCP(t, listener)
+	requireTCPEcho(t, a, b, 8000)
+
+	// the closed connection is exported to the collector
+	require.NoError(t, collector.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 65535)
+	n, _, err := collector.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, uint16(10), binary.BigEndian.Uint16(buf[0:]))
+	require.Equal(t, uint16(n), binary.BigEndian.Uint16(buf[2:]))
+
+	var record *flows.Record
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(flowLog)
+		require.NoError(t, err)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var r flows.Record
+			if json.Unmarshal([]byte(line), &r) == nil && r.DstPort == 8000 {
+				record = &r
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 100*time.Millisecond)
+	require.Equal(t, a.Address.String(), record.Src)
+	require.Equal(t, b.Address.String(), record.Dst)
+	require.Equal(t, uint8(6), record.Protocol)
+	require.Positive(t, record.Bytes)
+	// SYN was seen
+	require.NotZero(t, record.TCPFlags&0x02)
+}
+
+func TestAPICapture(t *testing.T) {
+	h := New(t, 2)
+	a, b := h.Peers[0], h.Peers[1]
+	listener, err := b.ListenTCP(8000)
+	require.NoError(t, err)
+	echoTCP(t, listener)
+
+	client := h.API(a)
+	var pcapng string
+	done := make(chan int)
+	go func() {
+		done <- client.Do(http.MethodGet, "/capture?duration=2s&filter=port+8000&peer="+url.QueryEscape(b.PrivateKey.PublicKey().String()), nil, &pcapng)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	requireTCPEcho(t, a, b, 8000)
+	require.Equal(t, http.StatusOK, <-done)
+
+	data := []byte(pcapng)
+	require.Equal(t, uint32(0x0a0d0d0a), binary.LittleEndian.Uint32(data))
+	packets := 0
+	for offset := 0; offset+8 <= len(data); {
+		blockLen := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		require.Positive(t, blockLen)
+		if binary.LittleEndian.Uint32(data[offset:]) == 6 {
+			packets++
+		}
+		offset += blockLen
+	}
+	require.Positive(t, packets)
+
+	require.Equal(t, http.StatusBadRequest, client.Do(http.MethodGet, "/capture?filter=port+foo", nil, nil))
+	require.Equal(t, http.StatusBadRequest, client.Do(http.MethodGet, "/capture?duration=1h", nil, nil))
+	require.Equal(t, http.StatusBadRequest, client.Do(http.MethodGet, "/capture?peer=unknown", nil, nil))
+}
+
+func TestAPIShaping(t *testing.T) {
+	h := New(t, 3, func(cfg *config.Config) {
+		cfg.Shaping = &config.ShapingConfig{}
+		require.NoError(t, cfg.Shaping.Validate())
+	})
+	a, b, c := h.Peers[0], h.Peers[1], h.Peers[2]
+	keyA := a.PrivateKey.PublicKey().String()
+	received := make(chan int64, 1)
+	listener, err := b.ListenTCP(8000)
+	require.NoError(t, err)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	}()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	// the api requests are sent by the unlimited peer c
+	client := h.API(c)
+	cfg := &config.ShapingConfig{
+		Peers: []*config.PeerShaping{
+			{PublicKey: keyA, ShapingPolicy: config.ShapingPolicy{Ingress: &config.RateLimit{Rate: "500KB", Burst: "64KB"}}},
+		},
+	}
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPut, "/shaping", cfg, nil))
+	var current config.ShapingConfig
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/shaping", nil, &current))
+	require.Equal(t, "500KB", current.Peers[0].Ingress.Rate)
+	require.Equal(t, config.DefaultInteractivePorts, current.InteractivePorts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	start := time.Now()
+	conn, err := a.DialTCP(ctx, b, 8000)
+	require.NoError(t, err)
+	_, err = conn.Write(make([]byte, 1<<20))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	select {
+	case n := <-received:
+		require.Equal(t, int64(1<<20), n)
+	case <-ctx.Done():
+		t.Fatal("transfer timed out")
+	}
+	// 1MiB at 500KB/s with a burst of 64KB
+	require.Greater(t, time.Since(start), 1500*time.Millisecond)
+
+	var queues []*shaping.QueueStats
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/shaping/queues", nil, &queues))
+	idx := slices.IndexFunc(queues, func(q *shaping.QueueStats) bool { return q.Source == keyA })
+	require.GreaterOrEqual(t, idx, 0)
+	require.Positive(t, queues[idx].Forwarded)
+
+	invalid := &config.ShapingConfig{Peers: []*config.PeerShaping{{PublicKey: keyA, ShapingPolicy: config.ShapingPolicy{Ingress: &config.RateLimit{Rate: "fast"}}}}}
+	require.Equal(t, http.StatusBadRequest, client.Do(http.MethodPut, "/shaping", invalid, nil))
+	var page audit.Page
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/audit?action=shaping.update", nil, &page))
+	require.Equal(t, 1, page.Total)
+}
+
+func TestAPIShapingNotConfigured(t *testing.T) {
+	h := New(t, 2)
+	a, b := h.Peers[0], h.Peers[1]
+	listener, err := a.ListenTCP(8000)
+	require.NoError(t, err)
+	echoTCP(t, listener)
+
+	// without a shaping config the packets are forwarded directly
+	requireTCPEcho(t, b, a, 8000)
+	client := h.API(b)
+	require.Equal(t, http.StatusNotFound, client.Do(http.MethodGet, "/shaping", nil, nil))
+	require.Equal(t, http.StatusNotFound, client.Do(http.MethodGet, "/shaping/queues", nil, nil))
+}
+
+func TestAPIPeerQuota(t *testing.T) {
+	h := New(t, 3, func(cfg *config.Config) {
+		cfg.PeerWatchInterval = 50 * time.Millisecond
+	})
+	a, b, c := h.Peers[0], h.Peers[1], h.Peers[2]
+	keyA := a.PrivateKey.PublicKey().String()
+	listener, err := b.ListenTCP(8000)
+	require.NoError(t, err)
+	echoTCP(t, listener)
+
+	// the api requests are sent by peer c without a quota
+	client := h.API(c)
+	var status peers.QuotaStatus
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPut, "/peers/"+keyA+"/quota", config.PeerQuota{Limit: "20KB", Period: config.QuotaOnce}, &status))
+	require.Equal(t, uint64(20000), status.Remaining)
+	require.Equal(t, http.StatusBadRequest, client.Do(http.MethodPut, "/peers/"+keyA+"/quota", config.PeerQuota{Limit: "0"}, nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), ConnectTimeout)
+	defer cancel()
+	conn, err := a.DialTCP(ctx, b, 8000)
+	require.NoError(t, err)
+	_, err = conn.Write(make([]byte, 32<<10))
+	require.NoError(t, err)
+	_, _ = io.ReadFull(conn, make([]byte, 32<<10))
+	_ = conn.Close()
+
+	var details api.PeerDetails
+	require.Eventually(t, func() bool {
+		return client.Do(http.MethodGet, "/peers/"+keyA, nil, &details) == http.StatusOK && len(details.Suspended) > 0
+	}, ConnectTimeout, 50*time.Millisecond)
+	require.Equal(t, []peers.SuspendReason{peers.SuspendQuota}, details.Suspended)
+	require.True(t, details.Quota.Exhausted)
+	// the allowed ip stays reserved
+	require.Equal(t, a.Address.String()+"/32", details.AllowedIP)
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), time.Second)
+	defer dialCancel()
+	_, err = a.DialTCP(dialCtx, b, 8000)
+	require.Error(t, err)
+
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPost, "/peers/"+keyA+"/quota/reset", nil, &status))
+	require.Equal(t, uint64(0), status.Used)
+	requireTCPEcho(t, a, b, 8000)
+
+	require.Equal(t, http.StatusOK, client.Do(http.MethodDelete, "/peers/"+keyA+"/quota", nil, nil))
+	require.Equal(t, http.StatusNotFound, client.Do(http.MethodGet, "/peers/"+keyA+"/quota", nil, nil))
+}
+
+func TestAPIPeerDisable(t *testing.T) {
+	disabled := false
+	h := New(t, 3, func(cfg *config.Config) {
+		cfg.Peers[2].Enabled = &disabled
+	})
+	a, b, c := h.Peers[0], h.Peers[1], h.Peers[2]
+	keyB, keyC := b.PrivateKey.PublicKey().String(), c.PrivateKey.PublicKey().String()
+	listener, err := a.ListenTCP(8000)
+	require.NoError(t, err)
+	echoTCP(t, listener)
+	requireNoTCP := func(p *Peer) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := p.DialTCP(ctx, a, 8000)
+		require.Error(t, err)
+	}
+
+	// peer c is disabled by the config file
+	client := h.API(a)
+	var details api.PeerDetails
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers/"+keyC, nil, &details))
+	require.False(t, details.Enabled)
+	require.Equal(t, []peers.SuspendReason{peers.SuspendDisabled}, details.Suspended)
+	requireNoTCP(c)
+
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPost, "/peers/"+keyC+"/enable", nil, nil))
+	details = api.PeerDetails{}
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers/"+keyC, nil, &details))
+	require.True(t, details.Enabled)
+	require.Empty(t, details.Suspended)
+	requireTCPEcho(t, c, a, 8000)
+
+	// the address of a disabled peer stays reserved
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPost, "/peers/"+keyB+"/disable", nil, nil))
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers/"+keyB, nil, &details))
+	require.False(t, details.Enabled)
+	require.Equal(t, b.Address.String()+"/32", details.AllowedIP)
+	requireNoTCP(b)
+	status := client.Do(http.MethodPost, "/peers", api.GeneratePeerRequest{AllowedIP: b.Address.String()}, nil)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPost, "/peers/"+keyB+"/enable", nil, nil))
+	requireTCPEcho(t, b, a, 8000)
+
+	// peers can be added disabled
+	var generated api.GeneratePeerResponse
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPost, "/peers", api.GeneratePeerRequest{Enabled: &disabled}, &generated))
+	details = api.PeerDetails{}
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers/"+generated.PublicKey, nil, &details))
+	require.False(t, details.Enabled)
+	require.Equal(t, generated.AllowedIP, details.AllowedIP)
+	added := generateKey(t).PublicKey().String()
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPut, "/peers/"+added, api.AddPeerRequest{Enabled: &disabled}, nil))
+	details = api.PeerDetails{}
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers/"+added, nil, &details))
+	require.False(t, details.Enabled)
+	require.Equal(t, []peers.SuspendReason{peers.SuspendDisabled}, details.Suspended)
+
+	require.Equal(t, http.StatusNotFound, client.Do(http.MethodPost, "/peers/"+generateKey(t).PublicKey().String()+"/disable", nil, nil))
+	require.Equal(t, http.StatusNotFound, client.Do(http.MethodPost, "/peers/"+generateKey(t).PublicKey().String()+"/enable", nil, nil))
+
+	var res audit.Page
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/audit?action=peer.disable", nil, &res))
+	require.Equal(t, 3, res.Total)
+}
+
+func TestAPIPeerSources(t *testing.T) {
+	h := New(t, 2, func(cfg *config.Config) {
+		cfg.Peers[1].AllowedSources = []string{"192.0.2.0/24"}
+	})
+	a, b := h.Peers[0], h.Peers[1]
+	keyB := b.PrivateKey.PublicKey().String()
+	listener, err := a.ListenTCP(8000)
+	require.NoError(t, err)
+	echoTCP(t, listener)
+	client := h.API(a)
+	getSources := func(publicKey string) []string {
+		t.Helper()
+		var details api.PeerDetails
+		require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers/"+publicKey, nil, &details))
+		return details.AllowedSources
+	}
+	require.Equal(t, []string{"192.0.2.0/24"}, getSources(keyB))
+	// the hub sees the packets of the test peers from the loopback address, which is exempt
+	requireTCPEcho(t, b, a, 8000)
+
+	var generated api.GeneratePeerResponse
+	genReq := api.GeneratePeerRequest{AllowedSources: []string{"2001:db8::/32"}}
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPost, "/peers", genReq, &generated))
+	require.Equal(t, []string{"2001:db8::/32"}, getSources(generated.PublicKey))
+
+	// updating the peer without allowed sources keeps them
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPut, "/peers/"+generated.PublicKey, api.AddPeerRequest{}, nil))
+	require.Equal(t, []string{"2001:db8::/32"}, getSources(generated.PublicKey))
+	req := api.AddPeerRequest{AllowedSources: []string{"198.51.100.7", "invalid"}}
+	require.Equal(t, http.StatusBadRequest, client.Do(http.MethodPut, "/peers/"+generated.PublicKey, req, nil))
+	req.AllowedSources = []string{"198.51.100.7"}
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPut, "/peers/"+generated.PublicKey, req, nil))
+	require.Equal(t, []string{"198.51.100.7/32"}, getSources(generated.PublicKey))
+	req.AllowedSources = []string{}
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPut, "/peers/"+generated.PublicKey, req, nil))
+	require.Empty(t, getSources(generated.PublicKey))
+}
+
+func TestAPIPeerSchedule(t *testing.T) {
+	h := New(t, 2, func(cfg *config.Config) {
+		cfg.PeerWatchInterval = 50 * time.Millisecond
+	})
+	a, b := h.Peers[0], h.Peers[1]
+	keyB := b.PrivateKey.PublicKey().String()
+	listener, err := a.ListenTCP(8000)
+	require.NoError(t, err)
+	echoTCP(t, listener)
+
+	client := h.API(a)
+	expiresAt := time.Now().Add(time.Second).UTC().Format(time.RFC3339)
+	var status peers.ScheduleStatus
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPut, "/peers/"+keyB+"/schedule", config.PeerSchedule{ExpiresAt: expiresAt}, &status))
+	require.False(t, status.Expired)
+	require.NotNil(t, status.NextChange)
+	requireTCPEcho(t, b, a, 8000)
+
+	var details api.PeerDetails
+	require.Eventually(t, func() bool {
+		return client.Do(http.MethodGet, "/peers/"+keyB, nil, &details) == http.StatusOK && len(details.Suspended) > 0
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, []peers.SuspendReason{peers.SuspendExpired}, details.Suspended)
+	require.True(t, details.Schedule.Expired)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = b.DialTCP(ctx, a, 8000)
+	require.Error(t, err)
+
+	// extending the access resumes the peer
+	schedule := config.PeerSchedule{
+		ExpiresAt: time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		Timezone:  "UTC",
+		Windows:   []*config.AccessWindow{{Start: "00:00", End: "24:00"}},
+	}
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPut, "/peers/"+keyB+"/schedule", schedule, &status))
+	require.True(t, status.InWindow)
+	requireTCPEcho(t, b, a, 8000)
+
+	schedule.Windows[0].End = "25:00"
+	require.Equal(t, http.StatusBadRequest, client.Do(http.MethodPut, "/peers/"+keyB+"/schedule", schedule, nil))
+	require.Equal(t, http.StatusNotFound, client.Do(http.MethodPut, "/peers/"+generateKey(t).PublicKey().String()+"/schedule", schedule, nil))
+	require.Equal(t, http.StatusOK, client.Do(http.MethodDelete, "/peers/"+keyB+"/schedule", nil, nil))
+	require.Equal(t, http.StatusNotFound, client.Do(http.MethodGet, "/peers/"+keyB+"/schedule", nil, nil))
+}
+
+func TestAPIEnrollment(t *testing.T) {
+	h := New(t, 1, func(cfg *config.Config) {
+		// the public enrollment listener is started next to the API of the hub network
+		cfg.EnrollAddress = "127.0.0.1:0"
+	})
+	a := h.Peers[0]
+	listener, err := a.ListenTCP(8000)
+	require.NoError(t, err)
+	echoTCP(t, listener)
+
+	client := h.API(a)
+	var created api.CreatePreAuthKeyResponse
+	status := client.Do(http.MethodPost, "/enrollment/keys", api.CreatePreAuthKeyRequest{
+		Tag:       "laptops",
+		Pool:      "10.0.0.128/26",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}, &created)
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, strings.HasPrefix(created.Key, auth.PreAuthKeyPrefix))
+	var keys []*auth.PreAuthKey
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/enrollment/keys", nil, &keys))
+	require.Len(t, keys, 1)
+	require.Equal(t, "10.0.0.128/26", keys[0].Pool)
+
+	// the device enrolls itself without authentication
+	device := generateKey(t)
+	devicePublicKey := device.PublicKey().String()
+	var res enroll.Response
+	status = h.Client(a).Do(http.MethodPost, "/enroll", enroll.Request{Key: created.Key, PublicKey: devicePublicKey}, &res)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "laptops", res.Tag)
+	require.Equal(t, h.Config.PrivateKey.PublicKey().String(), res.HubPublicKey)
+	require.Contains(t, res.Config, "PrivateKey = "+enroll.PrivateKeyPlaceholder)
+	address := netip.MustParsePrefix(res.AllowedIP).Addr()
+	require.True(t, netip.MustParsePrefix("10.0.0.128/26").Contains(address))
+
+	var details api.PeerDetails
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers/"+devicePublicKey, nil, &details))
+	require.Equal(t, "laptops", details.Tag)
+	p := h.NewPeer(device, address)
+	h.WaitConnected(p)
+	requireTCPEcho(t, p, a, 8000)
+
+	// single-use keys can only be redeemed once
+	req := enroll.Request{Key: created.Key, PublicKey: generateKey(t).PublicKey().String()}
+	require.Equal(t, http.StatusUnauthorized, h.Client(a).Do(http.MethodPost, "/enroll", req, nil))
+	req.Key = auth.PreAuthKeyPrefix + "invalid"
+	require.Equal(t, http.StatusUnauthorized, h.Client(a).Do(http.MethodPost, "/enroll", req, nil))
+
+	// existing peers can not enroll again
+	status = client.Do(http.MethodPost, "/enrollment/keys", api.CreatePreAuthKeyRequest{Reusable: true, ExpiresAt: time.Now().Add(time.Hour)}, &created)
+	require.Equal(t, http.StatusOK, status)
+	req = enroll.Request{Key: created.Key, PublicKey: devicePublicKey}
+	require.Equal(t, http.StatusBadRequest, h.Client(a).Do(http.MethodPost, "/enroll", req, nil))
+
+	require.Equal(t, http.StatusOK, client.Do(http.MethodDelete, "/enrollment/keys/"+created.ID, nil, nil))
+	require.Equal(t, http.StatusNotFound, client.Do(http.MethodDelete, "/enrollment/keys/"+created.ID, nil, nil))
+	req.PublicKey = generateKey(t).PublicKey().String()
+	require.Equal(t, http.StatusUnauthorized, h.Client(a).Do(http.MethodPost, "/enroll", req, nil))
+
+	var page audit.Page
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/audit?action=peer.enroll", nil, &page))
+	require.Equal(t, 1, page.Total)
+	require.Equal(t, "preauth:"+keys[0].ID, page.Events[0].Actor)
+}
+
+func TestAPIRegistration(t *testing.T) {
+	h := New(t, 1, func(cfg *config.Config) {
+		cfg.Registrations = true
+		cfg.WebuiLoginMaxAttempts = 3
+	})
+	a := h.Peers[0]
+	listener, err := a.ListenTCP(8000)
+	require.NoError(t, err)
+	echoTCP(t, listener)
+
+	// the device submits a registration without authentication
+	device := generateKey(t)
+	devicePublicKey := device.PublicKey().String()
+	var res enroll.RegistrationResult
+	req := enroll.RegistrationRequest{PublicKey: devicePublicKey, Hostname: "laptop-alice", Name: "Alice"}
+	require.Equal(t, http.StatusAccepted, h.Client(a).Do(http.MethodPost, "/register", req, &res))
+	require.Equal(t, "pending", res.Status)
+	require.Nil(t, res.Response)
+	require.Equal(t, http.StatusBadRequest, h.Client(a).Do(http.MethodPost, "/register", req, nil))
+
+	// pending registrations are not added to the hub device
+	client := h.API(a)
+	require.Equal(t, http.StatusNotFound, client.Do(http.MethodGet, "/peers/"+devicePublicKey, nil, nil))
+	var pending []*peers.Registration
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/registrations?status=pending", nil, &pending))
+	require.Len(t, pending, 1)
+	require.Equal(t, "laptop-alice", pending[0].Hostname)
+	require.Equal(t, http.StatusBadRequest, client.Do(http.MethodGet, "/registrations?status=unknown", nil, nil))
+
+	approve := api.ApproveRegistrationRequest{AllowedIP: "10.0.0.100", Groups: []string{"laptops"}}
+	var approved peers.Registration
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPost, "/registrations/"+res.ID+"/approve", approve, &approved))
+	require.Equal(t, peers.RegistrationApproved, approved.Status)
+	require.Equal(t, "admin", approved.DecidedBy)
+
+	res = enroll.RegistrationResult{}
+	require.Equal(t, http.StatusOK, h.Client(a).Do(http.MethodGet, "/register/"+approved.ID, nil, &res))
+	require.Equal(t, "approved", res.Status)
+	require.Equal(t, "10.0.0.100/32", res.AllowedIP)
+	require.Contains(t, res.Config, "PrivateKey = "+enroll.PrivateKeyPlaceholder)
+	var details api.PeerDetails
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/peers/"+devicePublicKey, nil, &details))
+	require.Equal(t, []string{"laptops"}, details.Groups)
+	p := h.NewPeer(device, netip.MustParseAddr("10.0.0.100"))
+	h.WaitConnected(p)
+	requireTCPEcho(t, p, a, 8000)
+
+	// rejected devices receive the reason
+	req.PublicKey = generateKey(t).PublicKey().String()
+	require.Equal(t, http.StatusAccepted, h.Client(a).Do(http.MethodPost, "/register", req, &res))
+	rejectedID := res.ID
+	reject := api.RejectRegistrationRequest{Reason: "unknown device"}
+	require.Equal(t, http.StatusOK, client.Do(http.MethodPost, "/registrations/"+rejectedID+"/reject", reject, nil))
+	require.Equal(t, http.StatusBadRequest, client.Do(http.MethodPost, "/registrations/"+rejectedID+"/approve", approve, nil))
+	res = enroll.RegistrationResult{}
+	require.Equal(t, http.StatusOK, h.Client(a).Do(http.MethodGet, "/register/"+rejectedID, nil, &res))
+	require.Equal(t, "rejected", res.Status)
+	require.Equal(t, "unknown device", res.Reason)
+	require.Nil(t, res.Response)
+	require.Equal(t, http.StatusNotFound, h.Client(a).Do(http.MethodGet, "/register/unknown", nil, nil))
+
+	var rejected []*peers.Registration
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/registrations?status=rejected", nil, &rejected))
+	require.Len(t, rejected, 1)
+	require.Equal(t, "unknown device", rejected[0].Reason)
+	var page audit.Page
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/audit?action=peer.registration_approve", nil, &page))
+	require.Equal(t, 1, page.Total)
+
+	// registrations are not counted as failed logins of the source address
+	req.PublicKey = generateKey(t).PublicKey().String()
+	require.Equal(t, http.StatusAccepted, h.Client(a).Do(http.MethodPost, "/register", req, nil))
+	var lockouts []*auth.Lockout
+	require.Equal(t, http.StatusOK, client.Do(http.MethodGet, "/auth/lockouts", nil, &lockouts))
+	require.Empty(t, lockouts)
+	require.Equal(t, http.StatusOK, h.Client(a).Login("admin", AdminPassword))
+}
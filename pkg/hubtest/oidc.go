@@ -0,0 +1,210 @@
+package hubtest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+// OIDCClientID is the client id of the hub at the test identity provider.
+const OIDCClientID = "wg-hub"
+
+// OIDCProvider is a minimal OpenID Connect identity provider that logs in
+// the configured user without interaction. It supports the authorization
+// code flow with PKCE (S256) only.
+type OIDCProvider struct {
+	t      testing.TB
+	server *httptest.Server
+	key    jwk.Key
+	// Issuer is the URL of the provider.
+	Issuer string
+
+	mu       sync.Mutex
+	username string
+	groups   []string
+	codes    map[string]*oidcCode
+}
+
+type oidcCode struct {
+	challenge   string
+	redirectURI string
+	nonce       string
+	username    string
+	groups      []string
+}
+
+// NewOIDCProvider starts an identity provider on a random loopback port, it is closed when the test finishes.
+func NewOIDCProvider(t testing.TB) *OIDCProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key, err := jwk.FromRaw(rsaKey)
+	require.NoError(t, err)
+	require.NoError(t, key.Set(jwk.KeyIDKey, "hubtest"))
+	require.NoError(t, key.Set(jwk.AlgorithmKey, jwa.RS256))
+
+	p := &OIDCProvider{
+		t:     t,
+		key:   key,
+		codes: make(map[string]*oidcCode),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("/authorize", p.handleAuthorize)
+	mux.HandleFunc("/token", p.handleToken)
+	mux.HandleFunc("/jwks", p.handleJWKS)
+	p.server = httptest.NewServer(mux)
+	p.Issuer = p.server.URL
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// Config returns the hub config for the provider, the groups admins, operators and viewers map to the roles.
+func (p *OIDCProvider) Config() *config.OIDCConfig {
+	return &config.OIDCConfig{
+		Issuer:         p.Issuer,
+		ClientID:       OIDCClientID,
+		AdminGroups:    []string{"admins"},
+		OperatorGroups: []string{"operators"},
+		ViewerGroups:   []string{"viewers"},
+	}
+}
+
+// SetUser sets the user that is logged in by the authorization endpoint.
+func (p *OIDCProvider) SetUser(username string, groups ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.username = username
+	p.groups = groups
+}
+
+func (p *OIDCProvider) writeJSON(w http.ResponseWriter, v any, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (p *OIDCProvider) handleDiscovery(w http.ResponseWriter, _ *http.Request) {
+	p.writeJSON(w, map[string]string{
+		"issuer":                 p.Issuer,
+		"authorization_endpoint": p.Issuer + "/authorize",
+		"token_endpoint":         p.Issuer + "/token",
+		"jwks_uri":               p.Issuer + "/jwks",
+	}, http.StatusOK)
+}
+
+func (p *OIDCProvider) handleJWKS(w http.ResponseWriter, _ *http.Request) {
+	publicKey, err := p.key.PublicKey()
+	require.NoError(p.t, err)
+	set := jwk.NewSet()
+	require.NoError(p.t, set.AddKey(publicKey))
+	p.writeJSON(w, set, http.StatusOK)
+}
+
+func (p *OIDCProvider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != OIDCClientID ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	codeBytes := make([]byte, 16)
+	_, err := rand.Read(codeBytes)
+	require.NoError(p.t, err)
+	code := base64.RawURLEncoding.EncodeToString(codeBytes)
+	p.mu.Lock()
+	p.codes[code] = &oidcCode{
+		challenge:   q.Get("code_challenge"),
+		redirectURI: q.Get("redirect_uri"),
+		nonce:       q.Get("nonce"),
+		username:    p.username,
+		groups:      p.groups,
+	}
+	p.mu.Unlock()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	require.NoError(p.t, err)
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *OIDCProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		p.writeJSON(w, map[string]string{"error": "invalid_request"}, http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	code, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || code.redirectURI != r.PostForm.Get("redirect_uri") || r.PostForm.Get("client_id") != OIDCClientID ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != code.challenge {
+		p.writeJSON(w, map[string]string{"error": "invalid_grant"}, http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	token, err := jwt.NewBuilder().
+		Issuer(p.Issuer).
+		Audience([]string{OIDCClientID}).
+		Subject("sub-"+code.username).
+		IssuedAt(now).
+		Expiration(now.Add(5*time.Minute)).
+		Claim("nonce", code.nonce).
+		Claim("preferred_username", code.username).
+		Claim("groups", code.groups).
+		Build()
+	require.NoError(p.t, err)
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.RS256, p.key))
+	require.NoError(p.t, err)
+	p.writeJSON(w, map[string]string{
+		"access_token": "unused",
+		"token_type":   "Bearer",
+		"id_token":     string(signed),
+	}, http.StatusOK)
+}
+
+// OIDCLogin runs the browser side of the OIDC login of the hub from the peer
+// and returns the values of the URL fragment of the final webui redirect
+// (token, refreshToken and expiresAt or error).
+func (h *Hub) OIDCLogin(p *Peer) url.Values {
+	noRedirect := func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	peerClient := &http.Client{
+		Transport:     &http.Transport{DialContext: p.dialContext, DisableKeepAlives: true},
+		CheckRedirect: noRedirect,
+		Timeout:       ConnectTimeout,
+	}
+	hostClient := &http.Client{CheckRedirect: noRedirect, Timeout: ConnectTimeout}
+
+	location := "http://" + HubAddress + "/api/auth/oidc/login"
+	for _, client := range []*http.Client{peerClient, hostClient, peerClient} {
+		resp, err := client.Get(location)
+		require.NoError(h.t, err)
+		_ = resp.Body.Close()
+		require.Equal(h.t, http.StatusFound, resp.StatusCode)
+		location = resp.Header.Get("Location")
+	}
+	redirect, err := url.Parse(location)
+	require.NoError(h.t, err)
+	require.Equal(h.t, "/", redirect.Path)
+	values, err := url.ParseQuery(redirect.Fragment)
+	require.NoError(h.t, err)
+	return values
+}
@@ -0,0 +1,167 @@
+package loopback
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// UnknownPeer is the source or destination of packets that match no allowed ip.
+const UnknownPeer = "unknown"
+
+// MatrixEntry is the traffic from a source to a destination peer with a protocol.
+type MatrixEntry struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Protocol    string `json:"protocol"`
+	Bytes       uint64 `json:"bytes"`
+	Packets     uint64 `json:"packets"`
+}
+
+type pair struct {
+	src, dst string
+	protocol uint8
+}
+
+type counter struct {
+	bytes, packets uint64
+}
+
+type peerPrefix struct {
+	prefix    netip.Prefix
+	publicKey string
+}
+
+// Matrix attributes the packets that pass the loopback to their source and
+// destination peer by the allowed ips and counts the traffic per pair.
+type Matrix struct {
+	mu       sync.Mutex
+	prefixes []peerPrefix
+	counters map[pair]*counter
+}
+
+func NewMatrix() *Matrix {
+	return &Matrix{counters: make(map[pair]*counter)}
+}
+
+// SetPeers replaces the allowed ips of the peers (public key to allowed ip), the traffic of removed peers is dropped.
+func (m *Matrix) SetPeers(peers map[string]netip.Prefix) {
+	prefixes := make([]peerPrefix, 0, len(peers))
+	for publicKey, prefix := range peers {
+		prefixes = append(prefixes, peerPrefix{prefix: prefix.Masked(), publicKey: publicKey})
+	}
+	// the most specific prefix matches first
+	slices.SortFunc(prefixes, func(a, b peerPrefix) int {
+		return b.prefix.Bits() - a.prefix.Bits()
+	})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prefixes = prefixes
+	for p := range m.counters {
+		_, srcOk := peers[p.src]
+		_, dstOk := peers[p.dst]
+		if (!srcOk && p.src != UnknownPeer) || (!dstOk && p.dst != UnknownPeer) {
+			delete(m.counters, p)
+		}
+	}
+}
+
+func (m *Matrix) lookup(addr netip.Addr) string {
+	for _, p := range m.prefixes {
+		if p.prefix.Contains(addr) {
+			return p.publicKey
+		}
+	}
+	return UnknownPeer
+}
+
+// parsePacket returns the addresses and the protocol of an IPv4 or IPv6 packet.
+func parsePacket(packet []byte) (src, dst netip.Addr, protocol uint8, ok bool) {
+	if len(packet) == 0 {
+		return src, dst, 0, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return src, dst, 0, false
+		}
+		src = netip.AddrFrom4([4]byte(packet[12:16]))
+		dst = netip.AddrFrom4([4]byte(packet[16:20]))
+		return src, dst, packet[9], true
+	case 6:
+		if len(packet) < 40 {
+			return src, dst, 0, false
+		}
+		src = netip.AddrFrom16([16]byte(packet[8:24]))
+		dst = netip.AddrFrom16([16]byte(packet[24:40]))
+		// extension headers are not followed
+		return src, dst, packet[6], true
+	}
+	return src, dst, 0, false
+}
+
+// Observe counts the packet.
+func (m *Matrix) Observe(packet []byte) {
+	src, dst, protocol, ok := parsePacket(packet)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := pair{src: m.lookup(src), dst: m.lookup(dst), protocol: protocol}
+	c, ok := m.counters[p]
+	if !ok {
+		c = &counter{}
+		m.counters[p] = c
+	}
+	c.bytes += uint64(len(packet))
+	c.packets++
+}
+
+func protocolName(protocol uint8) string {
+	switch protocol {
+	case 1:
+		return "icmp"
+	case 6:
+		return "tcp"
+	case 17:
+		return "udp"
+	case 58:
+		return "icmpv6"
+	}
+	return strconv.Itoa(int(protocol))
+}
+
+// Entries returns the traffic of all pairs, sorted by bytes (descending).
+func (m *Matrix) Entries() []*MatrixEntry {
+	entries := make([]*MatrixEntry, 0)
+	if m == nil {
+		return entries
+	}
+	m.mu.Lock()
+	for p, c := range m.counters {
+		entries = append(entries, &MatrixEntry{
+			Source:      p.src,
+			Destination: p.dst,
+			Protocol:    protocolName(p.protocol),
+			Bytes:       c.bytes,
+			Packets:     c.packets,
+		})
+	}
+	m.mu.Unlock()
+	slices.SortFunc(entries, func(a, b *MatrixEntry) int {
+		if c := cmp.Compare(b.Bytes, a.Bytes); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.Source, b.Source); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.Destination, b.Destination); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Protocol, b.Protocol)
+	})
+	return entries
+}
@@ -0,0 +1,53 @@
+package loopback
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func ipv4Packet(src, dst string, protocol uint8, size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = 0x45
+	packet[9] = protocol
+	copy(packet[12:16], netip.MustParseAddr(src).AsSlice())
+	copy(packet[16:20], netip.MustParseAddr(dst).AsSlice())
+	return packet
+}
+
+func TestMatrix(t *testing.T) {
+	var nilMatrix *Matrix
+	require.Empty(t, nilMatrix.Entries())
+
+	m := NewMatrix()
+	m.SetPeers(map[string]netip.Prefix{
+		"a":   netip.MustParsePrefix("10.0.0.1/32"),
+		"b":   netip.MustParsePrefix("10.0.0.2/32"),
+		"net": netip.MustParsePrefix("10.0.1.0/24"),
+		"all": netip.MustParsePrefix("10.0.0.0/16"),
+	})
+	m.Observe(ipv4Packet("10.0.0.1", "10.0.0.2", 6, 100))
+	m.Observe(ipv4Packet("10.0.0.1", "10.0.0.2", 6, 60))
+	m.Observe(ipv4Packet("10.0.0.2", "10.0.1.5", 17, 80))
+	m.Observe(ipv4Packet("10.0.0.2", "10.0.2.5", 1, 40))
+	m.Observe(ipv4Packet("192.168.0.1", "10.0.0.1", 99, 20))
+	m.Observe([]byte{0x45, 0})
+
+	require.Equal(t, []*MatrixEntry{
+		{Source: "a", Destination: "b", Protocol: "tcp", Bytes: 160, Packets: 2},
+		{Source: "b", Destination: "net", Protocol: "udp", Bytes: 80, Packets: 1},
+		{Source: "b", Destination: "all", Protocol: "icmp", Bytes: 40, Packets: 1},
+		{Source: UnknownPeer, Destination: "a", Protocol: "99", Bytes: 20, Packets: 1},
+	}, m.Entries())
+
+	// the traffic of removed peers is dropped
+	m.SetPeers(map[string]netip.Prefix{
+		"a": netip.MustParsePrefix("10.0.0.1/32"),
+		"b": netip.MustParsePrefix("10.0.0.2/32"),
+	})
+	require.Equal(t, []*MatrixEntry{
+		{Source: "a", Destination: "b", Protocol: "tcp", Bytes: 160, Packets: 2},
+		{Source: UnknownPeer, Destination: "a", Protocol: "99", Bytes: 20, Packets: 1},
+	}, m.Entries())
+}
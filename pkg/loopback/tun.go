@@ -13,10 +13,29 @@ type Tun struct {
 	writeSignal chan struct{}
 	readSignal  chan struct{}
 	mtu         int
+	observers   []Observer
+	scheduler   Scheduler
 }
 
-func CreateTun(mtu int) tun.Device {
+// Observer receives every packet that passes the loopback, the packet must not be modified or retained.
+type Observer interface {
+	Observe(packet []byte)
+}
+
+// Scheduler queues the packets that are written to the loopback and decides when they are read again.
+type Scheduler interface {
+	// Enqueue copies the packet into the queue, it reports whether the packet was queued or dropped.
+	Enqueue(packet []byte) bool
+	// Dequeue blocks until a packet is due, copies it into buf and returns its size.
+	Dequeue(buf []byte) (int, error)
+	// Close stops the scheduler, pending and future Dequeue calls return an error.
+	Close() error
+}
+
+// CreateTun creates a tun device that returns every written packet back to the device.
+func CreateTun(mtu int, observers ...Observer) tun.Device {
 	dev := &Tun{
+		observers:   observers,
 		events:      make(chan tun.Event, 10),
 		buf:         bytes.NewBuffer(nil),
 		writeSignal: make(chan struct{}, 1),
@@ -28,17 +47,43 @@ func CreateTun(mtu int) tun.Device {
 	return dev
 }
 
+// CreateScheduledTun creates a tun device that returns the written packets in the order of the scheduler.
+func CreateScheduledTun(mtu int, scheduler Scheduler, observers ...Observer) tun.Device {
+	dev := &Tun{
+		observers: observers,
+		scheduler: scheduler,
+		events:    make(chan tun.Event, 10),
+		mtu:       mtu,
+	}
+	dev.events <- tun.EventUp
+	return dev
+}
+
 func (tun *Tun) File() *os.File {
 	return nil
 }
 
 func (tun *Tun) Read(buffs [][]byte, sizes []int, offset int) (int, error) {
+	if tun.scheduler != nil {
+		n, err := tun.scheduler.Dequeue(buffs[0][offset:])
+		if err != nil {
+			return 0, os.ErrClosed
+		}
+		sizes[0] = n
+		for _, o := range tun.observers {
+			o.Observe(buffs[0][offset : offset+n])
+		}
+		return 1, nil
+	}
 	_, ok := <-tun.readSignal
 	if !ok {
 		return 0, os.ErrClosed
 	}
 	n, err := tun.buf.Read(buffs[0][offset:])
 	sizes[0] = n
+	for _, o := range tun.observers {
+		o.Observe(buffs[0][offset : offset+n])
+	}
 	tun.writeSignal <- struct{}{}
 	return 1, err
 }
@@ -51,6 +96,11 @@ func (tun *Tun) Write(buffs [][]byte, offset int) (int, error) {
 	if len(packet) == 0 {
 		return 1, nil
 	}
+	if tun.scheduler != nil {
+		// dropped packets are lost like on a congested link
+		tun.scheduler.Enqueue(packet)
+		return 1, nil
+	}
 	_, ok := <-tun.writeSignal
 	if !ok {
 		return 0, os.ErrClosed
@@ -77,6 +127,9 @@ func (tun *Tun) Close() error {
 	if tun.events != nil {
 		close(tun.events)
 	}
+	if tun.scheduler != nil {
+		return tun.scheduler.Close()
+	}
 
 	// take out the write signal
 	<-tun.writeSignal
@@ -0,0 +1,489 @@
+package peers
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/christophwitzko/wg-hub/pkg/wgconn"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// storeKey is the key of the peers that were added at runtime.
+	storeKey = "peers"
+	// tagsStoreKey is the key of the tags of the enrolled peers.
+	tagsStoreKey = "peer_tags"
+	// groupsStoreKey is the key of the groups of the approved peers.
+	groupsStoreKey = "peer_groups"
+)
+
+// ValidationError is returned if a peer change is rejected because of invalid input.
+type ValidationError struct {
+	msg string
+}
+
+func (e *ValidationError) Error() string {
+	return e.msg
+}
+
+var (
+	ErrInvalidPublicKey = &ValidationError{"failed to decode peer public key"}
+	ErrInvalidAllowedIP = &ValidationError{"failed to parse allowed ip"}
+	ErrHubOverlap       = &ValidationError{"hub address overlaps with allowed ip"}
+	ErrAllowedIPInUse   = &ValidationError{"allowed ip already in use"}
+	ErrPeerExists       = &ValidationError{"peer already exists"}
+	ErrInvalidSources   = &ValidationError{"failed to parse allowed sources"}
+)
+
+type AddResult struct {
+	AllowedIP  string `json:"allowedIP"`
+	HubNetwork string `json:"hubNetwork"`
+	// PreviousAllowedIP is the allowed ip before the update, empty if the peer was added.
+	PreviousAllowedIP string `json:"previousAllowedIP,omitempty"`
+}
+
+// AddOption configures how a peer is added.
+type AddOption func(*addOptions)
+
+type addOptions struct {
+	disabled bool
+}
+
+// WithDisabled adds the peer suspended as disabled, so its allowed ip is never set on the device.
+func WithDisabled() AddOption {
+	return func(o *addOptions) {
+		o.disabled = true
+	}
+}
+
+// Manager serializes all peer changes of the hub device, persists
+// the peers that were added at runtime and publishes the changes.
+type Manager struct {
+	log   *logrus.Logger
+	dev   *device.Device
+	cfg   *config.Config
+	store store.Store
+	bus   *events.Bus
+	// filter is nil if the bind of the hub does not filter source addresses
+	filter *wgconn.SourceFilter
+
+	mu sync.Mutex // serializes all ipc operations
+	// runtimePeers maps the public key of peers added at runtime to their allowed ip
+	runtimePeers map[string]string
+	// suspended maps the public key of suspended peers to their reserved allowed ip
+	suspended map[string]*suspension
+	// tags maps the public key of enrolled peers to the tag of their pre-auth key
+	tags map[string]string
+	// groups maps the public key of approved peers to the groups assigned by the admin
+	groups map[string][]string
+	// sources maps the public key of peers to their allowed source addresses
+	sources map[string][]string
+}
+
+func NewManager(log *logrus.Logger, dev *device.Device, cfg *config.Config, st store.Store, bus *events.Bus) *Manager {
+	sources := make(map[string][]string)
+	for _, peer := range cfg.Peers {
+		if len(peer.AllowedSources) > 0 {
+			sources[peer.PublicKey] = peer.AllowedSources
+		}
+	}
+	return &Manager{
+		log:          log,
+		dev:          dev,
+		cfg:          cfg,
+		store:        st,
+		bus:          bus,
+		runtimePeers: make(map[string]string),
+		suspended:    make(map[string]*suspension),
+		tags:         make(map[string]string),
+		groups:       make(map[string][]string),
+		sources:      sources,
+	}
+}
+
+// SetSourceFilter sets the source filter that receives the changes of the allowed sources of the peers.
+func (m *Manager) SetSourceFilter(filter *wgconn.SourceFilter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.filter = filter
+}
+
+// setSources sets the allowed source addresses of the peer, empty sources remove the restriction.
+// Empty sources are kept to override the allowed sources of the config file after a restart.
+func (m *Manager) setSources(publicKey string, sources []string) {
+	if sources != nil {
+		m.sources[publicKey] = sources
+	} else {
+		delete(m.sources, publicKey)
+	}
+	key, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return
+	}
+	prefixes := make([]netip.Prefix, len(sources))
+	for i, source := range sources {
+		prefixes[i] = netip.MustParsePrefix(source)
+	}
+	m.filter.SetPeerSources(key, prefixes)
+}
+
+// AllowedSources returns the allowed source addresses of the peer.
+func (m *Manager) AllowedSources(publicKey string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.sources[publicKey])
+}
+
+// Restore adds the peers that were added at runtime before the last restart, suspends
+// the suspended peers and applies the enabled flag of the peers of the config file.
+func (m *Manager) Restore() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var storedPeers []*config.Peer
+	err := m.store.Load(storeKey, &storedPeers)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("failed to load peers: %w", err)
+	}
+	err = m.store.Load(tagsStoreKey, &m.tags)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("failed to load peer tags: %w", err)
+	}
+	err = m.store.Load(groupsStoreKey, &m.groups)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("failed to load peer groups: %w", err)
+	}
+	for _, peer := range storedPeers {
+		publicKeyHex, err := ipc.Base64ToHex(peer.PublicKey)
+		if err != nil {
+			m.log.Warnf("skipping stored peer %s: %v", peer.PublicKey, err)
+			continue
+		}
+		err = m.dev.IpcSet(fmt.Sprintf("public_key=%s\nreplace_allowed_ips=true\nallowed_ip=%s\n", publicKeyHex, peer.AllowedIP))
+		if err != nil {
+			return fmt.Errorf("failed to restore peer %s: %w", peer.PublicKey, err)
+		}
+		m.runtimePeers[peer.PublicKey] = peer.AllowedIP
+		if peer.AllowedSources != nil {
+			m.setSources(peer.PublicKey, peer.AllowedSources)
+		}
+		m.log.Infof("restored peer %s (%s)", publicKeyHex, peer.AllowedIP)
+	}
+	if err := m.restoreSuspensions(); err != nil {
+		return err
+	}
+	return m.applyEnabled()
+}
+
+func (m *Manager) persist() {
+	storedPeers := make([]*config.Peer, 0, len(m.runtimePeers))
+	for publicKey, allowedIP := range m.runtimePeers {
+		storedPeers = append(storedPeers, &config.Peer{
+			PublicKey:      publicKey,
+			AllowedIP:      allowedIP,
+			AllowedSources: m.sources[publicKey],
+		})
+	}
+	sort.Slice(storedPeers, func(i, j int) bool {
+		return storedPeers[i].PublicKey < storedPeers[j].PublicKey
+	})
+	if err := m.store.Save(storeKey, storedPeers); err != nil {
+		m.log.Errorf("failed to persist peers: %v", err)
+	}
+}
+
+// List returns all peers of the hub device including the hub instance,
+// suspended peers are returned with their reserved allowed ip.
+func (m *Manager) List() ([]*ipc.Peer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.list()
+}
+
+func (m *Manager) list() ([]*ipc.Peer, error) {
+	devConfig, err := m.dev.IpcGet()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ipc operation")
+	}
+	peers := ipc.ParsePeers(devConfig)
+	for _, peer := range peers {
+		if s, ok := m.suspended[peer.PublicKey]; ok {
+			peer.AllowedIP = s.AllowedIP
+		}
+	}
+	return peers, nil
+}
+
+func getAllowedIPRanges(peers []*ipc.Peer) []string {
+	ipRanges := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		ipRanges = append(ipRanges, peer.AllowedIP)
+	}
+	return ipRanges
+}
+
+// Add adds or updates the peer with the given base64 encoded public key. If the
+// allowed ip is empty, a random free ip of the hub network is assigned. The allowed
+// sources replace the allowed source addresses of the peer, nil keeps them.
+func (m *Manager) Add(publicKey, allowedIP string, allowedSources []string, opts ...AddOption) (*AddResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.add(publicKey, allowedIP, allowedSources, opts...)
+}
+
+//gocyclo:ignore
+func (m *Manager) add(publicKey, allowedIP string, allowedSources []string, opts ...AddOption) (*AddResult, error) {
+	var o addOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	publicKeyHex, err := ipc.Base64ToHex(publicKey)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	if allowedSources != nil {
+		allowedSources, err = config.NormalizePrefixes(allowedSources)
+		if err != nil {
+			return nil, ErrInvalidSources
+		}
+	}
+	peers, err := m.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var hubNetwork, allowedIPPrefix string
+	if allowedIP == "" {
+		allowedIPPrefix, hubNetwork, err = config.GenerateRandomIP(getAllowedIPRanges(peers))
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate random ip")
+		}
+	} else {
+		allowedIPPrefix, err = config.NormalizeAllowedIP(allowedIP)
+		if err != nil {
+			return nil, ErrInvalidAllowedIP
+		}
+		hubNetwork, err = config.FindMinimalNetwork(append(getAllowedIPRanges(peers), allowedIPPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("failed to find hub network")
+		}
+	}
+
+	hubOverlap, err := config.CheckIPOverlap(allowedIPPrefix, m.cfg.GetHubAddress())
+	if err != nil {
+		return nil, fmt.Errorf("failed to check ip overlap")
+	}
+	if hubOverlap {
+		return nil, ErrHubOverlap
+	}
+
+	var previousAllowedIP string
+	for _, peer := range peers {
+		if peer.PublicKey == publicKey {
+			// the peer may keep or change its own allowed ip
+			previousAllowedIP = peer.AllowedIP
+			continue
+		}
+		overlap, overlapErr := config.CheckIPOverlap(peer.AllowedIP, allowedIPPrefix)
+		if overlapErr != nil {
+			return nil, fmt.Errorf("failed to check ip overlap")
+		}
+		if overlap {
+			return nil, ErrAllowedIPInUse
+		}
+	}
+	addInstruction := fmt.Sprintf(
+		"public_key=%s\nreplace_allowed_ips=true\nallowed_ip=%s\n",
+		publicKeyHex,
+		allowedIPPrefix,
+	)
+	// suspended peers keep the new allowed ip reserved
+	s, suspended := m.suspended[publicKey]
+	if suspended || o.disabled {
+		addInstruction = fmt.Sprintf("public_key=%s\nreplace_allowed_ips=true\n", publicKeyHex)
+	}
+	err = m.dev.IpcSet(addInstruction)
+	if err != nil {
+		m.log.Errorf("failed to add peer: %v", err)
+		return nil, fmt.Errorf("failed to add peer")
+	}
+	m.log.Infof("added peer %s (%s)", publicKeyHex, allowedIPPrefix)
+	m.runtimePeers[publicKey] = allowedIPPrefix
+	if allowedSources != nil {
+		m.setSources(publicKey, allowedSources)
+	}
+	m.persist()
+	if suspended {
+		s.AllowedIP = allowedIPPrefix
+		if o.disabled && !slices.Contains(s.Reasons, SuspendDisabled) {
+			s.Reasons = append(s.Reasons, SuspendDisabled)
+		}
+		m.persistSuspensions()
+	} else if o.disabled {
+		m.log.Infof("suspended peer %s (%s): %s", publicKeyHex, allowedIPPrefix, SuspendDisabled)
+		m.suspended[publicKey] = &suspension{AllowedIP: allowedIPPrefix, Reasons: []SuspendReason{SuspendDisabled}}
+		m.persistSuspensions()
+	}
+	if previousAllowedIP == "" {
+		m.bus.Publish(events.PeerAdded, &events.PeerData{PublicKey: publicKey, AllowedIP: allowedIPPrefix})
+	} else {
+		m.bus.Publish(events.PeerUpdated, &events.PeerData{
+			PublicKey:         publicKey,
+			AllowedIP:         allowedIPPrefix,
+			PreviousAllowedIP: previousAllowedIP,
+		})
+	}
+	if !suspended && o.disabled {
+		m.bus.Publish(events.PeerSuspended, &events.PeerData{PublicKey: publicKey, AllowedIP: allowedIPPrefix, Reason: string(SuspendDisabled)})
+	}
+	return &AddResult{AllowedIP: allowedIPPrefix, HubNetwork: hubNetwork, PreviousAllowedIP: previousAllowedIP}, nil
+}
+
+// Remove removes the peer with the given base64 encoded public key and
+// returns its allowed ip (empty if the peer did not exist).
+func (m *Manager) Remove(publicKey string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	publicKeyHex, err := ipc.Base64ToHex(publicKey)
+	if err != nil {
+		return "", ErrInvalidPublicKey
+	}
+	peers, err := m.list()
+	if err != nil {
+		return "", err
+	}
+	var allowedIP string
+	for _, peer := range peers {
+		if peer.PublicKey == publicKey {
+			allowedIP = peer.AllowedIP
+		}
+	}
+	deleteInstruction := fmt.Sprintf("public_key=%s\nremove=true\n", publicKeyHex)
+	err = m.dev.IpcSet(deleteInstruction)
+	if err != nil {
+		m.log.Errorf("failed to remove peer: %v", err)
+		return "", fmt.Errorf("failed to remove peer")
+	}
+	m.log.Infof("removed peer %s", publicKeyHex)
+	if _, ok := m.runtimePeers[publicKey]; ok {
+		delete(m.runtimePeers, publicKey)
+		m.persist()
+	}
+	if _, ok := m.suspended[publicKey]; ok {
+		delete(m.suspended, publicKey)
+		m.persistSuspensions()
+	}
+	if _, ok := m.tags[publicKey]; ok {
+		delete(m.tags, publicKey)
+		m.persistTags()
+	}
+	if _, ok := m.groups[publicKey]; ok {
+		delete(m.groups, publicKey)
+		m.persistGroups()
+	}
+	m.setSources(publicKey, nil)
+	if allowedIP != "" {
+		m.bus.Publish(events.PeerRemoved, &events.PeerData{PublicKey: publicKey, AllowedIP: allowedIP})
+	}
+	return allowedIP, nil
+}
+
+func (m *Manager) persistTags() {
+	if err := m.store.Save(tagsStoreKey, m.tags); err != nil {
+		m.log.Errorf("failed to persist peer tags: %v", err)
+	}
+}
+
+// Tag returns the tag of an enrolled peer.
+func (m *Manager) Tag(publicKey string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tags[publicKey]
+}
+
+func (m *Manager) persistGroups() {
+	if err := m.store.Save(groupsStoreKey, m.groups); err != nil {
+		m.log.Errorf("failed to persist peer groups: %v", err)
+	}
+}
+
+// Groups returns the groups of an approved peer.
+func (m *Manager) Groups(publicKey string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.groups[publicKey])
+}
+
+// listNew returns the peers of the hub device if the peer does not exist yet.
+func (m *Manager) listNew(publicKey string) ([]*ipc.Peer, error) {
+	if _, err := ipc.Base64ToHex(publicKey); err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	peers, err := m.list()
+	if err != nil {
+		return nil, err
+	}
+	if slices.ContainsFunc(peers, func(p *ipc.Peer) bool { return p.PublicKey == publicKey }) {
+		return nil, ErrPeerExists
+	}
+	return peers, nil
+}
+
+// Enroll adds a new peer with a random free ip of the pool (the hub network if
+// empty) and tags it, enrolling an existing peer is rejected.
+func (m *Manager) Enroll(publicKey, pool, tag string) (*AddResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peers, err := m.listNew(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	allowedIP := ""
+	if pool != "" {
+		allowedIP, _, err = config.GenerateRandomIPInPool(pool, getAllowedIPRanges(peers))
+		if err != nil {
+			return nil, &ValidationError{err.Error()}
+		}
+	}
+	res, err := m.add(publicKey, allowedIP, nil)
+	if err != nil {
+		return nil, err
+	}
+	if tag != "" {
+		m.tags[publicKey] = tag
+		m.persistTags()
+	}
+	return res, nil
+}
+
+// Approve adds the peer of an approved registration with the allowed ip (a random free
+// ip of the hub network if empty) and its groups, approving an existing peer is rejected.
+func (m *Manager) Approve(publicKey, allowedIP string, groups []string) (*AddResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.listNew(publicKey); err != nil {
+		return nil, err
+	}
+	res, err := m.add(publicKey, allowedIP, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) > 0 {
+		m.groups[publicKey] = slices.Clone(groups)
+		m.persistGroups()
+	}
+	return res, nil
+}
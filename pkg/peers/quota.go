@@ -0,0 +1,308 @@
+package peers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// quotasStoreKey is the key of the quotas and their usage.
+	quotasStoreKey = "peer_quotas"
+	// quotaPersistInterval limits how often the usage is persisted, state changes are persisted immediately.
+	quotaPersistInterval = time.Minute
+)
+
+// QuotaStatus is the quota of a peer and its usage in the current period.
+type QuotaStatus struct {
+	*config.PeerQuota
+	Used        uint64    `json:"used"`
+	Remaining   uint64    `json:"remaining"`
+	PeriodStart time.Time `json:"periodStart"`
+	// PeriodEnd is empty for one-off quotas.
+	PeriodEnd *time.Time `json:"periodEnd,omitempty"`
+	Exhausted bool       `json:"exhausted"`
+}
+
+type quotaState struct {
+	Quota *config.PeerQuota `json:"quota"`
+	// Runtime quotas were set via the API and are not replaced by the config file.
+	Runtime     bool      `json:"runtime"`
+	Used        uint64    `json:"used"`
+	Warned      bool      `json:"warned"`
+	Exhausted   bool      `json:"exhausted"`
+	PeriodStart time.Time `json:"periodStart"`
+}
+
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+func (s *quotaState) periodEnd() *time.Time {
+	if s.Quota.Period != config.QuotaMonthly {
+		return nil
+	}
+	end := monthStart(s.PeriodStart).AddDate(0, 1, 0)
+	return &end
+}
+
+func (s *quotaState) status() *QuotaStatus {
+	limit := s.Quota.Bytes()
+	return &QuotaStatus{
+		PeerQuota:   s.Quota,
+		Used:        s.Used,
+		Remaining:   limit - min(limit, s.Used),
+		PeriodStart: s.PeriodStart,
+		PeriodEnd:   s.periodEnd(),
+		Exhausted:   s.Exhausted,
+	}
+}
+
+// Quotas accounts the received and sent bytes of the peers with a quota, warns
+// once the warning threshold is reached and suspends the peers with an
+// exhausted quota until the quota is reset or the next period starts.
+type Quotas struct {
+	log     *logrus.Logger
+	suspend func(publicKey string, reason SuspendReason) error
+	resume  func(publicKey string, reason SuspendReason) error
+	now     func() time.Time
+	bus     *events.Bus
+	store   store.Store
+
+	mu     sync.Mutex
+	quotas map[string]*quotaState
+	// counters are the device counters (rx+tx) of the previous poll
+	counters    map[string]uint64
+	dirty       bool
+	lastPersist time.Time
+}
+
+// NewQuotas restores the persisted quotas and their usage, the quotas of the config
+// file replace the persisted quotas that were not set via the API.
+func NewQuotas(manager *Manager, bus *events.Bus, quotas []*config.PeerQuota) (*Quotas, error) {
+	q := &Quotas{
+		log:      manager.log,
+		suspend:  manager.Suspend,
+		resume:   manager.Resume,
+		now:      time.Now,
+		bus:      bus,
+		store:    manager.store,
+		quotas:   make(map[string]*quotaState),
+		counters: make(map[string]uint64),
+	}
+	if err := q.restore(quotas); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Quotas) restore(quotas []*config.PeerQuota) error {
+	err := q.store.Load(quotasStoreKey, &q.quotas)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("failed to load peer quotas: %w", err)
+	}
+	configured := make(map[string]*config.PeerQuota, len(quotas))
+	for _, quota := range quotas {
+		configured[quota.PublicKey] = quota
+	}
+	now := q.now()
+	for publicKey, s := range q.quotas {
+		_, ok := configured[publicKey]
+		if s.Quota == nil || s.Quota.Validate() != nil || (!s.Runtime && !ok) {
+			delete(q.quotas, publicKey)
+			q.dirty = true
+		}
+	}
+	for publicKey, quota := range configured {
+		s, ok := q.quotas[publicKey]
+		if !ok {
+			q.quotas[publicKey] = &quotaState{Quota: quota, PeriodStart: q.periodStart(quota, now)}
+			q.dirty = true
+			continue
+		}
+		if !s.Runtime {
+			s.Quota = quota
+		}
+	}
+	return nil
+}
+
+func (q *Quotas) periodStart(quota *config.PeerQuota, now time.Time) time.Time {
+	if quota.Period == config.QuotaMonthly {
+		return monthStart(now)
+	}
+	return now
+}
+
+// Run waits until the context is done and persists the usage on exit.
+func (q *Quotas) Run(ctx context.Context) {
+	<-ctx.Done()
+	q.mu.Lock()
+	q.persist(true)
+	q.mu.Unlock()
+}
+
+func (q *Quotas) persist(force bool) {
+	now := q.now()
+	if !q.dirty || (!force && now.Sub(q.lastPersist) < quotaPersistInterval) {
+		return
+	}
+	if err := q.store.Save(quotasStoreKey, q.quotas); err != nil {
+		q.log.Errorf("failed to persist peer quotas: %v", err)
+		return
+	}
+	q.dirty = false
+	q.lastPersist = now
+}
+
+// Update accounts the device counters of the peers, it is called with the
+// peers of every watcher poll.
+func (q *Quotas) Update(devicePeers []*ipc.Peer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	seen := make(map[string]bool, len(devicePeers))
+	for _, peer := range devicePeers {
+		seen[peer.PublicKey] = true
+		counter := peer.RxBytes + peer.TxBytes
+		previous := q.counters[peer.PublicKey]
+		q.counters[peer.PublicKey] = counter
+		s, ok := q.quotas[peer.PublicKey]
+		if !ok {
+			continue
+		}
+		// the device counters start at zero if the peer was added again
+		delta := counter
+		if counter >= previous {
+			delta = counter - previous
+		}
+		if delta > 0 {
+			s.Used += delta
+			q.dirty = true
+		}
+		q.check(peer.PublicKey, s, now)
+	}
+	for publicKey := range q.counters {
+		if !seen[publicKey] {
+			delete(q.counters, publicKey)
+		}
+	}
+	q.persist(false)
+}
+
+// check starts a new period and applies the warning threshold and the limit.
+func (q *Quotas) check(publicKey string, s *quotaState, now time.Time) {
+	changed := false
+	if end := s.periodEnd(); end != nil && !now.Before(*end) {
+		q.log.Infof("quota period of peer %s ended (used %d bytes)", publicKey, s.Used)
+		s.Used, s.Warned, s.PeriodStart = 0, false, monthStart(now)
+		changed = true
+		if s.Exhausted {
+			s.Exhausted = false
+			q.resumePeer(publicKey)
+		}
+	}
+	limit := s.Quota.Bytes()
+	data := &events.QuotaData{PublicKey: publicKey, Limit: limit, Used: s.Used}
+	if !s.Warned && float64(s.Used) >= s.Quota.WarnAt*float64(limit) {
+		s.Warned, changed = true, true
+		q.log.Warnf("peer %s used %d of %d quota bytes", publicKey, s.Used, limit)
+		q.bus.Publish(events.PeerQuotaWarning, data)
+	}
+	if !s.Exhausted && s.Used >= limit {
+		s.Exhausted, changed = true, true
+		q.log.Warnf("quota of peer %s exhausted, suspending the peer", publicKey)
+		q.bus.Publish(events.PeerQuotaExhausted, data)
+		if err := q.suspend(publicKey, SuspendQuota); err != nil {
+			q.log.Errorf("failed to suspend peer %s: %v", publicKey, err)
+		}
+	}
+	// state changes are persisted immediately
+	if changed {
+		q.dirty = true
+		q.persist(true)
+	}
+}
+
+func (q *Quotas) resumePeer(publicKey string) {
+	if err := q.resume(publicKey, SuspendQuota); err != nil {
+		q.log.Errorf("failed to resume peer %s: %v", publicKey, err)
+	}
+}
+
+// Get returns the quota status of the peer.
+func (q *Quotas) Get(publicKey string) (*QuotaStatus, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, ok := q.quotas[publicKey]
+	if !ok {
+		return nil, false
+	}
+	return s.status(), true
+}
+
+// Set sets the validated quota of a peer, the usage of the current period is kept.
+func (q *Quotas) Set(quota *config.PeerQuota) *QuotaStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	s, ok := q.quotas[quota.PublicKey]
+	if !ok {
+		s = &quotaState{PeriodStart: q.periodStart(quota, now)}
+		q.quotas[quota.PublicKey] = s
+	} else if s.Quota.Period != quota.Period {
+		s.PeriodStart = q.periodStart(quota, now)
+	}
+	s.Quota, s.Runtime, s.Warned = quota, true, false
+	q.dirty = true
+	if s.Exhausted && s.Used < quota.Bytes() {
+		s.Exhausted = false
+		q.resumePeer(quota.PublicKey)
+	}
+	q.check(quota.PublicKey, s, now)
+	q.persist(true)
+	return s.status()
+}
+
+// Delete removes the quota of the peer and resumes the peer if the quota was exhausted.
+func (q *Quotas) Delete(publicKey string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, ok := q.quotas[publicKey]
+	if !ok {
+		return false
+	}
+	delete(q.quotas, publicKey)
+	if s.Exhausted {
+		q.resumePeer(publicKey)
+	}
+	q.dirty = true
+	q.persist(true)
+	return true
+}
+
+// Reset clears the usage of the peer, starts a new period and resumes the peer if the quota was exhausted.
+func (q *Quotas) Reset(publicKey string) (*QuotaStatus, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, ok := q.quotas[publicKey]
+	if !ok {
+		return nil, false
+	}
+	s.Used, s.Warned, s.PeriodStart = 0, false, q.periodStart(s.Quota, q.now())
+	if s.Exhausted {
+		s.Exhausted = false
+		q.resumePeer(publicKey)
+	}
+	q.dirty = true
+	q.persist(true)
+	return s.status(), true
+}
@@ -0,0 +1,111 @@
+package peers
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+const quotaTestKey = "h1/wJ5KoQX1fQzQ25rlHb18wgAG80vkDLtn8B7pxOW0="
+
+func newTestQuotas(t *testing.T, st store.Store, now *time.Time, suspended map[string]bool, quotas ...*config.PeerQuota) *Quotas {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	q := &Quotas{
+		log: log,
+		suspend: func(publicKey string, _ SuspendReason) error {
+			suspended[publicKey] = true
+			return nil
+		},
+		resume: func(publicKey string, _ SuspendReason) error {
+			delete(suspended, publicKey)
+			return nil
+		},
+		now:      func() time.Time { return *now },
+		bus:      events.NewBus(),
+		store:    st,
+		quotas:   make(map[string]*quotaState),
+		counters: make(map[string]uint64),
+	}
+	for _, quota := range quotas {
+		require.NoError(t, quota.Validate())
+	}
+	require.NoError(t, q.restore(quotas))
+	return q
+}
+
+func TestQuotas(t *testing.T) {
+	st := store.NewMemoryStore()
+	now := time.Date(2024, 1, 20, 12, 0, 0, 0, time.UTC)
+	peer := &ipc.Peer{PublicKey: quotaTestKey, AllowedIP: "10.0.0.2/32"}
+	devicePeers := []*ipc.Peer{peer}
+	suspended := make(map[string]bool)
+	q := newTestQuotas(t, st, &now, suspended, &config.PeerQuota{PublicKey: quotaTestKey, Limit: "1000"})
+	sub := q.bus.Subscribe(10)
+	defer sub.Close()
+
+	peer.RxBytes, peer.TxBytes = 500, 300
+	q.Update(devicePeers)
+	status, ok := q.Get(quotaTestKey)
+	require.True(t, ok)
+	require.Equal(t, uint64(800), status.Used)
+	require.Equal(t, uint64(200), status.Remaining)
+	require.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), *status.PeriodEnd)
+	require.Equal(t, events.PeerQuotaWarning, (<-sub.Events()).Type)
+	require.Empty(t, suspended)
+
+	// the device counters were reset
+	peer.RxBytes, peer.TxBytes = 100, 100
+	q.Update(devicePeers)
+	status, _ = q.Get(quotaTestKey)
+	require.True(t, status.Exhausted)
+	require.Equal(t, uint64(0), status.Remaining)
+	require.True(t, suspended[quotaTestKey])
+	require.Equal(t, events.PeerQuotaExhausted, (<-sub.Events()).Type)
+
+	// the usage survives a restart, the device counters start at zero
+	peer.RxBytes, peer.TxBytes = 0, 0
+	q = newTestQuotas(t, st, &now, suspended, &config.PeerQuota{PublicKey: quotaTestKey, Limit: "2000"})
+	status, _ = q.Get(quotaTestKey)
+	require.Equal(t, uint64(1000), status.Used)
+	require.Equal(t, uint64(1000), status.Remaining)
+	require.True(t, status.Exhausted)
+
+	// a new period starts
+	now = time.Date(2024, 2, 1, 0, 0, 1, 0, time.UTC)
+	q.Update(devicePeers)
+	status, _ = q.Get(quotaTestKey)
+	require.False(t, status.Exhausted)
+	require.Equal(t, uint64(0), status.Used)
+	require.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), status.PeriodStart)
+	require.Empty(t, suspended)
+
+	// one-off quotas set at runtime keep the usage
+	peer.RxBytes = 150
+	q.Update(devicePeers)
+	quota := &config.PeerQuota{PublicKey: quotaTestKey, Limit: "100", Period: config.QuotaOnce}
+	require.NoError(t, quota.Validate())
+	status = q.Set(quota)
+	require.True(t, status.Exhausted)
+	require.Nil(t, status.PeriodEnd)
+	require.True(t, suspended[quotaTestKey])
+	status, ok = q.Reset(quotaTestKey)
+	require.True(t, ok)
+	require.Equal(t, uint64(0), status.Used)
+	require.Empty(t, suspended)
+
+	// runtime quotas are not replaced by the config file
+	q = newTestQuotas(t, st, &now, suspended)
+	status, _ = q.Get(quotaTestKey)
+	require.Equal(t, "100", status.Limit)
+	require.True(t, q.Delete(quotaTestKey))
+	_, ok = q.Get(quotaTestKey)
+	require.False(t, ok)
+}
@@ -0,0 +1,370 @@
+package peers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/sirupsen/logrus"
+)
+
+// registrationsStoreKey is the key of the registration requests.
+const registrationsStoreKey = "peer_registrations"
+
+const (
+	// maxPendingRegistrations limits the pending queue, because registrations do not require authentication.
+	maxPendingRegistrations = 100
+	// maxPendingRegistrationsPerAddress limits the pending registrations of a single source address.
+	maxPendingRegistrationsPerAddress = 5
+	// registrationRateBurst is the number of registrations a source address may submit at once.
+	registrationRateBurst = 10
+	// registrationRateInterval is the time after which a source address may submit a further registration.
+	registrationRateInterval = time.Minute
+	// maxRateLimitedAddresses limits the number of tracked source addresses.
+	maxRateLimitedAddresses = 4096
+)
+
+type RegistrationStatus string
+
+const (
+	RegistrationPending  RegistrationStatus = "pending"
+	RegistrationApproved RegistrationStatus = "approved"
+	RegistrationRejected RegistrationStatus = "rejected"
+)
+
+var (
+	ErrRegistrationNotFound = errors.New("registration not found")
+	ErrTooManyRegistrations = errors.New("too many pending registrations")
+	ErrRegistrationLimited  = errors.New("too many registrations, try again later")
+	ErrRegistrationPending  = &ValidationError{"registration of the peer already pending"}
+	ErrRegistrationDecided  = &ValidationError{"registration already decided"}
+	ErrInvalidRegistration  = &ValidationError{"invalid hostname or name"}
+	ErrInvalidGroup         = &ValidationError{"invalid group"}
+)
+
+// Registration is the request of a device to be added as peer, the device
+// polls the registration by its id until an admin approved or rejected it.
+type Registration struct {
+	ID         string             `json:"id"`
+	PublicKey  string             `json:"publicKey"`
+	Hostname   string             `json:"hostname"`
+	Name       string             `json:"name"`
+	RemoteAddr string             `json:"remoteAddr"`
+	Status     RegistrationStatus `json:"status"`
+	CreatedAt  time.Time          `json:"createdAt"`
+	DecidedAt  *time.Time         `json:"decidedAt,omitempty"`
+	DecidedBy  string             `json:"decidedBy,omitempty"`
+	// AllowedIP, HubNetwork and Groups are assigned on approval.
+	AllowedIP  string   `json:"allowedIP,omitempty"`
+	HubNetwork string   `json:"hubNetwork,omitempty"`
+	Groups     []string `json:"groups,omitempty"`
+	// Reason is the reason of the rejection.
+	Reason string `json:"reason,omitempty"`
+}
+
+func (r *Registration) copy() *Registration {
+	c := *r
+	c.Groups = slices.Clone(r.Groups)
+	return &c
+}
+
+// Registrations is the queue of the registration requests, only approved
+// registrations are added to the hub device. Pending registrations are dropped
+// after the pending ttl and the results of decided registrations after the ttl.
+type Registrations struct {
+	log        *logrus.Logger
+	approve    func(publicKey, allowedIP string, groups []string) (*AddResult, error)
+	list       func() ([]*ipc.Peer, error)
+	now        func() time.Time
+	store      store.Store
+	ttl        time.Duration
+	pendingTTL time.Duration
+
+	mu            sync.Mutex
+	registrations map[string]*Registration // by id
+	// buckets limits the rate of the registrations per source address
+	buckets map[string]*registrationBucket
+}
+
+type registrationBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRegistrations restores the persisted registration requests.
+func NewRegistrations(manager *Manager, ttl, pendingTTL time.Duration) (*Registrations, error) {
+	r := &Registrations{
+		log:           manager.log,
+		approve:       manager.Approve,
+		list:          manager.List,
+		now:           time.Now,
+		store:         manager.store,
+		ttl:           ttl,
+		pendingTTL:    pendingTTL,
+		registrations: make(map[string]*Registration),
+		buckets:       make(map[string]*registrationBucket),
+	}
+	if r.ttl <= 0 {
+		r.ttl = 24 * time.Hour
+	}
+	if r.pendingTTL <= 0 {
+		r.pendingTTL = time.Hour
+	}
+	err := r.store.Load(registrationsStoreKey, &r.registrations)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("failed to load peer registrations: %w", err)
+	}
+	return r, nil
+}
+
+func (r *Registrations) persist() {
+	if err := r.store.Save(registrationsStoreKey, r.registrations); err != nil {
+		r.log.Errorf("failed to persist peer registrations: %v", err)
+	}
+}
+
+// prune drops the pending registrations that are older than the pending ttl
+// and the decided registrations that were decided before the ttl.
+func (r *Registrations) prune(now time.Time) {
+	pruned := false
+	for id, reg := range r.registrations {
+		last, ttl := reg.CreatedAt, r.pendingTTL
+		if reg.DecidedAt != nil {
+			last, ttl = *reg.DecidedAt, r.ttl
+		}
+		if now.Sub(last) > ttl {
+			delete(r.registrations, id)
+			pruned = true
+		}
+	}
+	if pruned {
+		r.persist()
+	}
+}
+
+// takeToken returns false if the source address submitted too many registrations, the
+// registrations are limited separately from the failed logins, so devices behind a NAT
+// do not lock out the logins and enrollments of their address.
+func (r *Registrations) takeToken(remoteAddr string, now time.Time) bool {
+	b, ok := r.buckets[remoteAddr]
+	if !ok {
+		if len(r.buckets) >= maxRateLimitedAddresses {
+			r.pruneBuckets(now)
+		}
+		b = &registrationBucket{tokens: registrationRateBurst, last: now}
+		r.buckets[remoteAddr] = b
+	}
+	b.tokens = min(registrationRateBurst, b.tokens+float64(now.Sub(b.last))/float64(registrationRateInterval))
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// pruneBuckets removes the buckets that are full again, or the least recently used bucket.
+func (r *Registrations) pruneBuckets(now time.Time) {
+	var oldest string
+	for addr, b := range r.buckets {
+		if float64(now.Sub(b.last))/float64(registrationRateInterval)+b.tokens >= registrationRateBurst {
+			delete(r.buckets, addr)
+			continue
+		}
+		if oldest == "" || b.last.Before(r.buckets[oldest].last) {
+			oldest = addr
+		}
+	}
+	if len(r.buckets) >= maxRateLimitedAddresses {
+		delete(r.buckets, oldest)
+	}
+}
+
+func validLabel(s string, maxLen int) bool {
+	return len(s) <= maxLen && strings.IndexFunc(s, unicode.IsControl) < 0
+}
+
+// Submit adds a pending registration, registrations of existing peers are rejected.
+func (r *Registrations) Submit(publicKey, hostname, name, remoteAddr string) (*Registration, error) {
+	r.mu.Lock()
+	allowed := r.takeToken(remoteAddr, r.now())
+	r.mu.Unlock()
+	if !allowed {
+		return nil, ErrRegistrationLimited
+	}
+	if _, err := ipc.Base64ToHex(publicKey); err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	hostname, name = strings.TrimSpace(hostname), strings.TrimSpace(name)
+	if !validLabel(hostname, 253) || !validLabel(name, 100) || hostname+name == "" {
+		return nil, ErrInvalidRegistration
+	}
+	devicePeers, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+	if slices.ContainsFunc(devicePeers, func(p *ipc.Peer) bool { return p.PublicKey == publicKey }) {
+		return nil, ErrPeerExists
+	}
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.prune(now)
+	pending := 0
+	pendingByAddress := make(map[string][]*Registration)
+	for _, reg := range r.registrations {
+		if reg.Status != RegistrationPending {
+			continue
+		}
+		if reg.PublicKey == publicKey {
+			return nil, ErrRegistrationPending
+		}
+		pending++
+		pendingByAddress[reg.RemoteAddr] = append(pendingByAddress[reg.RemoteAddr], reg)
+	}
+	if len(pendingByAddress[remoteAddr]) >= maxPendingRegistrationsPerAddress {
+		return nil, ErrTooManyRegistrations
+	}
+	if pending >= maxPendingRegistrations && !r.evictPending(pendingByAddress, remoteAddr) {
+		return nil, ErrTooManyRegistrations
+	}
+	reg := &Registration{
+		ID:         base64.RawURLEncoding.EncodeToString(b),
+		PublicKey:  publicKey,
+		Hostname:   hostname,
+		Name:       name,
+		RemoteAddr: remoteAddr,
+		Status:     RegistrationPending,
+		CreatedAt:  now.UTC(),
+	}
+	r.registrations[reg.ID] = reg
+	r.persist()
+	return reg.copy(), nil
+}
+
+// evictPending drops the oldest pending registration of the source address with the most pending
+// registrations if it has more than the given address, so a full queue does not lock out new sources.
+func (r *Registrations) evictPending(pendingByAddress map[string][]*Registration, remoteAddr string) bool {
+	var evict []*Registration
+	for _, regs := range pendingByAddress {
+		if len(regs) > len(evict) || len(regs) == len(evict) && oldest(regs).CreatedAt.Before(oldest(evict).CreatedAt) {
+			evict = regs
+		}
+	}
+	if len(evict) <= len(pendingByAddress[remoteAddr]) {
+		return false
+	}
+	reg := oldest(evict)
+	r.log.Warnf("dropping registration %s of peer %s from %s, too many pending registrations", reg.ID, reg.PublicKey, reg.RemoteAddr)
+	delete(r.registrations, reg.ID)
+	return true
+}
+
+func oldest(regs []*Registration) *Registration {
+	return slices.MinFunc(regs, func(a, b *Registration) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+}
+
+// Get returns the registration with the given id.
+func (r *Registrations) Get(id string) (*Registration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune(r.now())
+	reg, ok := r.registrations[id]
+	if !ok {
+		return nil, false
+	}
+	return reg.copy(), true
+}
+
+// List returns the registrations with the given status (all if empty) sorted by their creation time.
+func (r *Registrations) List(status RegistrationStatus) []*Registration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune(r.now())
+	regs := make([]*Registration, 0, len(r.registrations))
+	for _, reg := range r.registrations {
+		if status == "" || reg.Status == status {
+			regs = append(regs, reg.copy())
+		}
+	}
+	sort.Slice(regs, func(i, j int) bool {
+		return regs[i].CreatedAt.Before(regs[j].CreatedAt)
+	})
+	return regs
+}
+
+// pending returns the pending registration with the given id.
+func (r *Registrations) pending(id string) (*Registration, error) {
+	r.prune(r.now())
+	reg, ok := r.registrations[id]
+	if !ok {
+		return nil, ErrRegistrationNotFound
+	}
+	if reg.Status != RegistrationPending {
+		return nil, ErrRegistrationDecided
+	}
+	return reg, nil
+}
+
+// Approve adds the peer of the pending registration with the allowed ip (a random free
+// ip of the hub network if empty) and the groups. The registration stays pending if the
+// peer can not be added.
+func (r *Registrations) Approve(id, allowedIP string, groups []string, decidedBy string) (*Registration, error) {
+	for _, group := range groups {
+		if group == "" || !validLabel(group, 100) {
+			return nil, ErrInvalidGroup
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, err := r.pending(id)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.approve(reg.PublicKey, allowedIP, groups)
+	if err != nil {
+		return nil, err
+	}
+	decidedAt := r.now().UTC()
+	reg.Status = RegistrationApproved
+	reg.DecidedAt = &decidedAt
+	reg.DecidedBy = decidedBy
+	reg.AllowedIP = res.AllowedIP
+	reg.HubNetwork = res.HubNetwork
+	reg.Groups = slices.Clone(groups)
+	r.persist()
+	return reg.copy(), nil
+}
+
+// Reject rejects the pending registration, the device receives the reason.
+func (r *Registrations) Reject(id, reason, decidedBy string) (*Registration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, err := r.pending(id)
+	if err != nil {
+		return nil, err
+	}
+	decidedAt := r.now().UTC()
+	reg.Status = RegistrationRejected
+	reg.DecidedAt = &decidedAt
+	reg.DecidedBy = decidedBy
+	reg.Reason = strings.TrimSpace(reason)
+	r.persist()
+	return reg.copy(), nil
+}
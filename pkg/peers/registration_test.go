@@ -0,0 +1,146 @@
+package peers
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestRegistrations(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	now := time.Date(2024, 2, 5, 8, 0, 0, 0, time.UTC)
+	var devicePeers []*ipc.Peer
+	r := &Registrations{
+		log: log,
+		approve: func(publicKey, allowedIP string, _ []string) (*AddResult, error) {
+			if allowedIP == "10.0.0.1/32" {
+				return nil, ErrAllowedIPInUse
+			}
+			devicePeers = append(devicePeers, &ipc.Peer{PublicKey: publicKey, AllowedIP: "10.0.0.2/32"})
+			return &AddResult{AllowedIP: "10.0.0.2/32", HubNetwork: "10.0.0.0/24"}, nil
+		},
+		list:          func() ([]*ipc.Peer, error) { return devicePeers, nil },
+		now:           func() time.Time { return now },
+		store:         store.NewMemoryStore(),
+		ttl:           time.Hour,
+		pendingTTL:    time.Hour,
+		registrations: make(map[string]*Registration),
+		buckets:       make(map[string]*registrationBucket),
+	}
+
+	_, err := r.Submit("invalid", "laptop", "", "203.0.113.1")
+	require.ErrorIs(t, err, ErrInvalidPublicKey)
+	_, err = r.Submit(quotaTestKey, "", "", "203.0.113.1")
+	require.ErrorIs(t, err, ErrInvalidRegistration)
+	reg, err := r.Submit(quotaTestKey, "laptop", "Alice's laptop", "203.0.113.1")
+	require.NoError(t, err)
+	require.Equal(t, RegistrationPending, reg.Status)
+	_, err = r.Submit(quotaTestKey, "laptop", "", "203.0.113.1")
+	require.ErrorIs(t, err, ErrRegistrationPending)
+	require.Len(t, r.List(RegistrationPending), 1)
+
+	// the registration stays pending if the peer can not be added
+	_, err = r.Approve(reg.ID, "10.0.0.1/32", nil, "admin")
+	require.ErrorIs(t, err, ErrAllowedIPInUse)
+	_, err = r.Approve(reg.ID, "", []string{""}, "admin")
+	require.ErrorIs(t, err, ErrInvalidGroup)
+	approved, err := r.Approve(reg.ID, "", []string{"laptops"}, "admin")
+	require.NoError(t, err)
+	require.Equal(t, RegistrationApproved, approved.Status)
+	require.Equal(t, "10.0.0.2/32", approved.AllowedIP)
+	require.Equal(t, []string{"laptops"}, approved.Groups)
+	_, err = r.Reject(reg.ID, "", "admin")
+	require.ErrorIs(t, err, ErrRegistrationDecided)
+	_, err = r.Submit(quotaTestKey, "laptop", "", "203.0.113.1")
+	require.ErrorIs(t, err, ErrPeerExists)
+
+	other, err := r.Submit("h2/PAmEgoIRLYBDDTL3dZKAOaLEhu4270vlNWXFMSys=", "phone", "", "203.0.113.1")
+	require.NoError(t, err)
+	rejected, err := r.Reject(other.ID, " unknown device ", "admin")
+	require.NoError(t, err)
+	require.Equal(t, "unknown device", rejected.Reason)
+	require.Empty(t, r.List(RegistrationPending))
+	require.Len(t, r.List(""), 2)
+
+	// decided registrations are dropped after the ttl
+	now = now.Add(2 * time.Hour)
+	_, ok := r.Get(reg.ID)
+	require.False(t, ok)
+	require.Empty(t, r.List(""))
+	_, err = r.Approve(other.ID, "", nil, "admin")
+	require.ErrorIs(t, err, ErrRegistrationNotFound)
+}
+
+func TestRegistrationsLimits(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	now := time.Date(2024, 2, 5, 8, 0, 0, 0, time.UTC)
+	r := &Registrations{
+		log:           log,
+		list:          func() ([]*ipc.Peer, error) { return nil, nil },
+		now:           func() time.Time { return now },
+		store:         store.NewMemoryStore(),
+		ttl:           24 * time.Hour,
+		pendingTTL:    10 * time.Minute,
+		registrations: make(map[string]*Registration),
+		buckets:       make(map[string]*registrationBucket),
+	}
+	submit := func(remoteAddr string) (*Registration, error) {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		now = now.Add(time.Millisecond)
+		return r.Submit(key.PublicKey().String(), "laptop", "", remoteAddr)
+	}
+
+	var first *Registration
+	for i := 0; i < maxPendingRegistrations; i++ {
+		reg, err := submit(fmt.Sprintf("203.0.113.%d", i/maxPendingRegistrationsPerAddress))
+		require.NoError(t, err)
+		if first == nil {
+			first = reg
+		}
+	}
+	_, err := submit("203.0.113.0")
+	require.ErrorIs(t, err, ErrTooManyRegistrations)
+
+	// a full queue drops the oldest registration of the source with the most pending registrations
+	_, err = submit("198.51.100.1")
+	require.NoError(t, err)
+	require.Len(t, r.List(RegistrationPending), maxPendingRegistrations)
+	_, ok := r.Get(first.ID)
+	require.False(t, ok)
+	// the limit per source address still applies
+	for i := 0; i < maxPendingRegistrationsPerAddress-1; i++ {
+		_, err = submit("198.51.100.1")
+		require.NoError(t, err)
+	}
+	_, err = submit("198.51.100.1")
+	require.ErrorIs(t, err, ErrTooManyRegistrations)
+
+	// pending registrations expire after the pending ttl
+	now = now.Add(11 * time.Minute)
+	require.Empty(t, r.List(""))
+
+	// the registrations of a source address are rate limited
+	for i := 0; i < registrationRateBurst; i++ {
+		_, err = submit("192.0.2.1")
+		if i < maxPendingRegistrationsPerAddress {
+			require.NoError(t, err)
+		} else {
+			require.ErrorIs(t, err, ErrTooManyRegistrations)
+		}
+	}
+	_, err = submit("192.0.2.1")
+	require.ErrorIs(t, err, ErrRegistrationLimited)
+	now = now.Add(11 * time.Minute)
+	_, err = submit("192.0.2.1")
+	require.NoError(t, err)
+}
@@ -0,0 +1,197 @@
+package peers
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/sirupsen/logrus"
+)
+
+// schedulesStoreKey is the key of the peer schedules.
+const schedulesStoreKey = "peer_schedules"
+
+// ScheduleStatus is the schedule of a peer and whether the peer currently has access.
+type ScheduleStatus struct {
+	*config.PeerSchedule
+	Expired  bool `json:"expired"`
+	InWindow bool `json:"inWindow"`
+	// NextChange is empty if the access of the peer does not change anymore.
+	NextChange *time.Time `json:"nextChange,omitempty"`
+}
+
+type scheduleState struct {
+	Schedule *config.PeerSchedule `json:"schedule"`
+	// Runtime schedules were set via the API and are not replaced by the config file.
+	Runtime bool `json:"runtime"`
+}
+
+// Scheduler suspends the peers whose access expired or who are outside of
+// their access windows and resumes them once they are inside a window again.
+type Scheduler struct {
+	log       *logrus.Logger
+	suspended func(publicKey string) []SuspendReason
+	suspend   func(publicKey string, reason SuspendReason) error
+	resume    func(publicKey string, reason SuspendReason) error
+	now       func() time.Time
+	store     store.Store
+
+	mu        sync.Mutex
+	schedules map[string]*scheduleState
+}
+
+// NewScheduler restores the persisted schedules, the schedules of the config file
+// replace the persisted schedules that were not set via the API.
+func NewScheduler(manager *Manager, schedules []*config.PeerSchedule) (*Scheduler, error) {
+	s := &Scheduler{
+		log:       manager.log,
+		suspended: manager.Suspended,
+		suspend:   manager.Suspend,
+		resume:    manager.Resume,
+		now:       time.Now,
+		store:     manager.store,
+		schedules: make(map[string]*scheduleState),
+	}
+	if err := s.restore(schedules); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Scheduler) restore(schedules []*config.PeerSchedule) error {
+	err := s.store.Load(schedulesStoreKey, &s.schedules)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("failed to load peer schedules: %w", err)
+	}
+	configured := make(map[string]*config.PeerSchedule, len(schedules))
+	for _, schedule := range schedules {
+		configured[schedule.PublicKey] = schedule
+	}
+	for publicKey, state := range s.schedules {
+		_, ok := configured[publicKey]
+		if state.Schedule == nil || state.Schedule.Validate() != nil || (!state.Runtime && !ok) {
+			delete(s.schedules, publicKey)
+			// the peer is not suspended by a removed schedule
+			s.release(publicKey)
+		}
+	}
+	for publicKey, schedule := range configured {
+		state, ok := s.schedules[publicKey]
+		if !ok {
+			s.schedules[publicKey] = &scheduleState{Schedule: schedule}
+			continue
+		}
+		if !state.Runtime {
+			state.Schedule = schedule
+		}
+	}
+	s.persist()
+	return nil
+}
+
+func (s *Scheduler) persist() {
+	if err := s.store.Save(schedulesStoreKey, s.schedules); err != nil {
+		s.log.Errorf("failed to persist peer schedules: %v", err)
+	}
+}
+
+// Apply applies the schedules to the peers, it is called with the peers of
+// every watcher poll.
+func (s *Scheduler) Apply(devicePeers []*ipc.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, peer := range devicePeers {
+		if state, ok := s.schedules[peer.PublicKey]; ok {
+			s.check(peer.PublicKey, state.Schedule, now)
+		}
+	}
+}
+
+// check suspends or resumes the peer if its access changed.
+func (s *Scheduler) check(publicKey string, schedule *config.PeerSchedule, now time.Time) {
+	reasons := s.suspended(publicKey)
+	s.transition(publicKey, SuspendExpired, schedule.Expired(now), slices.Contains(reasons, SuspendExpired))
+	s.transition(publicKey, SuspendSchedule, !schedule.InWindow(now), slices.Contains(reasons, SuspendSchedule))
+}
+
+func (s *Scheduler) transition(publicKey string, reason SuspendReason, suspend, suspended bool) {
+	switch {
+	case suspend && !suspended:
+		if reason == SuspendExpired {
+			s.log.Infof("access of peer %s expired, suspending the peer", publicKey)
+		} else {
+			s.log.Infof("access window of peer %s closed, suspending the peer", publicKey)
+		}
+		if err := s.suspend(publicKey, reason); err != nil {
+			s.log.Errorf("failed to suspend peer %s: %v", publicKey, err)
+		}
+	case !suspend && suspended:
+		if reason == SuspendExpired {
+			s.log.Infof("access of peer %s was extended, resuming the peer", publicKey)
+		} else {
+			s.log.Infof("access window of peer %s opened, resuming the peer", publicKey)
+		}
+		if err := s.resume(publicKey, reason); err != nil {
+			s.log.Errorf("failed to resume peer %s: %v", publicKey, err)
+		}
+	}
+}
+
+// release resumes the peer for the reasons of the scheduler.
+func (s *Scheduler) release(publicKey string) {
+	for _, reason := range []SuspendReason{SuspendExpired, SuspendSchedule} {
+		if err := s.resume(publicKey, reason); err != nil {
+			s.log.Errorf("failed to resume peer %s: %v", publicKey, err)
+		}
+	}
+}
+
+func (s *Scheduler) status(schedule *config.PeerSchedule) *ScheduleStatus {
+	now := s.now()
+	return &ScheduleStatus{
+		PeerSchedule: schedule,
+		Expired:      schedule.Expired(now),
+		InWindow:     schedule.InWindow(now),
+		NextChange:   schedule.NextChange(now),
+	}
+}
+
+// Get returns the schedule status of the peer.
+func (s *Scheduler) Get(publicKey string) (*ScheduleStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.schedules[publicKey]
+	if !ok {
+		return nil, false
+	}
+	return s.status(state.Schedule), true
+}
+
+// Set sets the validated schedule of a peer and applies it immediately.
+func (s *Scheduler) Set(schedule *config.PeerSchedule) *ScheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedules[schedule.PublicKey] = &scheduleState{Schedule: schedule, Runtime: true}
+	s.persist()
+	s.check(schedule.PublicKey, schedule, s.now())
+	return s.status(schedule)
+}
+
+// Delete removes the schedule of the peer and resumes the peer if it was suspended by the schedule.
+func (s *Scheduler) Delete(publicKey string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.schedules[publicKey]; !ok {
+		return false
+	}
+	delete(s.schedules, publicKey)
+	s.persist()
+	s.release(publicKey)
+	return true
+}
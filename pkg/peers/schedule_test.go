@@ -0,0 +1,96 @@
+package peers
+
+import (
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+var scheduleTestPeers = []*ipc.Peer{{PublicKey: quotaTestKey, AllowedIP: "10.0.0.2/32"}}
+
+func newTestScheduler(t *testing.T, st store.Store, now *time.Time, suspended map[string][]SuspendReason, schedules ...*config.PeerSchedule) *Scheduler {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	s := &Scheduler{
+		log:       log,
+		suspended: func(publicKey string) []SuspendReason { return suspended[publicKey] },
+		suspend: func(publicKey string, reason SuspendReason) error {
+			suspended[publicKey] = append(suspended[publicKey], reason)
+			return nil
+		},
+		resume: func(publicKey string, reason SuspendReason) error {
+			suspended[publicKey] = slices.DeleteFunc(suspended[publicKey], func(r SuspendReason) bool { return r == reason })
+			return nil
+		},
+		now:       func() time.Time { return *now },
+		store:     st,
+		schedules: make(map[string]*scheduleState),
+	}
+	for _, schedule := range schedules {
+		require.NoError(t, schedule.Validate())
+	}
+	require.NoError(t, s.restore(schedules))
+	return s
+}
+
+func TestScheduler(t *testing.T) {
+	st := store.NewMemoryStore()
+	// 2024-02-05 is a monday
+	now := time.Date(2024, 2, 5, 8, 0, 0, 0, time.UTC)
+	suspended := make(map[string][]SuspendReason)
+	schedule := &config.PeerSchedule{
+		PublicKey: quotaTestKey,
+		Timezone:  "UTC",
+		Windows:   []*config.AccessWindow{{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "18:00"}},
+	}
+	s := newTestScheduler(t, st, &now, suspended, schedule)
+
+	s.Apply(scheduleTestPeers)
+	require.Equal(t, []SuspendReason{SuspendSchedule}, suspended[quotaTestKey])
+	status, ok := s.Get(quotaTestKey)
+	require.True(t, ok)
+	require.False(t, status.InWindow)
+	require.Equal(t, time.Date(2024, 2, 5, 9, 0, 0, 0, time.UTC), *status.NextChange)
+
+	now = now.Add(time.Hour)
+	s.Apply(scheduleTestPeers)
+	require.Empty(t, suspended[quotaTestKey])
+	now = time.Date(2024, 2, 5, 18, 0, 0, 0, time.UTC)
+	s.Apply(scheduleTestPeers)
+	require.Equal(t, []SuspendReason{SuspendSchedule}, suspended[quotaTestKey])
+
+	// the access expires at runtime, the schedule survives a restart
+	expiring := &config.PeerSchedule{PublicKey: quotaTestKey, ExpiresAt: "2024-02-07T12:00:00Z"}
+	require.NoError(t, expiring.Validate())
+	status = s.Set(expiring)
+	require.True(t, status.InWindow)
+	require.Empty(t, suspended[quotaTestKey])
+	s = newTestScheduler(t, st, &now, suspended, schedule)
+	now = time.Date(2024, 2, 7, 12, 0, 0, 0, time.UTC)
+	s.Apply(scheduleTestPeers)
+	require.Equal(t, []SuspendReason{SuspendExpired}, suspended[quotaTestKey])
+	status, _ = s.Get(quotaTestKey)
+	require.True(t, status.Expired)
+	require.Nil(t, status.NextChange)
+
+	require.True(t, s.Delete(quotaTestKey))
+	require.Empty(t, suspended[quotaTestKey])
+	require.False(t, s.Delete(quotaTestKey))
+
+	// schedules removed from the config file release the peer
+	now = time.Date(2024, 2, 7, 20, 0, 0, 0, time.UTC)
+	s = newTestScheduler(t, st, &now, suspended, schedule)
+	s.Apply(scheduleTestPeers)
+	require.Equal(t, []SuspendReason{SuspendSchedule}, suspended[quotaTestKey])
+	s = newTestScheduler(t, st, &now, suspended)
+	require.Empty(t, suspended[quotaTestKey])
+	_, ok = s.Get(quotaTestKey)
+	require.False(t, ok)
+}
@@ -0,0 +1,291 @@
+package peers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// statsStoreKey is the key of the persisted traffic history of the peers.
+	statsStoreKey = "peer_stats"
+	// statsPersistInterval is the interval in which the traffic history is persisted.
+	statsPersistInterval = time.Minute
+)
+
+// resolutions are the down-sampled resolutions of the traffic history and the number of kept buckets.
+var resolutions = []struct {
+	res      time.Duration
+	capacity int
+}{
+	{time.Second, 600},  // 10 minutes
+	{time.Minute, 1440}, // 24 hours
+	{time.Hour, 720},    // 30 days
+}
+
+// MaxStatsRange is the longest range of the traffic history.
+const MaxStatsRange = 30 * 24 * time.Hour
+
+// Sample is the transferred bytes of a peer within one interval of the resolution.
+type Sample struct {
+	Time    time.Time `json:"time"`
+	RxBytes uint64    `json:"rxBytes"`
+	TxBytes uint64    `json:"txBytes"`
+	// RxRate and TxRate are the average bytes per second of the interval.
+	RxRate float64 `json:"rxRate"`
+	TxRate float64 `json:"txRate"`
+}
+
+// Stats is the traffic history of a peer, the totals include the traffic before restarts if the history is persisted.
+type Stats struct {
+	// Resolution is the interval of the samples in seconds.
+	Resolution   int64     `json:"resolution"`
+	TotalRxBytes uint64    `json:"totalRxBytes"`
+	TotalTxBytes uint64    `json:"totalTxBytes"`
+	Samples      []*Sample `json:"samples"`
+}
+
+type bucket struct {
+	Time    int64  `json:"t"`
+	RxBytes uint64 `json:"rx"`
+	TxBytes uint64 `json:"tx"`
+}
+
+// ring keeps the buckets of the last capacity intervals of a resolution.
+type ring struct {
+	res     int64
+	buckets []bucket
+}
+
+func newRing(res time.Duration, capacity int) *ring {
+	return &ring{res: int64(res / time.Second), buckets: make([]bucket, capacity)}
+}
+
+func (r *ring) slot(t int64) (int, int64) {
+	start := t - t%r.res
+	return int((start / r.res) % int64(len(r.buckets))), start
+}
+
+func (r *ring) add(t int64, rx, tx uint64) {
+	i, start := r.slot(t)
+	if r.buckets[i].Time != start {
+		r.buckets[i] = bucket{Time: start}
+	}
+	r.buckets[i].RxBytes += rx
+	r.buckets[i].TxBytes += tx
+}
+
+// samples returns the samples from the bucket of from until the bucket of to, missing buckets are empty.
+func (r *ring) samples(from, to int64) []*Sample {
+	_, first := r.slot(from)
+	_, last := r.slot(to)
+	samples := make([]*Sample, 0, (last-first)/r.res+1)
+	for start := first; start <= last; start += r.res {
+		s := &Sample{Time: time.Unix(start, 0).UTC()}
+		if i, _ := r.slot(start); r.buckets[i].Time == start {
+			s.RxBytes, s.TxBytes = r.buckets[i].RxBytes, r.buckets[i].TxBytes
+			s.RxRate = float64(s.RxBytes) / float64(r.res)
+			s.TxRate = float64(s.TxBytes) / float64(r.res)
+		}
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+// nonEmpty returns the used buckets for persistence.
+func (r *ring) nonEmpty() []bucket {
+	buckets := make([]bucket, 0)
+	for _, b := range r.buckets {
+		if b.Time != 0 {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+type peerStats struct {
+	rxBytes      uint64
+	txBytes      uint64
+	totalRxBytes uint64
+	totalTxBytes uint64
+	rings        []*ring
+}
+
+func newPeerStats() *peerStats {
+	ps := &peerStats{}
+	for _, r := range resolutions {
+		ps.rings = append(ps.rings, newRing(r.res, r.capacity))
+	}
+	return ps
+}
+
+type persistedStats struct {
+	TotalRxBytes uint64     `json:"totalRxBytes"`
+	TotalTxBytes uint64     `json:"totalTxBytes"`
+	Buckets      [][]bucket `json:"buckets"`
+}
+
+// Sampler samples the transferred bytes of the peers of every watcher poll and
+// keeps their traffic history in down-sampled ring buffers. The hub instance
+// is not sampled.
+type Sampler struct {
+	// now is replaced in tests
+	now     func() time.Time
+	log     *logrus.Logger
+	hubIP   string
+	store   store.Store
+	persist bool
+
+	mu    sync.Mutex
+	peers map[string]*peerStats
+}
+
+// NewSampler creates a sampler for the peers of the manager, the traffic
+// history is restored and persisted if persist is set.
+func NewSampler(manager *Manager, persist bool) (*Sampler, error) {
+	s := &Sampler{
+		now:     time.Now,
+		log:     manager.log,
+		hubIP:   manager.cfg.GetHubAddress(),
+		store:   manager.store,
+		persist: persist,
+		peers:   make(map[string]*peerStats),
+	}
+	if !persist {
+		return s, nil
+	}
+	if err := s.restore(); err != nil {
+		return nil, fmt.Errorf("failed to load peer stats: %w", err)
+	}
+	return s, nil
+}
+
+func (s *Sampler) restore() error {
+	var persisted map[string]*persistedStats
+	err := s.store.Load(statsStoreKey, &persisted)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for publicKey, p := range persisted {
+		ps := newPeerStats()
+		ps.totalRxBytes, ps.totalTxBytes = p.TotalRxBytes, p.TotalTxBytes
+		for i, buckets := range p.Buckets {
+			if i >= len(ps.rings) {
+				break
+			}
+			for _, b := range buckets {
+				ps.rings[i].add(b.Time, b.RxBytes, b.TxBytes)
+			}
+		}
+		s.peers[publicKey] = ps
+	}
+	return nil
+}
+
+func (s *Sampler) save() {
+	if !s.persist {
+		return
+	}
+	s.mu.Lock()
+	persisted := make(map[string]*persistedStats, len(s.peers))
+	for publicKey, ps := range s.peers {
+		p := &persistedStats{TotalRxBytes: ps.totalRxBytes, TotalTxBytes: ps.totalTxBytes}
+		for _, r := range ps.rings {
+			p.Buckets = append(p.Buckets, r.nonEmpty())
+		}
+		persisted[publicKey] = p
+	}
+	s.mu.Unlock()
+	if err := s.store.Save(statsStoreKey, persisted); err != nil {
+		s.log.Errorf("failed to persist peer stats: %v", err)
+	}
+}
+
+// Run persists the traffic history every persist interval until the context is
+// done, the traffic history is persisted before it returns.
+func (s *Sampler) Run(ctx context.Context) {
+	ticker := time.NewTicker(statsPersistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.save()
+			return
+		case <-ticker.C:
+			s.save()
+		}
+	}
+}
+
+// Sample adds the transferred bytes of the peers since the previous sample, it
+// is called with the peers of every watcher poll.
+func (s *Sampler) Sample(now time.Time, devicePeers []*ipc.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]struct{}, len(devicePeers))
+	for _, peer := range devicePeers {
+		if peer.AllowedIP == s.hubIP {
+			continue
+		}
+		seen[peer.PublicKey] = struct{}{}
+		ps, ok := s.peers[peer.PublicKey]
+		if !ok {
+			ps = newPeerStats()
+			s.peers[peer.PublicKey] = ps
+		}
+		rx, tx := peer.RxBytes, peer.TxBytes
+		// the counters start over if the peer was added again or the hub restarted
+		if rx >= ps.rxBytes && tx >= ps.txBytes {
+			rx, tx = rx-ps.rxBytes, tx-ps.txBytes
+		}
+		ps.rxBytes, ps.txBytes = peer.RxBytes, peer.TxBytes
+		ps.totalRxBytes += rx
+		ps.totalTxBytes += tx
+		for _, r := range ps.rings {
+			r.add(now.Unix(), rx, tx)
+		}
+	}
+	for publicKey := range s.peers {
+		if _, ok := seen[publicKey]; !ok {
+			delete(s.peers, publicKey)
+		}
+	}
+}
+
+// Stats returns the traffic history of the peer within the range until now, the
+// finest resolution that covers the range is used.
+func (s *Sampler) Stats(publicKey string, statsRange time.Duration) (*Stats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps, ok := s.peers[publicKey]
+	if !ok {
+		return nil, false
+	}
+	idx := len(resolutions) - 1
+	for i, r := range resolutions {
+		if statsRange <= r.res*time.Duration(r.capacity) {
+			idx = i
+			break
+		}
+	}
+	now := s.now()
+	from := now.Add(-min(statsRange, MaxStatsRange))
+	r := ps.rings[idx]
+	// the oldest bucket of the range is partially overwritten by the newest bucket
+	samples := r.samples(from.Unix()+r.res, now.Unix())
+	return &Stats{
+		Resolution:   r.res,
+		TotalRxBytes: ps.totalRxBytes,
+		TotalTxBytes: ps.totalTxBytes,
+		Samples:      samples,
+	}, true
+}
@@ -0,0 +1,82 @@
+package peers
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSampler(t *testing.T, st store.Store, now *time.Time) *Sampler {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	s := &Sampler{
+		now:     func() time.Time { return *now },
+		log:     log,
+		hubIP:   "10.0.0.1/32",
+		store:   st,
+		persist: true,
+		peers:   make(map[string]*peerStats),
+	}
+	require.NoError(t, s.restore())
+	return s
+}
+
+func TestSampler(t *testing.T) {
+	st := store.NewMemoryStore()
+	now := time.Unix(1_700_000_000, 0)
+	peer := &ipc.Peer{PublicKey: "peer", AllowedIP: "10.0.0.2/32"}
+	devicePeers := []*ipc.Peer{{PublicKey: "hub", AllowedIP: "10.0.0.1/32"}, peer}
+	s := newTestSampler(t, st, &now)
+
+	for i := 0; i < 120; i++ {
+		peer.RxBytes += 100
+		peer.TxBytes += 10
+		now = now.Add(time.Second)
+		s.Sample(now, devicePeers)
+	}
+	_, ok := s.Stats("hub", time.Minute)
+	require.False(t, ok)
+
+	stats, ok := s.Stats("peer", time.Minute)
+	require.True(t, ok)
+	require.Equal(t, int64(1), stats.Resolution)
+	require.Len(t, stats.Samples, 60)
+	require.Equal(t, now.UTC(), stats.Samples[59].Time)
+	require.Equal(t, 100.0, stats.Samples[59].RxRate)
+	require.Equal(t, uint64(12000), stats.TotalRxBytes)
+	require.Equal(t, uint64(1200), stats.TotalTxBytes)
+
+	stats, _ = s.Stats("peer", time.Hour)
+	require.Equal(t, int64(60), stats.Resolution)
+	require.Len(t, stats.Samples, 60)
+	var rxBytes uint64
+	for _, sample := range stats.Samples {
+		rxBytes += sample.RxBytes
+	}
+	require.Equal(t, uint64(12000), rxBytes)
+
+	stats, _ = s.Stats("peer", 7*24*time.Hour)
+	require.Equal(t, int64(3600), stats.Resolution)
+	require.Len(t, stats.Samples, 7*24)
+
+	// the totals survive a restart with reset device counters
+	s.save()
+	s = newTestSampler(t, st, &now)
+	peer.RxBytes, peer.TxBytes = 50, 5
+	now = now.Add(time.Second)
+	s.Sample(now, devicePeers)
+	stats, _ = s.Stats("peer", time.Hour)
+	require.Equal(t, uint64(12050), stats.TotalRxBytes)
+	require.Equal(t, uint64(1205), stats.TotalTxBytes)
+
+	// removed peers are dropped
+	devicePeers = devicePeers[:1]
+	s.Sample(now.Add(time.Second), devicePeers)
+	_, ok = s.Stats("peer", time.Hour)
+	require.False(t, ok)
+}
@@ -0,0 +1,177 @@
+package peers
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+)
+
+// suspensionsStoreKey is the key of the suspended peers.
+const suspensionsStoreKey = "peer_suspensions"
+
+// ErrPeerNotFound is returned if a peer that is not on the hub device is suspended or resumed.
+var ErrPeerNotFound = errors.New("peer not found")
+
+// SuspendReason is why a peer is suspended, a peer is resumed once all reasons are cleared.
+type SuspendReason string
+
+const (
+	// SuspendQuota suspends peers with an exhausted traffic quota.
+	SuspendQuota SuspendReason = "quota"
+	// SuspendDisabled suspends peers that were disabled via the config file or the API.
+	SuspendDisabled SuspendReason = "disabled"
+	// SuspendExpired suspends peers whose access expired.
+	SuspendExpired SuspendReason = "expired"
+	// SuspendSchedule suspends peers outside of their access windows.
+	SuspendSchedule SuspendReason = "schedule"
+)
+
+// suspension keeps the allowed ip of a suspended peer, the allowed ips of the
+// peer are cleared on the device, but the address stays reserved.
+type suspension struct {
+	AllowedIP string          `json:"allowedIP"`
+	Reasons   []SuspendReason `json:"reasons"`
+}
+
+func (m *Manager) restoreSuspensions() error {
+	err := m.store.Load(suspensionsStoreKey, &m.suspended)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load peer suspensions: %w", err)
+	}
+	devConfig, err := m.dev.IpcGet()
+	if err != nil {
+		return fmt.Errorf("failed to get ipc operation")
+	}
+	devicePeers := ipc.ParsePeers(devConfig)
+	for publicKey, s := range m.suspended {
+		publicKeyHex, err := ipc.Base64ToHex(publicKey)
+		// peers that were removed from the config file are not suspended anymore
+		if err != nil || !slices.ContainsFunc(devicePeers, func(p *ipc.Peer) bool { return p.PublicKey == publicKey }) {
+			delete(m.suspended, publicKey)
+			continue
+		}
+		if err := m.dev.IpcSet(fmt.Sprintf("public_key=%s\nupdate_only=true\nreplace_allowed_ips=true\n", publicKeyHex)); err != nil {
+			return fmt.Errorf("failed to suspend peer %s: %w", publicKey, err)
+		}
+		m.log.Infof("suspended peer %s (%s)", publicKeyHex, s.AllowedIP)
+	}
+	return nil
+}
+
+// applyEnabled disables the peers of the config file with enabled: false and
+// enables the peers with enabled: true, peers without the flag keep their state.
+func (m *Manager) applyEnabled() error {
+	for _, peer := range m.cfg.Peers {
+		if peer.Enabled == nil {
+			continue
+		}
+		var err error
+		if *peer.Enabled {
+			err = m.resume(peer.PublicKey, SuspendDisabled)
+		} else {
+			err = m.suspend(peer.PublicKey, SuspendDisabled)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to apply enabled flag of peer %s: %w", peer.PublicKey, err)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) persistSuspensions() {
+	if err := m.store.Save(suspensionsStoreKey, m.suspended); err != nil {
+		m.log.Errorf("failed to persist peer suspensions: %v", err)
+	}
+}
+
+// Suspended returns the reasons why the peer is suspended, nil if it is not suspended.
+func (m *Manager) Suspended(publicKey string) []SuspendReason {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.suspended[publicKey]; ok {
+		return slices.Clone(s.Reasons)
+	}
+	return nil
+}
+
+// Suspend clears the allowed ips of the peer on the device and keeps its
+// allowed ip reserved until the peer is resumed for all reasons.
+func (m *Manager) Suspend(publicKey string, reason SuspendReason) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.suspend(publicKey, reason)
+}
+
+func (m *Manager) suspend(publicKey string, reason SuspendReason) error {
+	if s, ok := m.suspended[publicKey]; ok {
+		if !slices.Contains(s.Reasons, reason) {
+			s.Reasons = append(s.Reasons, reason)
+			m.persistSuspensions()
+		}
+		return nil
+	}
+	publicKeyHex, err := ipc.Base64ToHex(publicKey)
+	if err != nil {
+		return ErrInvalidPublicKey
+	}
+	peers, err := m.list()
+	if err != nil {
+		return err
+	}
+	idx := slices.IndexFunc(peers, func(p *ipc.Peer) bool { return p.PublicKey == publicKey })
+	if idx < 0 {
+		return ErrPeerNotFound
+	}
+	allowedIP := peers[idx].AllowedIP
+	if err := m.dev.IpcSet(fmt.Sprintf("public_key=%s\nupdate_only=true\nreplace_allowed_ips=true\n", publicKeyHex)); err != nil {
+		m.log.Errorf("failed to suspend peer: %v", err)
+		return fmt.Errorf("failed to suspend peer")
+	}
+	m.log.Infof("suspended peer %s (%s): %s", publicKeyHex, allowedIP, reason)
+	m.suspended[publicKey] = &suspension{AllowedIP: allowedIP, Reasons: []SuspendReason{reason}}
+	m.persistSuspensions()
+	m.bus.Publish(events.PeerSuspended, &events.PeerData{PublicKey: publicKey, AllowedIP: allowedIP, Reason: string(reason)})
+	return nil
+}
+
+// Resume clears the reason and restores the allowed ip of the peer once no other reason is left.
+func (m *Manager) Resume(publicKey string, reason SuspendReason) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.resume(publicKey, reason)
+}
+
+func (m *Manager) resume(publicKey string, reason SuspendReason) error {
+	s, ok := m.suspended[publicKey]
+	if !ok || !slices.Contains(s.Reasons, reason) {
+		return nil
+	}
+	// the reasons are only changed once the device was updated, so a failed resume can be retried
+	reasons := slices.DeleteFunc(slices.Clone(s.Reasons), func(r SuspendReason) bool { return r == reason })
+	if len(reasons) > 0 {
+		s.Reasons = reasons
+		m.persistSuspensions()
+		return nil
+	}
+	publicKeyHex, err := ipc.Base64ToHex(publicKey)
+	if err != nil {
+		return ErrInvalidPublicKey
+	}
+	err = m.dev.IpcSet(fmt.Sprintf("public_key=%s\nupdate_only=true\nreplace_allowed_ips=true\nallowed_ip=%s\n", publicKeyHex, s.AllowedIP))
+	if err != nil {
+		m.log.Errorf("failed to resume peer: %v", err)
+		return fmt.Errorf("failed to resume peer")
+	}
+	m.log.Infof("resumed peer %s (%s)", publicKeyHex, s.AllowedIP)
+	delete(m.suspended, publicKey)
+	m.persistSuspensions()
+	m.bus.Publish(events.PeerResumed, &events.PeerData{PublicKey: publicKey, AllowedIP: s.AllowedIP, Reason: string(reason)})
+	return nil
+}
@@ -0,0 +1,391 @@
+package peers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// sessionsStoreKey is the key of the connection history of the peers.
+	sessionsStoreKey = "peer_sessions"
+	// maxSessions is the number of sessions kept per peer.
+	maxSessions = 100
+)
+
+type State string
+
+const (
+	// StateOnline peers had a recent handshake and transferred data within the idle timeout.
+	StateOnline State = "online"
+	// StateIdle peers had a recent handshake but transferred no data within the idle timeout.
+	StateIdle State = "idle"
+	// StateOffline peers had no handshake within the offline timeout.
+	StateOffline State = "offline"
+)
+
+// Status is the derived connection state of a peer.
+type Status struct {
+	State           State      `json:"state"`
+	LastHandshakeAt *time.Time `json:"lastHandshakeAt,omitempty"`
+	// LastActivityAt is the time the transferred bytes last changed.
+	LastActivityAt *time.Time `json:"lastActivityAt,omitempty"`
+	// RxRate and TxRate are the bytes per second since the previous poll.
+	RxRate float64 `json:"rxRate"`
+	TxRate float64 `json:"txRate"`
+}
+
+// Session is a connection of a peer from the first handshake until it went offline or changed its endpoint.
+type Session struct {
+	Start time.Time `json:"start"`
+	// End is empty while the session is active.
+	End           *time.Time `json:"end,omitempty"`
+	Endpoint      string     `json:"endpoint,omitempty"`
+	LastHandshake time.Time  `json:"lastHandshake"`
+	RxBytes       uint64     `json:"rxBytes"`
+	TxBytes       uint64     `json:"txBytes"`
+
+	// rxBase and txBase are the device counters at the start of the session
+	rxBase uint64
+	txBase uint64
+}
+
+type WatcherConfig struct {
+	// Interval of the device polls.
+	Interval time.Duration
+	// OfflineTimeout is the time since the last handshake after which a peer is offline.
+	OfflineTimeout time.Duration
+	// IdleTimeout is the time without transferred bytes after which a peer is idle.
+	IdleTimeout time.Duration
+}
+
+type watchedPeer struct {
+	allowedIP     string
+	endpoint      string
+	lastHandshake uint64
+	lastActivity  time.Time
+	state         State
+	rxBytes       uint64
+	txBytes       uint64
+	rxRate        float64
+	txRate        float64
+}
+
+// Watcher polls the peers of the hub device, derives their connection state
+// and keeps their connection history. It publishes the handshakes, endpoint
+// changes, peers that went offline and the traffic rates. The hub instance
+// is not watched.
+// The peers of every poll are passed to the observers, so the device is
+// listed once per interval for all consumers.
+type Watcher struct {
+	log   *logrus.Logger
+	list  func() ([]*ipc.Peer, error)
+	hubIP string
+	bus   *events.Bus
+	store store.Store
+	cfg   WatcherConfig
+	// observers are called with the peers of every poll, including the hub instance
+	observers []func(now time.Time, devicePeers []*ipc.Peer)
+
+	mu       sync.Mutex
+	peers    map[string]*watchedPeer
+	sessions map[string][]*Session
+	lastPoll time.Time
+}
+
+// NewWatcher creates a watcher for the peers of the manager and restores the connection history.
+func NewWatcher(manager *Manager, bus *events.Bus, cfg *WatcherConfig) (*Watcher, error) {
+	w := &Watcher{
+		log:      manager.log,
+		list:     manager.List,
+		hubIP:    manager.cfg.GetHubAddress(),
+		bus:      bus,
+		store:    manager.store,
+		cfg:      *cfg,
+		peers:    make(map[string]*watchedPeer),
+		sessions: make(map[string][]*Session),
+	}
+	if w.cfg.Interval <= 0 {
+		w.cfg.Interval = 5 * time.Second
+	}
+	if w.cfg.OfflineTimeout <= 0 {
+		w.cfg.OfflineTimeout = 3 * time.Minute
+	}
+	if w.cfg.IdleTimeout <= 0 {
+		w.cfg.IdleTimeout = 2 * time.Minute
+	}
+	err := w.store.Load(sessionsStoreKey, &w.sessions)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("failed to load peer sessions: %w", err)
+	}
+	// sessions that were active before the restart end with their last handshake
+	for _, sessions := range w.sessions {
+		for _, s := range sessions {
+			if s.End == nil {
+				end := s.LastHandshake
+				s.End = &end
+			}
+		}
+	}
+	return w, nil
+}
+
+// Observe registers a function that is called with the peers of every poll, it
+// has to be called before Run.
+func (w *Watcher) Observe(fn func(now time.Time, devicePeers []*ipc.Peer)) {
+	w.observers = append(w.observers, fn)
+}
+
+// Run polls the peers until the context is done.
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		if devicePeers, ok := w.poll(now); ok {
+			for _, observe := range w.observers {
+				observe(now, devicePeers)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status returns the status of the peer with the given base64 encoded public key.
+func (w *Watcher) Status(publicKey string) (*Status, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wp, ok := w.peers[publicKey]
+	if !ok {
+		return nil, false
+	}
+	s := &Status{State: wp.state, RxRate: wp.rxRate, TxRate: wp.txRate}
+	if wp.lastHandshake != 0 {
+		s.LastHandshakeAt = handshakeTime(wp.lastHandshake)
+	}
+	if !wp.lastActivity.IsZero() {
+		lastActivity := wp.lastActivity.UTC()
+		s.LastActivityAt = &lastActivity
+	}
+	return s, true
+}
+
+// Sessions returns the connection history of the peer, newest first.
+func (w *Watcher) Sessions(publicKey string) []*Session {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	sessions := make([]*Session, 0, len(w.sessions[publicKey]))
+	for i := len(w.sessions[publicKey]) - 1; i >= 0; i-- {
+		s := *w.sessions[publicKey][i]
+		sessions = append(sessions, &s)
+	}
+	return sessions
+}
+
+func handshakeTime(lastHandshake uint64) *time.Time {
+	t := time.Unix(int64(lastHandshake), 0).UTC()
+	return &t
+}
+
+func (w *Watcher) persistSessions() {
+	if err := w.store.Save(sessionsStoreKey, w.sessions); err != nil {
+		w.log.Errorf("failed to persist peer sessions: %v", err)
+	}
+}
+
+// poll updates the state of the peers and returns the listed peers.
+func (w *Watcher) poll(now time.Time) ([]*ipc.Peer, bool) {
+	devicePeers, err := w.list()
+	if err != nil {
+		w.log.Errorf("failed to watch peers: %v", err)
+		return nil, false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var elapsed time.Duration
+	if !w.lastPoll.IsZero() {
+		elapsed = now.Sub(w.lastPoll)
+	}
+	w.lastPoll = now
+	seen := make(map[string]struct{}, len(devicePeers))
+	traffic := make([]*events.PeerTraffic, 0, len(devicePeers))
+	ratesChanged, sessionsChanged := false, false
+	for _, peer := range devicePeers {
+		if peer.AllowedIP == w.hubIP {
+			continue
+		}
+		seen[peer.PublicKey] = struct{}{}
+		wp := w.update(peer, now)
+		if w.updateRates(wp, peer, elapsed) {
+			ratesChanged = true
+		}
+		if w.updateSession(wp, peer, now) {
+			sessionsChanged = true
+		}
+		traffic = append(traffic, &events.PeerTraffic{
+			PublicKey: peer.PublicKey,
+			RxBytes:   peer.RxBytes,
+			TxBytes:   peer.TxBytes,
+			RxRate:    wp.rxRate,
+			TxRate:    wp.txRate,
+		})
+	}
+	for publicKey := range w.peers {
+		if _, ok := seen[publicKey]; !ok {
+			delete(w.peers, publicKey)
+		}
+	}
+	// the history of removed peers is dropped
+	for publicKey := range w.sessions {
+		if _, ok := seen[publicKey]; !ok {
+			delete(w.sessions, publicKey)
+			sessionsChanged = true
+		}
+	}
+	if sessionsChanged {
+		w.persistSessions()
+	}
+	if ratesChanged {
+		w.bus.Publish(events.TrafficRates, traffic)
+	}
+	return devicePeers, true
+}
+
+// updateRates calculates the bytes per second since the last poll and reports whether they changed.
+func (w *Watcher) updateRates(wp *watchedPeer, peer *ipc.Peer, elapsed time.Duration) bool {
+	rxRate, txRate := 0.0, 0.0
+	// the counters start over if the peer was added again
+	if elapsed > 0 && peer.RxBytes >= wp.rxBytes && peer.TxBytes >= wp.txBytes {
+		rxRate = float64(peer.RxBytes-wp.rxBytes) / elapsed.Seconds()
+		txRate = float64(peer.TxBytes-wp.txBytes) / elapsed.Seconds()
+	}
+	changed := rxRate != wp.rxRate || txRate != wp.txRate
+	wp.rxBytes, wp.txBytes = peer.RxBytes, peer.TxBytes
+	wp.rxRate, wp.txRate = rxRate, txRate
+	return changed
+}
+
+func (w *Watcher) state(wp *watchedPeer, now time.Time) State {
+	if wp.lastHandshake == 0 || now.Sub(time.Unix(int64(wp.lastHandshake), 0)) >= w.cfg.OfflineTimeout {
+		return StateOffline
+	}
+	if now.Sub(wp.lastActivity) >= w.cfg.IdleTimeout {
+		return StateIdle
+	}
+	return StateOnline
+}
+
+// update derives the state of the peer and publishes the handshake, endpoint and offline events,
+// it is called before the rates are updated.
+func (w *Watcher) update(peer *ipc.Peer, now time.Time) *watchedPeer {
+	wp, ok := w.peers[peer.PublicKey]
+	if !ok || wp.allowedIP != peer.AllowedIP {
+		// a removed and added again peer starts over
+		wp = &watchedPeer{
+			allowedIP: peer.AllowedIP,
+			endpoint:  peer.Endpoint,
+			state:     StateOffline,
+			rxBytes:   peer.RxBytes,
+			txBytes:   peer.TxBytes,
+		}
+		w.peers[peer.PublicKey] = wp
+	}
+	data := func() *events.PeerData {
+		return &events.PeerData{PublicKey: peer.PublicKey, AllowedIP: peer.AllowedIP, Endpoint: peer.Endpoint}
+	}
+	if peer.LastHandshake != wp.lastHandshake && peer.LastHandshake != 0 {
+		d := data()
+		d.LastHandshake = handshakeTime(peer.LastHandshake)
+		if wp.lastHandshake == 0 {
+			w.bus.Publish(events.PeerFirstHandshake, d)
+		} else {
+			w.bus.Publish(events.PeerHandshake, d)
+		}
+		if handshake := time.Unix(int64(peer.LastHandshake), 0); handshake.After(wp.lastActivity) {
+			wp.lastActivity = handshake
+		}
+	}
+	if wp.endpoint != "" && peer.Endpoint != "" && wp.endpoint != peer.Endpoint {
+		d := data()
+		d.PreviousEndpoint = wp.endpoint
+		w.bus.Publish(events.PeerEndpointChanged, d)
+	}
+	if peer.Endpoint != "" {
+		wp.endpoint = peer.Endpoint
+	}
+	if peer.RxBytes != wp.rxBytes || peer.TxBytes != wp.txBytes {
+		wp.lastActivity = now
+	}
+	wp.lastHandshake = peer.LastHandshake
+	state := w.state(wp, now)
+	if wp.state != StateOffline && state == StateOffline {
+		d := data()
+		d.LastHandshake = handshakeTime(peer.LastHandshake)
+		w.bus.Publish(events.PeerOffline, d)
+	}
+	wp.state = state
+	return wp
+}
+
+// updateSession starts, updates or ends the current session of the peer, a
+// new session is started if the endpoint of the peer changed. It reports whether a
+// session started or ended.
+func (w *Watcher) updateSession(wp *watchedPeer, peer *ipc.Peer, now time.Time) bool {
+	sessions := w.sessions[peer.PublicKey]
+	var current *Session
+	if n := len(sessions); n > 0 && sessions[n-1].End == nil {
+		current = sessions[n-1]
+	}
+	var start time.Time
+	if current != nil {
+		if peer.RxBytes >= current.rxBase && peer.TxBytes >= current.txBase {
+			current.RxBytes = peer.RxBytes - current.rxBase
+			current.TxBytes = peer.TxBytes - current.txBase
+		}
+		if peer.LastHandshake != 0 {
+			current.LastHandshake = *handshakeTime(peer.LastHandshake)
+		}
+		roamed := peer.Endpoint != "" && current.Endpoint != "" && peer.Endpoint != current.Endpoint
+		if wp.state != StateOffline && !roamed {
+			return false
+		}
+		end := wp.lastActivity.UTC()
+		if roamed {
+			end = now.UTC()
+		}
+		if end.Before(current.Start) {
+			end = current.Start
+		}
+		current.End = &end
+		start = end
+	}
+	if wp.state != StateOffline {
+		if start.IsZero() {
+			start = *handshakeTime(peer.LastHandshake)
+		}
+		sessions = append(sessions, &Session{
+			Start:         start,
+			Endpoint:      peer.Endpoint,
+			LastHandshake: *handshakeTime(peer.LastHandshake),
+			rxBase:        peer.RxBytes,
+			txBase:        peer.TxBytes,
+		})
+		if len(sessions) > maxSessions {
+			sessions = slices.Delete(sessions, 0, len(sessions)-maxSessions)
+		}
+		w.sessions[peer.PublicKey] = sessions
+	}
+	return current != nil || wp.state != StateOffline
+}
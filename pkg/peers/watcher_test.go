@@ -0,0 +1,108 @@
+package peers
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestWatcher(t *testing.T, st store.Store, devicePeers *[]*ipc.Peer) *Watcher {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	w := &Watcher{
+		log:   log,
+		list:  func() ([]*ipc.Peer, error) { return *devicePeers, nil },
+		hubIP: "10.0.0.1/32",
+		bus:   events.NewBus(),
+		store: st,
+		cfg: WatcherConfig{
+			Interval:       time.Second,
+			OfflineTimeout: 3 * time.Minute,
+			IdleTimeout:    time.Minute,
+		},
+		peers:    make(map[string]*watchedPeer),
+		sessions: make(map[string][]*Session),
+	}
+	require.NoError(t, w.store.Load(sessionsStoreKey, &w.sessions))
+	return w
+}
+
+func TestWatcher(t *testing.T) {
+	st := store.NewMemoryStore()
+	require.NoError(t, st.Save(sessionsStoreKey, map[string][]*Session{}))
+	start := time.Unix(1_700_000_000, 0)
+	peer := &ipc.Peer{PublicKey: "peer", AllowedIP: "10.0.0.2/32"}
+	devicePeers := []*ipc.Peer{{PublicKey: "hub", AllowedIP: "10.0.0.1/32"}, peer}
+	w := newTestWatcher(t, st, &devicePeers)
+
+	w.poll(start)
+	status, ok := w.Status("peer")
+	require.True(t, ok)
+	require.Equal(t, StateOffline, status.State)
+	_, ok = w.Status("hub")
+	require.False(t, ok)
+	require.Empty(t, w.Sessions("peer"))
+
+	// handshake and traffic
+	peer.LastHandshake = uint64(start.Unix() + 5)
+	peer.Endpoint = "192.0.2.1:51820"
+	peer.RxBytes, peer.TxBytes = 1000, 500
+	w.poll(start.Add(10 * time.Second))
+	status, _ = w.Status("peer")
+	require.Equal(t, StateOnline, status.State)
+	require.Equal(t, 100.0, status.RxRate)
+	sessions := w.Sessions("peer")
+	require.Len(t, sessions, 1)
+	require.Nil(t, sessions[0].End)
+	require.Equal(t, start.Add(5*time.Second).UTC(), sessions[0].Start)
+
+	// no traffic within the idle timeout
+	peer.RxBytes, peer.TxBytes = 1500, 700
+	w.poll(start.Add(20 * time.Second))
+	w.poll(start.Add(90 * time.Second))
+	status, _ = w.Status("peer")
+	require.Equal(t, StateIdle, status.State)
+	require.Equal(t, start.Add(20*time.Second).UTC(), *status.LastActivityAt)
+	sessions = w.Sessions("peer")
+	require.Len(t, sessions, 1)
+	require.Equal(t, uint64(500), sessions[0].RxBytes)
+	require.Equal(t, uint64(200), sessions[0].TxBytes)
+
+	// roaming starts a new session
+	peer.LastHandshake = uint64(start.Unix() + 95)
+	peer.Endpoint = "198.51.100.1:51820"
+	w.poll(start.Add(100 * time.Second))
+	sessions = w.Sessions("peer")
+	require.Len(t, sessions, 2)
+	require.Equal(t, "198.51.100.1:51820", sessions[0].Endpoint)
+	require.Nil(t, sessions[0].End)
+	require.Equal(t, "192.0.2.1:51820", sessions[1].Endpoint)
+	require.Equal(t, start.Add(100*time.Second).UTC(), *sessions[1].End)
+
+	// no handshake within the offline timeout
+	sub := w.bus.Subscribe(10)
+	w.poll(start.Add(5 * time.Minute))
+	status, _ = w.Status("peer")
+	require.Equal(t, StateOffline, status.State)
+	e := <-sub.Events()
+	require.Equal(t, events.PeerOffline, e.Type)
+	sessions = w.Sessions("peer")
+	require.Len(t, sessions, 2)
+	// the session started after the last handshake
+	require.Equal(t, start.Add(100*time.Second).UTC(), *sessions[0].End)
+
+	// the history is restored and removed with the peer
+	w = newTestWatcher(t, st, &devicePeers)
+	require.Len(t, w.Sessions("peer"), 2)
+	devicePeers = devicePeers[:1]
+	w.poll(start.Add(6 * time.Minute))
+	require.Empty(t, w.Sessions("peer"))
+	w = newTestWatcher(t, st, &devicePeers)
+	require.Empty(t, w.Sessions("peer"))
+}
@@ -0,0 +1,449 @@
+// Package shaping schedules the packets of the loopback with per-peer and per-group token buckets.
+package shaping
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/flows"
+	"github.com/christophwitzko/wg-hub/pkg/loopback"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+)
+
+// ErrClosed is returned by Dequeue once the shaper is closed.
+var ErrClosed = errors.New("shaper closed")
+
+const (
+	// maxQueuedPackets limits the memory of all queues.
+	maxQueuedPackets = 16384
+	storeKey         = "shaping"
+)
+
+type bucket struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+func newBucket(limit *config.RateLimit, now time.Time) *bucket {
+	rate, burst := limit.Bytes()
+	return &bucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// required returns the tokens that are needed to send a packet of the given size.
+// Packets larger than the burst pass once the bucket is full, interactive packets
+// may overdraw the bucket by up to one burst.
+func (b *bucket) required(size int, interactive bool) float64 {
+	if interactive {
+		return float64(size) - b.burst
+	}
+	return min(float64(size), b.burst)
+}
+
+type pair struct {
+	src, dst string
+}
+
+type queue struct {
+	pair
+	// buckets are resolved on the first packet after a config or peer change
+	buckets     []*bucket
+	resolved    bool
+	interactive [][]byte
+	bulk        [][]byte
+	forwarded   uint64
+	dropped     uint64
+}
+
+func (q *queue) len() int {
+	return len(q.interactive) + len(q.bulk)
+}
+
+// QueueStats are the counters of the packets from a source to a destination peer.
+type QueueStats struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Queued      int    `json:"queued"`
+	Forwarded   uint64 `json:"forwarded"`
+	Dropped     uint64 `json:"dropped"`
+}
+
+type peerPrefix struct {
+	prefix    netip.Prefix
+	publicKey string
+}
+
+// Shaper is a loopback.Scheduler that queues the packets per source and destination
+// peer and forwards them round-robin once the token buckets of the ingress limits
+// of the source and the egress limits of the destination allow it. Interactive
+// packets are forwarded before the bulk packets.
+type Shaper struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	store    store.Store
+	cfg      *config.ShapingConfig
+	prefixes []peerPrefix
+	ingress  map[string][]*bucket
+	egress   map[string][]*bucket
+	queues   map[pair]*queue
+	// active are the queues with packets in round-robin order
+	active      []*queue
+	queued      int
+	interactive map[uint16]bool
+	signal      chan struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+var _ loopback.Scheduler = (*Shaper)(nil)
+
+// NewShaper creates a shaper with the validated config, a nil config forwards all packets without limits.
+// A config that was updated at runtime and persisted in the store replaces the given config.
+func NewShaper(cfg *config.ShapingConfig, st store.Store) (*Shaper, error) {
+	s := &Shaper{
+		now:    time.Now,
+		store:  st,
+		queues: make(map[pair]*queue),
+		signal: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	if st != nil {
+		var stored *config.ShapingConfig
+		err := st.Load(storeKey, &stored)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return nil, fmt.Errorf("failed to load shaping config: %w", err)
+		}
+		if stored != nil {
+			if err := stored.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid stored shaping config: %w", err)
+			}
+			cfg = stored
+		}
+	}
+	s.SetConfig(cfg)
+	return s, nil
+}
+
+// Stored reports whether a config that was updated at runtime is persisted in the store,
+// a store that fails to load the config reports true so NewShaper returns the error.
+func Stored(st store.Store) bool {
+	if st == nil {
+		return false
+	}
+	var stored *config.ShapingConfig
+	err := st.Load(storeKey, &stored)
+	return !errors.Is(err, store.ErrNotFound)
+}
+
+// Update validates, persists and applies the config.
+func (s *Shaper) Update(cfg *config.ShapingConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if s.store != nil {
+		if err := s.store.Save(storeKey, cfg); err != nil {
+			return fmt.Errorf("failed to persist shaping config: %w", err)
+		}
+	}
+	s.SetConfig(cfg)
+	return nil
+}
+
+func (s *Shaper) notify() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Config returns the current config.
+func (s *Shaper) Config() *config.ShapingConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// SetConfig replaces the limits, the buckets start full. The config must be validated.
+func (s *Shaper) SetConfig(cfg *config.ShapingConfig) {
+	if cfg == nil {
+		cfg = &config.ShapingConfig{}
+		_ = cfg.Validate()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.cfg = cfg
+	s.ingress = make(map[string][]*bucket)
+	s.egress = make(map[string][]*bucket)
+	add := func(publicKey string, policy *config.ShapingPolicy, ingress, egress *bucket) {
+		if policy.Ingress != nil {
+			s.ingress[publicKey] = append(s.ingress[publicKey], ingress)
+		}
+		if policy.Egress != nil {
+			s.egress[publicKey] = append(s.egress[publicKey], egress)
+		}
+	}
+	newBuckets := func(policy *config.ShapingPolicy) (ingress, egress *bucket) {
+		if policy.Ingress != nil {
+			ingress = newBucket(policy.Ingress, now)
+		}
+		if policy.Egress != nil {
+			egress = newBucket(policy.Egress, now)
+		}
+		return ingress, egress
+	}
+	for _, p := range cfg.Peers {
+		ingress, egress := newBuckets(&p.ShapingPolicy)
+		add(p.PublicKey, &p.ShapingPolicy, ingress, egress)
+	}
+	for _, g := range cfg.Groups {
+		// the peers of a group share the buckets
+		ingress, egress := newBuckets(&g.ShapingPolicy)
+		for _, publicKey := range g.Peers {
+			add(publicKey, &g.ShapingPolicy, ingress, egress)
+		}
+	}
+	s.interactive = make(map[uint16]bool, len(cfg.InteractivePorts))
+	for _, port := range cfg.InteractivePorts {
+		s.interactive[port] = true
+	}
+	s.resetBuckets()
+	s.notify()
+}
+
+// SetPeers replaces the allowed ips of the peers (public key to allowed ip), the queues of removed peers are dropped.
+func (s *Shaper) SetPeers(peers map[string]netip.Prefix) {
+	prefixes := make([]peerPrefix, 0, len(peers))
+	for publicKey, prefix := range peers {
+		prefixes = append(prefixes, peerPrefix{prefix: prefix.Masked(), publicKey: publicKey})
+	}
+	// the most specific prefix matches first
+	slices.SortFunc(prefixes, func(a, b peerPrefix) int {
+		return b.prefix.Bits() - a.prefix.Bits()
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prefixes = prefixes
+	for p, q := range s.queues {
+		_, srcOk := peers[p.src]
+		_, dstOk := peers[p.dst]
+		if (!srcOk && p.src != loopback.UnknownPeer) || (!dstOk && p.dst != loopback.UnknownPeer) {
+			delete(s.queues, p)
+			s.queued -= q.len()
+		}
+	}
+	s.active = slices.DeleteFunc(s.active, func(q *queue) bool {
+		_, ok := s.queues[q.pair]
+		return !ok
+	})
+	s.resetBuckets()
+	s.notify()
+}
+
+func (s *Shaper) resetBuckets() {
+	for _, q := range s.queues {
+		q.buckets, q.resolved = nil, false
+	}
+}
+
+func (s *Shaper) lookup(addr netip.Addr) string {
+	for _, p := range s.prefixes {
+		if p.prefix.Contains(addr) {
+			return p.publicKey
+		}
+	}
+	return loopback.UnknownPeer
+}
+
+func (s *Shaper) isInteractive(key *flows.Key) bool {
+	switch key.Protocol {
+	case 1, 58:
+		return true
+	case 6, 17:
+		return s.interactive[key.SrcPort] || s.interactive[key.DstPort]
+	}
+	return false
+}
+
+// Enqueue copies the packet into the queue of its source and destination peer.
+func (s *Shaper) Enqueue(packet []byte) bool {
+	key, _, ok := flows.ParsePacket(packet)
+	if !ok {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+		return false
+	default:
+	}
+	p := pair{src: s.lookup(key.Src), dst: s.lookup(key.Dst)}
+	q, ok := s.queues[p]
+	if !ok {
+		q = &queue{pair: p}
+		s.queues[p] = q
+	}
+	if q.len() >= s.cfg.QueueLength || s.queued >= maxQueuedPackets {
+		q.dropped++
+		return false
+	}
+	if q.len() == 0 {
+		s.active = append(s.active, q)
+	}
+	data := append([]byte(nil), packet...)
+	if s.isInteractive(&key) {
+		q.interactive = append(q.interactive, data)
+	} else {
+		q.bulk = append(q.bulk, data)
+	}
+	s.queued++
+	s.notify()
+	return true
+}
+
+func (s *Shaper) resolve(q *queue) []*bucket {
+	if !q.resolved {
+		q.buckets = append(slices.Clone(s.ingress[q.src]), s.egress[q.dst]...)
+		q.resolved = true
+	}
+	return q.buckets
+}
+
+// wait returns how long the buckets need to refill for the packet, zero if it can be sent.
+func wait(buckets []*bucket, size int, interactive bool, now time.Time) time.Duration {
+	var d time.Duration
+	for _, b := range buckets {
+		b.refill(now)
+		if missing := b.required(size, interactive) - b.tokens; missing > 0 {
+			d = max(d, time.Duration(missing/b.rate*float64(time.Second))+1)
+		}
+	}
+	return d
+}
+
+// next removes the next due packet from the queues or returns the time until a packet is due.
+func (s *Shaper) next() ([]byte, time.Duration) {
+	now := s.now()
+	next := time.Duration(-1)
+	for _, interactive := range []bool{true, false} {
+		for i, q := range s.active {
+			packets := &q.bulk
+			if interactive {
+				packets = &q.interactive
+			}
+			if len(*packets) == 0 {
+				continue
+			}
+			packet := (*packets)[0]
+			buckets := s.resolve(q)
+			if d := wait(buckets, len(packet), interactive, now); d > 0 {
+				if next < 0 || d < next {
+					next = d
+				}
+				continue
+			}
+			for _, b := range buckets {
+				b.tokens -= float64(len(packet))
+			}
+			(*packets)[0] = nil
+			*packets = (*packets)[1:]
+			q.forwarded++
+			s.queued--
+			// the queue continues at the end of the round
+			s.active = slices.Delete(s.active, i, i+1)
+			if q.len() > 0 {
+				s.active = append(s.active, q)
+			}
+			return packet, 0
+		}
+	}
+	return nil, next
+}
+
+// Dequeue blocks until a packet is due and copies it into buf.
+func (s *Shaper) Dequeue(buf []byte) (int, error) {
+	timer := time.NewTimer(0)
+	<-timer.C
+	for {
+		s.mu.Lock()
+		packet, d := s.next()
+		s.mu.Unlock()
+		if packet != nil {
+			return copy(buf, packet), nil
+		}
+		if d < 0 {
+			select {
+			case <-s.closed:
+				return 0, ErrClosed
+			case <-s.signal:
+			}
+			continue
+		}
+		timer.Reset(d)
+		select {
+		case <-s.closed:
+			timer.Stop()
+			return 0, ErrClosed
+		case <-s.signal:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+	}
+}
+
+// Close stops the shaper and drops the queued packets.
+func (s *Shaper) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		close(s.closed)
+		s.active = nil
+		s.queued = 0
+		for _, q := range s.queues {
+			q.interactive, q.bulk = nil, nil
+		}
+	})
+	return nil
+}
+
+// Stats returns the counters of all queues, sorted by dropped and forwarded packets (descending).
+func (s *Shaper) Stats() []*QueueStats {
+	stats := make([]*QueueStats, 0)
+	if s == nil {
+		return stats
+	}
+	s.mu.Lock()
+	for _, q := range s.queues {
+		stats = append(stats, &QueueStats{
+			Source:      q.src,
+			Destination: q.dst,
+			Queued:      q.len(),
+			Forwarded:   q.forwarded,
+			Dropped:     q.dropped,
+		})
+	}
+	s.mu.Unlock()
+	slices.SortFunc(stats, func(a, b *QueueStats) int {
+		if a.Dropped != b.Dropped {
+			return cmp.Compare(b.Dropped, a.Dropped)
+		}
+		return cmp.Compare(b.Forwarded, a.Forwarded)
+	})
+	return stats
+}
@@ -0,0 +1,162 @@
+package shaping
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func tcpPacket(src, dst string, dstPort uint16, size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = 0x45
+	packet[9] = 6
+	copy(packet[12:16], netip.MustParseAddr(src).AsSlice())
+	copy(packet[16:20], netip.MustParseAddr(dst).AsSlice())
+	binary.BigEndian.PutUint16(packet[20:], 40000)
+	binary.BigEndian.PutUint16(packet[22:], dstPort)
+	return packet
+}
+
+func newKey(t *testing.T) string {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	return key.PublicKey().String()
+}
+
+func newTestShaper(t *testing.T, cfg *config.ShapingConfig, now *time.Time, keys ...string) *Shaper {
+	if cfg != nil {
+		require.NoError(t, cfg.Validate())
+	}
+	s, err := NewShaper(cfg, nil)
+	require.NoError(t, err)
+	s.now = func() time.Time { return *now }
+	s.SetConfig(cfg)
+	peers := make(map[string]netip.Prefix)
+	for i, key := range keys {
+		peers[key] = netip.PrefixFrom(netip.AddrFrom4([4]byte{192, 168, 0, byte(i + 1)}), 32)
+	}
+	s.SetPeers(peers)
+	return s
+}
+
+func dstPort(packet []byte) uint16 {
+	return binary.BigEndian.Uint16(packet[22:])
+}
+
+func TestShaperRoundRobin(t *testing.T) {
+	now := time.Now()
+	a, b, c := newKey(t), newKey(t), newKey(t)
+	s := newTestShaper(t, nil, &now, a, b, c)
+	for i := 0; i < 3; i++ {
+		require.True(t, s.Enqueue(tcpPacket("192.168.0.1", "192.168.0.2", uint16(1000+i), 100)))
+	}
+	require.True(t, s.Enqueue(tcpPacket("192.168.0.3", "192.168.0.2", 2000, 100)))
+	var ports []uint16
+	for {
+		packet, d := s.next()
+		if packet == nil {
+			require.Equal(t, time.Duration(-1), d)
+			break
+		}
+		ports = append(ports, dstPort(packet))
+	}
+	require.Equal(t, []uint16{1000, 2000, 1001, 1002}, ports)
+}
+
+func TestShaperLimits(t *testing.T) {
+	now := time.Now()
+	a, b, c := newKey(t), newKey(t), newKey(t)
+	cfg := &config.ShapingConfig{
+		Peers: []*config.PeerShaping{
+			{PublicKey: a, ShapingPolicy: config.ShapingPolicy{Ingress: &config.RateLimit{Rate: "100KB"}}},
+		},
+		QueueLength: 20,
+	}
+	s := newTestShaper(t, cfg, &now, a, b, c)
+	for i := 0; i < 25; i++ {
+		s.Enqueue(tcpPacket("192.168.0.1", "192.168.0.2", 80, 1400))
+	}
+	// the 16KiB minimum burst of a allows 11 packets
+	for i := 0; i < 11; i++ {
+		packet, _ := s.next()
+		require.NotNil(t, packet)
+	}
+	packet, d := s.next()
+	require.Nil(t, packet)
+	require.InDelta(t, (1400-(16384-11*1400))*time.Second/100000, d, float64(time.Millisecond))
+
+	// interactive packets overdraw the bucket
+	s.Enqueue(tcpPacket("192.168.0.1", "192.168.0.2", 22, 100))
+	packet, _ = s.next()
+	require.Equal(t, uint16(22), dstPort(packet))
+
+	now = now.Add(100 * time.Millisecond)
+	packet, _ = s.next()
+	require.Equal(t, uint16(80), dstPort(packet))
+
+	require.Equal(t, []*QueueStats{{Source: a, Destination: b, Queued: 8, Forwarded: 13, Dropped: 5}}, s.Stats())
+
+	// the limits are changed at runtime
+	s.SetConfig(nil)
+	for i := 0; i < 8; i++ {
+		packet, _ := s.next()
+		require.NotNil(t, packet)
+	}
+
+	// the queues of removed peers are dropped
+	s.Enqueue(tcpPacket("192.168.0.1", "192.168.0.2", 80, 100))
+	s.SetPeers(nil)
+	packet, _ = s.next()
+	require.Nil(t, packet)
+	require.Empty(t, s.Stats())
+}
+
+func TestShaperGroup(t *testing.T) {
+	now := time.Now()
+	a, b := newKey(t), newKey(t)
+	cfg := &config.ShapingConfig{
+		Groups: []*config.GroupShaping{
+			{Name: "office", Peers: []string{a, b}, ShapingPolicy: config.ShapingPolicy{Egress: &config.RateLimit{Rate: "1mbit", Burst: "20KB"}}},
+		},
+	}
+	s := newTestShaper(t, cfg, &now, a, b)
+	for i := 0; i < 10; i++ {
+		s.Enqueue(tcpPacket("10.0.0.1", "192.168.0.1", 80, 1400))
+		s.Enqueue(tcpPacket("10.0.0.1", "192.168.0.2", 80, 1400))
+	}
+	// both peers share the burst of 20KB
+	forwarded := 0
+	for packet, _ := s.next(); packet != nil; packet, _ = s.next() {
+		forwarded++
+	}
+	require.Equal(t, 14, forwarded)
+	for _, stats := range s.Stats() {
+		require.Equal(t, uint64(7), stats.Forwarded)
+	}
+}
+
+func TestShaperDequeue(t *testing.T) {
+	s, err := NewShaper(nil, nil)
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Enqueue(tcpPacket("192.168.0.1", "192.168.0.2", 80, 100))
+	}()
+	buf := make([]byte, 1500)
+	n, err := s.Dequeue(buf)
+	require.NoError(t, err)
+	require.Equal(t, 100, n)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = s.Close()
+	}()
+	_, err = s.Dequeue(buf)
+	require.ErrorIs(t, err, ErrClosed)
+	require.False(t, s.Enqueue(tcpPacket("192.168.0.1", "192.168.0.2", 80, 100)))
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+var (
+	ErrNotFound   = errors.New("key not found")
+	ErrInvalidKey = errors.New("invalid key")
+	validKey      = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+)
+
+// Store persists JSON encoded values of the hub state (e.g. peers added at runtime).
+type Store interface {
+	// Load decodes the value stored under the key into v or returns ErrNotFound.
+	Load(key string, v any) error
+	// Save encodes and stores v under the key.
+	Save(key string, v any) error
+}
+
+// FileStore stores every key as a JSON file in a directory. The state contains
+// secrets (e.g. signing keys and TOTP secrets), so the files are only readable
+// by the owner (0600) and a new directory is created with mode 0700.
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(key string) (string, error) {
+	if !validKey.MatchString(key) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(s.dir, key+".json"), nil
+}
+
+func (s *FileStore) Load(key string, v any) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *FileStore) Save(key string, v any) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// write to a temporary file first, so that the state is never partially written
+	tmpFile, err := os.CreateTemp(s.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), p)
+}
+
+// MemoryStore keeps the state in memory, it is used if no state directory is configured.
+type MemoryStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string][]byte)}
+}
+
+func (s *MemoryStore) Load(key string, v any) error {
+	if !validKey.MatchString(key) {
+		return ErrInvalidKey
+	}
+	s.mu.Lock()
+	data, ok := s.data[key]
+	s.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *MemoryStore) Save(key string, v any) error {
+	if !validKey.MatchString(key) {
+		return ErrInvalidKey
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = data
+	return nil
+}
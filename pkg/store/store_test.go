@@ -0,0 +1,49 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testValue struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func testStore(t *testing.T, s Store) {
+	var v testValue
+	require.ErrorIs(t, s.Load("test", &v), ErrNotFound)
+	require.ErrorIs(t, s.Save("../test", v), ErrInvalidKey)
+
+	require.NoError(t, s.Save("test", testValue{Name: "a", Count: 1}))
+	require.NoError(t, s.Load("test", &v))
+	require.Equal(t, testValue{Name: "a", Count: 1}, v)
+
+	require.NoError(t, s.Save("test", testValue{Name: "b", Count: 2}))
+	require.NoError(t, s.Load("test", &v))
+	require.Equal(t, testValue{Name: "b", Count: 2}, v)
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStore(dir)
+	require.NoError(t, err)
+	testStore(t, s)
+	info, err := os.Stat(filepath.Join(dir, "test.json"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// the state survives a restart
+	s, err = NewFileStore(dir)
+	require.NoError(t, err)
+	var v testValue
+	require.NoError(t, s.Load("test", &v))
+	require.Equal(t, testValue{Name: "b", Count: 2}, v)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
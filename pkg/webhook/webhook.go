@@ -0,0 +1,308 @@
+// Package webhook delivers the hub events as signed JSON payloads to the configured endpoints.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SignatureHeader contains the hex encoded HMAC-SHA256 of the payload with the prefix sha256=.
+	SignatureHeader = "X-WG-Hub-Signature-256"
+	EventHeader     = "X-WG-Hub-Event"
+	DeliveryHeader  = "X-WG-Hub-Delivery"
+
+	// queueSize limits the pending deliveries per endpoint.
+	queueSize = 256
+	// maxDeliveries is the number of recent deliveries kept per endpoint.
+	maxDeliveries = 100
+	// maxRetryBackoff caps the exponential backoff of the retries.
+	maxRetryBackoff = time.Minute
+)
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusDelivered Status = "delivered"
+	StatusFailed    Status = "failed"
+	StatusDropped   Status = "dropped"
+)
+
+// Delivery is the delivery state of a single event to an endpoint.
+type Delivery struct {
+	ID           string      `json:"id"`
+	EventID      string      `json:"eventID"`
+	Event        events.Type `json:"event"`
+	Status       Status      `json:"status"`
+	Attempts     int         `json:"attempts"`
+	ResponseCode int         `json:"responseCode,omitempty"`
+	LastError    string      `json:"lastError,omitempty"`
+	CreatedAt    time.Time   `json:"createdAt"`
+	UpdatedAt    time.Time   `json:"updatedAt"`
+
+	payload []byte
+}
+
+// EndpointStatus contains the counters and the recent deliveries (newest first) of an endpoint.
+type EndpointStatus struct {
+	URL        string      `json:"url"`
+	Events     []string    `json:"events"`
+	Delivered  uint64      `json:"delivered"`
+	Failed     uint64      `json:"failed"`
+	Dropped    uint64      `json:"dropped"`
+	Deliveries []*Delivery `json:"deliveries"`
+}
+
+// Sign returns the value of the signature header for the payload.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether the signature header matches the payload.
+func Verify(secret string, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, payload)), []byte(signature))
+}
+
+type endpoint struct {
+	cfg    *config.WebhookConfig
+	client *http.Client
+	queue  chan *Delivery
+
+	mu         sync.Mutex
+	delivered  uint64
+	failed     uint64
+	dropped    uint64
+	deliveries []*Delivery
+}
+
+// Dispatcher subscribes to the events and delivers them to the endpoints. Every
+// endpoint has its own queue, so a slow endpoint does not delay the others.
+type Dispatcher struct {
+	log       *logrus.Logger
+	sub       *events.Subscription
+	endpoints []*endpoint
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewDispatcher validates the webhook configs and starts the delivery of the events of the bus.
+func NewDispatcher(log *logrus.Logger, bus *events.Bus, webhooks []*config.WebhookConfig) (*Dispatcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{log: log, ctx: ctx, cancel: cancel}
+	for _, cfg := range webhooks {
+		if err := cfg.Validate(); err != nil {
+			cancel()
+			return nil, err
+		}
+		d.endpoints = append(d.endpoints, &endpoint{
+			cfg:    cfg,
+			client: &http.Client{Timeout: cfg.Timeout},
+			queue:  make(chan *Delivery, queueSize),
+		})
+	}
+	d.sub = bus.Subscribe(queueSize)
+	d.wg.Add(1)
+	go d.dispatch()
+	for _, ep := range d.endpoints {
+		d.wg.Add(1)
+		go d.deliver(ep)
+	}
+	return d, nil
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (d *Dispatcher) dispatch() {
+	defer d.wg.Done()
+	for {
+		var e *events.Event
+		select {
+		case <-d.ctx.Done():
+			return
+		case e = <-d.sub.Events():
+			if e == nil {
+				return
+			}
+		}
+		payload, err := json.Marshal(e)
+		if err != nil {
+			d.log.Errorf("failed to encode webhook event %s: %v", e.Type, err)
+			continue
+		}
+		for _, ep := range d.endpoints {
+			if !ep.cfg.Matches(string(e.Type)) {
+				continue
+			}
+			now := time.Now().UTC()
+			delivery := &Delivery{
+				ID:        newID(),
+				EventID:   e.ID,
+				Event:     e.Type,
+				Status:    StatusPending,
+				CreatedAt: now,
+				UpdatedAt: now,
+				payload:   payload,
+			}
+			ep.add(delivery)
+			select {
+			case ep.queue <- delivery:
+			default:
+				d.log.Warnf("webhook queue of %s is full, dropping event %s", ep.cfg.URL, e.Type)
+				ep.finish(delivery, StatusDropped)
+			}
+		}
+	}
+}
+
+func (ep *endpoint) add(delivery *Delivery) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if len(ep.deliveries) >= maxDeliveries {
+		ep.deliveries = slices.Delete(ep.deliveries, 0, len(ep.deliveries)-maxDeliveries+1)
+	}
+	ep.deliveries = append(ep.deliveries, delivery)
+}
+
+func (ep *endpoint) attempt(delivery *Delivery, code int, err error) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	delivery.Attempts++
+	delivery.ResponseCode = code
+	delivery.LastError = ""
+	if err != nil {
+		delivery.LastError = err.Error()
+	}
+	delivery.UpdatedAt = time.Now().UTC()
+}
+
+func (ep *endpoint) finish(delivery *Delivery, status Status) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	delivery.Status = status
+	delivery.UpdatedAt = time.Now().UTC()
+	delivery.payload = nil
+	switch status {
+	case StatusDelivered:
+		ep.delivered++
+	case StatusFailed:
+		ep.failed++
+	case StatusDropped:
+		ep.dropped++
+	}
+}
+
+// retryable reports whether a failed request should be retried, client errors except timeouts and rate limits are final.
+func retryable(code int) bool {
+	return code == 0 || code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+}
+
+func (d *Dispatcher) deliver(ep *endpoint) {
+	defer d.wg.Done()
+	for {
+		var delivery *Delivery
+		select {
+		case <-d.ctx.Done():
+			return
+		case delivery = <-ep.queue:
+		}
+		backoff := ep.cfg.RetryBackoff
+		for {
+			code, err := d.send(ep, delivery)
+			ep.attempt(delivery, code, err)
+			if err == nil {
+				ep.finish(delivery, StatusDelivered)
+				break
+			}
+			if !retryable(code) || delivery.Attempts >= ep.cfg.MaxAttempts {
+				d.log.Warnf("webhook delivery of %s to %s failed after %d attempts: %v", delivery.Event, ep.cfg.URL, delivery.Attempts, err)
+				ep.finish(delivery, StatusFailed)
+				break
+			}
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxRetryBackoff)
+		}
+	}
+}
+
+func (d *Dispatcher) send(ep *endpoint, delivery *Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, ep.cfg.URL, bytes.NewReader(delivery.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "wg-hub")
+	req.Header.Set(EventHeader, string(delivery.Event))
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	if ep.cfg.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(ep.cfg.Secret, delivery.payload))
+	}
+	resp, err := ep.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Status returns the delivery status of all endpoints.
+func (d *Dispatcher) Status() []*EndpointStatus {
+	status := make([]*EndpointStatus, 0, len(d.endpoints))
+	for _, ep := range d.endpoints {
+		ep.mu.Lock()
+		deliveries := make([]*Delivery, 0, len(ep.deliveries))
+		for i := len(ep.deliveries) - 1; i >= 0; i-- {
+			delivery := *ep.deliveries[i]
+			deliveries = append(deliveries, &delivery)
+		}
+		eventFilter := ep.cfg.Events
+		if eventFilter == nil {
+			eventFilter = []string{}
+		}
+		status = append(status, &EndpointStatus{
+			URL:        ep.cfg.URL,
+			Events:     eventFilter,
+			Delivered:  ep.delivered,
+			Failed:     ep.failed,
+			Dropped:    ep.dropped,
+			Deliveries: deliveries,
+		})
+		ep.mu.Unlock()
+	}
+	return status
+}
+
+// Close stops the delivery, pending deliveries are discarded.
+func (d *Dispatcher) Close() {
+	d.cancel()
+	d.sub.Close()
+	d.wg.Wait()
+}
@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	events   []*events.Event
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.failures > 0 {
+		rc.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if !Verify("secret", payload, r.Header.Get(SignatureHeader)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var e events.Event
+	if err := json.Unmarshal(payload, &e); err != nil || r.Header.Get(EventHeader) != string(e.Type) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rc.events = append(rc.events, &e)
+}
+
+func (rc *receiver) received() []*events.Event {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.events
+}
+
+func TestDispatcher(t *testing.T) {
+	rc := &receiver{failures: 2}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	other := httptest.NewServer(&receiver{})
+	defer other.Close()
+
+	bus := events.NewBus()
+	d, err := NewDispatcher(logrus.New(), bus, []*config.WebhookConfig{
+		{URL: srv.URL, Secret: "secret", Events: []string{"peer.*"}, RetryBackoff: time.Millisecond},
+		{URL: other.URL, Secret: "wrong", Events: []string{"auth.login_failed"}, RetryBackoff: time.Millisecond},
+	})
+	require.NoError(t, err)
+	defer d.Close()
+
+	bus.Publish(events.PeerAdded, &events.PeerData{PublicKey: "a"})
+	bus.Publish(events.LoginFailed, &events.LoginData{Username: "admin"})
+	require.Eventually(t, func() bool {
+		status := d.Status()
+		return status[0].Delivered == 1 && status[1].Failed == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	received := rc.received()
+	require.Len(t, received, 1)
+	require.Equal(t, events.PeerAdded, received[0].Type)
+	status := d.Status()
+	require.Equal(t, 3, status[0].Deliveries[0].Attempts)
+	require.Equal(t, StatusDelivered, status[0].Deliveries[0].Status)
+	// client errors are not retried
+	require.Equal(t, 1, status[1].Deliveries[0].Attempts)
+	require.Equal(t, http.StatusUnauthorized, status[1].Deliveries[0].ResponseCode)
+
+	_, err = NewDispatcher(logrus.New(), bus, []*config.WebhookConfig{{URL: "ftp://example.com"}})
+	require.Error(t, err)
+}
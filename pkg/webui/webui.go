@@ -1,15 +1,15 @@
 package webui
 
 import (
-	"errors"
 	"net"
 	"net/http"
 
 	"github.com/christophwitzko/wg-hub/pkg/api"
 	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/httpserver"
+	"github.com/christophwitzko/wg-hub/pkg/peers"
 	"github.com/go-chi/chi/v5"
 	"github.com/sirupsen/logrus"
-	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
@@ -20,12 +20,12 @@ type Server struct {
 	api    *api.API
 }
 
-func newServer(log *logrus.Logger, dev *device.Device, cfg *config.Config) *Server {
+func newServer(log *logrus.Logger, cfg *config.Config, peerManager *peers.Manager, apiOpts ...api.Option) *Server {
 	w := &Server{
 		router: chi.NewRouter(),
 		log:    log,
 		cfg:    cfg,
-		api:    api.NewAPIServer(log, dev, cfg),
+		api:    api.NewAPIServer(log, cfg, peerManager, apiOpts...),
 	}
 	w.router.Get("/*", getWebuiServer())
 	w.router.Mount("/api", w.api)
@@ -36,17 +36,13 @@ func (a *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	a.router.ServeHTTP(w, r)
 }
 
-func StartServer(log *logrus.Logger, dev *device.Device, cfg *config.Config, tunNet *netstack.Net) error {
+func StartServer(log *logrus.Logger, cfg *config.Config, peerManager *peers.Manager, tunNet *netstack.Net, apiOpts ...api.Option) (*httpserver.Server, error) {
 	listener, err := tunNet.ListenTCP(&net.TCPAddr{Port: 80})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	server := &http.Server{Handler: newServer(log, dev, cfg)}
-	go func() {
-		err := server.Serve(listener)
-		if !errors.Is(err, http.ErrServerClosed) {
-			log.Errorf("failed to start webui server: %v", err)
-		}
-	}()
-	return nil
+	w := newServer(log, cfg, peerManager, apiOpts...)
+	srv := httpserver.Serve("webui server", listener, w)
+	srv.RegisterOnShutdown(w.api.Shutdown)
+	return srv, nil
 }
@@ -28,11 +28,14 @@ type StdNetBind struct {
 	blackhole4  bool
 	blackhole6  bool
 	bindAddress string
+	filter      *SourceFilter
 }
 
-func NewStdNetBind(bindAddress string) conn.Bind {
+// NewStdNetBind creates a new bind, the source filter is optional.
+func NewStdNetBind(bindAddress string, filter *SourceFilter) conn.Bind {
 	return &StdNetBind{
 		bindAddress: bindAddress,
+		filter:      filter,
 	}
 }
 
@@ -132,11 +135,11 @@ again:
 	}
 	var fns []conn.ReceiveFunc
 	if ipv4 != nil {
-		fns = append(fns, bind.makeReceiveIPv4(ipv4))
+		fns = append(fns, bind.filter.wrapReceiveFunc(bind.makeReceiveIPv4(ipv4)))
 		bind.ipv4 = ipv4
 	}
 	if ipv6 != nil {
-		fns = append(fns, bind.makeReceiveIPv6(ipv6))
+		fns = append(fns, bind.filter.wrapReceiveFunc(bind.makeReceiveIPv6(ipv6)))
 		bind.ipv6 = ipv6
 	}
 	if len(fns) == 0 {
@@ -218,6 +221,7 @@ func (bind *StdNetBind) Send(buffs [][]byte, endpoint conn.Endpoint) error {
 		return syscall.EAFNOSUPPORT
 	}
 	for _, buff := range buffs {
+		bind.filter.observeSend(buff)
 		_, err = c.WriteToUDPAddrPort(buff, addrPort)
 		if err != nil {
 			return err
@@ -0,0 +1,267 @@
+package wgconn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+const (
+	// DefaultMaxStreamConns limits the concurrent stream connections.
+	DefaultMaxStreamConns = 1024
+	// DefaultStreamIdleTimeout closes stream connections without a packet, WireGuard
+	// sends at least a keepalive or handshake every few minutes on active tunnels.
+	DefaultStreamIdleTimeout = 3 * time.Minute
+)
+
+type streamPacket struct {
+	buf  *[maxStreamPacketSize]byte
+	size int
+	ep   *StreamEndpoint
+}
+
+// StreamBind combines the UDP sockets of a StdNetBind with a TCP or WebSocket
+// listener, so that a single device can serve peers on both transports.
+type StreamBind struct {
+	log           *logrus.Logger
+	udp           *StdNetBind
+	filter        *SourceFilter
+	protocol      string
+	streamAddress string
+	maxConns      int
+	idleTimeout   time.Duration
+
+	mu       sync.Mutex // protects following fields
+	listener net.Listener
+	server   *http.Server
+	conns    map[*streamConn]struct{}
+	packets  chan streamPacket
+	closed   chan struct{}
+}
+
+// NewStreamBind creates a new bind, the source filter is optional and applied to the
+// packets of both transports. The source address of stream packets is the remote
+// address of the connection, so it needs to be the address of the client (not of a
+// reverse proxy) for the allowed sources to match.
+func NewStreamBind(log *logrus.Logger, bindAddress string, filter *SourceFilter, protocol, streamAddress string) conn.Bind {
+	return &StreamBind{
+		log:           log,
+		udp:           &StdNetBind{bindAddress: bindAddress, filter: filter},
+		filter:        filter,
+		protocol:      protocol,
+		streamAddress: streamAddress,
+		maxConns:      DefaultMaxStreamConns,
+		idleTimeout:   DefaultStreamIdleTimeout,
+	}
+}
+
+var _ conn.Bind = (*StreamBind)(nil)
+
+func (bind *StreamBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	return bind.udp.ParseEndpoint(s)
+}
+
+func (bind *StreamBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+
+	if bind.listener != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	fns, actualPort, err := bind.udp.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	listener, err := net.Listen("tcp", bind.streamAddress)
+	if err != nil {
+		_ = bind.udp.Close()
+		return nil, 0, err
+	}
+	bind.listener = listener
+	bind.conns = make(map[*streamConn]struct{})
+	bind.packets = make(chan streamPacket, 128)
+	bind.closed = make(chan struct{})
+
+	if bind.protocol == StreamProtocolWebSocket {
+		bind.server = &http.Server{Handler: http.HandlerFunc(bind.handleWebSocket)}
+		go func() {
+			err := bind.server.Serve(listener)
+			if !errors.Is(err, http.ErrServerClosed) {
+				bind.log.Errorf("failed to serve websocket listener: %v", err)
+			}
+		}()
+	} else {
+		go bind.acceptTCP(listener)
+	}
+	return append(fns, bind.makeReceiveStream(bind.packets, bind.closed)), actualPort, nil
+}
+
+// StreamAddr returns the address of the stream listener or nil if the bind is closed.
+func (bind *StreamBind) StreamAddr() net.Addr {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	if bind.listener == nil {
+		return nil
+	}
+	return bind.listener.Addr()
+}
+
+func (bind *StreamBind) acceptTCP(listener net.Listener) {
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				bind.log.Errorf("failed to accept stream connection: %v", err)
+			}
+			return
+		}
+		remote, err := netip.ParseAddrPort(c.RemoteAddr().String())
+		if err != nil {
+			_ = c.Close()
+			continue
+		}
+		go bind.serveConn(&streamConn{Conn: c, remote: remote})
+	}
+}
+
+func (bind *StreamBind) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "invalid remote address", http.StatusBadRequest)
+		return
+	}
+	if bind.full() {
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	wsConn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		bind.log.Debugf("failed to accept websocket connection: %v", err)
+		return
+	}
+	wsConn.SetReadLimit(maxStreamPacketSize + 2)
+	bind.serveConn(&streamConn{
+		Conn:   websocket.NetConn(r.Context(), wsConn, websocket.MessageBinary),
+		remote: remote,
+	})
+}
+
+// full returns true if the limit of concurrent stream connections is reached.
+func (bind *StreamBind) full() bool {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	return len(bind.conns) >= bind.maxConns
+}
+
+// serveConn reads packets from the given connection until it is closed or idle.
+func (bind *StreamBind) serveConn(c *streamConn) {
+	bind.mu.Lock()
+	if bind.conns == nil || len(bind.conns) >= bind.maxConns {
+		bind.mu.Unlock()
+		bind.log.Debugf("rejected stream connection from %s", c.remote)
+		_ = c.Close()
+		return
+	}
+	bind.conns[c] = struct{}{}
+	packets, closed := bind.packets, bind.closed
+	bind.mu.Unlock()
+
+	bind.log.Debugf("stream connection from %s opened", c.remote)
+	defer func() {
+		bind.mu.Lock()
+		delete(bind.conns, c)
+		bind.mu.Unlock()
+		_ = c.Close()
+		bind.log.Debugf("stream connection from %s closed", c.remote)
+	}()
+
+	ep := &StreamEndpoint{conn: c}
+	for {
+		if err := c.SetReadDeadline(time.Now().Add(bind.idleTimeout)); err != nil {
+			return
+		}
+		buf := packetPool.Get().(*[maxStreamPacketSize]byte)
+		size, err := readPacket(c, buf[:])
+		if err != nil {
+			packetPool.Put(buf)
+			return
+		}
+		if bind.filter != nil && !bind.filter.allowReceive(buf[:size], c.remote) {
+			packetPool.Put(buf)
+			continue
+		}
+		select {
+		case packets <- streamPacket{buf: buf, size: size, ep: ep}:
+		case <-closed:
+			packetPool.Put(buf)
+			return
+		}
+	}
+}
+
+func (*StreamBind) makeReceiveStream(packets <-chan streamPacket, closed <-chan struct{}) conn.ReceiveFunc {
+	return func(buffs [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
+		select {
+		case p := <-packets:
+			sizes[0] = copy(buffs[0], p.buf[:p.size])
+			eps[0] = p.ep
+			packetPool.Put(p.buf)
+			return 1, nil
+		case <-closed:
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+func (bind *StreamBind) BatchSize() int {
+	return 1
+}
+
+func (bind *StreamBind) Close() error {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+
+	err := bind.udp.Close()
+	if bind.listener == nil {
+		return err
+	}
+	close(bind.closed)
+	if bind.server != nil {
+		_ = bind.server.Shutdown(context.Background())
+		bind.server = nil
+	}
+	_ = bind.listener.Close()
+	bind.listener = nil
+	for c := range bind.conns {
+		_ = c.Close()
+	}
+	bind.conns = nil
+	return err
+}
+
+func (bind *StreamBind) Send(buffs [][]byte, endpoint conn.Endpoint) error {
+	sep, ok := endpoint.(*StreamEndpoint)
+	if !ok {
+		return bind.udp.Send(buffs, endpoint)
+	}
+	for _, buff := range buffs {
+		bind.filter.observeSend(buff)
+		if err := sep.conn.writePacket(buff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bind *StreamBind) SetMark(mark uint32) error {
+	return bind.udp.SetMark(mark)
+}
@@ -0,0 +1,166 @@
+package wgconn
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func testStreamBind(t *testing.T, protocol string) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+
+	bind := NewStreamBind(log, "127.0.0.1", nil, protocol, "127.0.0.1:0").(*StreamBind)
+	fns, _, err := bind.Open(0)
+	require.NoError(t, err)
+	defer bind.Close()
+	receiveStream := fns[len(fns)-1]
+
+	serverAddress := bind.StreamAddr().String()
+	if protocol == StreamProtocolWebSocket {
+		serverAddress = fmt.Sprintf("ws://%s/", serverAddress)
+	}
+	proxy, err := ListenClientProxy(log, "127.0.0.1:0", protocol, serverAddress)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	proxyDone := make(chan error)
+	go func() {
+		proxyDone <- proxy.Run(ctx)
+	}()
+
+	client, err := net.DialUDP("udp", nil, proxy.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer client.Close()
+
+	buffs := [][]byte{make([]byte, 1500)}
+	sizes := []int{0}
+	eps := []conn.Endpoint{nil}
+	for i := 0; i < 10; i++ {
+		packet := []byte(fmt.Sprintf("packet %d", i))
+		_, err = client.Write(packet)
+		require.NoError(t, err)
+		n, err := receiveStream(buffs, sizes, eps)
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+		require.Equal(t, packet, buffs[0][:sizes[0]])
+		require.IsType(t, &StreamEndpoint{}, eps[0])
+
+		reply := []byte(fmt.Sprintf("reply %d", i))
+		require.NoError(t, bind.Send([][]byte{reply}, eps[0]))
+		require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+		buf := make([]byte, 1500)
+		n, err = client.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, reply, buf[:n])
+	}
+
+	cancel()
+	require.NoError(t, <-proxyDone)
+	require.NoError(t, bind.Close())
+	_, err = receiveStream(buffs, sizes, eps)
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestStreamBindTCP(t *testing.T) {
+	testStreamBind(t, StreamProtocolTCP)
+}
+
+func TestStreamBindWebSocket(t *testing.T) {
+	testStreamBind(t, StreamProtocolWebSocket)
+}
+
+func TestPacketFraming(t *testing.T) {
+	r, w := net.Pipe()
+	defer r.Close()
+	defer w.Close()
+	go func() {
+		_ = writePacket(w, []byte("hello"))
+		_ = writePacket(w, nil)
+		_ = writePacket(w, make([]byte, 100))
+	}()
+	buf := make([]byte, 50)
+	n, err := readPacket(r, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf[:n]))
+	n, err = readPacket(r, buf)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	_, err = readPacket(r, buf)
+	require.ErrorIs(t, err, ErrPacketTooLarge)
+	require.ErrorIs(t, writePacket(w, make([]byte, maxStreamPacketSize+1)), ErrPacketTooLarge)
+}
+
+func TestStreamBindLimits(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+
+	bind := NewStreamBind(log, "127.0.0.1", nil, StreamProtocolTCP, "127.0.0.1:0").(*StreamBind)
+	bind.maxConns = 1
+	bind.idleTimeout = 200 * time.Millisecond
+	_, _, err := bind.Open(0)
+	require.NoError(t, err)
+	defer bind.Close()
+
+	first, err := net.Dial("tcp", bind.StreamAddr().String())
+	require.NoError(t, err)
+	defer first.Close()
+	require.Eventually(t, func() bool { return bind.full() }, time.Second, 10*time.Millisecond)
+
+	// further connections are closed while the limit is reached
+	second, err := net.Dial("tcp", bind.StreamAddr().String())
+	require.NoError(t, err)
+	defer second.Close()
+	require.NoError(t, second.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = second.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// idle connections are closed after the idle timeout
+	require.NoError(t, first.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = first.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	require.Eventually(t, func() bool { return !bind.full() }, time.Second, 10*time.Millisecond)
+}
+
+func TestStreamBindSourceFilter(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	hubPriv, _ := generateKeyPair(t)
+	filter, err := NewSourceFilter(&SourceFilterConfig{
+		PrivateKey:     hubPriv,
+		AllowedSources: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	require.NoError(t, err)
+	bind := NewStreamBind(log, "127.0.0.1", filter, StreamProtocolTCP, "127.0.0.1:0").(*StreamBind)
+	fns, _, err := bind.Open(0)
+	require.NoError(t, err)
+	defer bind.Close()
+	receiveStream := fns[len(fns)-1]
+
+	serve := func(remote string) net.Conn {
+		server, client := net.Pipe()
+		go bind.serveConn(&streamConn{Conn: server, remote: netip.MustParseAddrPort(remote)})
+		t.Cleanup(func() { _ = client.Close() })
+		return client
+	}
+	blocked := serve("192.0.2.1:1")
+	require.NoError(t, writePacket(blocked, createIndexMessage(messageTransportType, 1)))
+	allowed := serve("10.0.0.1:1")
+	require.NoError(t, writePacket(allowed, createIndexMessage(messageTransportType, 2)))
+
+	buffs := [][]byte{make([]byte, 1500)}
+	sizes := []int{0}
+	eps := []conn.Endpoint{nil}
+	n, err := receiveStream(buffs, sizes, eps)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, "10.0.0.1:1", eps[0].DstToString())
+	require.Eventually(t, func() bool { return filter.Stats().Blocked == 1 }, time.Second, 10*time.Millisecond)
+}
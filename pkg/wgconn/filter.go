@@ -0,0 +1,415 @@
+package wgconn
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+const (
+	// maxTrackedEntries limits the size of the per source and per index maps.
+	maxTrackedEntries = 4096
+	// indexTimeout is the time after which a handshake index is forgotten,
+	// WireGuard rejects sessions that are older than 180 seconds.
+	indexTimeout = 5 * time.Minute
+	// sourceStatsTimeout is the time after which an idle source is removed from the stats.
+	sourceStatsTimeout = time.Hour
+)
+
+type SourceFilterConfig struct {
+	// PrivateKey of the hub, used to identify the initiator of a handshake.
+	PrivateKey [32]byte
+	// AllowedSources restricts the source addresses of all packets.
+	AllowedSources []netip.Prefix
+	// PeerSources restricts the source addresses of the packets of a single peer.
+	PeerSources map[[32]byte][]netip.Prefix
+	// ExemptAddrs are never blocked or throttled (loopback addresses are always exempt).
+	ExemptAddrs []netip.Addr
+	// RateLimit is the number of packets per second per source address (0 disables the limit).
+	RateLimit float64
+	// RateBurst is the number of packets a source address may send at once.
+	RateBurst int
+}
+
+type SourceStats struct {
+	Address   string    `json:"address"`
+	Blocked   uint64    `json:"blocked"`
+	Throttled uint64    `json:"throttled"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+type FilterStats struct {
+	Blocked   uint64         `json:"blocked"`
+	Throttled uint64         `json:"throttled"`
+	Sources   []*SourceStats `json:"sources"`
+}
+
+type filteredPeer struct {
+	sources []netip.Prefix
+	mac1Key [blake2s.Size]byte
+}
+
+type indexEntry struct {
+	peer    *filteredPeer
+	created time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// SourceFilter drops packets of not allowed source addresses and throttles
+// source addresses that exceed the rate limit before they reach the device.
+type SourceFilter struct {
+	privateKey [32]byte
+	publicKey  [32]byte
+	// mac1Key of the hub, initiations with an invalid mac1 are dropped by the device anyway
+	mac1Key [blake2s.Size]byte
+	allowed []netip.Prefix
+	exempt  []netip.Addr
+	rate    float64
+	burst   float64
+	// now is replaced in tests
+	now func() time.Time
+	// active is false if nothing is filtered, so the packets pass without taking the lock
+	active atomic.Bool
+
+	mu          sync.Mutex // protects following fields
+	peers       map[[32]byte]*filteredPeer
+	buckets     map[netip.Addr]*tokenBucket
+	initiations map[uint32]indexEntry
+	sessions    map[uint32]indexEntry
+	blocked     uint64
+	throttled   uint64
+	sourceStats map[netip.Addr]*SourceStats
+}
+
+func NewSourceFilter(cfg *SourceFilterConfig) (*SourceFilter, error) {
+	publicKey, err := curve25519.X25519(cfg.PrivateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	f := &SourceFilter{
+		privateKey:  cfg.PrivateKey,
+		allowed:     cfg.AllowedSources,
+		exempt:      cfg.ExemptAddrs,
+		peers:       make(map[[32]byte]*filteredPeer, len(cfg.PeerSources)),
+		rate:        cfg.RateLimit,
+		burst:       float64(max(cfg.RateBurst, 1)),
+		now:         time.Now,
+		buckets:     make(map[netip.Addr]*tokenBucket),
+		initiations: make(map[uint32]indexEntry),
+		sessions:    make(map[uint32]indexEntry),
+		sourceStats: make(map[netip.Addr]*SourceStats),
+	}
+	copy(f.publicKey[:], publicKey)
+	f.mac1Key = mac1Key(f.publicKey)
+	for key, sources := range cfg.PeerSources {
+		f.peers[key] = &filteredPeer{sources: sources, mac1Key: mac1Key(key)}
+	}
+	f.updateActive()
+	return f, nil
+}
+
+// updateActive must be called with the lock held after the peers were changed.
+func (f *SourceFilter) updateActive() {
+	f.active.Store(len(f.allowed) > 0 || f.rate > 0 || len(f.peers) > 0)
+}
+
+// SetPeerSources replaces the allowed source addresses of a peer, empty sources remove the restriction.
+func (f *SourceFilter) SetPeerSources(publicKey [32]byte, sources []netip.Prefix) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.updateActive()
+	peer, ok := f.peers[publicKey]
+	if len(sources) > 0 {
+		if ok {
+			peer.sources = sources
+			return
+		}
+		f.peers[publicKey] = &filteredPeer{sources: sources, mac1Key: mac1Key(publicKey)}
+		return
+	}
+	if !ok {
+		return
+	}
+	delete(f.peers, publicKey)
+	for _, m := range []map[uint32]indexEntry{f.initiations, f.sessions} {
+		for i, e := range m {
+			if e.peer == peer {
+				delete(m, i)
+			}
+		}
+	}
+}
+
+// wrapReceiveFunc removes all packets from the received batch that are not allowed.
+func (f *SourceFilter) wrapReceiveFunc(fn conn.ReceiveFunc) conn.ReceiveFunc {
+	if f == nil {
+		return fn
+	}
+	return func(buffs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		for {
+			n, err := fn(buffs, sizes, eps)
+			if err != nil || n == 0 {
+				return n, err
+			}
+			allowed := 0
+			for i := 0; i < n; i++ {
+				ep, ok := eps[i].(StdNetEndpoint)
+				if ok && !f.allowReceive(buffs[i][:sizes[i]], netip.AddrPort(ep)) {
+					continue
+				}
+				buffs[allowed], buffs[i] = buffs[i], buffs[allowed]
+				sizes[allowed], eps[allowed] = sizes[i], eps[i]
+				allowed++
+			}
+			if allowed > 0 {
+				return allowed, nil
+			}
+		}
+	}
+}
+
+func (f *SourceFilter) isExempt(addr netip.Addr) bool {
+	return addr.IsLoopback() || slices.Contains(f.exempt, addr)
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	return slices.ContainsFunc(prefixes, func(p netip.Prefix) bool {
+		return p.Contains(addr)
+	})
+}
+
+func (f *SourceFilter) allowReceive(packet []byte, src netip.AddrPort) bool {
+	if !f.active.Load() {
+		return true
+	}
+	addr := src.Addr().Unmap()
+	if f.isExempt(addr) {
+		return true
+	}
+
+	f.mu.Lock()
+	now := f.now()
+	if !f.takeToken(addr, now) {
+		f.throttled++
+		if s := f.getSourceStats(addr, now); s != nil {
+			s.Throttled++
+		}
+		f.mu.Unlock()
+		return false
+	}
+	if len(f.allowed) > 0 && !containsAddr(f.allowed, addr) {
+		f.countBlocked(addr, now)
+		f.mu.Unlock()
+		return false
+	}
+	hasPeers := len(f.peers) > 0
+	f.mu.Unlock()
+	if !hasPeers {
+		return true
+	}
+
+	// the DH of an initiation is expensive, so it only runs for initiations
+	// with a valid mac1 (like in the device) and without holding the lock
+	var initiator *[32]byte
+	if messageType(packet) == messageInitiationType && checkInitiationMAC1(f.mac1Key, packet) {
+		if static, ok := decryptInitiatorStatic(f.privateKey, f.publicKey, packet); ok {
+			initiator = &static
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	peer := f.identifyPeer(packet, initiator, now)
+	if peer != nil && len(peer.sources) > 0 && !containsAddr(peer.sources, addr) {
+		f.countBlocked(addr, now)
+		return false
+	}
+	return true
+}
+
+func (f *SourceFilter) countBlocked(addr netip.Addr, now time.Time) {
+	f.blocked++
+	if s := f.getSourceStats(addr, now); s != nil {
+		s.Blocked++
+	}
+}
+
+func (f *SourceFilter) takeToken(addr netip.Addr, now time.Time) bool {
+	if f.rate <= 0 {
+		return true
+	}
+	b, ok := f.buckets[addr]
+	if !ok {
+		if len(f.buckets) >= maxTrackedEntries {
+			// remove all buckets that are full again
+			for a, old := range f.buckets {
+				if now.Sub(old.last).Seconds()*f.rate >= f.burst {
+					delete(f.buckets, a)
+				}
+			}
+		}
+		b = &tokenBucket{tokens: f.burst, last: now}
+		f.buckets[addr] = b
+	}
+	b.tokens = min(f.burst, b.tokens+now.Sub(b.last).Seconds()*f.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (f *SourceFilter) getSourceStats(addr netip.Addr, now time.Time) *SourceStats {
+	s, ok := f.sourceStats[addr]
+	if !ok {
+		if len(f.sourceStats) >= maxTrackedEntries {
+			for a, old := range f.sourceStats {
+				if now.Sub(old.LastSeen) > sourceStatsTimeout {
+					delete(f.sourceStats, a)
+				}
+			}
+			if len(f.sourceStats) >= maxTrackedEntries {
+				return nil
+			}
+		}
+		s = &SourceStats{Address: addr.String()}
+		f.sourceStats[addr] = s
+	}
+	s.LastSeen = now
+	return s
+}
+
+func putIndex(m map[uint32]indexEntry, index uint32, e indexEntry) {
+	if len(m) >= maxTrackedEntries {
+		for i, old := range m {
+			if e.created.Sub(old.created) > indexTimeout {
+				delete(m, i)
+			}
+		}
+		if len(m) >= maxTrackedEntries {
+			return
+		}
+	}
+	m[index] = e
+}
+
+// identifyPeer returns the peer that sent the packet if the peer has source restrictions,
+// the initiator is the decrypted static key of an initiation (nil if it could not be decrypted).
+func (f *SourceFilter) identifyPeer(packet []byte, initiator *[32]byte, now time.Time) *filteredPeer {
+	if len(f.peers) == 0 {
+		return nil
+	}
+	var receiver uint32
+	switch messageType(packet) {
+	case messageInitiationType:
+		if initiator == nil {
+			return nil
+		}
+		peer := f.peers[*initiator]
+		if peer != nil {
+			sender := binary.LittleEndian.Uint32(packet[4:8])
+			putIndex(f.initiations, sender, indexEntry{peer: peer, created: now})
+		}
+		return peer
+	case messageResponseType:
+		if len(packet) != messageResponseSize {
+			return nil
+		}
+		receiver = binary.LittleEndian.Uint32(packet[8:12])
+	case messageCookieReplyType:
+		if len(packet) != messageCookieReplySize {
+			return nil
+		}
+		receiver = binary.LittleEndian.Uint32(packet[4:8])
+	case messageTransportType:
+		if len(packet) < messageTransportMin {
+			return nil
+		}
+		receiver = binary.LittleEndian.Uint32(packet[4:8])
+	default:
+		return nil
+	}
+	e, ok := f.sessions[receiver]
+	if !ok || now.Sub(e.created) > indexTimeout {
+		return nil
+	}
+	return e.peer
+}
+
+// observeSend remembers the local handshake index of sessions with peers
+// that have source restrictions, so that their packets can be identified.
+func (f *SourceFilter) observeSend(packet []byte) {
+	if f == nil || !f.active.Load() {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.peers) == 0 {
+		return
+	}
+	now := f.now()
+	switch messageType(packet) {
+	case messageInitiationType:
+		if len(packet) != messageInitiationSize {
+			return
+		}
+		sender := binary.LittleEndian.Uint32(packet[4:8])
+		for _, peer := range f.peers {
+			if checkInitiationMAC1(peer.mac1Key, packet) {
+				putIndex(f.sessions, sender, indexEntry{peer: peer, created: now})
+				return
+			}
+		}
+	case messageResponseType:
+		if len(packet) != messageResponseSize {
+			return
+		}
+		sender := binary.LittleEndian.Uint32(packet[4:8])
+		receiver := binary.LittleEndian.Uint32(packet[8:12])
+		e, ok := f.initiations[receiver]
+		if !ok {
+			return
+		}
+		delete(f.initiations, receiver)
+		putIndex(f.sessions, sender, indexEntry{peer: e.peer, created: now})
+	}
+}
+
+// Stats returns the number of blocked and throttled packets in total and per source address.
+func (f *SourceFilter) Stats() *FilterStats {
+	stats := &FilterStats{Sources: make([]*SourceStats, 0)}
+	if f == nil {
+		return stats
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stats.Blocked = f.blocked
+	stats.Throttled = f.throttled
+	for _, s := range f.sourceStats {
+		sc := *s
+		stats.Sources = append(stats.Sources, &sc)
+	}
+	sort.Slice(stats.Sources, func(i, j int) bool {
+		a, b := stats.Sources[i], stats.Sources[j]
+		if a.Blocked+a.Throttled != b.Blocked+b.Throttled {
+			return a.Blocked+a.Throttled > b.Blocked+b.Throttled
+		}
+		return a.Address < b.Address
+	})
+	return stats
+}
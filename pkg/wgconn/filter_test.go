@@ -0,0 +1,255 @@
+package wgconn
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func generateKeyPair(t *testing.T) (privateKey, publicKey [32]byte) {
+	_, err := rand.Read(privateKey[:])
+	require.NoError(t, err)
+	pub, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	require.NoError(t, err)
+	copy(publicKey[:], pub)
+	return privateKey, publicKey
+}
+
+// createInitiation creates a handshake initiation with a valid encrypted static key and mac1.
+func createInitiation(t *testing.T, sender uint32, initiatorPublic, responderPublic [32]byte) []byte {
+	ePriv, ePub := generateKeyPair(t)
+	msg := make([]byte, messageInitiationSize)
+	binary.LittleEndian.PutUint32(msg[0:4], messageInitiationType)
+	binary.LittleEndian.PutUint32(msg[4:8], sender)
+	copy(msg[8:40], ePub[:])
+
+	h := mixHash(initialHash, responderPublic[:])
+	h = mixHash(h, ePub[:])
+	chainKey, _ := kdf2(initialChainKey[:], ePub[:])
+	ss, err := curve25519.X25519(ePriv[:], responderPublic[:])
+	require.NoError(t, err)
+	_, key := kdf2(chainKey, ss)
+	aead, err := chacha20poly1305.New(key)
+	require.NoError(t, err)
+	var nonce [chacha20poly1305.NonceSize]byte
+	aead.Seal(msg[40:40], nonce[:], initiatorPublic[:], h[:])
+
+	mac1 := mac1Key(responderPublic)
+	mac, _ := blake2s.New128(mac1[:])
+	mac.Write(msg[:116])
+	copy(msg[116:132], mac.Sum(nil))
+	return msg
+}
+
+func createIndexMessage(msgType, receiver uint32) []byte {
+	size := messageTransportMin
+	offset := 4
+	switch msgType {
+	case messageResponseType:
+		size = messageResponseSize
+		offset = 8
+	case messageCookieReplyType:
+		size = messageCookieReplySize
+	}
+	msg := make([]byte, size)
+	binary.LittleEndian.PutUint32(msg[0:4], msgType)
+	binary.LittleEndian.PutUint32(msg[offset:offset+4], receiver)
+	return msg
+}
+
+func createResponse(sender, receiver uint32) []byte {
+	msg := createIndexMessage(messageResponseType, receiver)
+	binary.LittleEndian.PutUint32(msg[4:8], sender)
+	return msg
+}
+
+func src(s string) netip.AddrPort {
+	return netip.MustParseAddrPort(s)
+}
+
+func TestDecryptInitiatorStatic(t *testing.T) {
+	hubPriv, hubPub := generateKeyPair(t)
+	_, peerPub := generateKeyPair(t)
+	msg := createInitiation(t, 1, peerPub, hubPub)
+	static, ok := decryptInitiatorStatic(hubPriv, hubPub, msg)
+	require.True(t, ok)
+	require.Equal(t, peerPub, static)
+	require.True(t, checkInitiationMAC1(mac1Key(hubPub), msg))
+	require.False(t, checkInitiationMAC1(mac1Key(peerPub), msg))
+
+	otherPriv, otherPub := generateKeyPair(t)
+	_, ok = decryptInitiatorStatic(otherPriv, otherPub, msg)
+	require.False(t, ok)
+}
+
+func TestSourceFilterAllowedSources(t *testing.T) {
+	hubPriv, _ := generateKeyPair(t)
+	f, err := NewSourceFilter(&SourceFilterConfig{
+		PrivateKey:     hubPriv,
+		AllowedSources: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		ExemptAddrs:    []netip.Addr{netip.MustParseAddr("192.168.1.1")},
+	})
+	require.NoError(t, err)
+	msg := createIndexMessage(messageTransportType, 1)
+	require.True(t, f.allowReceive(msg, src("10.1.2.3:1234")))
+	require.True(t, f.allowReceive(msg, src("[::ffff:10.1.2.3]:1234")))
+	require.True(t, f.allowReceive(msg, src("127.0.0.1:1234")))
+	require.True(t, f.allowReceive(msg, src("192.168.1.1:1234")))
+	require.False(t, f.allowReceive(msg, src("192.168.1.2:1234")))
+	require.False(t, f.allowReceive(msg, src("192.168.1.2:1234")))
+
+	stats := f.Stats()
+	require.Equal(t, uint64(2), stats.Blocked)
+	require.Equal(t, uint64(0), stats.Throttled)
+	require.Len(t, stats.Sources, 1)
+	require.Equal(t, "192.168.1.2", stats.Sources[0].Address)
+	require.Equal(t, uint64(2), stats.Sources[0].Blocked)
+}
+
+func TestSourceFilterRateLimit(t *testing.T) {
+	hubPriv, _ := generateKeyPair(t)
+	f, err := NewSourceFilter(&SourceFilterConfig{
+		PrivateKey: hubPriv,
+		RateLimit:  10,
+		RateBurst:  5,
+	})
+	require.NoError(t, err)
+	now := time.Unix(1000, 0)
+	f.now = func() time.Time { return now }
+
+	msg := createIndexMessage(messageTransportType, 1)
+	for i := 0; i < 5; i++ {
+		require.True(t, f.allowReceive(msg, src("1.1.1.1:1")))
+	}
+	require.False(t, f.allowReceive(msg, src("1.1.1.1:1")))
+	// other sources have their own bucket
+	require.True(t, f.allowReceive(msg, src("2.2.2.2:1")))
+
+	// refill one token after 100ms
+	now = now.Add(100 * time.Millisecond)
+	require.True(t, f.allowReceive(msg, src("1.1.1.1:1")))
+	require.False(t, f.allowReceive(msg, src("1.1.1.1:1")))
+
+	// the bucket is never filled above the burst size
+	now = now.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		require.True(t, f.allowReceive(msg, src("1.1.1.1:1")))
+	}
+	require.False(t, f.allowReceive(msg, src("1.1.1.1:1")))
+
+	stats := f.Stats()
+	require.Equal(t, uint64(0), stats.Blocked)
+	require.Equal(t, uint64(3), stats.Throttled)
+}
+
+func TestSourceFilterPeerSources(t *testing.T) {
+	hubPriv, hubPub := generateKeyPair(t)
+	_, restrictedPub := generateKeyPair(t)
+	_, otherPub := generateKeyPair(t)
+	f, err := NewSourceFilter(&SourceFilterConfig{
+		PrivateKey: hubPriv,
+		PeerSources: map[[32]byte][]netip.Prefix{
+			restrictedPub: {netip.MustParsePrefix("10.0.0.1/32")},
+		},
+	})
+	require.NoError(t, err)
+
+	// handshakes of the restricted peer are only allowed from its sources
+	require.False(t, f.allowReceive(createInitiation(t, 1, restrictedPub, hubPub), src("10.0.0.2:1")))
+	require.True(t, f.allowReceive(createInitiation(t, 2, restrictedPub, hubPub), src("10.0.0.1:1")))
+	// other peers are not restricted
+	require.True(t, f.allowReceive(createInitiation(t, 3, otherPub, hubPub), src("10.0.0.2:1")))
+
+	// the hub responds to the initiation with sender index 2
+	f.observeSend(createResponse(42, 2))
+	transport := createIndexMessage(messageTransportType, 42)
+	require.True(t, f.allowReceive(transport, src("10.0.0.1:1")))
+	require.False(t, f.allowReceive(transport, src("10.0.0.2:1")))
+
+	// the hub initiates a handshake with the restricted peer
+	f.observeSend(createInitiation(t, 43, hubPub, restrictedPub))
+	require.False(t, f.allowReceive(createIndexMessage(messageResponseType, 43), src("10.0.0.2:1")))
+	require.False(t, f.allowReceive(createIndexMessage(messageCookieReplyType, 43), src("10.0.0.2:1")))
+	require.True(t, f.allowReceive(createIndexMessage(messageResponseType, 43), src("10.0.0.1:1")))
+
+	// unknown sessions are passed to the device
+	require.True(t, f.allowReceive(createIndexMessage(messageTransportType, 44), src("10.0.0.2:1")))
+	require.Equal(t, uint64(4), f.Stats().Blocked)
+
+	// initiations with an invalid mac1 are not decrypted, the device drops them
+	forged := createInitiation(t, 5, restrictedPub, hubPub)
+	forged[116] ^= 0xff
+	require.True(t, f.allowReceive(forged, src("10.0.0.2:1")))
+	require.NotContains(t, f.initiations, uint32(5))
+}
+
+func TestSourceFilterSetPeerSources(t *testing.T) {
+	hubPriv, hubPub := generateKeyPair(t)
+	_, peerPub := generateKeyPair(t)
+	f, err := NewSourceFilter(&SourceFilterConfig{PrivateKey: hubPriv})
+	require.NoError(t, err)
+	// packets pass without any bookkeeping if nothing is filtered
+	require.False(t, f.active.Load())
+	require.True(t, f.allowReceive(createInitiation(t, 1, peerPub, hubPub), src("10.0.0.2:1")))
+
+	// peers added at runtime are restricted
+	f.SetPeerSources(peerPub, []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")})
+	require.False(t, f.allowReceive(createInitiation(t, 2, peerPub, hubPub), src("10.0.0.2:1")))
+	require.True(t, f.allowReceive(createInitiation(t, 3, peerPub, hubPub), src("10.0.0.1:1")))
+	f.observeSend(createResponse(42, 3))
+	transport := createIndexMessage(messageTransportType, 42)
+	require.False(t, f.allowReceive(transport, src("10.0.0.2:1")))
+
+	// updates apply to the existing sessions
+	f.SetPeerSources(peerPub, []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32")})
+	require.True(t, f.allowReceive(transport, src("10.0.0.2:1")))
+	require.False(t, f.allowReceive(transport, src("10.0.0.1:1")))
+
+	// removed restrictions also remove the sessions of the peer
+	f.SetPeerSources(peerPub, nil)
+	require.True(t, f.allowReceive(transport, src("10.0.0.1:1")))
+	require.True(t, f.allowReceive(createInitiation(t, 4, peerPub, hubPub), src("10.0.0.3:1")))
+	require.Empty(t, f.sessions)
+	require.Equal(t, uint64(3), f.Stats().Blocked)
+	require.False(t, f.active.Load())
+}
+
+func TestSourceFilterReceiveFunc(t *testing.T) {
+	hubPriv, _ := generateKeyPair(t)
+	f, err := NewSourceFilter(&SourceFilterConfig{
+		PrivateKey:     hubPriv,
+		AllowedSources: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	require.NoError(t, err)
+
+	// fake receive function that returns packets from the given sources
+	sources := []string{"1.1.1.1:1", "2.2.2.2:2", "10.0.0.1:3", "3.3.3.3:4", "10.0.0.2:5"}
+	fakeReceive := func(buffs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		s := sources[0]
+		sources = sources[1:]
+		sizes[0] = copy(buffs[0], s)
+		eps[0] = asEndpoint(src(s))
+		return 1, nil
+	}
+	receive := f.wrapReceiveFunc(fakeReceive)
+	buffs := [][]byte{make([]byte, 100)}
+	sizes := []int{0}
+	eps := []conn.Endpoint{nil}
+	n, err := receive(buffs, sizes, eps)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, "10.0.0.1:3", eps[0].DstToString())
+	require.Equal(t, "10.0.0.1:3", string(buffs[0][:sizes[0]]))
+	_, err = receive(buffs, sizes, eps)
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.2:5", eps[0].DstToString())
+	require.Equal(t, uint64(3), f.Stats().Blocked)
+}
@@ -0,0 +1,113 @@
+package wgconn
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"hash"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// WireGuard message types and sizes, see https://www.wireguard.com/protocol/
+const (
+	messageInitiationType  = 1
+	messageResponseType    = 2
+	messageCookieReplyType = 3
+	messageTransportType   = 4
+
+	messageInitiationSize  = 148
+	messageResponseSize    = 92
+	messageCookieReplySize = 64
+	messageTransportMin    = 32
+
+	noiseConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	wgIdentifier      = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	wgLabelMAC1       = "mac1----"
+)
+
+var (
+	initialChainKey = blake2s.Sum256([]byte(noiseConstruction))
+	initialHash     = mixHash(initialChainKey, []byte(wgIdentifier))
+)
+
+func mixHash(h [blake2s.Size]byte, data []byte) [blake2s.Size]byte {
+	hsh, _ := blake2s.New256(nil)
+	hsh.Write(h[:])
+	hsh.Write(data)
+	var sum [blake2s.Size]byte
+	hsh.Sum(sum[:0])
+	return sum
+}
+
+func hmacBlake2s(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// kdf2 derives two keys from the chaining key and the input.
+func kdf2(key, input []byte) (t0, t1 []byte) {
+	prk := hmacBlake2s(key, input)
+	t0 = hmacBlake2s(prk, []byte{0x1})
+	t1 = hmacBlake2s(prk, t0, []byte{0x2})
+	return t0, t1
+}
+
+// messageType returns the type of WireGuard message or 0 if the message is invalid.
+func messageType(msg []byte) uint32 {
+	if len(msg) < 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(msg[:4])
+}
+
+// decryptInitiatorStatic decrypts the static public key of the initiator
+// of a handshake initiation message with the private key of the responder.
+func decryptInitiatorStatic(privateKey, publicKey [32]byte, msg []byte) ([32]byte, bool) {
+	var static [32]byte
+	if len(msg) != messageInitiationSize || messageType(msg) != messageInitiationType {
+		return static, false
+	}
+	ephemeral := msg[8:40]
+	h := mixHash(initialHash, publicKey[:])
+	h = mixHash(h, ephemeral)
+	chainKey, _ := kdf2(initialChainKey[:], ephemeral)
+	ss, err := curve25519.X25519(privateKey[:], ephemeral)
+	if err != nil {
+		return static, false
+	}
+	_, key := kdf2(chainKey, ss)
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return static, false
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	if _, err := aead.Open(static[:0], nonce[:], msg[40:88], h[:]); err != nil {
+		return static, false
+	}
+	return static, true
+}
+
+// mac1Key returns the key that is used to calculate the mac1 field of
+// messages sent to the owner of the given public key.
+func mac1Key(publicKey [32]byte) [blake2s.Size]byte {
+	return blake2s.Sum256(append([]byte(wgLabelMAC1), publicKey[:]...))
+}
+
+// checkInitiationMAC1 reports whether the handshake initiation is addressed
+// to the owner of the given mac1 key.
+func checkInitiationMAC1(key [blake2s.Size]byte, msg []byte) bool {
+	if len(msg) != messageInitiationSize {
+		return false
+	}
+	mac, _ := blake2s.New128(key[:])
+	mac.Write(msg[:116])
+	return hmac.Equal(mac.Sum(nil), msg[116:132])
+}
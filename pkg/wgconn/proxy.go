@@ -0,0 +1,150 @@
+package wgconn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/coder/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// ClientProxy runs next to a WireGuard client and forwards its UDP datagrams
+// to the stream listener of a StreamBind and vice versa.
+type ClientProxy struct {
+	log           *logrus.Logger
+	udpConn       *net.UDPConn
+	protocol      string
+	serverAddress string
+
+	clientAddr atomic.Pointer[netip.AddrPort]
+
+	mu     sync.Mutex // protects following fields
+	stream net.Conn
+}
+
+// ListenClientProxy listens on the given local UDP address. For the websocket
+// protocol the server address is an URL (e.g. wss://hub.example.com/),
+// otherwise it is a host:port pair.
+func ListenClientProxy(log *logrus.Logger, listenAddress, protocol, serverAddress string) (*ClientProxy, error) {
+	if err := ValidateStreamProtocol(protocol); err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", listenAddress)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientProxy{
+		log:           log,
+		udpConn:       udpConn,
+		protocol:      protocol,
+		serverAddress: serverAddress,
+	}, nil
+}
+
+func (p *ClientProxy) LocalAddr() net.Addr {
+	return p.udpConn.LocalAddr()
+}
+
+// Run forwards packets until the context is canceled.
+func (p *ClientProxy) Run(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		_ = p.udpConn.Close()
+		p.mu.Lock()
+		if p.stream != nil {
+			_ = p.stream.Close()
+		}
+		p.mu.Unlock()
+	}()
+
+	buf := make([]byte, maxStreamPacketSize)
+	for {
+		n, clientAddr, err := p.udpConn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		p.clientAddr.Store(&clientAddr)
+		stream, err := p.getStream(ctx)
+		if err != nil {
+			// the packet is dropped, WireGuard will retransmit the handshake
+			p.log.Warnf("failed to connect to %s: %v", p.serverAddress, err)
+			continue
+		}
+		if err := writePacket(stream, buf[:n]); err != nil {
+			p.log.Warnf("failed to write packet to %s: %v", p.serverAddress, err)
+			p.closeStream(stream)
+		}
+	}
+}
+
+// getStream returns the current stream connection or dials a new one.
+func (p *ClientProxy) getStream(ctx context.Context) (net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stream != nil {
+		return p.stream, nil
+	}
+	stream, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.log.Infof("connected to %s", p.serverAddress)
+	p.stream = stream
+	go p.readStream(stream)
+	return stream, nil
+}
+
+func (p *ClientProxy) dial(ctx context.Context) (net.Conn, error) {
+	if p.protocol == StreamProtocolWebSocket {
+		wsConn, _, err := websocket.Dial(ctx, p.serverAddress, nil)
+		if err != nil {
+			return nil, err
+		}
+		wsConn.SetReadLimit(maxStreamPacketSize + 2)
+		return websocket.NetConn(ctx, wsConn, websocket.MessageBinary), nil
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", p.serverAddress)
+}
+
+func (p *ClientProxy) closeStream(stream net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = stream.Close()
+	if p.stream == stream {
+		p.stream = nil
+	}
+}
+
+// readStream forwards packets from the stream to the last known client address.
+func (p *ClientProxy) readStream(stream net.Conn) {
+	defer p.closeStream(stream)
+	buf := make([]byte, maxStreamPacketSize)
+	for {
+		n, err := readPacket(stream, buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				p.log.Warnf("connection to %s lost: %v", p.serverAddress, err)
+			}
+			return
+		}
+		clientAddr := p.clientAddr.Load()
+		if clientAddr == nil {
+			continue
+		}
+		if _, err := p.udpConn.WriteToUDPAddrPort(buf[:n], *clientAddr); err != nil {
+			p.log.Warnf("failed to write packet to %s: %v", clientAddr, err)
+		}
+	}
+}
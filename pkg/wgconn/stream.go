@@ -0,0 +1,101 @@
+package wgconn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+const (
+	StreamProtocolTCP       = "tcp"
+	StreamProtocolWebSocket = "websocket"
+
+	// maxStreamPacketSize is the largest datagram that fits into the 2 byte length prefix.
+	maxStreamPacketSize = 1<<16 - 1
+)
+
+var ErrPacketTooLarge = errors.New("packet too large")
+
+func ValidateStreamProtocol(protocol string) error {
+	switch protocol {
+	case StreamProtocolTCP, StreamProtocolWebSocket:
+		return nil
+	}
+	return fmt.Errorf("unsupported stream protocol: %s", protocol)
+}
+
+var packetPool = sync.Pool{
+	New: func() any {
+		return new([maxStreamPacketSize]byte)
+	},
+}
+
+// writePacket writes a single datagram prefixed with its length as uint16 (big endian).
+func writePacket(w io.Writer, packet []byte) error {
+	if len(packet) > maxStreamPacketSize {
+		return ErrPacketTooLarge
+	}
+	frame := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(frame, uint16(len(packet)))
+	copy(frame[2:], packet)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readPacket reads a single length prefixed datagram into buf and returns its size.
+func readPacket(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > len(buf) {
+		return 0, ErrPacketTooLarge
+	}
+	return io.ReadFull(r, buf[:size])
+}
+
+// streamConn is a single stream connection that carries length prefixed datagrams.
+type streamConn struct {
+	net.Conn
+	remote  netip.AddrPort
+	writeMu sync.Mutex
+}
+
+func (c *streamConn) writePacket(packet []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return writePacket(c.Conn, packet)
+}
+
+// StreamEndpoint is the endpoint of a peer that is connected through a stream connection.
+type StreamEndpoint struct {
+	conn *streamConn
+}
+
+func (*StreamEndpoint) ClearSrc() {}
+
+func (e *StreamEndpoint) DstIP() netip.Addr {
+	return e.conn.remote.Addr()
+}
+
+func (e *StreamEndpoint) SrcIP() netip.Addr {
+	return netip.Addr{} // not supported
+}
+
+func (e *StreamEndpoint) DstToBytes() []byte {
+	b, _ := e.conn.remote.MarshalBinary()
+	return b
+}
+
+func (e *StreamEndpoint) DstToString() string {
+	return e.conn.remote.String()
+}
+
+func (e *StreamEndpoint) SrcToString() string {
+	return ""
+}
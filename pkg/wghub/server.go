@@ -0,0 +1,655 @@
+// Package wghub allows to embed a wg-hub instance into other Go programs.
+package wghub
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/christophwitzko/wg-hub/pkg/api"
+	"github.com/christophwitzko/wg-hub/pkg/audit"
+	"github.com/christophwitzko/wg-hub/pkg/auth"
+	"github.com/christophwitzko/wg-hub/pkg/capture"
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/debug"
+	"github.com/christophwitzko/wg-hub/pkg/events"
+	"github.com/christophwitzko/wg-hub/pkg/flows"
+	"github.com/christophwitzko/wg-hub/pkg/httpserver"
+	"github.com/christophwitzko/wg-hub/pkg/hub"
+	"github.com/christophwitzko/wg-hub/pkg/ipc"
+	"github.com/christophwitzko/wg-hub/pkg/loopback"
+	"github.com/christophwitzko/wg-hub/pkg/peers"
+	"github.com/christophwitzko/wg-hub/pkg/shaping"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/christophwitzko/wg-hub/pkg/webhook"
+	"github.com/christophwitzko/wg-hub/pkg/webui"
+	"github.com/christophwitzko/wg-hub/pkg/wgconn"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var (
+	ErrConfigRequired = errors.New("config is required")
+	ErrAlreadyStarted = errors.New("server already started")
+	ErrNotStarted     = errors.New("server not started")
+)
+
+type Option func(s *Server)
+
+// WithConfig sets the hub config (required).
+func WithConfig(cfg *config.Config) Option {
+	return func(s *Server) {
+		s.cfg = cfg
+	}
+}
+
+// WithLogger sets the logger, the logrus standard logger is used by default.
+func WithLogger(log *logrus.Logger) Option {
+	return func(s *Server) {
+		s.log = log
+	}
+}
+
+// WithBind replaces the UDP (and stream) bind that is created from the config.
+func WithBind(bind conn.Bind) Option {
+	return func(s *Server) {
+		s.bind = bind
+	}
+}
+
+// WithTUN replaces the loopback TUN device that forwards packets between peers.
+func WithTUN(tunDev tun.Device) Option {
+	return func(s *Server) {
+		s.tun = tunDev
+	}
+}
+
+// WithStore sets the store that persists the hub state, by default the
+// state directory of the config or an in-memory store is used.
+func WithStore(st store.Store) Option {
+	return func(s *Server) {
+		s.store = st
+	}
+}
+
+// Server is a wg-hub instance consisting of the hub device, the optional hub
+// instance with its netstack and the debug and webui servers.
+type Server struct {
+	cfg   *config.Config
+	log   *logrus.Logger
+	bind  conn.Bind
+	tun   tun.Device
+	store store.Store
+	bus   *events.Bus
+
+	mu          sync.Mutex // protects following fields
+	started     bool
+	dev         *device.Device
+	tunNet      *netstack.Net
+	peerManager *peers.Manager
+	watcher     *peers.Watcher
+	sampler     *peers.Sampler
+	quotas      *peers.Quotas
+	scheduler   *peers.Scheduler
+	matrix      *loopback.Matrix
+	capturer    *capture.Capturer
+	shaper      *shaping.Shaper
+	tokens      *auth.Tokens
+	preAuthKeys *auth.PreAuthKeys
+	// registrations is nil if the registrations are disabled
+	registrations *peers.Registrations
+	sessions      *auth.Sessions
+	totp          *auth.TOTP
+	// limiter is shared by the api and the enrollment server
+	limiter      *auth.LoginLimiter
+	auditLog     *audit.Log
+	webhooks     *webhook.Dispatcher
+	sourceFilter *wgconn.SourceFilter
+	servers      []*httpserver.Server
+	closeFns     []func()
+	closeOnce    sync.Once
+	errCh        chan error
+}
+
+func New(opts ...Option) (*Server, error) {
+	s := &Server{
+		log:   logrus.StandardLogger(),
+		bus:   events.NewBus(),
+		errCh: make(chan error, 1),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.cfg == nil {
+		return nil, ErrConfigRequired
+	}
+	return s, nil
+}
+
+func (s *Server) createBind() (conn.Bind, error) {
+	if s.bind != nil {
+		return s.bind, nil
+	}
+	filterCfg := s.cfg.GetSourceFilterConfig()
+	sourceFilter, err := wgconn.NewSourceFilter(filterCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create source filter: %w", err)
+	}
+	if len(filterCfg.AllowedSources) > 0 || len(filterCfg.PeerSources) > 0 || filterCfg.RateLimit > 0 {
+		s.log.Infof("source filter enabled")
+	}
+	s.sourceFilter = sourceFilter
+	if s.cfg.StreamAddress != "" {
+		return wgconn.NewStreamBind(s.log, s.cfg.BindAddress, s.sourceFilter, s.cfg.StreamProtocol, s.cfg.StreamAddress), nil
+	}
+	return wgconn.NewStdNetBind(s.cfg.BindAddress, s.sourceFilter), nil
+}
+
+func (s *Server) createStore() (store.Store, error) {
+	if s.store != nil {
+		return s.store, nil
+	}
+	if s.cfg.StateDir != "" {
+		return store.NewFileStore(s.cfg.StateDir)
+	}
+	return store.NewMemoryStore(), nil
+}
+
+// createFlowTracker creates the flow tracker if a flow log file or an IPFIX collector is configured.
+func (s *Server) createFlowTracker() (*flows.Tracker, error) {
+	var exporters []flows.Exporter
+	if s.cfg.FlowLogFile != "" {
+		fileExporter, err := flows.NewFileExporter(s.cfg.FlowLogFile)
+		if err != nil {
+			return nil, err
+		}
+		s.log.Infof("logging flows to %s", s.cfg.FlowLogFile)
+		exporters = append(exporters, fileExporter)
+	}
+	if s.cfg.FlowIPFIXCollector != "" {
+		ipfixExporter, err := flows.NewIPFIXExporter(s.cfg.FlowIPFIXCollector, 0)
+		if err != nil {
+			for _, e := range exporters {
+				_ = e.Close()
+			}
+			return nil, err
+		}
+		s.log.Infof("exporting flows to the ipfix collector %s", s.cfg.FlowIPFIXCollector)
+		exporters = append(exporters, ipfixExporter)
+	}
+	if len(exporters) == 0 {
+		return nil, nil
+	}
+	return flows.NewTracker(s.log, &flows.Config{
+		IdleTimeout:   s.cfg.FlowIdleTimeout,
+		ActiveTimeout: s.cfg.FlowActiveTimeout,
+	}, exporters...), nil
+}
+
+// Start creates the hub device and starts all configured services. The
+// server is closed as soon as the context is done.
+//
+//gocyclo:ignore
+func (s *Server) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return ErrAlreadyStarted
+	}
+	if err := s.start(ctx); err != nil {
+		// release everything that was started, so Start can be called again
+		s.close()
+		s.servers, s.closeFns, s.closeOnce = nil, nil, sync.Once{}
+		return err
+	}
+	s.started = true
+	return nil
+}
+
+func (s *Server) start(ctx context.Context) error {
+	bind, err := s.createBind()
+	if err != nil {
+		return err
+	}
+	st, err := s.createStore()
+	if err != nil {
+		return err
+	}
+	tunDev := s.tun
+	if tunDev == nil {
+		s.matrix = loopback.NewMatrix()
+		s.capturer = capture.NewCapturer()
+		observers := []loopback.Observer{s.matrix, s.capturer}
+		tracker, err := s.createFlowTracker()
+		if err != nil {
+			return err
+		}
+		if tracker != nil {
+			observers = append(observers, tracker)
+			trackerCtx, stopTracker := context.WithCancel(context.Background())
+			trackerDone := make(chan struct{})
+			go func() {
+				defer close(trackerDone)
+				tracker.Run(trackerCtx)
+			}()
+			// the remaining flows are exported after the device is closed
+			s.closeFns = append(s.closeFns, func() {
+				stopTracker()
+				<-trackerDone
+			})
+		}
+		// the shaper is only used if shaping is configured, otherwise the packets are forwarded directly
+		if s.cfg.Shaping != nil || shaping.Stored(st) {
+			s.shaper, err = shaping.NewShaper(s.cfg.Shaping, st)
+			if err != nil {
+				return err
+			}
+			tunDev = loopback.CreateScheduledTun(device.DefaultMTU, s.shaper, observers...)
+		} else {
+			tunDev = loopback.CreateTun(device.DefaultMTU, observers...)
+		}
+	}
+	devLogger := &device.Logger{
+		Verbosef: s.log.Debugf,
+		Errorf:   s.log.Errorf,
+	}
+	s.dev = device.NewDevice(tunDev, bind, devLogger)
+	s.closeFns = append(s.closeFns, s.dev.Close)
+
+	wgConf := &bytes.Buffer{}
+	wgConf.WriteString("private_key=" + s.cfg.PrivateKeyHex + "\n")
+	wgConf.WriteString("listen_port=" + s.cfg.GetPort() + "\n")
+	for _, peer := range s.cfg.Peers {
+		wgConf.WriteString("public_key=" + peer.PublicKeyHex + "\n")
+		wgConf.WriteString("allowed_ip=" + peer.AllowedIP + "\n")
+	}
+	err = s.dev.IpcSetOperation(wgConf)
+	if err != nil {
+		return err
+	}
+	err = s.dev.Up()
+	if err != nil {
+		return err
+	}
+
+	s.peerManager = peers.NewManager(s.log, s.dev, s.cfg, st, s.bus)
+	s.peerManager.SetSourceFilter(s.sourceFilter)
+	err = s.peerManager.Restore()
+	if err != nil {
+		return err
+	}
+
+	if len(s.cfg.Webhooks) > 0 {
+		s.webhooks, err = webhook.NewDispatcher(s.log, s.bus, s.cfg.Webhooks)
+		if err != nil {
+			return err
+		}
+		s.log.Infof("sending events to %d webhooks", len(s.cfg.Webhooks))
+		s.closeFns = append(s.closeFns, s.webhooks.Close)
+	}
+	s.watcher, err = peers.NewWatcher(s.peerManager, s.bus, &peers.WatcherConfig{
+		Interval:       s.cfg.PeerWatchInterval,
+		OfflineTimeout: s.cfg.PeerOfflineTimeout,
+		IdleTimeout:    s.cfg.PeerIdleTimeout,
+	})
+	if err != nil {
+		return err
+	}
+	s.sampler, err = peers.NewSampler(s.peerManager, s.cfg.PeerStatsPersist)
+	if err != nil {
+		return err
+	}
+	sampleCtx, stopSampler := context.WithCancel(context.Background())
+	samplerDone := make(chan struct{})
+	go func() {
+		defer close(samplerDone)
+		s.sampler.Run(sampleCtx)
+	}()
+	// wait for the traffic history to be persisted
+	s.closeFns = append(s.closeFns, func() {
+		stopSampler()
+		<-samplerDone
+	})
+
+	s.quotas, err = peers.NewQuotas(s.peerManager, s.bus, s.cfg.Quotas)
+	if err != nil {
+		return err
+	}
+	quotaCtx, stopQuotas := context.WithCancel(context.Background())
+	quotasDone := make(chan struct{})
+	go func() {
+		defer close(quotasDone)
+		s.quotas.Run(quotaCtx)
+	}()
+	// wait for the quota usage to be persisted
+	s.closeFns = append(s.closeFns, func() {
+		stopQuotas()
+		<-quotasDone
+	})
+
+	s.scheduler, err = peers.NewScheduler(s.peerManager, s.cfg.Schedules)
+	if err != nil {
+		return err
+	}
+	// the sampler, the quotas and the scheduler use the peers of the watcher polls
+	s.watcher.Observe(s.sampler.Sample)
+	s.watcher.Observe(func(_ time.Time, devicePeers []*ipc.Peer) {
+		s.quotas.Update(devicePeers)
+		s.scheduler.Apply(devicePeers)
+	})
+	watchCtx, stopWatcher := context.WithCancel(context.Background())
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		s.watcher.Run(watchCtx)
+	}()
+	// the watcher is stopped before the traffic history and the quota usage are persisted
+	s.closeFns = append(s.closeFns, func() {
+		stopWatcher()
+		<-watcherDone
+	})
+
+	s.tokens, err = auth.NewTokens(st)
+	if err != nil {
+		return err
+	}
+	s.preAuthKeys, err = auth.NewPreAuthKeys(st)
+	if err != nil {
+		return err
+	}
+	if s.cfg.Registrations {
+		s.registrations, err = peers.NewRegistrations(s.peerManager, s.cfg.RegistrationTTL, s.cfg.RegistrationPendingTTL)
+		if err != nil {
+			return err
+		}
+	}
+	s.sessions, err = auth.NewSessions(st, s.cfg.WebuiJWTSecret, s.cfg.WebuiAccessTokenTTL, s.cfg.WebuiRefreshTokenTTL)
+	if err != nil {
+		return err
+	}
+	s.totp, err = auth.NewTOTP(st)
+	if err != nil {
+		return err
+	}
+	s.limiter = auth.NewLoginLimiter(&auth.LoginLimiterConfig{
+		MaxAttempts: s.cfg.WebuiLoginMaxAttempts,
+		Lockout:     s.cfg.WebuiLoginLockout,
+		MaxLockout:  s.cfg.WebuiLoginMaxLockout,
+	})
+
+	auditLogFile := s.cfg.AuditLogFile
+	if auditLogFile == "" && s.cfg.StateDir != "" {
+		auditLogFile = filepath.Join(s.cfg.StateDir, "audit.jsonl")
+	}
+	s.auditLog, err = audit.Open(auditLogFile)
+	if err != nil {
+		return err
+	}
+	s.closeFns = append(s.closeFns, func() { _ = s.auditLog.Close() })
+
+	if s.cfg.HubAddress != "" {
+		s.log.Infof("starting hub instance on %s", s.cfg.HubAddress)
+		stopHubInstance, tunNet, err := hub.Init(s.log, s.dev, s.cfg)
+		if err != nil {
+			return fmt.Errorf("failed to start hub instance: %w", err)
+		}
+		s.tunNet = tunNet
+		// the hub instance needs to be stopped before the hub device
+		s.closeFns = append(s.closeFns, stopHubInstance)
+	}
+
+	if s.matrix != nil {
+		syncCtx, stopSync := context.WithCancel(context.Background())
+		go s.syncAllowedIPs(syncCtx, s.bus.Subscribe(16))
+		s.closeFns = append(s.closeFns, stopSync)
+	}
+
+	if s.cfg.DebugServer && s.tunNet != nil {
+		s.log.Infof("starting debug server on http://%s:8080", s.cfg.HubAddress)
+		debugServer, err := debug.StartServer(s.log, s.dev, s.tunNet)
+		if err != nil {
+			return fmt.Errorf("failed to start debug server: %w", err)
+		}
+		s.watchServer(debugServer)
+	}
+
+	if s.cfg.Webui && s.tunNet != nil {
+		s.log.Infof("starting webui on http://%s", s.cfg.HubAddress)
+		webuiServer, err := webui.StartServer(s.log, s.cfg, s.peerManager, s.tunNet,
+			api.WithSourceFilter(s.sourceFilter),
+			api.WithTokens(s.tokens),
+			api.WithPreAuthKeys(s.preAuthKeys),
+			api.WithRegistrations(s.registrations),
+			api.WithSessions(s.sessions),
+			api.WithTOTP(s.totp),
+			api.WithLoginLimiter(s.limiter),
+			api.WithAuditLog(s.auditLog),
+			api.WithEvents(s.bus),
+			api.WithWebhooks(s.webhooks),
+			api.WithPeerWatcher(s.watcher),
+			api.WithPeerSampler(s.sampler),
+			api.WithPeerQuotas(s.quotas),
+			api.WithPeerScheduler(s.scheduler),
+			api.WithTrafficMatrix(s.matrix),
+			api.WithCapturer(s.capturer),
+			api.WithShaper(s.shaper),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to start api server: %w", err)
+		}
+		s.watchServer(webuiServer)
+	}
+
+	if s.cfg.EnrollAddress != "" {
+		enrollServer, err := s.startEnrollmentServer()
+		if err != nil {
+			return fmt.Errorf("failed to start enrollment server: %w", err)
+		}
+		s.watchServer(enrollServer)
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = s.Close()
+	}()
+	return nil
+}
+
+// startEnrollmentServer serves the enrollment endpoint outside of the hub network, so
+// devices that are not peers yet can enroll themselves with a pre-auth key or submit
+// a registration request.
+func (s *Server) startEnrollmentServer() (*httpserver.Server, error) {
+	listener, err := net.Listen("tcp", s.cfg.EnrollAddress)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "http"
+	if s.cfg.EnrollTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(s.cfg.EnrollTLSCert, s.cfg.EnrollTLSKey)
+		if err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+		scheme = "https"
+	}
+	s.log.Infof("starting enrollment server on %s://%s", scheme, listener.Addr())
+	handler := api.NewEnrollmentHandler(s.log, s.cfg, s.peerManager,
+		api.WithPreAuthKeys(s.preAuthKeys),
+		api.WithRegistrations(s.registrations),
+		api.WithLoginLimiter(s.limiter),
+		api.WithAuditLog(s.auditLog),
+		api.WithEvents(s.bus),
+	)
+	return httpserver.Serve("enrollment server", listener, handler), nil
+}
+
+// watchServer forwards the serve error of the http server to the error channel of the hub server.
+func (s *Server) watchServer(srv *httpserver.Server) {
+	s.servers = append(s.servers, srv)
+	go func() {
+		for err := range srv.Err() {
+			select {
+			case s.errCh <- fmt.Errorf("%s failed: %w", srv.Name(), err):
+			default:
+			}
+		}
+	}()
+}
+
+// syncAllowedIPs updates the allowed ips of the traffic matrix and the shaper on every peer change,
+// the allowed ips are also updated if the subscription dropped events.
+func (s *Server) syncAllowedIPs(ctx context.Context, sub *events.Subscription) {
+	defer sub.Close()
+	peerManager := s.peerManager
+	update := func() {
+		devicePeers, err := peerManager.List()
+		if err != nil {
+			s.log.Errorf("failed to update the allowed ips of the loopback: %v", err)
+			return
+		}
+		allowedIPs := make(map[string]netip.Prefix, len(devicePeers))
+		for _, peer := range devicePeers {
+			prefix, err := netip.ParsePrefix(peer.AllowedIP)
+			if err != nil {
+				continue
+			}
+			allowedIPs[peer.PublicKey] = prefix
+		}
+		s.matrix.SetPeers(allowedIPs)
+		if s.shaper != nil {
+			s.shaper.SetPeers(allowedIPs)
+		}
+	}
+	update()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-sub.Events():
+			// every update lists all peers, so it also covers the dropped peer changes
+			dropped := sub.Dropped()
+			if dropped || e.Type == events.PeerAdded || e.Type == events.PeerUpdated || e.Type == events.PeerRemoved {
+				update()
+			}
+		}
+	}
+}
+
+// Err returns a channel that receives the first error of a http server that stopped unexpectedly.
+func (s *Server) Err() <-chan error {
+	return s.errCh
+}
+
+// shutdownServers waits until all in-flight requests are finished or the shutdown timeout is reached.
+func (s *Server) shutdownServers() {
+	timeout := s.cfg.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range s.servers {
+		wg.Add(1)
+		go func(srv *httpserver.Server) {
+			defer wg.Done()
+			s.log.Infof("shutting down %s...", srv.Name())
+			if err := srv.Shutdown(ctx); err != nil {
+				s.log.Warnf("failed to shut down %s gracefully: %v", srv.Name(), err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
+
+// close shuts down the http servers and runs all close functions in reverse order.
+func (s *Server) close() {
+	s.closeOnce.Do(func() {
+		s.shutdownServers()
+		for i := len(s.closeFns) - 1; i >= 0; i-- {
+			s.closeFns[i]()
+		}
+	})
+}
+
+// Close gracefully stops the http servers, the hub instance and closes the
+// hub device, it is safe to call Close multiple times.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		return ErrNotStarted
+	}
+	s.close()
+	return nil
+}
+
+// Events returns the event bus of the hub, subscriptions can be created before the hub is started.
+func (s *Server) Events() *events.Bus {
+	return s.bus
+}
+
+// Device returns the WireGuard device of the hub.
+func (s *Server) Device() *device.Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dev
+}
+
+// Net returns the netstack of the hub instance or nil if no hub address is configured.
+func (s *Server) Net() *netstack.Net {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tunNet
+}
+
+func (s *Server) getPeerManager() (*peers.Manager, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		return nil, ErrNotStarted
+	}
+	return s.peerManager, nil
+}
+
+// Peers returns all peers of the hub device including the hub instance.
+func (s *Server) Peers() ([]*ipc.Peer, error) {
+	pm, err := s.getPeerManager()
+	if err != nil {
+		return nil, err
+	}
+	return pm.List()
+}
+
+// AddPeer adds or updates a peer. If the allowed ip is empty, a random free ip
+// of the hub network is assigned. The allowed sources replace the allowed source
+// addresses of the peer if given. Invalid input is reported as *peers.ValidationError.
+func (s *Server) AddPeer(publicKey wgtypes.Key, allowedIP string, allowedSources ...string) (*peers.AddResult, error) {
+	pm, err := s.getPeerManager()
+	if err != nil {
+		return nil, err
+	}
+	return pm.Add(publicKey.String(), allowedIP, allowedSources)
+}
+
+// RemovePeer removes a peer from the hub device.
+func (s *Server) RemovePeer(publicKey wgtypes.Key) error {
+	pm, err := s.getPeerManager()
+	if err != nil {
+		return err
+	}
+	_, err = pm.Remove(publicKey.String())
+	return err
+}
@@ -0,0 +1,130 @@
+package wghub
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/christophwitzko/wg-hub/pkg/config"
+	"github.com/christophwitzko/wg-hub/pkg/peers"
+	"github.com/christophwitzko/wg-hub/pkg/store"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func freeUDPPort(t *testing.T) uint16 {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer c.Close()
+	return uint16(c.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func testConfig(t *testing.T) *config.Config {
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	cfg := config.NewConfig(privateKey, freeUDPPort(t))
+	cfg.BindAddress = "127.0.0.1"
+	cfg.HubAddress = "192.168.0.254"
+	peerKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	peer, err := config.NewPeer(peerKey.PublicKey().String() + ",192.168.0.1")
+	require.NoError(t, err)
+	cfg.Peers = []*config.Peer{peer}
+	return cfg
+}
+
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return log
+}
+
+func TestServer(t *testing.T) {
+	_, err := New()
+	require.ErrorIs(t, err, ErrConfigRequired)
+
+	cfg := testConfig(t)
+	st := store.NewMemoryStore()
+	srv, err := New(WithConfig(cfg), WithLogger(testLogger()), WithStore(st))
+	require.NoError(t, err)
+	_, err = srv.Peers()
+	require.ErrorIs(t, err, ErrNotStarted)
+
+	require.NoError(t, srv.Start(context.Background()))
+	require.ErrorIs(t, srv.Start(context.Background()), ErrAlreadyStarted)
+	require.NotNil(t, srv.Net())
+	require.NotNil(t, srv.Device())
+
+	hubPeers, err := srv.Peers()
+	require.NoError(t, err)
+	// configured peer and hub instance
+	require.Len(t, hubPeers, 2)
+
+	peerKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	res, err := srv.AddPeer(peerKey.PublicKey(), "192.168.0.2")
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.2/32", res.AllowedIP)
+	require.Equal(t, "192.168.0.0/24", res.HubNetwork)
+	// a peer can be updated with its own allowed ip
+	res, err = srv.AddPeer(peerKey.PublicKey(), "192.168.0.2")
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.2/32", res.PreviousAllowedIP)
+
+	otherKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	_, err = srv.AddPeer(otherKey.PublicKey(), "192.168.0.2")
+	require.ErrorIs(t, err, peers.ErrAllowedIPInUse)
+	var validationErr *peers.ValidationError
+	require.True(t, errors.As(err, &validationErr))
+	_, err = srv.AddPeer(otherKey.PublicKey(), "192.168.0.254")
+	require.ErrorIs(t, err, peers.ErrHubOverlap)
+
+	hubPeers, err = srv.Peers()
+	require.NoError(t, err)
+	require.Len(t, hubPeers, 3)
+	require.NoError(t, srv.Close())
+	require.NoError(t, srv.Close())
+
+	// peers added at runtime are restored from the store
+	srv, err = New(WithConfig(cfg), WithLogger(testLogger()), WithStore(st))
+	require.NoError(t, err)
+	require.NoError(t, srv.Start(context.Background()))
+	hubPeers, err = srv.Peers()
+	require.NoError(t, err)
+	require.Len(t, hubPeers, 3)
+	require.NoError(t, srv.RemovePeer(peerKey.PublicKey()))
+	hubPeers, err = srv.Peers()
+	require.NoError(t, err)
+	require.Len(t, hubPeers, 2)
+	require.NoError(t, srv.Close())
+}
+
+func TestServerStartFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	cfg := testConfig(t)
+	cfg.EnrollAddress = listener.Addr().String()
+	srv, err := New(WithConfig(cfg), WithLogger(testLogger()))
+	require.NoError(t, err)
+	require.Error(t, srv.Start(context.Background()))
+	require.ErrorIs(t, srv.Close(), ErrNotStarted)
+
+	// the hub can be started again once the address is free
+	require.NoError(t, listener.Close())
+	require.NoError(t, srv.Start(context.Background()))
+	require.NoError(t, srv.Close())
+}
+
+func TestServerContext(t *testing.T) {
+	srv, err := New(WithConfig(testConfig(t)), WithLogger(testLogger()))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, srv.Start(ctx))
+	cancel()
+	// closing is idempotent, even if the context already closed the server
+	require.NoError(t, srv.Close())
+}
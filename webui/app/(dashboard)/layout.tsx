@@ -7,6 +7,7 @@ import Link from "next/link";
 import { useTheme } from "next-themes";
 
 import { useAuth } from "@/lib/auth";
+import { useEventStream } from "@/lib/events";
 import { cn } from "@/lib/utils";
 import Loading from "@/app/loading";
 import { Button, buttonVariants } from "@/components/ui/button";
@@ -22,11 +23,13 @@ const navItems = [
     href: "/peers",
     title: "Peers",
     icon: Network,
+    role: "viewer",
   },
   {
     href: "/config",
     title: "Config",
     icon: FileCog,
+    role: "admin",
   },
 ] as const;
 
@@ -35,6 +38,7 @@ export default function Layout({ children }: { children: ReactNode }) {
   const router = useRouter();
   const pathname = usePathname();
   const auth = useAuth();
+  useEventStream(auth.token);
   useEffect(() => {
     if (auth.isInitialized && !auth.token) {
       router.push("/");
@@ -51,27 +55,29 @@ export default function Layout({ children }: { children: ReactNode }) {
         <h1 className="text-3xl pt-4 pb-6 text-center font-bold border-b mb-6">
           wg-hub
         </h1>
-        {navItems.map((item) => {
-          const selected = pathname === item.href;
-          return (
-            <Link
-              key={item.href}
-              className={cn(
-                buttonVariants({
-                  variant: selected ? "default" : "ghost",
-                  size: "sm",
-                }),
-                selected &&
-                  "dark:bg-muted dark:text-white dark:hover:bg-muted dark:hover:text-white",
-                "justify-start w-44",
-              )}
-              href={item.href}
-            >
-              <item.icon className="mr-2 size-4" />
-              {item.title}
-            </Link>
-          );
-        })}
+        {navItems
+          .filter((item) => auth.hasRole(item.role))
+          .map((item) => {
+            const selected = pathname === item.href;
+            return (
+              <Link
+                key={item.href}
+                className={cn(
+                  buttonVariants({
+                    variant: selected ? "default" : "ghost",
+                    size: "sm",
+                  }),
+                  selected &&
+                    "dark:bg-muted dark:text-white dark:hover:bg-muted dark:hover:text-white",
+                  "justify-start w-44",
+                )}
+                href={item.href}
+              >
+                <item.icon className="mr-2 size-4" />
+                {item.title}
+              </Link>
+            );
+          })}
         <div className="flex-grow"></div>
         <Button onClick={() => auth.logout()} variant="ghost">
           <LogOut className="mr-2 size-4" />
@@ -74,7 +74,9 @@ export function CellActions({ row }: { row: Row<Peer> }) {
           <DialogTrigger asChild>
             <DropdownMenuItem
               className="text-destructive"
-              disabled={peer.isHub || peer.isRequester}
+              disabled={
+                peer.isHub || peer.isRequester || !auth.hasRole("operator")
+              }
             >
               Delete Peer
             </DropdownMenuItem>
@@ -25,6 +25,20 @@ function header({ column }: { column: Column<Peer> }) {
   );
 }
 
+function StateBadge({ peer }: { peer: Peer }) {
+  // the hub itself has no state
+  const state =
+    peer.state ?? (peer.lastHandshake === 0 ? "offline" : "online");
+  switch (state) {
+    case "offline":
+      return <Badge className="text-destructive">Offline</Badge>;
+    case "idle":
+      return <Badge className="text-muted-foreground">Idle</Badge>;
+    default:
+      return <Badge className="text-online">Online</Badge>;
+  }
+}
+
 export function getColumns(): ColumnDef<Peer>[] {
   return [
     {
@@ -33,11 +47,7 @@ export function getColumns(): ColumnDef<Peer>[] {
       header: () => <span>Status</span>,
       cell: ({ row }) => (
         <div className="flex items-center gap-2">
-          {row.original.lastHandshake === 0 ? (
-            <Badge className="text-destructive">Offline</Badge>
-          ) : (
-            <Badge className="text-online">Online</Badge>
-          )}
+          <StateBadge peer={row.original} />
           {row.original.isHub ? <Badge>Hub</Badge> : null}
           {row.original.isRequester ? <Badge>You</Badge> : null}
         </div>
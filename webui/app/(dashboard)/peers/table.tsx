@@ -18,12 +18,14 @@ import {
   TableRow,
 } from "@/components/ui/table";
 import { Peer } from "@/lib/api";
+import { useAuth } from "@/lib/auth";
 import { AddPeer } from "./add-peer";
 import { getColumns } from "./columns";
 import { ColumnToggle } from "./column-toggle";
 import { GeneratePeer } from "./generate-peer";
 
 export function PeersTable({ data }: { data: Peer[] }) {
+  const auth = useAuth();
   const columns = useMemo(() => getColumns(), []);
   const table = useReactTable({
     data,
@@ -41,8 +43,12 @@ export function PeersTable({ data }: { data: Peer[] }) {
   return (
     <div className="w-full">
       <div className="flex items-center py-4 gap-4">
-        <AddPeer />
-        <GeneratePeer />
+        {auth.hasRole("operator") && (
+          <>
+            <AddPeer />
+            <GeneratePeer />
+          </>
+        )}
         <ColumnToggle table={table} />
       </div>
       <div className="rounded-md border">
@@ -1,5 +1,6 @@
 "use client";
 
+import { useEffect, useState } from "react";
 import { useForm } from "react-hook-form";
 import { z } from "zod";
 import { zodResolver } from "@hookform/resolvers/zod";
@@ -23,11 +24,13 @@ import {
   FormMessage,
 } from "@/components/ui/form";
 import { useAuth } from "@/lib/auth";
+import { isOIDCEnabled } from "@/lib/api";
 import { Center } from "@/components/center";
 
 const loginFormSchema = z.object({
   username: z.string().min(1).max(50),
   password: z.string().min(1).max(50),
+  code: z.string().max(20),
 });
 
 export function Login() {
@@ -36,11 +39,18 @@ export function Login() {
     defaultValues: {
       username: "admin",
       password: "",
+      code: "",
     },
   });
   const auth = useAuth();
+  const [oidcEnabled, setOIDCEnabled] = useState(false);
+  useEffect(() => {
+    isOIDCEnabled()
+      .then(setOIDCEnabled)
+      .catch(() => setOIDCEnabled(false));
+  }, []);
   function onSubmit(values: z.infer<typeof loginFormSchema>) {
-    auth.login(values.username, values.password);
+    auth.login(values.username, values.password, values.code);
   }
 
   return (
@@ -76,6 +86,26 @@ export function Login() {
                   </FormItem>
                 )}
               />
+              {auth.totpRequired && (
+                <FormField
+                  control={form.control}
+                  name="code"
+                  render={({ field }) => (
+                    <FormItem>
+                      <FormLabel>Two-factor code</FormLabel>
+                      <FormControl>
+                        <Input
+                          {...field}
+                          autoComplete="one-time-code"
+                          placeholder="123456 or recovery code"
+                          autoFocus
+                        />
+                      </FormControl>
+                      <FormMessage />
+                    </FormItem>
+                  )}
+                />
+              )}
               {auth.error && (
                 <Alert variant="destructive">
                   <AlertCircle className="size-4" />
@@ -84,7 +114,12 @@ export function Login() {
                 </Alert>
               )}
             </CardContent>
-            <CardFooter className="flex justify-end">
+            <CardFooter className="flex justify-end gap-2">
+              {oidcEnabled && (
+                <Button variant="outline" asChild>
+                  <a href="/api/auth/oidc/login">Log in with SSO</a>
+                </Button>
+              )}
               <Button type="submit" disabled={auth.isLoading}>
                 Log in
               </Button>
@@ -2,6 +2,16 @@
 
 import useSWR from "swr";
 
+export class APIError extends Error {
+  constructor(
+    message: string,
+    public status: number,
+    public data: any,
+  ) {
+    super(message);
+  }
+}
+
 async function fetchAPI(
   method: string,
   path: string,
@@ -20,7 +30,7 @@ async function fetchAPI(
     // handle client errors
     if (res.status >= 400 && res.status < 500) {
       const err = await res.json();
-      throw new Error(err.error);
+      throw new APIError(err.error, res.status, err);
     }
     // handle server errors
     throw new Error(res.statusText);
@@ -28,19 +38,49 @@ async function fetchAPI(
   return await res.json();
 }
 
+export type TokenPair = {
+  token: string;
+  refreshToken: string;
+  expiresAt: string;
+};
+
+function toTokenPair(authRes: any): TokenPair {
+  if (!authRes.token || !authRes.refreshToken) {
+    throw new Error("Invalid response from server.");
+  }
+  return authRes;
+}
+
 export async function createToken(
   username: string,
   password: string,
-): Promise<string> {
-  const authRes = await fetchAPI("POST", "auth", "", { username, password });
-  if (!authRes.token) {
-    throw new Error("Invalid response from server.");
-  }
-  return authRes.token;
+  code: string = "",
+): Promise<TokenPair> {
+  return toTokenPair(
+    await fetchAPI("POST", "auth", "", { username, password, code }),
+  );
+}
+
+export async function refreshToken(refreshToken: string): Promise<TokenPair> {
+  return toTokenPair(
+    await fetchAPI("POST", "auth/refresh", "", { refreshToken }),
+  );
+}
+
+export async function isOIDCEnabled(): Promise<boolean> {
+  const res = await fetchAPI("GET", "auth/oidc");
+  return !!res.enabled;
 }
 
+export async function deleteToken(token: string): Promise<void> {
+  await fetchAPI("DELETE", "auth", token);
+}
+
+export type Role = "viewer" | "operator" | "admin";
+
 export type User = {
   username: string;
+  role: Role;
   iat: number;
   exp: number;
 };
@@ -57,10 +97,11 @@ export type Peer = {
   rxBytes: number;
   isHub: boolean;
   isRequester: boolean;
+  state?: "online" | "idle" | "offline";
 };
 export function usePeers(token: string) {
+  // updated by the event stream of the dashboard
   return useSWR<Peer[]>("peers", () => fetchAPI("GET", "peers", token), {
-    refreshInterval: 1000,
     fallbackData: [],
   });
 }
@@ -70,9 +111,8 @@ export type Config = {
 };
 
 export function useConfig(token: string) {
-  return useSWR<Config>("config", () => fetchAPI("GET", "config", token), {
-    refreshInterval: 1000,
-  });
+  // updated by the event stream of the dashboard
+  return useSWR<Config>("config", () => fetchAPI("GET", "config", token));
 }
 
 export type AddedPeer = {
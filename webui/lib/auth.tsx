@@ -11,16 +11,36 @@ import {
   useSyncExternalStore,
 } from "react";
 import useLocalStorageState from "use-local-storage-state";
-import { createToken, getUser } from "@/lib/api";
+import {
+  APIError,
+  createToken,
+  deleteToken,
+  getUser,
+  refreshToken as refreshTokenPair,
+  Role,
+  TokenPair,
+} from "@/lib/api";
+
+// the access token is refreshed shortly before it expires
+const refreshMargin = 60 * 1000;
+
+const roleLevels: Record<Role, number> = {
+  viewer: 1,
+  operator: 2,
+  admin: 3,
+};
 
 export type AuthContextType = {
   token: string;
   isInitialized: boolean;
   isLoading: boolean;
   error: string;
-  login: (username: string, password: string) => void;
+  totpRequired: boolean;
+  login: (username: string, password: string, code?: string) => void;
   logout: () => void;
   username: string;
+  role: Role | "";
+  hasRole: (role: Role) => boolean;
 };
 
 export const AuthContext = createContext({} as AuthContextType);
@@ -36,33 +56,114 @@ export function AuthProvider({ children }: { children: ReactNode }) {
   const [token, setToken, { removeItem }] = useLocalStorageState("authToken", {
     defaultValue: "",
   });
+  const [refreshToken, setRefreshToken, { removeItem: removeRefreshToken }] =
+    useLocalStorageState("refreshToken", {
+      defaultValue: "",
+    });
+  const [expiresAt, setExpiresAt, { removeItem: removeExpiresAt }] =
+    useLocalStorageState("authTokenExpiresAt", {
+      defaultValue: "",
+    });
   const [isInitialized, setIsInitialized] = useState(false);
   const [isLoading, setIsLoading] = useState(false);
   const [error, setError] = useState("");
+  const [totpRequired, setTotpRequired] = useState(false);
   const [username, setUsername] = useState("");
+  const [role, setRole] = useState<Role | "">("");
+
+  const setTokenPair = useCallback(
+    (pair: TokenPair) => {
+      setToken(pair.token);
+      setRefreshToken(pair.refreshToken);
+      setExpiresAt(pair.expiresAt);
+    },
+    [setToken, setRefreshToken, setExpiresAt],
+  );
 
   const login = useCallback(
-    (username: string, password: string) => {
+    (username: string, password: string, code: string = "") => {
       setIsLoading(true);
       setToken("");
       setError("");
-      createToken(username, password)
-        .then((token) => {
-          setToken(token);
+      createToken(username, password, code)
+        .then((pair) => {
+          setTotpRequired(false);
+          setTokenPair(pair);
         })
         .catch((err) => {
+          if (err instanceof APIError && err.data?.totpRequired) {
+            // ask for the two-factor code and send the credentials again
+            setTotpRequired(true);
+            return;
+          }
           setError(err.message);
         })
         .finally(() => {
           setIsLoading(false);
         });
     },
-    [setToken],
+    [setToken, setTokenPair],
   );
 
-  const logout = useCallback(() => {
+  const clearTokens = useCallback(() => {
     removeItem();
-  }, [removeItem]);
+    removeRefreshToken();
+    removeExpiresAt();
+  }, [removeItem, removeRefreshToken, removeExpiresAt]);
+
+  const logout = useCallback(() => {
+    if (token) {
+      // revoke the session on the server, the local tokens are removed anyway
+      deleteToken(token).catch(() => {});
+    }
+    clearTokens();
+  }, [token, clearTokens]);
+
+  const refresh = useCallback(() => {
+    if (!refreshToken) {
+      clearTokens();
+      return;
+    }
+    refreshTokenPair(refreshToken)
+      .then((pair) => {
+        setTokenPair(pair);
+      })
+      .catch(() => {
+        clearTokens();
+      });
+  }, [refreshToken, setTokenPair, clearTokens]);
+
+  useEffect(() => {
+    if (isSSR || !window.location.hash) {
+      return;
+    }
+    // the OIDC login redirects with the tokens or the error in the URL fragment
+    const params = new URLSearchParams(window.location.hash.slice(1));
+    const oidcToken = params.get("token");
+    const oidcRefreshToken = params.get("refreshToken");
+    const oidcError = params.get("error");
+    if (oidcToken && oidcRefreshToken) {
+      setTokenPair({
+        token: oidcToken,
+        refreshToken: oidcRefreshToken,
+        expiresAt: params.get("expiresAt") || "",
+      });
+    } else if (oidcError) {
+      setError(oidcError);
+    } else {
+      return;
+    }
+    window.history.replaceState(null, "", window.location.pathname);
+  }, [isSSR, setTokenPair]);
+
+  useEffect(() => {
+    if (isSSR || !token || !expiresAt) {
+      return;
+    }
+    const delay = new Date(expiresAt).getTime() - Date.now() - refreshMargin;
+    const timeout = setTimeout(refresh, Math.max(delay, 0));
+    return () => clearTimeout(timeout);
+  }, [isSSR, token, expiresAt, refresh]);
 
   useEffect(() => {
     if (isSSR) {
@@ -75,14 +176,23 @@ export function AuthProvider({ children }: { children: ReactNode }) {
     getUser(token)
       .then((user) => {
         setUsername(user.username);
+        setRole(user.role);
       })
-      .catch((err) => {
-        logout();
+      .catch(() => {
+        // the access token may have expired while the webui was closed
+        refresh();
       })
       .finally(() => {
         setIsInitialized(true);
       });
-  }, [token, isSSR, logout]);
+    // the user is only loaded if the access token changes
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, [token, isSSR]);
+
+  const hasRole = useCallback(
+    (required: Role) => !!role && roleLevels[role] >= roleLevels[required],
+    [role],
+  );
 
   const contextValue = useMemo(() => {
     return {
@@ -90,11 +200,25 @@ export function AuthProvider({ children }: { children: ReactNode }) {
       isInitialized,
       isLoading,
       error,
+      totpRequired,
       login,
       logout,
       username,
+      role,
+      hasRole,
     } as AuthContextType;
-  }, [token, isLoading, isInitialized, error, login, logout, username]);
+  }, [
+    token,
+    isLoading,
+    isInitialized,
+    error,
+    totpRequired,
+    login,
+    logout,
+    username,
+    role,
+    hasRole,
+  ]);
 
   return (
     <AuthContext.Provider value={contextValue}>{children}</AuthContext.Provider>
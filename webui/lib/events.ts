@@ -0,0 +1,104 @@
+"use client";
+
+import { useEffect } from "react";
+import { useSWRConfig } from "swr";
+import { Peer } from "@/lib/api";
+
+// delay before the event stream is reconnected
+const reconnectDelay = 2000;
+
+export type HubEvent = {
+  id: string;
+  type: string;
+  time: string;
+  data: any;
+};
+
+type PeerTraffic = {
+  publicKey: string;
+  rxBytes: number;
+  txBytes: number;
+};
+
+async function readEvents(
+  token: string,
+  signal: AbortSignal,
+  onEvent: (event: HubEvent) => void,
+) {
+  const res = await fetch("/api/events", {
+    headers: { Authorization: `Bearer ${token}` },
+    signal,
+  });
+  if (!res.ok || !res.body) {
+    throw new Error(res.statusText);
+  }
+  const reader = res.body.pipeThrough(new TextDecoderStream()).getReader();
+  let buffer = "";
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) {
+      return;
+    }
+    buffer += value;
+    const messages = buffer.split("\n\n");
+    buffer = messages.pop() || "";
+    for (const message of messages) {
+      const data = message
+        .split("\n")
+        .find((line) => line.startsWith("data: "));
+      if (data) {
+        onEvent(JSON.parse(data.slice("data: ".length)));
+      }
+    }
+  }
+}
+
+// useEventStream keeps the peers and the config up to date with the events of GET /api/events.
+export function useEventStream(token: string) {
+  const { mutate } = useSWRConfig();
+  useEffect(() => {
+    if (!token) {
+      return;
+    }
+    const controller = new AbortController();
+    const onEvent = (event: HubEvent) => {
+      if (event.type === "peers.snapshot") {
+        mutate("peers", event.data, { revalidate: false });
+        return;
+      }
+      if (event.type === "traffic.rates") {
+        const traffic = new Map<string, PeerTraffic>(
+          event.data.map((t: PeerTraffic) => [t.publicKey, t]),
+        );
+        mutate(
+          "peers",
+          (peers: Peer[] | undefined) =>
+            peers?.map((p) => {
+              const t = traffic.get(p.publicKey);
+              return t ? { ...p, rxBytes: t.rxBytes, txBytes: t.txBytes } : p;
+            }),
+          { revalidate: false },
+        );
+        return;
+      }
+      if (event.type.startsWith("peer.") || event.type === "config.changed") {
+        mutate("peers");
+        mutate("config");
+      }
+    };
+    const run = async () => {
+      while (!controller.signal.aborted) {
+        try {
+          await readEvents(token, controller.signal, onEvent);
+        } catch {
+          if (controller.signal.aborted) {
+            return;
+          }
+        }
+        await new Promise((resolve) => setTimeout(resolve, reconnectDelay));
+      }
+    };
+    run();
+    return () => controller.abort();
+  }, [token, mutate]);
+}